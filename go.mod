@@ -16,6 +16,8 @@ require (
 	github.com/go-kit/log v0.2.0
 	github.com/google/uuid v1.6.0
 	go.uber.org/mock v0.4.0
+	golang.org/x/sys v0.2.0
+	google.golang.org/protobuf v1.33.0
 )
 
 require (
@@ -30,7 +32,5 @@ require (
 	github.com/sirupsen/logrus v1.9.3 // indirect
 	github.com/xeipuuv/gojsonpointer v0.0.0-20151027082146-e0fe6f683076 // indirect
 	github.com/xeipuuv/gojsonreference v0.0.0-20150808065054-e02fc20de94c // indirect
-	golang.org/x/sys v0.2.0 // indirect
-	google.golang.org/protobuf v1.33.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
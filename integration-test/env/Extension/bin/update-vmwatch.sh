@@ -16,3 +16,6 @@ rm ./VMWatch/*windows*
 rm ./VMWatch/*darwin*
 
 chmod +x ./VMWatch/vmwatch_linux*
+
+# write the checksum manifest the extension verifies the binaries and config against before launching VMWatch
+$(dirname "$0")/../../../../misc/vmwatch-manifest.sh ./VMWatch
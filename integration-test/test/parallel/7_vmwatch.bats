@@ -101,6 +101,7 @@ teardown(){
     [[ "$output" == *"--apphealth-version $extension_version"* ]]
     [[ "$output" == *'Env: [SIGNAL_FOLDER=/var/log/azure/Extension/events VERBOSE_LOG_FILE_FULL_PATH=/var/log/azure/Extension/VE.RS.ION/vmwatch.log]'* ]]
     [[ "$output" == *'VMWatch is running'* ]]
+    [[ "$output" == *'VMWatch retry policy: '* ]]
 
     status_file="$(container_read_extension_status)"
     verify_substatus_item "$status_file" VMWatch success "VMWatch is running"
@@ -384,7 +385,7 @@ teardown(){
     [[ "$output" == *'VMWatch is running'* ]]
 
     [[ "$output" == *'Invoking: /var/lib/waagent/Extension/bin/applicationhealth-shim disable'* ]]
-    [[ "$output" == *'applicationhealth-extension process terminated'* ]]
+    [[ "$output" == *'Existing AHE process with PID '*' has exited'* ]]
 
     status_file="$(container_read_extension_status)"
     verify_status_item "$status_file" Disable success "Disable succeeded"
@@ -412,7 +413,7 @@ teardown(){
     [[ "$output" == *'VMWatch is running'* ]]
 
     [[ "$output" == *'Invoking: /var/lib/waagent/Extension/bin/applicationhealth-shim uninstall'* ]]
-    [[ "$output" == *'applicationhealth-extension process terminated'* ]]
+    [[ "$output" == *'Existing AHE process with PID '*' has exited'* ]]
     any_regex_pattern="[[:digit:]|[:space:]|[:alpha:]|[:punct:]]"
     assert_line --regexp "operation=uninstall seq=0 path=/var/lib/waagent/apphealth ${any_regex_pattern}* event=\"Handler successfully uninstalled\""
 }
@@ -0,0 +1,324 @@
+// Package cgroupusage reads the resource usage and limits of a process from the
+// memory and cpu controllers of the cgroup it belongs to, on both cgroup v1 and
+// cgroup v2 (unified) hierarchies, including hybrid hosts that mount both.
+package cgroupusage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMountRoot is where the cgroup hierarchies are mounted.
+const DefaultMountRoot = "/sys/fs/cgroup"
+
+// ErrNoCgroup is returned when a process is not in a cgroup with a memory or
+// cpu controller.
+var ErrNoCgroup = errors.New("cgroupusage: no memory or cpu cgroup found")
+
+// Controller is the cgroup directory of one controller.
+type Controller struct {
+	Dir string
+	// V1 is true if Dir is in a cgroup v1 hierarchy.
+	V1 bool
+}
+
+// Paths are the cgroup directories of a process's memory and cpu controllers.
+// A zero Controller means the controller was not found.
+type Paths struct {
+	Memory Controller
+	CPU    Controller
+}
+
+// Usage is a sample of the counters of a cgroup. The counters are cumulative
+// over the lifetime of the cgroup, except MemoryCurrent.
+type Usage struct {
+	MemoryCurrent uint64
+	// MemoryPeak is the highest memory usage recorded, or zero if the kernel
+	// does not report it.
+	MemoryPeak uint64
+	// OOMKills is the number of processes killed by the OOM killer, or zero if
+	// the kernel does not report it.
+	OOMKills            uint64
+	CPUPeriods          uint64
+	CPUThrottledPeriods uint64
+	CPUThrottledTime    time.Duration
+}
+
+// Limits are the resource limits of a cgroup.
+type Limits struct {
+	// CPUQuota is the CPU time the cgroup may use in each CPUPeriod, or zero if
+	// the CPU is not limited.
+	CPUQuota  time.Duration
+	CPUPeriod time.Duration
+	// MemoryMax is the memory limit in bytes, or zero if memory is not limited.
+	MemoryMax uint64
+}
+
+// CPUPercentage returns the CPU quota as a percentage of one CPU, or zero if
+// the CPU is not limited.
+func (l *Limits) CPUPercentage() float64 {
+	if l.CPUQuota == 0 || l.CPUPeriod == 0 {
+		return 0
+	}
+	return float64(l.CPUQuota) / float64(l.CPUPeriod) * 100
+}
+
+// v1Unlimited is the smallest memory.limit_in_bytes treated as no limit, as
+// cgroup v1 reports an unset limit as the largest page aligned int64.
+const v1Unlimited = 1 << 62
+
+// ForPID resolves the cgroup directories of process pid from /proc/<pid>/cgroup.
+func ForPID(pid int, mountRoot string) (*Paths, error) {
+	f, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil, fmt.Errorf("cgroupusage: failed to read cgroup of pid=%d error=%v", pid, err)
+	}
+	defer f.Close()
+	return Parse(f, mountRoot)
+}
+
+// Parse resolves the cgroup directories from the content of a /proc/<pid>/cgroup
+// file. Each line has the form hierarchy-ID:controller-list:cgroup-path, with an
+// empty controller list for the unified hierarchy. Controllers in a v1 hierarchy
+// take precedence over the unified hierarchy, as on hybrid hosts the unified
+// hierarchy has no controllers enabled.
+func Parse(r io.Reader, mountRoot string) (*Paths, error) {
+	var p Paths
+	unified := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		controllers, path := parts[1], parts[2]
+		if controllers == "" {
+			unified = filepath.Join(mountRoot, path)
+			if _, err := os.Stat(filepath.Join(mountRoot, "cgroup.controllers")); err != nil {
+				// hybrid host, the unified hierarchy is mounted in a sub folder
+				unified = filepath.Join(mountRoot, "unified", path)
+			}
+			continue
+		}
+		for _, c := range strings.Split(controllers, ",") {
+			switch c {
+			case "memory":
+				p.Memory = Controller{Dir: v1Dir(mountRoot, controllers, c, path), V1: true}
+			case "cpu":
+				p.CPU = Controller{Dir: v1Dir(mountRoot, controllers, c, path), V1: true}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cgroupusage: failed to parse cgroup file: %v", err)
+	}
+	if unified != "" {
+		if p.Memory.Dir == "" {
+			p.Memory = Controller{Dir: unified}
+		}
+		if p.CPU.Dir == "" {
+			p.CPU = Controller{Dir: unified}
+		}
+	}
+	if p.Memory.Dir == "" && p.CPU.Dir == "" {
+		return nil, ErrNoCgroup
+	}
+	return &p, nil
+}
+
+// v1Dir returns the directory of path in the v1 hierarchy of controller, which
+// is mounted either under the name of all its co-mounted controllers (e.g.
+// cpu,cpuacct) or under the controller name.
+func v1Dir(mountRoot, controllers, controller, path string) string {
+	dir := filepath.Join(mountRoot, controllers)
+	if _, err := os.Stat(dir); err != nil {
+		dir = filepath.Join(mountRoot, controller)
+	}
+	return filepath.Join(dir, path)
+}
+
+// Read samples the usage counters. Counters the kernel does not provide are left
+// at zero; an error is returned only if the memory usage or the cpu statistics
+// cannot be read.
+func (p *Paths) Read() (*Usage, error) {
+	var u Usage
+	if p.Memory.Dir != "" {
+		if err := u.readMemory(p.Memory); err != nil {
+			return nil, err
+		}
+	}
+	if p.CPU.Dir != "" {
+		if err := u.readCPU(p.CPU); err != nil {
+			return nil, err
+		}
+	}
+	return &u, nil
+}
+
+// ReadLimits reads the CPU quota and memory limit set on the cgroup. An error is
+// returned if a limit cannot be read, e.g. in the root cgroup, which cannot be
+// limited.
+func (p *Paths) ReadLimits() (*Limits, error) {
+	var l Limits
+	if p.Memory.Dir != "" {
+		if err := l.readMemory(p.Memory); err != nil {
+			return nil, err
+		}
+	}
+	if p.CPU.Dir != "" {
+		if err := l.readCPU(p.CPU); err != nil {
+			return nil, err
+		}
+	}
+	return &l, nil
+}
+
+func (l *Limits) readMemory(c Controller) error {
+	if c.V1 {
+		max, err := readUint(filepath.Join(c.Dir, "memory.limit_in_bytes"))
+		if err != nil {
+			return err
+		}
+		if max < v1Unlimited {
+			l.MemoryMax = max
+		}
+		return nil
+	}
+	fields, err := readFields(filepath.Join(c.Dir, "memory.max"), 1)
+	if err != nil {
+		return err
+	}
+	if fields[0] != "max" {
+		if l.MemoryMax, err = parseUint(c.Dir, "memory.max", fields[0]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Limits) readCPU(c Controller) error {
+	var quota, period string
+	if c.V1 {
+		q, err := readFields(filepath.Join(c.Dir, "cpu.cfs_quota_us"), 1)
+		if err != nil {
+			return err
+		}
+		p, err := readFields(filepath.Join(c.Dir, "cpu.cfs_period_us"), 1)
+		if err != nil {
+			return err
+		}
+		quota, period = q[0], p[0]
+		if quota == "-1" {
+			quota = "max"
+		}
+	} else {
+		fields, err := readFields(filepath.Join(c.Dir, "cpu.max"), 2)
+		if err != nil {
+			return err
+		}
+		quota, period = fields[0], fields[1]
+	}
+	n, err := parseUint(c.Dir, "cpu period", period)
+	if err != nil {
+		return err
+	}
+	l.CPUPeriod = time.Duration(n) * time.Microsecond
+	if quota != "max" {
+		if n, err = parseUint(c.Dir, "cpu quota", quota); err != nil {
+			return err
+		}
+		l.CPUQuota = time.Duration(n) * time.Microsecond
+	}
+	return nil
+}
+
+func (u *Usage) readMemory(c Controller) error {
+	current, peak, events, oomKey := "memory.current", "memory.peak", "memory.events", "oom_kill"
+	if c.V1 {
+		current, peak, events = "memory.usage_in_bytes", "memory.max_usage_in_bytes", "memory.oom_control"
+	}
+	var err error
+	if u.MemoryCurrent, err = readUint(filepath.Join(c.Dir, current)); err != nil {
+		return err
+	}
+	u.MemoryPeak, _ = readUint(filepath.Join(c.Dir, peak))
+	if kv, err := readKeyValues(filepath.Join(c.Dir, events)); err == nil {
+		u.OOMKills = kv[oomKey]
+	}
+	return nil
+}
+
+func (u *Usage) readCPU(c Controller) error {
+	kv, err := readKeyValues(filepath.Join(c.Dir, "cpu.stat"))
+	if err != nil {
+		return err
+	}
+	u.CPUPeriods = kv["nr_periods"]
+	u.CPUThrottledPeriods = kv["nr_throttled"]
+	if c.V1 {
+		u.CPUThrottledTime = time.Duration(kv["throttled_time"])
+	} else {
+		u.CPUThrottledTime = time.Duration(kv["throttled_usec"]) * time.Microsecond
+	}
+	return nil
+}
+
+func readUint(path string) (uint64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("cgroupusage: failed to read path=%s error=%v", path, err)
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cgroupusage: failed to parse path=%s error=%v", path, err)
+	}
+	return n, nil
+}
+
+// readFields reads a file holding n space separated values.
+func readFields(path string, n int) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cgroupusage: failed to read path=%s error=%v", path, err)
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != n {
+		return nil, fmt.Errorf("cgroupusage: failed to parse path=%s error=expected %d values, got %q", path, n, strings.TrimSpace(string(b)))
+	}
+	return fields, nil
+}
+
+func parseUint(dir, name, value string) (uint64, error) {
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cgroupusage: failed to parse %s in path=%s error=%v", name, dir, err)
+	}
+	return n, nil
+}
+
+// readKeyValues reads a flat keyed file such as cpu.stat, with one "key value"
+// pair per line. Lines that are not in this form are ignored.
+func readKeyValues(path string) (map[string]uint64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cgroupusage: failed to read path=%s error=%v", path, err)
+	}
+	kv := make(map[string]uint64)
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if n, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			kv[fields[0]] = n
+		}
+	}
+	return kv, nil
+}
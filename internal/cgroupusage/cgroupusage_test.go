@@ -0,0 +1,141 @@
+package cgroupusage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+}
+
+func TestParse_Unified(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"cgroup.controllers": "cpu memory"})
+
+	p, err := Parse(strings.NewReader("0::/system.slice/run-r1234.scope\n"), root)
+	require.NoError(t, err)
+	dir := filepath.Join(root, "system.slice/run-r1234.scope")
+	require.Equal(t, &Paths{Memory: Controller{Dir: dir}, CPU: Controller{Dir: dir}}, p)
+}
+
+func TestParse_V1(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "cpu,cpuacct"), 0755))
+
+	content := "12:pids:/\n11:memory:/vmwatch.slice\n4:cpu,cpuacct:/vmwatch.slice\n1:name=systemd:/\n0::/\n"
+	p, err := Parse(strings.NewReader(content), root)
+	require.NoError(t, err)
+	require.Equal(t, Controller{Dir: filepath.Join(root, "memory/vmwatch.slice"), V1: true}, p.Memory)
+	require.Equal(t, Controller{Dir: filepath.Join(root, "cpu,cpuacct/vmwatch.slice"), V1: true}, p.CPU)
+}
+
+func TestParse_NoCgroup(t *testing.T) {
+	_, err := Parse(strings.NewReader("1:name=systemd:/\n"), t.TempDir())
+	require.ErrorIs(t, err, ErrNoCgroup)
+}
+
+func TestRead_Unified(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"memory.current": "47185920\n",
+		"memory.peak":    "62914560\n",
+		"memory.events":  "low 0\nhigh 0\nmax 12\noom 1\noom_kill 1\n",
+		"cpu.stat":       "usage_usec 1000\nnr_periods 120\nnr_throttled 3\nthrottled_usec 25000\n",
+	})
+
+	u, err := (&Paths{Memory: Controller{Dir: dir}, CPU: Controller{Dir: dir}}).Read()
+	require.NoError(t, err)
+	require.Equal(t, &Usage{
+		MemoryCurrent:       47185920,
+		MemoryPeak:          62914560,
+		OOMKills:            1,
+		CPUPeriods:          120,
+		CPUThrottledPeriods: 3,
+		CPUThrottledTime:    25 * time.Millisecond,
+	}, u)
+}
+
+func TestRead_V1(t *testing.T) {
+	memory, cpu := t.TempDir(), t.TempDir()
+	writeFiles(t, memory, map[string]string{
+		"memory.usage_in_bytes":     "1024\n",
+		"memory.max_usage_in_bytes": "2048\n",
+		"memory.oom_control":        "oom_kill_disable 0\nunder_oom 0\noom_kill 2\n",
+	})
+	writeFiles(t, cpu, map[string]string{"cpu.stat": "nr_periods 10\nnr_throttled 4\nthrottled_time 5000000\n"})
+
+	u, err := (&Paths{Memory: Controller{Dir: memory, V1: true}, CPU: Controller{Dir: cpu, V1: true}}).Read()
+	require.NoError(t, err)
+	require.Equal(t, &Usage{
+		MemoryCurrent:       1024,
+		MemoryPeak:          2048,
+		OOMKills:            2,
+		CPUPeriods:          10,
+		CPUThrottledPeriods: 4,
+		CPUThrottledTime:    5 * time.Millisecond,
+	}, u)
+}
+
+func TestRead_OptionalCountersMissing(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"memory.current": "100\n", "cpu.stat": "usage_usec 1\n"})
+
+	u, err := (&Paths{Memory: Controller{Dir: dir}, CPU: Controller{Dir: dir}}).Read()
+	require.NoError(t, err)
+	require.Equal(t, &Usage{MemoryCurrent: 100}, u)
+
+	_, err = (&Paths{Memory: Controller{Dir: filepath.Join(dir, "missing")}}).Read()
+	require.Error(t, err, "the cgroup no longer existing should be reported")
+}
+
+func TestReadLimits_Unified(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"cpu.max": "10000 1000000\n", "memory.max": "209715200\n"})
+
+	l, err := (&Paths{Memory: Controller{Dir: dir}, CPU: Controller{Dir: dir}}).ReadLimits()
+	require.NoError(t, err)
+	require.Equal(t, &Limits{CPUQuota: 10 * time.Millisecond, CPUPeriod: time.Second, MemoryMax: 209715200}, l)
+	require.Equal(t, 1.0, l.CPUPercentage())
+
+	writeFiles(t, dir, map[string]string{"cpu.max": "max 100000\n", "memory.max": "max\n"})
+	l, err = (&Paths{Memory: Controller{Dir: dir}, CPU: Controller{Dir: dir}}).ReadLimits()
+	require.NoError(t, err)
+	require.Equal(t, &Limits{CPUPeriod: 100 * time.Millisecond}, l)
+	require.Zero(t, l.CPUPercentage())
+}
+
+func TestReadLimits_V1(t *testing.T) {
+	memory, cpu := t.TempDir(), t.TempDir()
+	writeFiles(t, memory, map[string]string{"memory.limit_in_bytes": "9223372036854771712\n"})
+	writeFiles(t, cpu, map[string]string{"cpu.cfs_quota_us": "-1\n", "cpu.cfs_period_us": "100000\n"})
+
+	p := &Paths{Memory: Controller{Dir: memory, V1: true}, CPU: Controller{Dir: cpu, V1: true}}
+	l, err := p.ReadLimits()
+	require.NoError(t, err)
+	require.Equal(t, &Limits{CPUPeriod: 100 * time.Millisecond}, l, "unset limits")
+
+	writeFiles(t, memory, map[string]string{"memory.limit_in_bytes": "104857600\n"})
+	writeFiles(t, cpu, map[string]string{"cpu.cfs_quota_us": "5000\n"})
+	l, err = p.ReadLimits()
+	require.NoError(t, err)
+	require.Equal(t, &Limits{CPUQuota: 5 * time.Millisecond, CPUPeriod: 100 * time.Millisecond, MemoryMax: 104857600}, l)
+	require.Equal(t, 5.0, l.CPUPercentage())
+}
+
+func TestReadLimits_RootCgroup(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"memory.current": "100\n"})
+
+	_, err := (&Paths{Memory: Controller{Dir: dir}, CPU: Controller{Dir: dir}}).ReadLimits()
+	require.Error(t, err, "the root cgroup has no limit files")
+}
@@ -0,0 +1,100 @@
+// Package liveness tracks the single long-running enable process through an
+// advisory lock file, held for the lifetime of the process, and a heartbeat file
+// it refreshes on every iteration of its loop. The kernel releases the lock when
+// the holder exits, so a held lock reliably means the holder is alive, while the
+// heartbeat tells whether it is still making progress.
+package liveness
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/state"
+)
+
+// HeartbeatSchemaVersion is the schema version of the heartbeat payload.
+const HeartbeatSchemaVersion = 1
+
+// ErrLocked is returned by TryLock when another process holds the lock.
+var ErrLocked = errors.New("liveness: lock is held by another process")
+
+// Lock is an exclusive advisory (flock) lock on a file.
+type Lock struct {
+	f *os.File
+}
+
+// TryLock acquires an exclusive lock on the file at path without blocking,
+// creating the file if needed. It returns ErrLocked if another process, or
+// another open file in this process, holds the lock. On success the PID of the
+// current process is written to the file for diagnostics.
+func TryLock(path string) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("liveness: failed to open lock file path=%s error=%v", path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, fmt.Errorf("liveness: failed to lock path=%s error=%v", path, err)
+	}
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &Lock{f: f}, nil
+}
+
+// Release unlocks and closes the lock file. The lock is also released by the
+// kernel when the process exits, so calling Release is only needed to give up
+// the lock while the process keeps running.
+func (l *Lock) Release() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
+
+// Heartbeat is written by the enable process on every loop iteration.
+type Heartbeat struct {
+	PID            int       `json:"pid"`
+	SequenceNumber uint      `json:"sequenceNumber"`
+	StartTime      time.Time `json:"startTime"`
+	LastLoopTime   time.Time `json:"lastLoopTime"`
+}
+
+// IsFresh reports whether the last loop iteration happened less than threshold ago.
+func (h *Heartbeat) IsFresh(threshold time.Duration) bool {
+	return time.Since(h.LastLoopTime) < threshold
+}
+
+// ReadHeartbeat loads the heartbeat stored at path. It returns state.ErrNotFound
+// if no heartbeat has been written.
+func ReadHeartbeat(path string) (*Heartbeat, error) {
+	d, err := state.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	if d.SchemaVersion != HeartbeatSchemaVersion {
+		return nil, fmt.Errorf("liveness: unsupported heartbeat schema version %d", d.SchemaVersion)
+	}
+	var h Heartbeat
+	if err := d.Decode(&h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// WriteHeartbeat atomically stores h at path.
+func WriteHeartbeat(path, extensionVersion string, h Heartbeat) error {
+	return state.Write(path, HeartbeatSchemaVersion, extensionVersion, h)
+}
@@ -0,0 +1,70 @@
+package liveness
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/state"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTryLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "enable.lock")
+
+	l, err := TryLock(path)
+	require.NoError(t, err)
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, strconv.Itoa(os.Getpid()), strings.TrimSpace(string(b)))
+
+	// flock locks belong to the open file, so a second open conflicts even in
+	// the same process
+	_, err = TryLock(path)
+	require.ErrorIs(t, err, ErrLocked)
+
+	require.NoError(t, l.Release())
+	l, err = TryLock(path)
+	require.NoError(t, err, "lock should be available again once released")
+	require.NoError(t, l.Release())
+	require.NoError(t, l.Release(), "releasing twice should be a no-op")
+}
+
+func TestTryLock_MissingDirectory(t *testing.T) {
+	_, err := TryLock(filepath.Join(t.TempDir(), "missing", "enable.lock"))
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrLocked)
+}
+
+func TestHeartbeat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "liveness.json")
+
+	_, err := ReadHeartbeat(path)
+	require.ErrorIs(t, err, state.ErrNotFound)
+
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	h := Heartbeat{PID: 42, SequenceNumber: 7, StartTime: start, LastLoopTime: time.Now().UTC()}
+	require.NoError(t, WriteHeartbeat(path, "2.0.14", h))
+
+	got, err := ReadHeartbeat(path)
+	require.NoError(t, err)
+	require.Equal(t, 42, got.PID)
+	require.Equal(t, uint(7), got.SequenceNumber)
+	require.True(t, start.Equal(got.StartTime))
+	require.True(t, got.IsFresh(time.Minute))
+
+	got.LastLoopTime = time.Now().Add(-10 * time.Minute)
+	require.False(t, got.IsFresh(6*time.Minute))
+}
+
+func TestReadHeartbeat_UnsupportedSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "liveness.json")
+	require.NoError(t, state.Write(path, HeartbeatSchemaVersion+1, "2.0.15", Heartbeat{PID: 1}))
+
+	_, err := ReadHeartbeat(path)
+	require.ErrorContains(t, err, "unsupported heartbeat schema version")
+}
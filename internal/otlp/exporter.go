@@ -0,0 +1,358 @@
+// Package otlp exports metrics and telemetry events as logs to a local
+// OpenTelemetry collector, using OTLP over HTTP with protobuf payloads.
+//
+// Measurements are aggregated in memory and events are queued, and both are
+// sent in the background every export interval, so recording never blocks on
+// the collector. Events are dropped when the queue is full.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
+)
+
+const (
+	// SinkName is the name of the telemetry sink of the exporter.
+	SinkName = "otlp"
+
+	// DefaultExportInterval is how often metrics and events are sent when the
+	// configuration does not say.
+	DefaultExportInterval = 10 * time.Second
+	// DefaultMaxQueuedEvents is how many events are kept until the next export
+	// when the configuration does not say.
+	DefaultMaxQueuedEvents = 1000
+
+	logsPath    = "/v1/logs"
+	metricsPath = "/v1/metrics"
+	contentType = "application/x-protobuf"
+	// maxRequestTimeout bounds how long an export may take, so that a hung
+	// collector does not delay the next exports.
+	maxRequestTimeout = 5 * time.Second
+)
+
+// Config configures an Exporter.
+type Config struct {
+	// Endpoint is the base URL of the collector, e.g. http://localhost:4318.
+	// It must be on the loopback interface.
+	Endpoint       string
+	ExportInterval time.Duration
+	// MaxQueuedEvents bounds the events kept until the next export.
+	MaxQueuedEvents int
+	// ServiceName and ServiceVersion identify the exporter in the resource of
+	// the exported metrics and logs.
+	ServiceName    string
+	ServiceVersion string
+}
+
+// ValidateEndpoint checks that endpoint is an http(s) URL on the loopback
+// interface, as health data must not leave the VM.
+func ValidateEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid OTLP endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("OTLP endpoint %q must use http or https", endpoint)
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("OTLP endpoint %q must be on localhost", endpoint)
+}
+
+// errRedirect is returned for redirects, which are not followed so that the
+// exports cannot be sent off the VM.
+var errRedirect = errors.New("the OTLP collector redirected the export, which is not followed")
+
+// newClient returns a client that only connects to loopback addresses, without
+// a proxy, and does not follow redirects.
+func newClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: dialLoopback},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return errRedirect
+		},
+	}
+}
+
+// dialLoopback connects to addr if its host is a loopback address. localhost is
+// pinned to 127.0.0.1 and ::1 rather than resolved, as the resolver could map
+// it to another address.
+func dialLoopback(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	hosts := []string{host}
+	if host == "localhost" {
+		hosts = []string{"127.0.0.1", "::1"}
+	}
+	var d net.Dialer
+	var dialErr error
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("OTLP collector address %s is not on localhost", addr)
+		}
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(h, port))
+		if err == nil {
+			return conn, nil
+		}
+		if dialErr == nil {
+			dialErr = err
+		}
+	}
+	return nil, dialErr
+}
+
+// Exporter sends metrics and telemetry events to an OTLP collector. It is a
+// telemetry.Sink, receiving events as logs.
+type Exporter struct {
+	cfg      Config
+	client   *http.Client
+	resource []byte
+	start    time.Time
+
+	mu      sync.Mutex
+	metrics []metric
+	events  []telemetry.Event
+	dropped int
+	// failing is set while exports fail, so that failures are logged once.
+	failing bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New returns an exporter sending to cfg.Endpoint, which must pass
+// ValidateEndpoint. Exports start right away and run until Shutdown.
+func New(cfg Config) (*Exporter, error) {
+	if err := ValidateEndpoint(cfg.Endpoint); err != nil {
+		return nil, err
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	if cfg.ExportInterval <= 0 {
+		cfg.ExportInterval = DefaultExportInterval
+	}
+	if cfg.MaxQueuedEvents <= 0 {
+		cfg.MaxQueuedEvents = DefaultMaxQueuedEvents
+	}
+	timeout := cfg.ExportInterval
+	if timeout > maxRequestTimeout {
+		timeout = maxRequestTimeout
+	}
+
+	attrs := map[string]string{"service.name": cfg.ServiceName, "service.version": cfg.ServiceVersion}
+	if host, err := os.Hostname(); err == nil {
+		attrs["host.name"] = host
+	}
+	e := &Exporter{
+		cfg:      cfg,
+		client:   newClient(timeout),
+		resource: appendAttributes(nil, fieldResourceAttributes, attrs),
+		start:    time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+// Gauge returns a new gauge exported with the given name, description and unit.
+func (e *Exporter) Gauge(name, description, unit string) *Gauge {
+	g := &Gauge{metricInfo: metricInfo{name, description, unit}, points: make(map[string]gaugePoint)}
+	e.addMetric(g)
+	return g
+}
+
+// Counter returns a new counter exported with the given name, description and unit.
+func (e *Exporter) Counter(name, description, unit string) *Counter {
+	c := &Counter{metricInfo: metricInfo{name, description, unit}, points: make(map[string]*counterPoint)}
+	e.addMetric(c)
+	return c
+}
+
+// Histogram returns a new histogram with the given increasing bucket bounds,
+// exported with the given name, description and unit.
+func (e *Exporter) Histogram(name, description, unit string, bounds []float64) *Histogram {
+	h := &Histogram{metricInfo: metricInfo{name, description, unit}, bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+	e.addMetric(h)
+	return h
+}
+
+func (e *Exporter) addMetric(m metric) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.metrics = append(e.metrics, m)
+}
+
+func (e *Exporter) Name() string { return SinkName }
+
+// Send queues the event for the next export, dropping it if the queue is full.
+func (e *Exporter) Send(ev telemetry.Event) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.events) >= e.cfg.MaxQueuedEvents {
+		e.dropped++
+		return nil
+	}
+	e.events = append(e.events, ev)
+	return nil
+}
+
+// Shutdown stops the exports after a final one, which is abandoned when ctx is
+// done. It does nothing on a nil exporter.
+func (e *Exporter) Shutdown(ctx context.Context) {
+	if e == nil {
+		return
+	}
+	select {
+	case <-e.stop:
+		return
+	default:
+		close(e.stop)
+	}
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+	}
+}
+
+func (e *Exporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.cfg.ExportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			e.export()
+			return
+		case <-ticker.C:
+			e.export()
+		}
+	}
+}
+
+// export sends the queued events and the current metric data points.
+func (e *Exporter) export() {
+	e.mu.Lock()
+	events, dropped, metrics := e.events, e.dropped, e.metrics
+	e.events, e.dropped = nil, 0
+	e.mu.Unlock()
+
+	if dropped > 0 {
+		slog.Warn("Dropped telemetry events queued for OTLP export", "dropped", dropped)
+	}
+	var err error
+	if len(events) > 0 {
+		err = e.post(logsPath, e.encodeLogs(events))
+	}
+	if body := e.encodeMetrics(metrics, time.Now()); body != nil {
+		if mErr := e.post(metricsPath, body); err == nil {
+			err = mErr
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err != nil && !e.failing {
+		slog.Warn("Failed to export to OTLP collector", "endpoint", e.cfg.Endpoint, "error", err)
+	} else if err == nil && e.failing {
+		slog.Info("Exporting to OTLP collector again", "endpoint", e.cfg.Endpoint)
+	}
+	e.failing = err != nil
+}
+
+func (e *Exporter) post(path string, body []byte) error {
+	resp, err := e.client.Post(e.cfg.Endpoint+path, contentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: %s", path, resp.Status)
+	}
+	return nil
+}
+
+// encodeLogs encodes an ExportLogsServiceRequest with the events.
+func (e *Exporter) encodeLogs(events []telemetry.Event) []byte {
+	var scopeLogs []byte
+	scopeLogs = appendScope(scopeLogs, fieldScope, e.cfg.ServiceName, e.cfg.ServiceVersion)
+	for _, ev := range events {
+		scopeLogs = appendMessage(scopeLogs, fieldLogRecords, encodeLogRecord(ev))
+	}
+	var resourceLogs []byte
+	resourceLogs = appendMessage(resourceLogs, fieldResource, e.resource)
+	resourceLogs = appendMessage(resourceLogs, fieldScopeLogs, scopeLogs)
+	return appendMessage(nil, fieldResourceLogs, resourceLogs)
+}
+
+func encodeLogRecord(ev telemetry.Event) []byte {
+	attrs := map[string]string{"task": string(ev.Task)}
+	for i := 0; i+1 < len(ev.Keyvals); i += 2 {
+		attrs[fmt.Sprint(ev.Keyvals[i])] = fmt.Sprint(ev.Keyvals[i+1])
+	}
+	var b []byte
+	b = appendFixed64(b, fieldLogTime, uint64(ev.Time.UnixNano()))
+	b = appendVarint(b, fieldLogSeverityNumber, severityNumber(ev.Level))
+	b = appendString(b, fieldLogSeverityText, string(ev.Level))
+	b = appendMessage(b, fieldLogBody, appendStringValue(nil, ev.Message))
+	b = appendAttributes(b, fieldLogAttributes, attrs)
+	return appendFixed64(b, fieldLogObservedTime, uint64(ev.Time.UnixNano()))
+}
+
+// severityNumber maps an event level to the OTLP SeverityNumber.
+func severityNumber(level telemetry.EventLevel) uint64 {
+	switch level {
+	case telemetry.VerboseEvent:
+		return 5 // DEBUG
+	case telemetry.InfoEvent:
+		return 9 // INFO
+	case telemetry.WarningEvent:
+		return 13 // WARN
+	case telemetry.ErrorEvent:
+		return 17 // ERROR
+	case telemetry.CriticalEvent:
+		return 21 // FATAL
+	default:
+		return 0 // UNSPECIFIED
+	}
+}
+
+// encodeMetrics encodes an ExportMetricsServiceRequest with the data points of
+// the metrics, or returns nil if none has any.
+func (e *Exporter) encodeMetrics(metrics []metric, now time.Time) []byte {
+	var scopeMetrics []byte
+	scopeMetrics = appendScope(scopeMetrics, fieldScope, e.cfg.ServiceName, e.cfg.ServiceVersion)
+	empty := true
+	for _, m := range metrics {
+		if b := m.encode(e.start, now); b != nil {
+			scopeMetrics = appendMessage(scopeMetrics, fieldScopeMetric, b)
+			empty = false
+		}
+	}
+	if empty {
+		return nil
+	}
+	var resourceMetrics []byte
+	resourceMetrics = appendMessage(resourceMetrics, fieldResource, e.resource)
+	resourceMetrics = appendMessage(resourceMetrics, fieldScopeMetrics, scopeMetrics)
+	return appendMessage(nil, fieldResourceMetrics, resourceMetrics)
+}
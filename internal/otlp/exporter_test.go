@@ -0,0 +1,165 @@
+package otlp
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestValidateEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"http://localhost:4318", "https://localhost:4318/", "http://127.0.0.1:4318", "http://[::1]:4318"} {
+		require.NoError(t, ValidateEndpoint(endpoint), endpoint)
+	}
+	for _, endpoint := range []string{"localhost:4318", "grpc://localhost:4317", "http://10.0.0.4:4318", "http://collector.example.com:4318", "http://localhost.example.com:4318"} {
+		require.Error(t, ValidateEndpoint(endpoint), endpoint)
+	}
+}
+
+func TestExporter_doesNotFollowRedirects(t *testing.T) {
+	c, target := newCollector(t)
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL+logsPath, http.StatusTemporaryRedirect))
+	t.Cleanup(redirect.Close)
+
+	e, err := New(Config{Endpoint: redirect.URL, ExportInterval: time.Hour})
+	require.NoError(t, err)
+	defer e.Shutdown(context.Background())
+	require.ErrorIs(t, e.post(logsPath, []byte("logs")), errRedirect)
+	require.Empty(t, c.received(logsPath))
+}
+
+func Test_dialLoopback(t *testing.T) {
+	_, srv := newCollector(t)
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	require.NoError(t, err)
+
+	conn, err := dialLoopback(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+	require.NoError(t, err, "localhost is pinned to the loopback addresses")
+	require.True(t, conn.RemoteAddr().(*net.TCPAddr).IP.IsLoopback())
+	conn.Close()
+
+	_, err = dialLoopback(context.Background(), "tcp", "10.0.0.4:4318")
+	require.ErrorContains(t, err, "is not on localhost")
+	_, err = dialLoopback(context.Background(), "tcp", "collector.example.com:4318")
+	require.ErrorContains(t, err, "is not on localhost", "host names other than localhost are not resolved")
+}
+
+// collector records the requests received by a fake OTLP collector.
+type collector struct {
+	mu       sync.Mutex
+	requests map[string][][]byte
+}
+
+func newCollector(t *testing.T) (*collector, *httptest.Server) {
+	c := &collector{requests: make(map[string][][]byte)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, contentType, r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.requests[r.URL.Path] = append(c.requests[r.URL.Path], body)
+	}))
+	t.Cleanup(srv.Close)
+	return c, srv
+}
+
+func (c *collector) received(path string) [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.requests[path]
+}
+
+func TestExporter(t *testing.T) {
+	c, srv := newCollector(t)
+	e, err := New(Config{Endpoint: srv.URL + "/", ExportInterval: time.Hour, ServiceName: "apphealth", ServiceVersion: "2.0.0"})
+	require.NoError(t, err)
+
+	state := e.Gauge("apphealth.health_state", "", "1")
+	transitions := e.Counter("apphealth.health_state.transitions", "", "1")
+	duration := e.Histogram("apphealth.probe.duration", "", "s", []float64{0.1, 1})
+	state.Set(1, "state", "Healthy")
+	transitions.Add(2, "state", "Healthy")
+	duration.Record(0.5)
+	require.NoError(t, e.Send(telemetry.Event{
+		Time:    time.Now(),
+		Level:   telemetry.WarningEvent,
+		Task:    telemetry.AppHealthTask,
+		Message: "Health state changed to unhealthy",
+		Keyvals: []interface{}{"error", "connection refused"},
+	}))
+
+	e.Shutdown(context.Background())
+
+	metrics := c.received(metricsPath)
+	require.Len(t, metrics, 1)
+	for _, s := range []string{"apphealth", "2.0.0", "apphealth.health_state", "apphealth.health_state.transitions", "apphealth.probe.duration", "Healthy"} {
+		require.Contains(t, string(metrics[0]), s)
+	}
+	num, typ, n := protowire.ConsumeTag(metrics[0])
+	require.Equal(t, fieldResourceMetrics, num)
+	require.Equal(t, protowire.BytesType, typ)
+	_, m := protowire.ConsumeBytes(metrics[0][n:])
+	require.Equal(t, len(metrics[0]), n+m, "the request is a single ResourceMetrics")
+
+	logs := c.received(logsPath)
+	require.Len(t, logs, 1)
+	for _, s := range []string{"Health state changed to unhealthy", "Warning", "connection refused", string(telemetry.AppHealthTask)} {
+		require.Contains(t, string(logs[0]), s)
+	}
+}
+
+func TestExporter_nothingToExport(t *testing.T) {
+	c, srv := newCollector(t)
+	e, err := New(Config{Endpoint: srv.URL, ExportInterval: time.Hour})
+	require.NoError(t, err)
+	e.Counter("apphealth.vmwatch.restarts", "", "1")
+
+	e.Shutdown(context.Background())
+	require.Empty(t, c.received(metricsPath), "metrics without data points are not exported")
+	require.Empty(t, c.received(logsPath))
+}
+
+func TestExporter_dropsEventsWhenQueueIsFull(t *testing.T) {
+	c, srv := newCollector(t)
+	e, err := New(Config{Endpoint: srv.URL, ExportInterval: time.Hour, MaxQueuedEvents: 2})
+	require.NoError(t, err)
+	for _, msg := range []string{"first", "second", "third"} {
+		require.NoError(t, e.Send(telemetry.Event{Time: time.Now(), Level: telemetry.InfoEvent, Message: msg}))
+	}
+
+	e.Shutdown(context.Background())
+	logs := c.received(logsPath)
+	require.Len(t, logs, 1)
+	require.Contains(t, string(logs[0]), "second")
+	require.NotContains(t, string(logs[0]), "third")
+}
+
+func TestExporter_exportsPeriodically(t *testing.T) {
+	c, srv := newCollector(t)
+	e, err := New(Config{Endpoint: srv.URL, ExportInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer e.Shutdown(context.Background())
+
+	e.Gauge("apphealth.health_state", "", "1").Set(1, "state", "Healthy")
+	require.Eventually(t, func() bool { return len(c.received(metricsPath)) >= 2 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestHistogram_buckets(t *testing.T) {
+	h := &Histogram{bounds: []float64{0.1, 1}, counts: make([]uint64, 3)}
+	for _, v := range []float64{0.05, 0.1, 0.5, 1, 5} {
+		h.Record(v)
+	}
+	require.Equal(t, []uint64{2, 2, 1}, h.counts)
+	require.Equal(t, uint64(5), h.count)
+	require.InDelta(t, 6.65, h.sum, 1e-9)
+}
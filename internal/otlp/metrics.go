@@ -0,0 +1,177 @@
+package otlp
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metric is an instrument whose current data points are encoded as an OTLP
+// Metric message.
+type metric interface {
+	encode(start, now time.Time) []byte
+}
+
+type metricInfo struct {
+	name, description, unit string
+}
+
+func (m metricInfo) appendHeader(b []byte) []byte {
+	b = appendString(b, fieldMetricName, m.name)
+	b = appendString(b, fieldMetricDescription, m.description)
+	return appendString(b, fieldMetricUnit, m.unit)
+}
+
+// attrKey identifies a set of attributes, which are given as key-value pairs.
+func attrKey(attrs []string) string {
+	return strings.Join(attrs, "\x00")
+}
+
+func attrMap(attrs []string) map[string]string {
+	m := make(map[string]string, len(attrs)/2)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		m[attrs[i]] = attrs[i+1]
+	}
+	return m
+}
+
+// sortedKeys returns the keys of points in a deterministic order.
+func sortedKeys[T any](points map[string]T) []string {
+	keys := make([]string, 0, len(points))
+	for k := range points {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Gauge is the last value of a measurement for each set of attributes.
+type Gauge struct {
+	metricInfo
+	mu     sync.Mutex
+	points map[string]gaugePoint
+}
+
+type gaugePoint struct {
+	attrs []string
+	value float64
+}
+
+// Set records the value for the attributes, given as key-value pairs.
+func (g *Gauge) Set(value float64, attrs ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.points[attrKey(attrs)] = gaugePoint{attrs: attrs, value: value}
+}
+
+func (g *Gauge) encode(start, now time.Time) []byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.points) == 0 {
+		return nil
+	}
+	var gauge []byte
+	for _, k := range sortedKeys(g.points) {
+		p := g.points[k]
+		var dp []byte
+		dp = appendFixed64(dp, fieldNumberTime, uint64(now.UnixNano()))
+		dp = appendDouble(dp, fieldNumberAsDouble, p.value)
+		dp = appendAttributes(dp, fieldNumberAttributes, attrMap(p.attrs))
+		gauge = appendMessage(gauge, fieldDataPoints, dp)
+	}
+	return appendMessage(g.appendHeader(nil), fieldMetricGauge, gauge)
+}
+
+// Counter is a monotonic cumulative sum for each set of attributes.
+type Counter struct {
+	metricInfo
+	mu     sync.Mutex
+	points map[string]*counterPoint
+}
+
+type counterPoint struct {
+	attrs []string
+	value int64
+}
+
+// Add adds delta, which must not be negative, for the attributes, given as
+// key-value pairs.
+func (c *Counter) Add(delta int64, attrs ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := attrKey(attrs)
+	p, ok := c.points[k]
+	if !ok {
+		p = &counterPoint{attrs: attrs}
+		c.points[k] = p
+	}
+	p.value += delta
+}
+
+func (c *Counter) encode(start, now time.Time) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.points) == 0 {
+		return nil
+	}
+	var sum []byte
+	for _, k := range sortedKeys(c.points) {
+		p := c.points[k]
+		var dp []byte
+		dp = appendFixed64(dp, fieldNumberStartTime, uint64(start.UnixNano()))
+		dp = appendFixed64(dp, fieldNumberTime, uint64(now.UnixNano()))
+		dp = appendFixed64(dp, fieldNumberAsInt, uint64(p.value))
+		dp = appendAttributes(dp, fieldNumberAttributes, attrMap(p.attrs))
+		sum = appendMessage(sum, fieldDataPoints, dp)
+	}
+	sum = appendVarint(sum, fieldAggregationTemporality, aggregationTemporalityCumulative)
+	sum = appendVarint(sum, fieldIsMonotonic, 1)
+	return appendMessage(c.appendHeader(nil), fieldMetricSum, sum)
+}
+
+// Histogram is a cumulative distribution of measurements over explicit bucket
+// bounds.
+type Histogram struct {
+	metricInfo
+	bounds []float64
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Record adds a measurement.
+func (h *Histogram) Record(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// bucket i holds the values in (bounds[i-1], bounds[i]]
+	h.counts[sort.SearchFloat64s(h.bounds, value)]++
+	h.count++
+	h.sum += value
+}
+
+func (h *Histogram) encode(start, now time.Time) []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return nil
+	}
+	var dp []byte
+	dp = appendFixed64(dp, fieldHistogramStartTime, uint64(start.UnixNano()))
+	dp = appendFixed64(dp, fieldHistogramTime, uint64(now.UnixNano()))
+	dp = appendFixed64(dp, fieldHistogramCount, h.count)
+	dp = appendDouble(dp, fieldHistogramSum, h.sum)
+	dp = appendPackedFixed64(dp, fieldHistogramBucketCounts, h.counts)
+	bounds := make([]uint64, len(h.bounds))
+	for i, b := range h.bounds {
+		bounds[i] = math.Float64bits(b)
+	}
+	dp = appendPackedFixed64(dp, fieldHistogramExplicitBounds, bounds)
+
+	var histogram []byte
+	histogram = appendMessage(histogram, fieldDataPoints, dp)
+	histogram = appendVarint(histogram, fieldAggregationTemporality, aggregationTemporalityCumulative)
+	return appendMessage(h.appendHeader(nil), fieldMetricHistogram, histogram)
+}
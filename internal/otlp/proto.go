@@ -0,0 +1,143 @@
+package otlp
+
+import (
+	"math"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the OTLP protobuf messages, from
+// opentelemetry/proto/{common,resource,logs,metrics}/v1 and the collector
+// service requests. Only the fields the exporter writes are listed.
+const (
+	// ExportLogsServiceRequest / ExportMetricsServiceRequest
+	fieldResourceLogs    protowire.Number = 1
+	fieldResourceMetrics protowire.Number = 1
+
+	// ResourceLogs / ResourceMetrics
+	fieldResource     protowire.Number = 1
+	fieldScopeLogs    protowire.Number = 2
+	fieldScopeMetrics protowire.Number = 2
+
+	// Resource
+	fieldResourceAttributes protowire.Number = 1
+
+	// ScopeLogs / ScopeMetrics
+	fieldScope        protowire.Number = 1
+	fieldLogRecords   protowire.Number = 2
+	fieldScopeMetric  protowire.Number = 2
+	fieldScopeName    protowire.Number = 1
+	fieldScopeVersion protowire.Number = 2
+
+	// LogRecord
+	fieldLogTime           protowire.Number = 1
+	fieldLogSeverityNumber protowire.Number = 2
+	fieldLogSeverityText   protowire.Number = 3
+	fieldLogBody           protowire.Number = 5
+	fieldLogAttributes     protowire.Number = 6
+	fieldLogObservedTime   protowire.Number = 11
+
+	// KeyValue / AnyValue
+	fieldKey         protowire.Number = 1
+	fieldValue       protowire.Number = 2
+	fieldStringValue protowire.Number = 1
+
+	// Metric
+	fieldMetricName        protowire.Number = 1
+	fieldMetricDescription protowire.Number = 2
+	fieldMetricUnit        protowire.Number = 3
+	fieldMetricGauge       protowire.Number = 5
+	fieldMetricSum         protowire.Number = 7
+	fieldMetricHistogram   protowire.Number = 9
+
+	// Gauge / Sum / Histogram
+	fieldDataPoints             protowire.Number = 1
+	fieldAggregationTemporality protowire.Number = 2
+	fieldIsMonotonic            protowire.Number = 3
+
+	// NumberDataPoint
+	fieldNumberStartTime  protowire.Number = 2
+	fieldNumberTime       protowire.Number = 3
+	fieldNumberAsDouble   protowire.Number = 4
+	fieldNumberAsInt      protowire.Number = 6
+	fieldNumberAttributes protowire.Number = 7
+
+	// HistogramDataPoint
+	fieldHistogramStartTime      protowire.Number = 2
+	fieldHistogramTime           protowire.Number = 3
+	fieldHistogramCount          protowire.Number = 4
+	fieldHistogramSum            protowire.Number = 5
+	fieldHistogramBucketCounts   protowire.Number = 6
+	fieldHistogramExplicitBounds protowire.Number = 7
+)
+
+// aggregationTemporalityCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+const aggregationTemporalityCumulative = 2
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+func appendDouble(b []byte, num protowire.Number, v float64) []byte {
+	return appendFixed64(b, num, math.Float64bits(v))
+}
+
+// appendPackedFixed64 appends a packed repeated fixed64 or double field.
+func appendPackedFixed64(b []byte, num protowire.Number, values []uint64) []byte {
+	var packed []byte
+	for _, v := range values {
+		packed = protowire.AppendFixed64(packed, v)
+	}
+	return appendMessage(b, num, packed)
+}
+
+// appendAttributes appends attrs as KeyValue messages with string values,
+// sorted by key so that the encoding is deterministic.
+func appendAttributes(b []byte, num protowire.Number, attrs map[string]string) []byte {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var kv []byte
+		kv = appendString(kv, fieldKey, k)
+		kv = appendMessage(kv, fieldValue, appendStringValue(nil, attrs[k]))
+		b = appendMessage(b, num, kv)
+	}
+	return b
+}
+
+// appendStringValue appends the fields of an AnyValue holding s.
+func appendStringValue(b []byte, s string) []byte {
+	b = protowire.AppendTag(b, fieldStringValue, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// appendScope appends an InstrumentationScope message.
+func appendScope(b []byte, num protowire.Number, name, version string) []byte {
+	var scope []byte
+	scope = appendString(scope, fieldScopeName, name)
+	scope = appendString(scope, fieldScopeVersion, version)
+	return appendMessage(b, num, scope)
+}
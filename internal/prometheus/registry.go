@@ -0,0 +1,248 @@
+// Package prometheus exposes metrics in the Prometheus text exposition format
+// on a local HTTP endpoint, for the extension's own state to be scraped.
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// contentType is the content type of the text exposition format.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// family is a metric with its samples for each set of label values.
+type family interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds the metrics exposed by an endpoint, in the order they were
+// created.
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Gauge returns a new gauge with the given name, help text and label names.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{header: header{name, help, "gauge"}, labels: labels, values: make(map[string]*sample)}
+	r.add(g)
+	return g
+}
+
+// Counter returns a new counter with the given name, help text and label names.
+// By convention the name of a counter ends with _total.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{Gauge{header: header{name, help, "counter"}, labels: labels, values: make(map[string]*sample)}}
+	r.add(c)
+	return c
+}
+
+// Histogram returns a new histogram with the given name, help text and
+// increasing bucket upper bounds.
+func (r *Registry) Histogram(name, help string, bounds []float64) *Histogram {
+	h := &Histogram{header: header{name, help, "histogram"}, bounds: bounds, counts: make([]uint64, len(bounds))}
+	r.add(h)
+	return h
+}
+
+func (r *Registry) add(f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, f)
+}
+
+// WriteTo writes the metrics in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := append([]family(nil), r.families...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		f.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves the metrics in the text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	r.WriteTo(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type header struct {
+	name, help, typ string
+}
+
+func (h header) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, escapeHelp(h.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", h.name, h.typ)
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+// Gauge is a value that can go up and down, for each set of label values.
+type Gauge struct {
+	header
+	labels []string
+	mu     sync.Mutex
+	values map[string]*sample
+}
+
+// Set sets the value for the label values, given in the order of the label
+// names.
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sample(labelValues).value = value
+}
+
+func (g *Gauge) sample(labelValues []string) *sample {
+	if len(labelValues) != len(g.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", g.name, len(g.labels), len(labelValues)))
+	}
+	k := strings.Join(labelValues, "\x00")
+	s, ok := g.values[k]
+	if !ok {
+		s = &sample{labelValues: append([]string(nil), labelValues...)}
+		g.values[k] = s
+	}
+	return s
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.header.write(w)
+	keys := make([]string, 0, len(g.values))
+	for k := range g.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := g.values[k]
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, s.labelValues), formatValue(s.value))
+	}
+}
+
+// Counter is a value that only goes up, for each set of label values.
+type Counter struct {
+	Gauge
+}
+
+// Add adds delta, which must not be negative, for the label values.
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sample(labelValues).value += delta
+}
+
+// Inc adds one for the label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Histogram is a cumulative distribution of observations over bucket bounds.
+type Histogram struct {
+	header
+	bounds []float64
+	mu     sync.Mutex
+	// counts[i] is the number of observations in (bounds[i-1], bounds[i]]
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Observe adds an observation.
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i := sort.SearchFloat64s(h.bounds, value); i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header.write(w)
+	var cumulative uint64
+	for i, b := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatValue(b), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, escapeLabelValue(values[i]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string       { return helpEscaper.Replace(s) }
+func escapeLabelValue(s string) string { return labelValueEscaper.Replace(s) }
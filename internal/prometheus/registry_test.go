@@ -0,0 +1,61 @@
+package prometheus
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := NewRegistry()
+	state := r.Gauge("apphealth_committed_state", "Committed health state.", "state")
+	restarts := r.Counter("apphealth_vmwatch_restarts_total", "Number of VMWatch restarts.")
+	duration := r.Histogram("apphealth_probe_duration_seconds", "Duration of the probes.", []float64{0.1, 1})
+
+	state.Set(1, "Healthy")
+	state.Set(0, "Unhealthy")
+	restarts.Inc()
+	restarts.Add(2)
+	for _, v := range []float64{0.05, 0.5, 5} {
+		duration.Observe(v)
+	}
+
+	var b bytes.Buffer
+	n, err := r.WriteTo(&b)
+	require.NoError(t, err)
+	require.Equal(t, int64(b.Len()), n)
+	require.Equal(t, `# HELP apphealth_committed_state Committed health state.
+# TYPE apphealth_committed_state gauge
+apphealth_committed_state{state="Healthy"} 1
+apphealth_committed_state{state="Unhealthy"} 0
+# HELP apphealth_vmwatch_restarts_total Number of VMWatch restarts.
+# TYPE apphealth_vmwatch_restarts_total counter
+apphealth_vmwatch_restarts_total 3
+# HELP apphealth_probe_duration_seconds Duration of the probes.
+# TYPE apphealth_probe_duration_seconds histogram
+apphealth_probe_duration_seconds_bucket{le="0.1"} 1
+apphealth_probe_duration_seconds_bucket{le="1"} 2
+apphealth_probe_duration_seconds_bucket{le="+Inf"} 3
+apphealth_probe_duration_seconds_sum 5.55
+apphealth_probe_duration_seconds_count 3
+`, b.String())
+}
+
+func TestRegistry_escaping(t *testing.T) {
+	r := NewRegistry()
+	r.Gauge("g", "a \\ help\ntext", "l").Set(1, "a \"quoted\"\nvalue")
+
+	var b bytes.Buffer
+	_, err := r.WriteTo(&b)
+	require.NoError(t, err)
+	require.Equal(t, `# HELP g a \\ help\ntext
+# TYPE g gauge
+g{l="a \"quoted\"\nvalue"} 1
+`, b.String())
+}
+
+func TestGauge_wrongNumberOfLabelValues(t *testing.T) {
+	g := NewRegistry().Gauge("g", "", "a", "b")
+	require.Panics(t, func() { g.Set(1, "only one") })
+}
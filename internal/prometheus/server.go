@@ -0,0 +1,85 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// MetricsPath is the path the metrics are served on.
+const MetricsPath = "/metrics"
+
+// ValidateAddress checks that addr is a host:port on the loopback interface, so
+// that the metrics are not exposed outside of the VM.
+func ValidateAddress(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid metrics endpoint address %q: %w", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("metrics endpoint address %q must be on localhost", addr)
+}
+
+// listenAddress pins localhost in addr to 127.0.0.1 rather than resolving it,
+// as the resolver could map it to an address reachable from outside the VM.
+func listenAddress(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "localhost" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// Server serves the metrics of a registry on MetricsPath.
+type Server struct {
+	srv      *http.Server
+	listener net.Listener
+}
+
+// Serve starts serving the metrics of r on addr, which must pass
+// ValidateAddress. It returns once the address is listened on, so that errors
+// binding it are returned.
+func Serve(addr string, r *Registry) (*Server, error) {
+	if err := ValidateAddress(addr); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", listenAddress(addr))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, r)
+	s := &Server{
+		srv:      &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second},
+		listener: l,
+	}
+	go func() {
+		if err := s.srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Metrics endpoint stopped", "address", addr, "error", err)
+		}
+	}()
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Shutdown stops the server, waiting for the scrapes in progress until ctx is
+// done. It does nothing on a nil server.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	return s.srv.Shutdown(ctx)
+}
@@ -0,0 +1,59 @@
+package prometheus
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateAddress(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:9469", "localhost:9469", "[::1]:9469"} {
+		require.NoError(t, ValidateAddress(addr), addr)
+	}
+	for _, addr := range []string{"127.0.0.1", ":9469", "0.0.0.0:9469", "10.0.0.4:9469"} {
+		require.Error(t, ValidateAddress(addr), addr)
+	}
+}
+
+func TestServe(t *testing.T) {
+	r := NewRegistry()
+	r.Gauge("apphealth_consecutive_probes", "Consecutive probes.").Set(2)
+	s, err := Serve("127.0.0.1:0", r)
+	require.NoError(t, err)
+	defer s.Shutdown(context.Background())
+
+	resp, err := http.Get("http://" + s.Addr().String() + MetricsPath)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, contentType, resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "apphealth_consecutive_probes 2\n")
+
+	resp, err = http.Post("http://"+s.Addr().String()+MetricsPath, "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, err = http.Get("http://" + s.Addr().String() + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServe_pinsLocalhost(t *testing.T) {
+	s, err := Serve("localhost:0", NewRegistry())
+	require.NoError(t, err)
+	defer s.Shutdown(context.Background())
+	require.Equal(t, "127.0.0.1", s.Addr().(*net.TCPAddr).IP.String())
+}
+
+func TestServe_rejectsNonLoopbackAddress(t *testing.T) {
+	_, err := Serve("0.0.0.0:0", NewRegistry())
+	require.ErrorContains(t, err, "must be on localhost")
+}
@@ -0,0 +1,106 @@
+package seqno
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchMask selects the inotify events that indicate a file was (re)written in a
+// watched directory: written and closed, created, or renamed into place.
+const watchMask = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_MOVED_TO
+
+// Watcher watches directories with inotify, such as the folder holding the mrseq
+// file and the extension config folder, and reports the paths of files written
+// to them.
+type Watcher struct {
+	f       *os.File
+	dirs    map[int32]string
+	changes chan string
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewWatcher starts watching dirs. It returns an error if inotify is unavailable
+// or a directory cannot be watched, in which case callers should fall back to
+// polling.
+func NewWatcher(dirs ...string) (*Watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("seqno: failed to initialize inotify: %w", err)
+	}
+	w := &Watcher{
+		// a non-blocking fd is registered with the runtime poller, so Close
+		// unblocks a pending Read
+		f:       os.NewFile(uintptr(fd), "inotify"),
+		dirs:    map[int32]string{},
+		changes: make(chan string, 16),
+		done:    make(chan struct{}),
+	}
+	for _, dir := range dirs {
+		wd, err := unix.InotifyAddWatch(fd, dir, watchMask)
+		if err != nil {
+			w.f.Close()
+			return nil, fmt.Errorf("seqno: failed to watch %s: %w", dir, err)
+		}
+		w.dirs[int32(wd)] = dir
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+// Changes returns the channel on which the paths of changed files are sent. An
+// empty path means events were lost and every watched directory should be
+// considered changed. The channel is closed when the watcher is closed or fails.
+func (w *Watcher) Changes() <-chan string {
+	return w.changes
+}
+
+// Close stops watching.
+func (w *Watcher) Close() error {
+	var err error
+	w.once.Do(func() {
+		close(w.done)
+		err = w.f.Close()
+	})
+	return err
+}
+
+func (w *Watcher) readEvents() {
+	defer close(w.changes)
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			nameEnd := nameStart + int(event.Len)
+			if nameEnd > n {
+				break
+			}
+			offset = nameEnd
+
+			var path string
+			if event.Mask&unix.IN_Q_OVERFLOW == 0 {
+				dir, ok := w.dirs[event.Wd]
+				if !ok || event.Len == 0 {
+					continue
+				}
+				path = filepath.Join(dir, strings.TrimRight(string(buf[nameStart:nameEnd]), "\x00"))
+			}
+			select {
+			case w.changes <- path:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
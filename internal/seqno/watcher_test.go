@@ -0,0 +1,64 @@
+package seqno
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// waitForChange waits until w reports a change to path, failing the test if it
+// does not arrive in time. Writing a new file reports it more than once (created,
+// then written), so other changes are skipped.
+func waitForChange(t *testing.T, w *Watcher, path string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case changed, ok := <-w.Changes():
+			require.True(t, ok, "changes channel closed unexpectedly")
+			if changed == path {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for a change to %s", path)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	binDir, configDir := t.TempDir(), t.TempDir()
+	w, err := NewWatcher(binDir, configDir)
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "mrseq"), []byte("4"), 0600))
+	waitForChange(t, w, filepath.Join(binDir, "mrseq"))
+
+	// a file renamed into place is reported under its final name
+	tmp := filepath.Join(t.TempDir(), "5.settings")
+	require.NoError(t, os.WriteFile(tmp, []byte("{}"), 0600))
+	require.NoError(t, os.Rename(tmp, filepath.Join(configDir, "5.settings")))
+	waitForChange(t, w, filepath.Join(configDir, "5.settings"))
+}
+
+func TestWatcher_Close(t *testing.T) {
+	w, err := NewWatcher(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, w.Close(), "closing twice should be a no-op")
+
+	select {
+	case _, ok := <-w.Changes():
+		require.False(t, ok, "changes channel should be closed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("changes channel was not closed")
+	}
+}
+
+func TestNewWatcher_MissingDirectory(t *testing.T) {
+	_, err := NewWatcher(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+}
@@ -0,0 +1,98 @@
+// Package state persists extension handler state under the data directory as
+// version-tagged JSON documents, so that the on-disk format can evolve between
+// extension versions and be migrated (or discarded) when the extension is updated.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when the requested state file does not exist.
+	ErrNotFound = errors.New("state file not found")
+	// ErrInvalidDocument is returned when a state file exists but is not a valid
+	// version-tagged document (e.g. it was written by a version that predates
+	// versioned state, or it is corrupt).
+	ErrInvalidDocument = errors.New("state file is not a valid versioned document")
+)
+
+// Document is the envelope every state file is stored in. SchemaVersion
+// identifies the format of Data, while ExtensionVersion records which extension
+// version wrote the file.
+type Document struct {
+	SchemaVersion    int             `json:"schemaVersion"`
+	ExtensionVersion string          `json:"extensionVersion"`
+	UpdatedUTC       string          `json:"updatedUTC"`
+	Data             json.RawMessage `json:"data"`
+}
+
+// Decode unmarshals the document payload into v.
+func (d *Document) Decode(v interface{}) error {
+	if err := json.Unmarshal(d.Data, v); err != nil {
+		return fmt.Errorf("state: failed to decode schema version %d payload: %w", d.SchemaVersion, err)
+	}
+	return nil
+}
+
+// Read loads the document stored at path. It returns ErrNotFound if the file does
+// not exist and ErrInvalidDocument if it cannot be parsed as a versioned document.
+func Read(path string) (*Document, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("state: failed to read path=%s error=%v", path, err)
+	}
+
+	var d Document
+	if err := json.Unmarshal(b, &d); err != nil || d.SchemaVersion <= 0 {
+		return nil, fmt.Errorf("%w: path=%s", ErrInvalidDocument, path)
+	}
+	return &d, nil
+}
+
+// Write stores v at path wrapped in a Document with the given schema and
+// extension versions. The file is written to a temporary file in the same folder
+// and renamed into place for atomicity.
+func Write(path string, schemaVersion int, extensionVersion string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("state: failed to marshal payload: %v", err)
+	}
+	return WriteDocument(path, &Document{
+		SchemaVersion:    schemaVersion,
+		ExtensionVersion: extensionVersion,
+		Data:             data,
+	})
+}
+
+// WriteDocument atomically stores d at path, stamping its update time.
+func WriteDocument(path string, d *Document) error {
+	d.UpdatedUTC = time.Now().UTC().Format(time.RFC3339)
+	b, err := json.MarshalIndent(d, "", "\t")
+	if err != nil {
+		return fmt.Errorf("state: failed to marshal document: %v", err)
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("state: failed to create temporary file: %v", err)
+	}
+	tmpFile.Close()
+
+	if err := os.WriteFile(tmpFile.Name(), b, 0644); err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("state: failed to write to path=%s error=%v", tmpFile.Name(), err)
+	}
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("state: failed to move to path=%s error=%v", path, err)
+	}
+	return nil
+}
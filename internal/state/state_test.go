@@ -0,0 +1,61 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testPayload struct {
+	Count int    `json:"count"`
+	Name  string `json:"name"`
+}
+
+func TestWriteAndRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.json")
+
+	require.NoError(t, Write(path, 2, "2.0.13", testPayload{Count: 3, Name: "foo"}))
+
+	d, err := Read(path)
+	require.NoError(t, err)
+	require.Equal(t, 2, d.SchemaVersion)
+	require.Equal(t, "2.0.13", d.ExtensionVersion)
+	require.NotEmpty(t, d.UpdatedUTC)
+
+	var p testPayload
+	require.NoError(t, d.Decode(&p))
+	require.Equal(t, testPayload{Count: 3, Name: "foo"}, p)
+
+	// no temporary files should be left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestRead_NotFound(t *testing.T) {
+	_, err := Read(filepath.Join(t.TempDir(), "missing.json"))
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestRead_InvalidDocument(t *testing.T) {
+	dir := t.TempDir()
+
+	corrupt := filepath.Join(dir, "corrupt.json")
+	require.NoError(t, os.WriteFile(corrupt, []byte("not json"), 0644))
+	_, err := Read(corrupt)
+	require.ErrorIs(t, err, ErrInvalidDocument)
+
+	// a plain JSON object without a schema version predates versioned state
+	unversioned := filepath.Join(dir, "unversioned.json")
+	require.NoError(t, os.WriteFile(unversioned, []byte(`{"count": 3}`), 0644))
+	_, err = Read(unversioned)
+	require.ErrorIs(t, err, ErrInvalidDocument)
+}
+
+func TestWrite_MissingDirectory(t *testing.T) {
+	err := Write(filepath.Join(t.TempDir(), "missing", "test.json"), 1, "", testPayload{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to create temporary file")
+}
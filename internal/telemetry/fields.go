@@ -0,0 +1,129 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Names of the fields of common events, which consumers of the events can rely
+// on instead of parsing the messages.
+const (
+	// EventKindField identifies common events, with one of the EventKind values.
+	EventKindField = "event"
+	// ErrorField is the error of a failed operation.
+	ErrorField = "error"
+
+	// StateTypeField is ObservedState or CommittedState in state change events.
+	StateTypeField = "stateType"
+	// StateField and PreviousStateField are the health states after and before a
+	// state change.
+	StateField         = "state"
+	PreviousStateField = "previousState"
+
+	// PIDField, AttemptField, ExitReasonField and ExitCodeField describe a
+	// VMWatch attempt in VMWatch exit events. ExitCodeField is -1 when VMWatch
+	// was killed by a signal.
+	PIDField        = "pid"
+	AttemptField    = "attempt"
+	ExitReasonField = "exitReason"
+	ExitCodeField   = "exitCode"
+)
+
+// EventKind is the value of EventKindField.
+type EventKind string
+
+const (
+	// StateChangeEventKind is the kind of the events sent when the observed or
+	// committed health state changes.
+	StateChangeEventKind EventKind = "stateChange"
+	// ProbeErrorEventKind is the kind of the events sent when a health probe fails.
+	ProbeErrorEventKind EventKind = "probeError"
+	// VMWatchExitEventKind is the kind of the events sent when a VMWatch attempt ends.
+	VMWatchExitEventKind EventKind = "vmWatchExit"
+)
+
+// Values of StateTypeField.
+const (
+	ObservedState  = "observed"
+	CommittedState = "committed"
+)
+
+// PayloadFormat is the format of the messages of the events written to the
+// events folder, see EventsFolderSink.SetPayloadFormat.
+type PayloadFormat string
+
+const (
+	// MessagePayload writes the message of the events as is. It is the default,
+	// which the consumers of the events folder expect.
+	MessagePayload PayloadFormat = "message"
+	// JSONPayload writes the message and the key-value pairs of the events as a
+	// JSON object, see Event.Payload.
+	JSONPayload PayloadFormat = "json"
+)
+
+// Valid reports whether f is one of the payload formats.
+func (f PayloadFormat) Valid() bool {
+	return f == MessagePayload || f == JSONPayload
+}
+
+// PayloadVersion is the version of the JSON payload, which is incremented when
+// fields are renamed or removed but not when fields are added.
+const PayloadVersion = 1
+
+// payload is the JSON object written as the message of the events in the
+// JSONPayload format:
+//
+//	{"version":1,"message":"Committed health state is healthy","fields":{"event":"stateChange","previousState":"Initializing","state":"Healthy","stateType":"committed"}}
+//
+// The fields are omitted when the event has none. Fields are sorted by name.
+// Strings, booleans and numbers keep their JSON type, errors and other values
+// are formatted as strings, durations as seconds and times as RFC 3339. Secrets
+// were redacted from the values when the event was sent.
+type payload struct {
+	Version int                    `json:"version"`
+	Message string                 `json:"message"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Payload returns the JSON payload of the event, see payload.
+func (e Event) Payload() string {
+	p := payload{Version: PayloadVersion, Message: e.Message, Fields: e.Fields()}
+	b, err := json.Marshal(p)
+	if err != nil {
+		// the fields only hold JSON-compatible values
+		return e.Message
+	}
+	return string(b)
+}
+
+// Fields returns the key-value pairs of the event as JSON-compatible values, or
+// nil if it has none. A key without a value is ignored.
+func (e Event) Fields() map[string]interface{} {
+	if len(e.Keyvals) < 2 {
+		return nil
+	}
+	fields := make(map[string]interface{}, len(e.Keyvals)/2)
+	for i := 0; i+1 < len(e.Keyvals); i += 2 {
+		key := fmt.Sprint(e.Keyvals[i])
+		fields[key] = fieldValue(e.Keyvals[i+1])
+	}
+	return fields
+}
+
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case time.Duration:
+		return v.Seconds()
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case error:
+		return v.Error()
+	default:
+		return fmt.Sprint(v)
+	}
+}
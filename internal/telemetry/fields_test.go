@@ -0,0 +1,88 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
+	"github.com/stretchr/testify/require"
+)
+
+type state string
+
+func TestEvent_Payload(t *testing.T) {
+	e := Event{
+		Message: "Committed health state is healthy",
+		Keyvals: []interface{}{
+			EventKindField, StateChangeEventKind,
+			StateTypeField, CommittedState,
+			StateField, state("Healthy"),
+			PreviousStateField, state("Initializing"),
+		},
+	}
+	require.Equal(t, `{"version":1,"message":"Committed health state is healthy","fields":{"event":"stateChange","previousState":"Initializing","state":"Healthy","stateType":"committed"}}`, e.Payload())
+
+	require.Equal(t, `{"version":1,"message":"no fields"}`, Event{Message: "no fields"}.Payload())
+	require.Equal(t, `{"version":1,"message":"dangling key"}`, Event{Message: "dangling key", Keyvals: []interface{}{"key"}}.Payload())
+}
+
+func TestEvent_Fields(t *testing.T) {
+	e := Event{Keyvals: []interface{}{
+		PIDField, 4242,
+		ExitCodeField, -1,
+		"oomKilled", true,
+		"cpuPercentage", 12.5,
+		"elapsed", 1500 * time.Millisecond,
+		"at", time.Date(2024, 1, 1, 0, 0, 0, 0, time.FixedZone("UTC+1", 3600)),
+		ErrorField, errors.New("connection refused"),
+		StateField, state("Healthy"),
+		"missing", nil,
+	}}
+
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(e.Payload()), &struct {
+		Fields *map[string]interface{} `json:"fields"`
+	}{&fields}))
+	require.Equal(t, map[string]interface{}{
+		"pid":           float64(4242),
+		"exitCode":      float64(-1),
+		"oomKilled":     true,
+		"cpuPercentage": 12.5,
+		"elapsed":       1.5,
+		"at":            "2023-12-31T23:00:00Z",
+		"error":         "connection refused",
+		"state":         "Healthy",
+		"missing":       nil,
+	}, fields)
+}
+
+func TestEventsFolderSink_PayloadFormat(t *testing.T) {
+	e := Event{Level: InfoEvent, Task: AppHealthTask, Message: "Health state changed to healthy",
+		Keyvals: []interface{}{EventKindField, StateChangeEventKind}}
+	writtenMessage := func(format PayloadFormat) string {
+		h := &handlerenv.HandlerEnvironment{}
+		h.EventsFolder = t.TempDir()
+		s := NewEventsFolderSink(h)
+		if format != "" {
+			s.SetPayloadFormat(format)
+		}
+		require.NoError(t, s.Send(e))
+
+		files, err := filepath.Glob(filepath.Join(h.EventsFolder, "*.json"))
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		b, err := os.ReadFile(files[0])
+		require.NoError(t, err)
+		var event struct{ Message string }
+		require.NoError(t, json.Unmarshal(b, &event))
+		return event.Message
+	}
+
+	require.Equal(t, "Health state changed to healthy", writtenMessage(""), "the message is written as is by default")
+	require.Equal(t, "Health state changed to healthy", writtenMessage(MessagePayload))
+	require.Equal(t, `{"version":1,"message":"Health state changed to healthy","fields":{"event":"stateChange"}}`, writtenMessage(JSONPayload))
+}
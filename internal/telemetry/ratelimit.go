@@ -0,0 +1,133 @@
+package telemetry
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RateLimit bounds how many similar events are sent: at most MaxEvents events
+// with the same level, task and message template per Window. The events beyond
+// that are suppressed, and a summary with their number is sent once the window
+// ends.
+type RateLimit struct {
+	// MaxEvents is the number of similar events sent per window. Zero or less
+	// disables rate limiting.
+	MaxEvents int
+	Window    time.Duration
+}
+
+// DefaultRateLimit is the rate limit of the telemetry singleton unless
+// configured otherwise. It lets through the events of a few probes per window,
+// which are sent every 5 seconds by default.
+var DefaultRateLimit = RateLimit{MaxEvents: 10, Window: 10 * time.Minute}
+
+func (l RateLimit) String() string {
+	if l.MaxEvents <= 0 {
+		return "no rate limit"
+	}
+	return fmt.Sprintf("%d similar events per %v", l.MaxEvents, l.Window)
+}
+
+// numbers matches the parts of a message that vary between events sent from the
+// same place, e.g. durations, counts, ports and PIDs.
+var numbers = regexp.MustCompile(`[0-9]+`)
+
+// messageTemplate returns message with its numbers replaced, so that the events
+// sent from the same place are similar.
+func messageTemplate(message string) string {
+	return numbers.ReplaceAllLiteralString(message, "#")
+}
+
+type eventKey struct {
+	level    EventLevel
+	task     EventTask
+	template string
+}
+
+// eventWindow counts the similar events since the start of the window.
+type eventWindow struct {
+	start      time.Time
+	sent       int
+	suppressed int
+	// last is the last suppressed event.
+	last Event
+}
+
+type rateLimiter struct {
+	limit RateLimit
+	now   func() time.Time
+
+	mu      sync.Mutex
+	windows map[eventKey]*eventWindow
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{limit: limit, now: time.Now, windows: make(map[eventKey]*eventWindow)}
+}
+
+// allow reports whether e is sent, counting it against the limit when limited
+// is set. It also returns the summaries of the events suppressed in windows that
+// ended, which must be sent first.
+func (l *rateLimiter) allow(e Event, limited bool) (bool, []Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	summaries := l.endWindows(func(w *eventWindow) bool { return now.Sub(w.start) >= l.limit.Window })
+	if !limited {
+		return true, summaries
+	}
+
+	key := eventKey{e.Level, e.Task, messageTemplate(e.Message)}
+	w, ok := l.windows[key]
+	if !ok {
+		w = &eventWindow{start: now}
+		l.windows[key] = w
+	}
+	if w.sent < l.limit.MaxEvents {
+		w.sent++
+		return true, summaries
+	}
+	w.suppressed++
+	w.last = e
+	return false, summaries
+}
+
+// flush ends all windows, returning the summaries of the events suppressed so
+// far.
+func (l *rateLimiter) flush() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.endWindows(func(*eventWindow) bool { return true })
+}
+
+// endWindows removes the windows that ended and returns the summaries of their
+// suppressed events, oldest window first.
+func (l *rateLimiter) endWindows(ended func(*eventWindow) bool) []Event {
+	var windows []*eventWindow
+	for key, w := range l.windows {
+		if !ended(w) {
+			continue
+		}
+		delete(l.windows, key)
+		if w.suppressed > 0 {
+			windows = append(windows, w)
+		}
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].start.Before(windows[j].start) })
+
+	var summaries []Event
+	for _, w := range windows {
+		summaries = append(summaries, Event{
+			Time:  l.now(),
+			Level: w.last.Level,
+			Task:  w.last.Task,
+			Message: fmt.Sprintf("%d similar events suppressed since %s, last: %s",
+				w.suppressed, w.start.UTC().Format(time.RFC3339), w.last.Message),
+			Keyvals: []interface{}{"suppressed", w.suppressed},
+		})
+	}
+	return summaries
+}
@@ -0,0 +1,164 @@
+package telemetry
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
+	"github.com/stretchr/testify/require"
+)
+
+// newRateLimitedTelemetry returns a telemetry with a rate limited memory sink
+// and a rate limit whose clock is advanced by the returned function.
+func newRateLimitedTelemetry(limit RateLimit) (*Telemetry, *MemorySink, func(time.Duration)) {
+	tel := &Telemetry{}
+	sink := NewMemorySink()
+	tel.AddSink(sink, VerboseEvent)
+	tel.SetRateLimited(MemorySinkName, true)
+	tel.SetRateLimit(limit)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tel.limiter.now = func() time.Time { return now }
+	return tel, sink, func(d time.Duration) { now = now.Add(d) }
+}
+
+func messages(events []Event) []string {
+	var msgs []string
+	for _, e := range events {
+		msgs = append(msgs, e.Message)
+	}
+	return msgs
+}
+
+func TestRateLimit_suppressesSimilarEvents(t *testing.T) {
+	tel, sink, advance := newRateLimitedTelemetry(RateLimit{MaxEvents: 2, Window: time.Minute})
+
+	for i := 1; i <= 5; i++ {
+		tel.SendEvent(InfoEvent, AppHealthTask, fmt.Sprintf("Honoring grace period. Time elapsed = %ds", i*5))
+		tel.SendEvent(InfoEvent, AppHealthProbeTask, fmt.Sprintf("Honoring grace period. Time elapsed = %ds", i*5))
+	}
+	tel.SendEvent(WarningEvent, AppHealthTask, "Honoring grace period. Time elapsed = 30s")
+	require.Equal(t, []string{
+		"Honoring grace period. Time elapsed = 5s",
+		"Honoring grace period. Time elapsed = 5s",
+		"Honoring grace period. Time elapsed = 10s",
+		"Honoring grace period. Time elapsed = 10s",
+		"Honoring grace period. Time elapsed = 30s",
+	}, messages(sink.Events()), "events are limited per level, task and message template")
+
+	sink.Reset()
+	advance(time.Minute)
+	tel.SendEvent(InfoEvent, AppHealthTask, "Honoring grace period. Time elapsed = 65s")
+	events := sink.Events()
+	require.Len(t, events, 3, "the summaries are sent once the window ends, before the event")
+	require.Equal(t, "3 similar events suppressed since 2024-01-01T00:00:00Z, last: Honoring grace period. Time elapsed = 25s", events[0].Message)
+	require.Equal(t, InfoEvent, events[0].Level)
+	require.Contains(t, []EventTask{events[0].Task, events[1].Task}, AppHealthProbeTask)
+	require.Equal(t, []interface{}{"suppressed", 3}, events[0].Keyvals)
+	require.Equal(t, "Honoring grace period. Time elapsed = 65s", events[2].Message)
+}
+
+func TestRateLimit_alwaysSendsStateChangesAndCriticalEvents(t *testing.T) {
+	tel, sink, _ := newRateLimitedTelemetry(RateLimit{MaxEvents: 1, Window: time.Minute})
+
+	for i := 0; i < 3; i++ {
+		tel.SendStateChange(InfoEvent, AppHealthTask, "Committed health state is healthy")
+		tel.SendEvent(CriticalEvent, AppHealthTask, "critical")
+		tel.SendEvent(ErrorEvent, AppHealthTask, "error")
+	}
+	require.Equal(t, []string{
+		"Committed health state is healthy", "critical", "error",
+		"Committed health state is healthy", "critical",
+		"Committed health state is healthy", "critical",
+	}, messages(sink.Events()))
+}
+
+func TestSendHeartBeat(t *testing.T) {
+	tel, sink, _ := newRateLimitedTelemetry(RateLimit{MaxEvents: 1, Window: time.Minute})
+	tel.AddSink(LogSink{}, VerboseEvent)
+	var handlerLog bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&handlerLog, nil)))
+	defer slog.SetDefault(defaultLogger)
+
+	for i := 0; i < 3; i++ {
+		tel.SendHeartBeat("AppHealthExtension is running")
+	}
+	require.Equal(t, []string{
+		"AppHealthExtension is running", "AppHealthExtension is running", "AppHealthExtension is running",
+	}, messages(sink.Events()), "heartbeats are never rate limited")
+	require.Equal(t, ReportHeatBeatTask, sink.Events()[0].Task)
+	require.Equal(t, InfoEvent, sink.Events()[0].Level)
+	require.Empty(t, handlerLog.String(), "the caller writes heartbeats to the handler log")
+}
+
+func TestRateLimit_onlyLimitsRateLimitedSinks(t *testing.T) {
+	tel, limited, advance := newRateLimitedTelemetry(RateLimit{MaxEvents: 1, Window: time.Minute})
+	var handlerLog bytes.Buffer
+	all := NewJSONLinesSink(&handlerLog)
+	tel.AddSink(all, VerboseEvent)
+
+	for i := 0; i < 3; i++ {
+		tel.SendEvent(InfoEvent, ReportHeatBeatTask, "AppHealthExtension is running")
+	}
+	advance(time.Minute)
+	tel.Flush()
+	require.Equal(t, []string{
+		"AppHealthExtension is running",
+		"2 similar events suppressed since 2024-01-01T00:00:00Z, last: AppHealthExtension is running",
+	}, messages(limited.Events()))
+	require.Equal(t, 3, strings.Count(handlerLog.String(), "AppHealthExtension is running"), "the other sinks receive every event")
+	require.NotContains(t, handlerLog.String(), "suppressed", "the other sinks are not sent the summaries")
+}
+
+func TestTelemetry_eventsFolderSinkIsRateLimited(t *testing.T) {
+	tel := &Telemetry{}
+	tel.AddSink(NewEventsFolderSink(&handlerenv.HandlerEnvironment{}), VerboseEvent)
+	tel.AddSink(LogSink{}, VerboseEvent)
+	tel.SetMinLevel(EventsFolderSinkName, WarningEvent)
+	require.True(t, tel.sinks[0].rateLimited, "the rate limit is kept when the minimum level changes")
+	require.False(t, tel.sinks[1].rateLimited)
+
+	require.True(t, tel.SetRateLimited(EventsFolderSinkName, false))
+	require.False(t, tel.sinks[0].rateLimited)
+	require.False(t, tel.SetRateLimited(MemorySinkName, true))
+}
+
+func TestRateLimit_flush(t *testing.T) {
+	tel, sink, _ := newRateLimitedTelemetry(RateLimit{MaxEvents: 1, Window: time.Hour})
+
+	for i := 0; i < 3; i++ {
+		tel.SendEvent(ErrorEvent, AppHealthTask, "Error evaluating health probe: connection refused")
+	}
+	require.Len(t, sink.Events(), 1)
+
+	tel.Flush()
+	require.Len(t, sink.Events(), 2)
+	require.Contains(t, sink.Events()[1].Message, "2 similar events suppressed")
+	require.Equal(t, ErrorEvent, sink.Events()[1].Level)
+
+	tel.Flush()
+	tel.SendEvent(ErrorEvent, AppHealthTask, "Error evaluating health probe: connection refused")
+	require.Len(t, sink.Events(), 3, "flushing starts new windows")
+}
+
+func TestRateLimit_disabled(t *testing.T) {
+	tel := &Telemetry{}
+	sink := NewMemorySink()
+	tel.AddSink(sink, VerboseEvent)
+	tel.SetRateLimit(RateLimit{MaxEvents: 0, Window: time.Minute})
+
+	for i := 0; i < 20; i++ {
+		tel.SendEvent(InfoEvent, AppHealthTask, "VMWatch is running")
+	}
+	tel.Flush()
+	require.Len(t, sink.Events(), 20)
+}
+
+func Test_messageTemplate(t *testing.T) {
+	require.Equal(t, "Honoring grace period. Time elapsed = #m#.#s", messageTemplate("Honoring grace period. Time elapsed = 1m5.0021s"))
+	require.Equal(t, "VMWatch PID # exited", messageTemplate("VMWatch PID 4242 exited"))
+}
@@ -0,0 +1,94 @@
+package telemetry
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	secretSignature = "c2lnbmF0dXJl"
+	secretToken     = "dG9rZW4K"
+	sasURL          = "https://account.blob.core.windows.net/config/vmwatch.json?sv=2022-11-02&sig=" + secretSignature
+)
+
+// sendWithSecrets sends events with secrets in their messages and key-value
+// pairs through every path of t.
+func sendWithSecrets(t *Telemetry) {
+	err := fmt.Errorf("failed to download %s: %w", sasURL, errors.New("403"))
+	t.SendEvent(ErrorEvent, MainTask, "Failed to download "+sasURL, ErrorField, err, "url", sasURL, "sasToken", secretToken)
+	t.SendEvent(CriticalEvent, MainTask, err.Error(), ErrorField, err)
+	t.SendStateChange(WarningEvent, MainTask, "Global config changed to "+sasURL, "apiKey", secretToken, "config", fmt.Stringer(stringer(sasURL)))
+	// suppressed by the rate limit, and summarized when flushed
+	for i := 0; i < 3; i++ {
+		t.SendEvent(InfoEvent, MainTask, fmt.Sprintf("Attempt %d: downloading %s", i, sasURL), "attempt", i)
+	}
+	t.Flush()
+}
+
+type stringer string
+
+func (s stringer) String() string { return string(s) }
+
+func requireNoSecrets(t *testing.T, what, s string) {
+	t.Helper()
+	require.NotContains(t, s, secretSignature, what)
+	require.NotContains(t, s, secretToken, what)
+}
+
+func TestSendEvent_redactsSecretsFromEverySink(t *testing.T) {
+	dir := t.TempDir()
+	h := &handlerenv.HandlerEnvironment{}
+	h.EventsFolder = dir
+
+	var jsonLines, handlerLog bytes.Buffer
+	memory := NewMemorySink()
+	tel := &Telemetry{}
+	tel.SetRateLimit(RateLimit{MaxEvents: 1, Window: time.Hour})
+	tel.AddSink(NewEventsFolderSink(h), VerboseEvent)
+	tel.AddSink(LogSink{}, VerboseEvent)
+	tel.AddSink(NewJSONLinesSink(&jsonLines), VerboseEvent)
+	tel.AddSink(memory, VerboseEvent)
+	// like the events folder, so that the summary is checked too
+	tel.SetRateLimited(MemorySinkName, true)
+
+	// the log sink writes to the default logger, i.e. the handler log, whose
+	// handler must not be the one redacting here
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&handlerLog, nil)))
+	defer slog.SetDefault(defaultLogger)
+
+	sendWithSecrets(tel)
+
+	events := memory.Events()
+	require.Len(t, events, 5, "3 events, 1 rate limited event and its summary")
+	require.Contains(t, events[4].Message, "similar events suppressed")
+	for _, e := range events {
+		requireNoSecrets(t, "message", e.Message)
+		requireNoSecrets(t, "keyvals", fmt.Sprint(e.Keyvals...))
+		requireNoSecrets(t, "payload", e.Payload())
+	}
+	require.Contains(t, events[0].Message, "vmwatch.json?<redacted>")
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	for _, f := range files {
+		b, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		require.NoError(t, err)
+		requireNoSecrets(t, "events folder", string(b))
+	}
+	requireNoSecrets(t, "JSON lines", jsonLines.String())
+	require.Equal(t, 6, strings.Count(jsonLines.String(), "\n"), "the JSON lines sink is not rate limited")
+	requireNoSecrets(t, "handler log", handlerLog.String())
+	require.Contains(t, handlerLog.String(), "<redacted>")
+}
@@ -0,0 +1,213 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
+	"github.com/Azure/applicationhealth-extension-linux/pkg/logging"
+	"github.com/Azure/azure-extension-platform/pkg/extensionevents"
+)
+
+// Names of the built-in sinks.
+const (
+	EventsFolderSinkName = "events"
+	LogSinkName          = "log"
+	JSONLinesSinkName    = "file"
+	MemorySinkName       = "memory"
+)
+
+// Event is a telemetry event sent with SendEvent.
+type Event struct {
+	Time    time.Time
+	Level   EventLevel
+	Task    EventTask
+	Message string
+	// Keyvals are the key-value pairs the event was sent with.
+	Keyvals []interface{}
+}
+
+// Sink is a destination telemetry events are fanned out to.
+type Sink interface {
+	// Name identifies the sink, e.g. to configure its minimum level.
+	Name() string
+	Send(e Event) error
+}
+
+// severity orders the event levels, from Verbose to Critical. Unknown levels
+// have no severity.
+func (l EventLevel) severity() int {
+	switch l {
+	case VerboseEvent:
+		return 1
+	case InfoEvent:
+		return 2
+	case WarningEvent:
+		return 3
+	case ErrorEvent:
+		return 4
+	case CriticalEvent:
+		return 5
+	default:
+		return 0
+	}
+}
+
+// Valid reports whether l is one of the event levels.
+func (l EventLevel) Valid() bool {
+	return l.severity() > 0
+}
+
+// EventsFolderSink writes events to the events folder of the handler
+// environment, from where the guest agent uploads them. Only the message of the
+// events is written unless the JSONPayload format is set.
+type EventsFolderSink struct {
+	eem         *extensionevents.ExtensionEventManager
+	jsonPayload atomic.Bool
+}
+
+func NewEventsFolderSink(h *handlerenv.HandlerEnvironment) *EventsFolderSink {
+	return &EventsFolderSink{eem: extensionevents.New(logging.NewNopLogger(), &h.HandlerEnvironment)}
+}
+
+func (s *EventsFolderSink) Name() string { return EventsFolderSinkName }
+
+func (s *EventsFolderSink) Send(e Event) error {
+	message := e.Message
+	if s.jsonPayload.Load() {
+		message = e.Payload()
+	}
+	switch e.Level {
+	case InfoEvent:
+		s.eem.LogInformationalEvent(string(e.Task), message)
+	case VerboseEvent:
+		s.eem.LogVerboseEvent(string(e.Task), message)
+	case WarningEvent:
+		s.eem.LogWarningEvent(string(e.Task), message)
+	case ErrorEvent:
+		s.eem.LogErrorEvent(string(e.Task), message)
+	case CriticalEvent:
+		s.eem.LogCriticalEvent(string(e.Task), message)
+	default:
+		return fmt.Errorf("invalid event level %q", e.Level)
+	}
+	return nil
+}
+
+// SetPayloadFormat sets the format of the messages of the events written from
+// now on, see PayloadFormat.
+func (s *EventsFolderSink) SetPayloadFormat(format PayloadFormat) {
+	s.jsonPayload.Store(format == JSONPayload)
+}
+
+// SetOperationID sets the operation ID of the events written from now on.
+func (s *EventsFolderSink) SetOperationID(operationID string) {
+	s.eem.SetOperationID(operationID)
+}
+
+// LogSink writes events to the default slog logger, i.e. the handler log.
+type LogSink struct{}
+
+func (LogSink) Name() string { return LogSinkName }
+
+func (LogSink) Send(e Event) error {
+	keyvals := append(e.Keyvals[:len(e.Keyvals):len(e.Keyvals)], "task", e.Task)
+	switch e.Level {
+	case InfoEvent:
+		slog.Info(e.Message, keyvals...)
+	case VerboseEvent:
+		slog.Debug(e.Message, keyvals...)
+	case WarningEvent:
+		slog.Warn(e.Message, keyvals...)
+	case ErrorEvent, CriticalEvent:
+		slog.Error(e.Message, keyvals...)
+	default:
+		return fmt.Errorf("invalid event level %q", e.Level)
+	}
+	return nil
+}
+
+// JSONLinesSink writes each event as a line of JSON to a local file, for
+// troubleshooting on the VM without access to the uploaded events.
+type JSONLinesSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONLinesSink returns a sink writing to w, which receives one Write call
+// per event.
+func NewJSONLinesSink(w io.Writer) *JSONLinesSink {
+	return &JSONLinesSink{w: w}
+}
+
+func (s *JSONLinesSink) Name() string { return JSONLinesSinkName }
+
+// jsonLine is the format of an event written by JSONLinesSink.
+type jsonLine struct {
+	Time    string            `json:"time"`
+	Level   EventLevel        `json:"level"`
+	Task    EventTask         `json:"task"`
+	Message string            `json:"message"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+}
+
+func (s *JSONLinesSink) Send(e Event) error {
+	line := jsonLine{
+		Time:    e.Time.UTC().Format(time.RFC3339Nano),
+		Level:   e.Level,
+		Task:    e.Task,
+		Message: e.Message,
+	}
+	for i := 0; i+1 < len(e.Keyvals); i += 2 {
+		if line.Attrs == nil {
+			line.Attrs = make(map[string]string)
+		}
+		line.Attrs[fmt.Sprint(e.Keyvals[i])] = fmt.Sprint(e.Keyvals[i+1])
+	}
+	b, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+// MemorySink keeps the events in memory, for tests.
+type MemorySink struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+func (s *MemorySink) Name() string { return MemorySinkName }
+
+func (s *MemorySink) Send(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+// Events returns the events received so far.
+func (s *MemorySink) Events() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Event(nil), s.events...)
+}
+
+// Reset discards the events received so far.
+func (s *MemorySink) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = nil
+}
@@ -4,10 +4,10 @@ import (
 	"fmt"
 	"log/slog"
 	"sync"
+	"time"
 
 	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
-	"github.com/Azure/applicationhealth-extension-linux/pkg/logging"
-	"github.com/Azure/azure-extension-platform/pkg/extensionevents"
+	"github.com/Azure/applicationhealth-extension-linux/pkg/redact"
 	"github.com/google/uuid"
 )
 
@@ -32,6 +32,8 @@ const (
 	StopVMWatchTask    EventTask = "OnExited"
 	SetupVMWatchTask   EventTask = "SetupVMWatchProcess"
 	KillVMWatchTask    EventTask = "KillVMWatchIfApplicable"
+	VMWatchUsageTask   EventTask = "ReportVMWatchResourceUsage"
+	UpdateTask         EventTask = "Update"
 )
 
 var (
@@ -39,8 +41,21 @@ var (
 	ErrTelemetryNotInit   = fmt.Errorf("telemetry not initialized")
 )
 
+// Telemetry fans the events sent with SendEvent out to its sinks, each of which
+// only receives the events at or above its minimum level. Once a rate limit is
+// set, similar events are rate limited for the rate limited sinks, by default
+// the events folder, whose events are uploaded by the guest agent; the other
+// sinks, e.g. the handler log, receive every event.
 type Telemetry struct {
-	eem *extensionevents.ExtensionEventManager
+	mu      sync.RWMutex
+	sinks   []*registeredSink
+	limiter *rateLimiter
+}
+
+type registeredSink struct {
+	sink        Sink
+	minLevel    EventLevel
+	rateLimited bool
 }
 
 var (
@@ -58,12 +73,14 @@ func NewTelemetry(h *handlerenv.HandlerEnvironment) (*Telemetry, error) {
 		return nil, fmt.Errorf("events folder is not set: %w", ErrUnableToInitialize)
 	}
 	once.Do(func() {
-		instance = &Telemetry{
-			eem: extensionevents.New(logging.NewNopLogger(), &h.HandlerEnvironment),
-		}
+		events := NewEventsFolderSink(h)
 		// OperationId is initialized here but currently AppHealth telemetry does not depend on it.
 		// There are other scenarios for VMWatch where it is overridden
-		instance.eem.SetOperationID(uuid.New().String())
+		events.SetOperationID(uuid.New().String())
+		instance = &Telemetry{}
+		instance.SetRateLimit(DefaultRateLimit)
+		instance.AddSink(events, VerboseEvent)
+		instance.AddSink(LogSink{}, VerboseEvent)
 	})
 	return instance, nil
 }
@@ -79,53 +96,204 @@ func GetTelemetry() (*Telemetry, error) {
 	return instance, nil
 }
 
-// LogEvent sends a telemetry event with the specified level, task name, and message.
-func (t *Telemetry) SendEvent(level EventLevel, taskName EventTask, message string, keyvals ...interface{}) {
-	keyvals = append(keyvals, "task", taskName)
-	// Select the appropriate event dispatcher and log dispatcher based on the event level.
-	// then log and send the event.
-	if eventDispatcher, ok := t.getEventDispatcherFunc(level); ok {
-		if log, ok := t.getLogDispatcherFunc(level); ok {
-			log(message, keyvals...)
+// AddSink adds a sink receiving the events at or above minLevel, replacing any
+// sink with the same name. Only the events folder sink is rate limited, see
+// SetRateLimited.
+func (t *Telemetry) AddSink(sink Sink, minLevel EventLevel) {
+	t.updateSinks(func(sinks []*registeredSink) []*registeredSink {
+		r := &registeredSink{sink: sink, minLevel: minLevel, rateLimited: sink.Name() == EventsFolderSinkName}
+		for i := range sinks {
+			if sinks[i].sink.Name() == sink.Name() {
+				sinks[i] = r
+				return sinks
+			}
 		}
-		eventDispatcher(string(taskName), message)
-	} else {
+		return append(sinks, r)
+	})
+}
+
+// RemoveSink removes the sink with the given name, if any.
+func (t *Telemetry) RemoveSink(name string) {
+	t.updateSinks(func(sinks []*registeredSink) []*registeredSink {
+		for i := range sinks {
+			if sinks[i].sink.Name() == name {
+				return append(sinks[:i], sinks[i+1:]...)
+			}
+		}
+		return sinks
+	})
+}
+
+// SetMinLevel sets the minimum level of the events the sink with the given name
+// receives. It returns false if there is no such sink.
+func (t *Telemetry) SetMinLevel(name string, minLevel EventLevel) bool {
+	found := false
+	t.updateSinks(func(sinks []*registeredSink) []*registeredSink {
+		for i := range sinks {
+			if sinks[i].sink.Name() == name {
+				sinks[i] = &registeredSink{sink: sinks[i].sink, minLevel: minLevel, rateLimited: sinks[i].rateLimited}
+				found = true
+			}
+		}
+		return sinks
+	})
+	return found
+}
+
+// Receives reports whether the sink with the given name receives the events at
+// level, i.e. whether there is such a sink and level is at or above its minimum
+// level.
+func (t *Telemetry) Receives(name string, level EventLevel) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, r := range t.sinks {
+		if r.sink.Name() == name {
+			return level.severity() >= r.minLevel.severity()
+		}
+	}
+	return false
+}
+
+// SetRateLimited sets whether the sink with the given name is subject to the
+// rate limit, and receives the summaries of the events it suppressed. It
+// returns false if there is no such sink.
+func (t *Telemetry) SetRateLimited(name string, rateLimited bool) bool {
+	found := false
+	t.updateSinks(func(sinks []*registeredSink) []*registeredSink {
+		for i := range sinks {
+			if sinks[i].sink.Name() == name {
+				sinks[i] = &registeredSink{sink: sinks[i].sink, minLevel: sinks[i].minLevel, rateLimited: rateLimited}
+				found = true
+			}
+		}
+		return sinks
+	})
+	return found
+}
+
+// updateSinks replaces the sinks with the result of update, which is passed a
+// copy so that events being sent concurrently are not affected.
+func (t *Telemetry) updateSinks(update func([]*registeredSink) []*registeredSink) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sinks = update(append([]*registeredSink(nil), t.sinks...))
+}
+
+// SetRateLimit sets the rate limit of similar events sent to the rate limited
+// sinks, see RateLimit. The counts of the previous limit are discarded.
+func (t *Telemetry) SetRateLimit(limit RateLimit) {
+	var limiter *rateLimiter
+	if limit.MaxEvents > 0 {
+		limiter = newRateLimiter(limit)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limiter = limiter
+}
+
+// SendEvent sends a telemetry event with the specified level, task name, and message to the sinks.
+// Secrets are redacted from the message and key-value pairs before they reach the sinks, see
+// redactKeyvals. Similar events beyond the rate limit are not sent to the rate limited sinks,
+// except Critical ones.
+func (t *Telemetry) SendEvent(level EventLevel, taskName EventTask, message string, keyvals ...interface{}) {
+	t.send(level, taskName, message, keyvals, level != CriticalEvent, everySink)
+}
+
+// SendStateChange sends a telemetry event reporting a state change, like
+// SendEvent, except that it is never rate limited so that state changes are
+// always delivered to every sink.
+func (t *Telemetry) SendStateChange(level EventLevel, taskName EventTask, message string, keyvals ...interface{}) {
+	t.send(level, taskName, message, keyvals, false, everySink)
+}
+
+// SendHeartBeat sends an informational heartbeat event of ReportHeatBeatTask,
+// which is never rate limited so that every heartbeat is uploaded. It is sent to
+// every sink except the log sink: the heartbeat must be written to the handler
+// log regardless of the log level, which is up to the caller.
+func (t *Telemetry) SendHeartBeat(message string) {
+	t.send(InfoEvent, ReportHeatBeatTask, message, nil, false, func(r *registeredSink) bool {
+		return r.sink.Name() != LogSinkName
+	})
+}
+
+// Flush sends the summaries of the events suppressed so far by the rate limit.
+func (t *Telemetry) Flush() {
+	t.mu.RLock()
+	sinks, limiter := t.sinks, t.limiter
+	t.mu.RUnlock()
+	if limiter == nil {
+		return
+	}
+	for _, summary := range limiter.flush() {
+		fanOut(sinks, summary, isRateLimited)
+	}
+}
+
+func (t *Telemetry) send(level EventLevel, taskName EventTask, message string, keyvals []interface{}, limited bool, selected func(*registeredSink) bool) {
+	if !level.Valid() {
 		slog.Error("Invalid event level", "level", level)
+		return
+	}
+	e := Event{Time: time.Now(), Level: level, Task: taskName, Message: redact.Text(message), Keyvals: redactKeyvals(keyvals)}
+
+	t.mu.RLock()
+	sinks, limiter := t.sinks, t.limiter
+	t.mu.RUnlock()
+	allowed := true
+	if limiter != nil {
+		var summaries []Event
+		allowed, summaries = limiter.allow(e, limited)
+		for _, summary := range summaries {
+			fanOut(sinks, summary, isRateLimited)
+		}
 	}
+	fanOut(sinks, e, func(r *registeredSink) bool { return selected(r) && (allowed || !r.rateLimited) })
 }
 
-// Helper method to dynamically get the dispatch function
-func (t *Telemetry) getEventDispatcherFunc(level EventLevel) (func(string, string), bool) {
-	switch level {
-	case InfoEvent:
-		return t.eem.LogInformationalEvent, true
-	case VerboseEvent:
-		return t.eem.LogVerboseEvent, true
-	case WarningEvent:
-		return t.eem.LogWarningEvent, true
-	case ErrorEvent:
-		return t.eem.LogErrorEvent, true
-	case CriticalEvent:
-		return t.eem.LogCriticalEvent, true
-	default:
-		return nil, false
+// redactKeyvals returns a copy of keyvals with secrets redacted from the string
+// values, and from errors and other values formatted as strings, see
+// redact.KeyValue. Booleans, numbers, durations and times are kept as is.
+func redactKeyvals(keyvals []interface{}) []interface{} {
+	if len(keyvals) == 0 {
+		return keyvals
+	}
+	redacted := make([]interface{}, len(keyvals))
+	copy(redacted, keyvals)
+	for i := 0; i+1 < len(redacted); i += 2 {
+		key := fmt.Sprint(redacted[i])
+		switch v := redacted[i+1].(type) {
+		case nil, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, time.Duration, time.Time:
+		case string:
+			redacted[i+1] = redact.KeyValue(key, v)
+		case error:
+			redacted[i+1] = redact.KeyValue(key, v.Error())
+		default:
+			redacted[i+1] = redact.KeyValue(key, fmt.Sprint(v))
+		}
 	}
+	return redacted
+}
+
+// everySink selects every sink.
+func everySink(*registeredSink) bool {
+	return true
+}
+
+// isRateLimited selects the rate limited sinks, which are the only ones sent
+// the summaries of the suppressed events as the others received them.
+func isRateLimited(r *registeredSink) bool {
+	return r.rateLimited
 }
 
-func (t *Telemetry) getLogDispatcherFunc(level EventLevel) (func(string, ...any), bool) {
-	switch level {
-	case InfoEvent:
-		return slog.Info, true
-	case VerboseEvent:
-		return slog.Debug, true
-	case WarningEvent:
-		return slog.Warn, true
-	case ErrorEvent:
-		return slog.Error, true
-	case CriticalEvent:
-		return slog.Error, true
-	default:
-		return nil, false
+// fanOut sends e to the selected sinks whose minimum level it is at or above.
+func fanOut(sinks []*registeredSink, e Event, selected func(*registeredSink) bool) {
+	for _, r := range sinks {
+		if !selected(r) || e.Level.severity() < r.minLevel.severity() {
+			continue
+		}
+		if err := r.sink.Send(e); err != nil && r.sink.Name() != LogSinkName {
+			slog.Error("Failed to send telemetry event", "sink", r.sink.Name(), "error", err)
+		}
 	}
 }
 
@@ -136,7 +304,95 @@ func SetOperationID(operationID string) {
 
 	// ExtensionEvent package does not expose current operation ID.
 	instance.SendEvent(InfoEvent, MainTask, fmt.Sprintf("Overriding OperationId with %s", operationID))
-	instance.eem.SetOperationID(operationID)
+	instance.mu.RLock()
+	defer instance.mu.RUnlock()
+	for _, r := range instance.sinks {
+		if s, ok := r.sink.(interface{ SetOperationID(string) }); ok {
+			s.SetOperationID(operationID)
+		}
+	}
+}
+
+// SetPayloadFormat sets the format of the events the telemetry singleton writes
+// to the events folder, see EventsFolderSink.SetPayloadFormat.
+func SetPayloadFormat(format PayloadFormat) {
+	if instance == nil {
+		return
+	}
+	instance.mu.RLock()
+	defer instance.mu.RUnlock()
+	for _, r := range instance.sinks {
+		if s, ok := r.sink.(interface{ SetPayloadFormat(PayloadFormat) }); ok {
+			s.SetPayloadFormat(format)
+		}
+	}
+}
+
+// AddSink adds a sink to the telemetry singleton, see Telemetry.AddSink.
+func AddSink(sink Sink, minLevel EventLevel) {
+	if instance == nil {
+		return
+	}
+	instance.AddSink(sink, minLevel)
+}
+
+// RemoveSink removes a sink from the telemetry singleton, see Telemetry.RemoveSink.
+func RemoveSink(name string) {
+	if instance == nil {
+		return
+	}
+	instance.RemoveSink(name)
+}
+
+// SetMinLevel sets the minimum level of a sink of the telemetry singleton, see Telemetry.SetMinLevel.
+func SetMinLevel(name string, minLevel EventLevel) bool {
+	if instance == nil {
+		return false
+	}
+	return instance.SetMinLevel(name, minLevel)
+}
+
+// Receives reports whether a sink of the telemetry singleton receives the events at level, see
+// Telemetry.Receives.
+func Receives(name string, level EventLevel) bool {
+	if instance == nil {
+		return false
+	}
+	return instance.Receives(name, level)
+}
+
+// SetRateLimit sets the rate limit of the telemetry singleton, see Telemetry.SetRateLimit.
+func SetRateLimit(limit RateLimit) {
+	if instance == nil {
+		return
+	}
+	instance.SetRateLimit(limit)
+}
+
+// Flush sends the summaries of the events suppressed by the telemetry singleton, see Telemetry.Flush.
+func Flush() {
+	if instance == nil {
+		return
+	}
+	instance.Flush()
+}
+
+// SendStateChange sends an event reporting a state change, which is never rate limited, see
+// Telemetry.SendStateChange.
+func SendStateChange(level EventLevel, taskName EventTask, message string, keyvals ...interface{}) {
+	if instance == nil {
+		return
+	}
+	instance.SendStateChange(level, taskName, message, keyvals...)
+}
+
+// SendHeartBeat sends a heartbeat event, which is never rate limited, to the sinks of the
+// telemetry singleton except the log sink, see Telemetry.SendHeartBeat.
+func SendHeartBeat(message string) {
+	if instance == nil {
+		return
+	}
+	instance.SendHeartBeat(message)
 }
 
 // SendEvent sends an event with the specified level, task name, message, and key-value pairs.
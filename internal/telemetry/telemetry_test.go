@@ -0,0 +1,87 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type failingSink struct{ MemorySink }
+
+func (s *failingSink) Name() string       { return "failing" }
+func (s *failingSink) Send(e Event) error { return errors.New("sink unavailable") }
+
+func TestSendEvent_FansOutByMinLevel(t *testing.T) {
+	verbose, warning := NewMemorySink(), &namedMemorySink{name: "warning"}
+	tel := &Telemetry{}
+	tel.AddSink(verbose, VerboseEvent)
+	tel.AddSink(warning, WarningEvent)
+	tel.AddSink(&failingSink{}, VerboseEvent)
+
+	tel.SendEvent(VerboseEvent, MainTask, "verbose")
+	tel.SendEvent(InfoEvent, MainTask, "info", "key", "value")
+	tel.SendEvent(ErrorEvent, MainTask, "error")
+	tel.SendEvent(EventLevel("Debug"), MainTask, "invalid level")
+
+	require.Len(t, verbose.Events(), 3, "a failing sink does not affect the others")
+	require.Equal(t, []interface{}{"key", "value"}, verbose.Events()[1].Keyvals)
+	require.Len(t, warning.Events(), 1)
+	require.Equal(t, "error", warning.Events()[0].Message)
+	require.Equal(t, ErrorEvent, warning.Events()[0].Level)
+
+	require.True(t, tel.SetMinLevel(MemorySinkName, ErrorEvent))
+	require.False(t, tel.SetMinLevel("missing", ErrorEvent))
+	require.True(t, tel.Receives(MemorySinkName, CriticalEvent))
+	require.False(t, tel.Receives(MemorySinkName, WarningEvent))
+	require.False(t, tel.Receives("missing", CriticalEvent))
+	verbose.Reset()
+	tel.SendEvent(WarningEvent, MainTask, "warning")
+	require.Empty(t, verbose.Events())
+
+	require.Len(t, warning.Events(), 2)
+
+	tel.RemoveSink("warning")
+	tel.SendEvent(CriticalEvent, MainTask, "critical")
+	require.Len(t, verbose.Events(), 1)
+	require.Len(t, warning.Events(), 2, "removed sinks receive no events")
+}
+
+func TestAddSink_ReplacesSinkWithSameName(t *testing.T) {
+	first, second := NewMemorySink(), NewMemorySink()
+	tel := &Telemetry{}
+	tel.AddSink(first, VerboseEvent)
+	tel.AddSink(second, VerboseEvent)
+
+	tel.SendEvent(InfoEvent, MainTask, "info")
+	require.Empty(t, first.Events())
+	require.Len(t, second.Events(), 1)
+}
+
+func TestJSONLinesSink(t *testing.T) {
+	var buf bytes.Buffer
+	tel := &Telemetry{}
+	tel.AddSink(NewJSONLinesSink(&buf), InfoEvent)
+
+	tel.SendEvent(InfoEvent, StartVMWatchTask, "started", "pid", 42)
+	tel.SendEvent(WarningEvent, StopVMWatchTask, "exited")
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+	var line jsonLine
+	require.NoError(t, json.Unmarshal(lines[0], &line))
+	require.Equal(t, InfoEvent, line.Level)
+	require.Equal(t, StartVMWatchTask, line.Task)
+	require.Equal(t, "started", line.Message)
+	require.Equal(t, map[string]string{"pid": "42"}, line.Attrs)
+	require.NotEmpty(t, line.Time)
+}
+
+type namedMemorySink struct {
+	MemorySink
+	name string
+}
+
+func (s *namedMemorySink) Name() string { return s.name }
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
+	"github.com/Azure/applicationhealth-extension-linux/internal/liveness"
+	"github.com/Azure/applicationhealth-extension-linux/internal/otlp"
+	"github.com/Azure/applicationhealth-extension-linux/internal/prometheus"
+	"github.com/Azure/applicationhealth-extension-linux/internal/state"
 	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
 	"github.com/Azure/applicationhealth-extension-linux/pkg/redact"
 	"github.com/pkg/errors"
@@ -22,7 +28,7 @@ func appHealthBinaryName() string {
 	return AppHealthBinaryNameAmd64
 }
 
-type cmdFunc func(lg *slog.Logger, hEnv *handlerenv.HandlerEnvironment, seqNum uint) (msg string, err error)
+type cmdFunc func(ctx context.Context, lg *slog.Logger, hEnv *handlerenv.HandlerEnvironment, seqNum uint) (msg string, err error)
 type preFunc func(lg *slog.Logger, seqNum uint) error
 
 type cmd struct {
@@ -41,32 +47,46 @@ var (
 	cmdInstall   = cmd{install, "Install", false, nil, 52}
 	cmdEnable    = cmd{enable, "Enable", true, enablePre, 3}
 	cmdUninstall = cmd{uninstall, "Uninstall", false, nil, 3}
+	cmdDisable   = cmd{disable, "Disable", true, nil, 3}
+	cmdUpdate    = cmd{update, "Update", true, nil, 3}
 
 	cmds = map[string]cmd{
 		"install":   cmdInstall,
 		"uninstall": cmdUninstall,
 		"enable":    cmdEnable,
-		"update":    {noop, "Update", true, nil, 3},
-		"disable":   {noop, "Disable", true, nil, 3},
+		"update":    cmdUpdate,
+		"disable":   cmdDisable,
 	}
 )
 
-func noop(lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (string, error) {
-	lg.Info("noop")
-	return "", nil
-}
-
-func install(lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (string, error) {
+func install(ctx context.Context, lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (string, error) {
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		return "", errors.Wrap(err, "failed to create data dir")
 	}
 
 	telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask, "Created data dir", "path", dataDir)
+
+	// When installing as part of an update, the previous version's uninstall has
+	// removed dataDir after update migrated it, so bring the migrated state back.
+	if err := restoreStagedState(dataDir); err != nil {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
+			fmt.Sprintf("Failed to restore state staged by update: %v", err), "error", err)
+	}
+	if _, err := state.Read(filepath.Join(dataDir, extensionStateFileName)); err != nil {
+		if version, err := GetExtensionManifestVersion(); err == nil {
+			if err := recordExtensionVersion(version, ""); err != nil {
+				telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
+					fmt.Sprintf("Failed to record extension version in data dir: %v", err), "error", err)
+			}
+		}
+	}
 	telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask, "Handler successfully installed")
 	return "", nil
 }
 
-func uninstall(lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (string, error) {
+func uninstall(ctx context.Context, lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (string, error) {
+	// VMWatch was stopped by disable, remove the scopes and cgroups its runs may have left behind
+	reapVMWatchCgroups()
 	{ // a new context scope with path
 		slog.SetDefault(lg.With("path", dataDir))
 		telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask, "Removing data dir", "path", dataDir)
@@ -80,13 +100,46 @@ func uninstall(lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (
 }
 
 const (
-	statusMessage = "Successfully polling for application health"
+	statusMessage         = "Successfully polling for application health"
+	disabledStatusMessage = "Application health reporting is disabled"
 )
 
+// disable stops the detached enable process (and with it the health probe loop)
+// as well as any VMWatch process, so that no further health or VMWatch status is
+// reported until the extension is enabled again.
+func disable(ctx context.Context, lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (string, error) {
+	pids, err := findExistingProcesses()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to discover running AHE processes")
+	}
+	if len(pids) == 0 {
+		telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask, "No running AHE process found, nothing to stop")
+	} else {
+		telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask,
+			fmt.Sprintf("Stopping running AHE processes PIDs=%v", pids), "pids", pids)
+		killProcesses(pids)
+	}
+
+	// The enable process terminates its VMWatch child when it receives SIGTERM, so
+	// anything still running at this point was orphaned and is stopped directly.
+	vmWatchPids, err := findExistingVMWatchProcesses()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to discover running VMWatch processes")
+	}
+	if len(vmWatchPids) > 0 {
+		telemetry.SendEvent(telemetry.InfoEvent, telemetry.KillVMWatchTask,
+			fmt.Sprintf("Stopping orphaned VMWatch processes PIDs=%v", vmWatchPids), "pids", vmWatchPids)
+		killProcesses(vmWatchPids)
+	}
+
+	telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask, "Handler successfully disabled")
+	return disabledStatusMessage, nil
+}
+
 var (
-	errTerminated        = errors.New("Application health process terminated")
-	errIdempotentExit    = errors.New("idempotent exit: healthy process already running with current configuration")
-	errSuperseded        = errors.New("process superseded by newer sequence number")
+	errTerminated     = errors.New("Application health process terminated")
+	errIdempotentExit = errors.New("idempotent exit: healthy process already running with current configuration")
+	errSuperseded     = errors.New("process superseded by newer sequence number")
 )
 
 func enablePre(lg *slog.Logger, seqNum uint) error {
@@ -98,6 +151,52 @@ func enablePre(lg *slog.Logger, seqNum uint) error {
 		return errors.Wrap(err, "failed to get current sequence number")
 	}
 
+	// The enable lock is held by the running enable process for its whole
+	// lifetime, so it tells reliably whether one is alive. Process discovery
+	// through /proc is only used when the lock cannot be used at all.
+	lock, lockErr := acquireEnableLock()
+	if lockErr != nil && !errors.Is(lockErr, liveness.ErrLocked) {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
+			fmt.Sprintf("Failed to acquire enable lock: %v. Falling back to process discovery.", lockErr), "error", lockErr)
+		return enablePreFromProcesses(lg, seqNum, mrSeqNum)
+	}
+
+	var holder *liveness.Heartbeat
+	if lockErr != nil {
+		holder = readLivenessHeartbeat()
+		if shouldExit := checkLockHolderIdempotency(lg, seqNum, mrSeqNum, holder); shouldExit {
+			return errIdempotentExit
+		}
+	} else {
+		telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask,
+			fmt.Sprintf("IsHandlerStillExecuting: enable lock acquired by PID %d, result=False", os.Getpid()))
+	}
+
+	if mrSeqNum != 0 && seqNum < mrSeqNum {
+		lock.Release()
+		lg.Info("the script configuration has already been processed, will not run again")
+		return errors.Errorf("most recent sequence number %d is greater than the requested sequence number %d", mrSeqNum, seqNum)
+	}
+
+	// Save the sequence number before stopping the lock holder, see enablePreFromProcesses.
+	if err := seqnoManager.SetSequenceNumber(fullName, "", seqNum); err != nil {
+		lock.Release()
+		return errors.Wrap(err, "failed to save sequence number")
+	}
+
+	if lockErr != nil {
+		if lock, err = takeOverEnableLock(lg, holder); err != nil {
+			return errors.Wrap(err, "failed to take over the enable lock")
+		}
+	}
+	enableLock = lock
+	return nil
+}
+
+// enablePreFromProcesses is the fallback for enablePre when the enable lock is
+// unavailable: it infers whether another enable process is alive by scanning
+// /proc and from the handler log's last write time exported by the shim.
+func enablePreFromProcesses(lg *slog.Logger, seqNum uint, mrSeqNum uint) error {
 	// Discover existing AHE processes once and reuse the result for both
 	// idempotency checks and new-sequence-number cleanup.
 	var existingPids []int
@@ -222,7 +321,7 @@ func checkIdempotency(lg *slog.Logger, seqNum uint, mrSeqNum uint, existingPids
 	return false
 }
 
-func enable(lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (string, error) {
+func enable(ctx context.Context, lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (string, error) {
 	// parse the extension handler settings (not available prior to 'enable')
 	cfg, err := parseAndValidateSettings(lg, h.ConfigFolder)
 	if err != nil {
@@ -230,8 +329,48 @@ func enable(lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (str
 	}
 
 	telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask, "Successfully parsed and validated settings")
+	configureRedaction(cfg.redactionSettings())
+	configureLogging(cfg.logSettings())
+	exporter, err := configureTelemetrySinks(h, cfg.telemetrySettings())
+	if err != nil {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask, err.Error(), "error", err)
+	}
+	if exporter != nil {
+		defer func() {
+			// export the last events and metrics, without delaying the exit much
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			telemetry.RemoveSink(otlp.SinkName)
+			exporter.Shutdown(shutdownCtx)
+		}()
+	}
+	// send the summaries of the suppressed events before the exporter shuts down
+	defer telemetry.Flush()
+	var registry *prometheus.Registry
+	if addr := cfg.metricsEndpointAddress(); addr != "" {
+		registry = prometheus.NewRegistry()
+		if server, err := prometheus.Serve(addr, registry); err != nil {
+			telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
+				fmt.Sprintf("Failed to start metrics endpoint: %v", err), "error", err)
+			registry = nil
+		} else {
+			telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask,
+				fmt.Sprintf("Serving metrics on http://%s%s", server.Addr(), prometheus.MetricsPath))
+			defer func() {
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				server.Shutdown(shutdownCtx)
+			}()
+		}
+	}
+	metrics = newHealthMetrics(exporter, registry)
 	telemetry.SendEvent(telemetry.VerboseEvent, telemetry.AppHealthTask, fmt.Sprintf("HandlerSettings = %s", redact.JSON(cfg.String())))
 
+	// ctx is cancelled when a shutdown is requested, when a newer configuration is
+	// detected, or when enable returns, which also stops VMWatch.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
 	probe := NewHealthProbe(lg, &cfg)
 	var (
 		intervalBetweenProbesInMs  = time.Duration(cfg.intervalInSeconds()) * time.Millisecond * 1000
@@ -247,6 +386,7 @@ func enable(lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (str
 		vmWatchResult              = VMWatchResult{Status: Disabled, Error: nil}
 		vmWatchResultChannel       = make(chan VMWatchResult)
 		timeOfLastVMWatchLog       = time.Time{}
+		livenessErr                error
 	)
 
 	if !honorGracePeriod {
@@ -269,7 +409,12 @@ func enable(lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (str
 		telemetry.SendEvent(telemetry.InfoEvent, telemetry.StartVMWatchTask, "VMWatch is disabled, not starting process.")
 	} else {
 		vmWatchResult = VMWatchResult{Status: NotRunning, Error: nil}
-		go executeVMWatch(lg, vmWatchSettings, h, vmWatchResultChannel)
+		go executeVMWatch(ctx, lg, vmWatchSettings, h, vmWatchResultChannel)
+		defer func() {
+			// stop VMWatch and wait for it to exit, so that it does not outlive this process
+			cancel(nil)
+			waitForVMWatchExit(vmWatchResultChannel, vmWatchShutdownTimeout)
+		}()
 	}
 
 	// The committed health status (the state written to the status file) initially does not have a state
@@ -282,37 +427,57 @@ func enable(lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (str
 	// The committed health state will remain in 'Initializing' state until any of the following occurs:
 	//	1. Grace period expires, then application will either be Unknown/Unhealthy depending on probe type
 	//	2. A valid health state is observed numberOfProbes consecutive times
+	//
+	// A newer configuration (sequence number recorded by another enable process, or a
+	// newer settings file) cancels ctx as soon as the watcher notices it. Without the
+	// watcher, mrseq is polled at the start of every iteration instead.
+	watching := watchForNewerConfiguration(ctx, cancel, lg, h, seqNum)
+	if watching.Load() {
+		// catch a newer configuration recorded before the watcher was started
+		if err := checkSuperseded(lg, seqNum); err != nil {
+			return "", err
+		}
+	}
 	for {
 		// Check if a newer sequence number has been started by another process.
 		// If so, this process has a stale configuration and should exit gracefully.
-		mostRecentSequenceNumberStarted, err := seqnoManager.GetCurrentSequenceNumber(lg, fullName, "")
-		if err != nil {
-			telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
-				fmt.Sprintf("Failed to read current sequence number: %v. Continuing with current configuration.", err), "error", err)
-		} else if seqNum < mostRecentSequenceNumberStarted {
-			telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
-				fmt.Sprintf("Current sequence number %d is less than the most recently started sequence number %d. PID %d initiating graceful shutdown.",
-					seqNum, mostRecentSequenceNumberStarted, os.Getpid()),
-				"sequenceNumber", seqNum, "mostRecentSequenceNumberStarted", mostRecentSequenceNumberStarted, "currentPid", os.Getpid())
-			return "", errSuperseded
+		if !watching.Load() {
+			if err := checkSuperseded(lg, seqNum); err != nil {
+				return "", err
+			}
+		}
+		if ctx.Err() != nil {
+			return "", context.Cause(ctx)
 		}
 
 		// Since we only log health state changes, it is possible there will be no recent logs for app health extension.
 		// As an indication that the extension is running, we log app health extension heart beat at a set interval.
 		LogHeartBeat()
 
+		// The liveness heartbeat lets a later enable invocation tell whether this loop is still making progress.
+		if err := writeLivenessHeartbeat(seqNum); err != nil && livenessErr == nil {
+			telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
+				fmt.Sprintf("Failed to write liveness heartbeat: %v", err), "error", err)
+			livenessErr = err
+		} else if err == nil {
+			livenessErr = nil
+		}
+
 		startTime := time.Now()
-		probeResponse, err := probe.evaluate(lg)
+		probeResponse, err := probe.evaluate(ctx, lg)
+		metrics.recordProbe(time.Since(startTime))
+		lg.Debug("Evaluated health probe", "state", probeResponse.ApplicationHealthState, "customMetrics", probeResponse.CustomMetrics,
+			"duration", time.Since(startTime), "error", err)
 		state := probeResponse.ApplicationHealthState
 		customMetrics := probeResponse.CustomMetrics
 		if err != nil {
 			telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask,
-				fmt.Sprintf("Error evaluating health probe: %v", err), "error", err)
+				fmt.Sprintf("Error evaluating health probe: %v", err),
+				telemetry.EventKindField, telemetry.ProbeErrorEventKind, telemetry.ErrorField, err)
 		}
 
-		if shutdown {
-			telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask, "Shutting down AppHealth Extension Gracefully")
-			return "", errTerminated
+		if ctx.Err() != nil {
+			return "", context.Cause(ctx)
 		}
 
 		// If VMWatch was never supposed to run, it will be in Disabled state, so we do not need to read from the channel
@@ -324,11 +489,11 @@ func enable(lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (str
 			if !ok {
 				vmWatchResult = VMWatchResult{Status: Failed, Error: errors.New("VMWatch channel has closed, unknown error")}
 			} else if result.Status == Running {
-				telemetry.SendEvent(telemetry.InfoEvent, telemetry.ReportHeatBeatTask, "VMWatch is running")
+				telemetry.SendStateChange(telemetry.InfoEvent, telemetry.ReportHeatBeatTask, "VMWatch is running")
 			} else if result.Status == Failed {
-				telemetry.SendEvent(telemetry.ErrorEvent, telemetry.ReportHeatBeatTask, vmWatchResult.GetMessage())
+				telemetry.SendStateChange(telemetry.ErrorEvent, telemetry.ReportHeatBeatTask, vmWatchResult.GetMessage())
 			} else if result.Status == NotRunning {
-				telemetry.SendEvent(telemetry.InfoEvent, telemetry.ReportHeatBeatTask, "VMWatch is not running")
+				telemetry.SendStateChange(telemetry.InfoEvent, telemetry.ReportHeatBeatTask, "VMWatch is not running")
 			}
 		default:
 			if vmWatchResult.Status == Running && time.Since(timeOfLastVMWatchLog) >= 60*time.Second {
@@ -342,7 +507,9 @@ func enable(lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (str
 			numConsecutiveProbes++
 			// Log stage changes and also reset consecutive count to 1 as a new state was observed
 		} else {
-			telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask, fmt.Sprintf("Health state changed to %s", strings.ToLower(string(state))))
+			telemetry.SendStateChange(telemetry.InfoEvent, telemetry.AppHealthTask, fmt.Sprintf("Health state changed to %s", strings.ToLower(string(state))),
+				telemetry.EventKindField, telemetry.StateChangeEventKind, telemetry.StateTypeField, telemetry.ObservedState,
+				telemetry.StateField, state, telemetry.PreviousStateField, prevState)
 			numConsecutiveProbes = 1
 			prevState = state
 		}
@@ -351,7 +518,7 @@ func enable(lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (str
 			timeElapsed := time.Now().Sub(gracePeriodStartTime)
 			// If grace period expires, application didn't initialize on time
 			if timeElapsed >= gracePeriodInSeconds {
-				telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask, fmt.Sprintf("No longer honoring grace period - expired. Time elapsed = %v", timeElapsed))
+				telemetry.SendStateChange(telemetry.InfoEvent, telemetry.AppHealthTask, fmt.Sprintf("No longer honoring grace period - expired. Time elapsed = %v", timeElapsed))
 				honorGracePeriod = false
 				state = probe.healthStatusAfterGracePeriodExpires()
 				prevState = probe.healthStatusAfterGracePeriodExpires()
@@ -359,7 +526,7 @@ func enable(lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (str
 				committedState = HealthStatus(Empty)
 				// If grace period has not expired, check if we have consecutive valid probes
 			} else if (numConsecutiveProbes == numberOfProbes) && (state != probe.healthStatusAfterGracePeriodExpires()) {
-				telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask, fmt.Sprintf("No longer honoring grace period - successful probes. Time elapsed = %v", timeElapsed))
+				telemetry.SendStateChange(telemetry.InfoEvent, telemetry.AppHealthTask, fmt.Sprintf("No longer honoring grace period - successful probes. Time elapsed = %v", timeElapsed))
 				honorGracePeriod = false
 				// Application will be in Initializing state since we have not received consecutive valid health states
 			} else {
@@ -367,11 +534,22 @@ func enable(lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (str
 				state = Initializing
 			}
 		}
+		metrics.recordObservedState(prevState, numConsecutiveProbes)
+		if honorGracePeriod {
+			metrics.recordGracePeriodRemaining(gracePeriodInSeconds - time.Since(gracePeriodStartTime))
+		} else {
+			metrics.recordGracePeriodRemaining(0)
+		}
+		metrics.recordVMWatchStatus(vmWatchResult.Status)
 
 		if (numConsecutiveProbes == numberOfProbes) || (committedState == HealthStatus(Empty)) {
 			if state != committedState {
+				previousState := committedState
 				committedState = state
-				telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask, fmt.Sprintf("Committed health state is %s", strings.ToLower(string(committedState))))
+				metrics.recordCommittedState(committedState)
+				telemetry.SendStateChange(telemetry.InfoEvent, telemetry.AppHealthTask, fmt.Sprintf("Committed health state is %s", strings.ToLower(string(committedState))),
+					telemetry.EventKindField, telemetry.StateChangeEventKind, telemetry.StateTypeField, telemetry.CommittedState,
+					telemetry.StateField, committedState, telemetry.PreviousStateField, previousState)
 			}
 			// Only reset if we've observed consecutive probes in order to preserve previous observations when handling grace period
 			if numConsecutiveProbes == numberOfProbes {
@@ -394,7 +572,7 @@ func enable(lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (str
 			}
 			substatuses = append(substatuses, NewSubstatus(SubstatusKeyNameCustomMetrics, customMetricsStatusType, customMetrics))
 			if commitedCustomMetricsState != CustomMetricsStatus(customMetrics) {
-				telemetry.SendEvent(telemetry.InfoEvent, telemetry.ReportStatusTask,
+				telemetry.SendStateChange(telemetry.InfoEvent, telemetry.ReportStatusTask,
 					fmt.Sprintf("Reporting CustomMetric Substatus with status: %s , message: %s", customMetricsStatusType, customMetrics))
 				commitedCustomMetricsState = CustomMetricsStatus(customMetrics)
 			}
@@ -403,10 +581,18 @@ func enable(lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (str
 		// VMWatch substatus should only be displayed when settings are present
 		if vmWatchSettings != nil {
 			substatuses = append(substatuses, NewSubstatus(SubstatusKeyNameVMWatch, vmWatchResult.Status.GetStatusType(), vmWatchResult.GetMessage()))
+			// reported separately so that the VMWatch substatus message is unchanged
+			if usage := getVMWatchResourceUsage(); vmWatchSettings.Enabled && usage != nil {
+				substatuses = append(substatuses, NewSubstatus(SubstatusKeyNameVMWatchResourceUsage, usage.statusType(), usage.String()))
+			}
+			if heartbeat := getVMWatchHeartbeat(); vmWatchSettings.Enabled && heartbeat != nil {
+				substatuses = append(substatuses, NewSubstatus(SubstatusKeyNameVMWatchSignalHealth, heartbeat.statusType(), heartbeat.signalHealth()))
+			}
 		}
 
 		err = reportStatusWithSubstatuses(lg, h, seqNum, StatusSuccess, "enable", statusMessage, substatuses)
 		if err != nil {
+			metrics.recordStatusWriteFailure()
 			telemetry.SendEvent(telemetry.ErrorEvent, telemetry.ReportStatusTask,
 				fmt.Sprintf("Error while trying to report extension status with seqNum: %d, StatusType: %s, message: %s, substatuses: %#v, error: %s",
 					seqNum,
@@ -419,11 +605,13 @@ func enable(lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (str
 		endTime := time.Now()
 		durationToWait := intervalBetweenProbesInMs - endTime.Sub(startTime)
 		if durationToWait > 0 {
-			time.Sleep(durationToWait)
+			select {
+			case <-ctx.Done():
+			case <-time.After(durationToWait):
+			}
 		}
-
-		if shutdown {
-			return "", errTerminated
+		if ctx.Err() != nil {
+			return "", context.Cause(ctx)
 		}
 	}
 }
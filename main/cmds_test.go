@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
+	"github.com/Azure/applicationhealth-extension-linux/internal/liveness"
 	"github.com/Azure/applicationhealth-extension-linux/internal/seqno"
+	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/mock/gomock"
@@ -41,13 +46,20 @@ func Test_commands_shouldReportStatus(t *testing.T) {
 // them after the test to prevent test pollution.
 func saveAndRestoreIdempotencyMocks(t *testing.T) {
 	origFindExistingProcesses := findExistingProcesses
+	origFindExistingVMWatchProcesses := findExistingVMWatchProcesses
 	origKillProcesses := killProcesses
+	origAcquireEnableLock := acquireEnableLock
 	t.Cleanup(func() {
 		findExistingProcesses = origFindExistingProcesses
+		findExistingVMWatchProcesses = origFindExistingVMWatchProcesses
 		killProcesses = origKillProcesses
+		acquireEnableLock = origAcquireEnableLock
 	})
 	// Default to no-op kill in tests to avoid sending real signals
 	killProcesses = func(pids []int) {}
+	// Default to an unusable enable lock so that tests exercise the process
+	// discovery fallback; Test_enablePre_EnableLock covers the lock itself.
+	acquireEnableLock = func() (*liveness.Lock, error) { return nil, fmt.Errorf("lock unavailable in test") }
 }
 
 // mockNoExistingProcess sets up mocks so idempotency check finds no existing process
@@ -279,6 +291,226 @@ func Test_enablePre_Idempotency(t *testing.T) {
 	})
 }
 
+// setupEnableLockTest points dataDir at a temporary directory so that enablePre
+// uses a real enable lock, and releases any lock taken by the test.
+func setupEnableLockTest(t *testing.T) string {
+	saveAndRestoreIdempotencyMocks(t)
+	origDataDir, origWaitTimeout := dataDir, enableLockWaitTimeout
+	t.Cleanup(func() {
+		enableLock.Release()
+		enableLock = nil
+		dataDir, enableLockWaitTimeout = origDataDir, origWaitTimeout
+	})
+	acquireEnableLock = acquireEnableLockImpl
+	enableLockWaitTimeout = 200 * time.Millisecond
+	dataDir = t.TempDir()
+	return dataDir
+}
+
+// holdEnableLock simulates another enable process holding the lock with the
+// given heartbeat. Returns the held lock.
+func holdEnableLock(t *testing.T, dir string, hb *liveness.Heartbeat) *liveness.Lock {
+	l, err := liveness.TryLock(filepath.Join(dir, enableLockFileName))
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Release() })
+	if hb != nil {
+		require.NoError(t, liveness.WriteHeartbeat(filepath.Join(dir, livenessFileName), "2.0.14", *hb))
+	}
+	return l
+}
+
+func Test_enablePre_EnableLock(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	ctrl := gomock.NewController(t)
+	mockSeqNumManager := seqno.NewMockSequenceNumberManager(ctrl)
+
+	t.Run("LockFree_ShouldAcquireWithoutProcessDiscovery", func(t *testing.T) {
+		setupEnableLockTest(t)
+		seqnoManager = mockSeqNumManager
+		mockSeqNumManager.EXPECT().GetCurrentSequenceNumber(gomock.Any(), gomock.Any(), gomock.Any()).Return(uint(3), nil)
+		mockSeqNumManager.EXPECT().SetSequenceNumber(gomock.Any(), gomock.Any(), uint(3)).Return(nil)
+		findExistingProcesses = func() ([]int, error) {
+			t.Fatal("process discovery should not be used when the lock is free")
+			return nil, nil
+		}
+
+		require.NoError(t, enablePre(logger, 3))
+		assert.NotNil(t, enableLock, "enable lock should be held after enablePre")
+	})
+
+	t.Run("SameSeq_FreshHeartbeat_ShouldReturnIdempotentExit", func(t *testing.T) {
+		dir := setupEnableLockTest(t)
+		seqnoManager = mockSeqNumManager
+		mockSeqNumManager.EXPECT().GetCurrentSequenceNumber(gomock.Any(), gomock.Any(), gomock.Any()).Return(uint(20), nil)
+		holdEnableLock(t, dir, &liveness.Heartbeat{PID: 1234, SequenceNumber: 20, StartTime: time.Now(), LastLoopTime: time.Now().Add(-time.Minute)})
+
+		killCalled := false
+		killProcesses = func(pids []int) { killCalled = true }
+
+		err := enablePre(logger, 20)
+		assert.ErrorIs(t, err, errIdempotentExit)
+		assert.False(t, killCalled, "should not stop a responsive lock holder")
+	})
+
+	t.Run("SameSeq_StaleHeartbeat_ShouldTakeOver", func(t *testing.T) {
+		dir := setupEnableLockTest(t)
+		seqnoManager = mockSeqNumManager
+		mockSeqNumManager.EXPECT().GetCurrentSequenceNumber(gomock.Any(), gomock.Any(), gomock.Any()).Return(uint(21), nil)
+		mockSeqNumManager.EXPECT().SetSequenceNumber(gomock.Any(), gomock.Any(), uint(21)).Return(nil)
+		held := holdEnableLock(t, dir, &liveness.Heartbeat{PID: 5678, SequenceNumber: 21, LastLoopTime: time.Now().Add(-15 * time.Minute)})
+
+		var killedPids []int
+		killProcesses = func(pids []int) {
+			killedPids = pids
+			held.Release() // the holder exits and the kernel releases its lock
+		}
+
+		require.NoError(t, enablePre(logger, 21))
+		assert.Equal(t, []int{5678}, killedPids, "should have stopped the lock holder")
+		assert.NotNil(t, enableLock)
+	})
+
+	t.Run("HigherSeq_ShouldStopHolderAndContinue", func(t *testing.T) {
+		dir := setupEnableLockTest(t)
+		seqnoManager = mockSeqNumManager
+		mockSeqNumManager.EXPECT().GetCurrentSequenceNumber(gomock.Any(), gomock.Any(), gomock.Any()).Return(uint(36), nil)
+		mockSeqNumManager.EXPECT().SetSequenceNumber(gomock.Any(), gomock.Any(), uint(37)).Return(nil)
+		held := holdEnableLock(t, dir, &liveness.Heartbeat{PID: 5492, SequenceNumber: 36, LastLoopTime: time.Now()})
+
+		var killedPids []int
+		killProcesses = func(pids []int) {
+			killedPids = pids
+			held.Release()
+		}
+
+		require.NoError(t, enablePre(logger, 37))
+		assert.Equal(t, []int{5492}, killedPids)
+	})
+
+	t.Run("LowerSeq_ShouldFailWithoutStoppingHolder", func(t *testing.T) {
+		dir := setupEnableLockTest(t)
+		seqnoManager = mockSeqNumManager
+		mockSeqNumManager.EXPECT().GetCurrentSequenceNumber(gomock.Any(), gomock.Any(), gomock.Any()).Return(uint(26), nil)
+		holdEnableLock(t, dir, &liveness.Heartbeat{PID: 1234, SequenceNumber: 26, LastLoopTime: time.Now()})
+
+		killCalled := false
+		killProcesses = func(pids []int) { killCalled = true }
+
+		err := enablePre(logger, 25)
+		assert.EqualError(t, err, "most recent sequence number 26 is greater than the requested sequence number 25")
+		assert.False(t, killCalled)
+	})
+
+	t.Run("MissingHeartbeat_ShouldFallBackToProcessDiscovery", func(t *testing.T) {
+		dir := setupEnableLockTest(t)
+		seqnoManager = mockSeqNumManager
+		mockSeqNumManager.EXPECT().GetCurrentSequenceNumber(gomock.Any(), gomock.Any(), gomock.Any()).Return(uint(10), nil)
+		mockSeqNumManager.EXPECT().SetSequenceNumber(gomock.Any(), gomock.Any(), uint(10)).Return(nil)
+		held := holdEnableLock(t, dir, nil)
+
+		findExistingProcesses = func() ([]int, error) { return []int{9999}, nil }
+		var killedPids []int
+		killProcesses = func(pids []int) {
+			killedPids = pids
+			held.Release()
+		}
+
+		require.NoError(t, enablePre(logger, 10))
+		assert.Equal(t, []int{9999}, killedPids, "should stop the processes found in /proc")
+	})
+
+	t.Run("HolderDoesNotExit_ShouldFail", func(t *testing.T) {
+		dir := setupEnableLockTest(t)
+		seqnoManager = mockSeqNumManager
+		mockSeqNumManager.EXPECT().GetCurrentSequenceNumber(gomock.Any(), gomock.Any(), gomock.Any()).Return(uint(10), nil)
+		mockSeqNumManager.EXPECT().SetSequenceNumber(gomock.Any(), gomock.Any(), uint(11)).Return(nil)
+		holdEnableLock(t, dir, &liveness.Heartbeat{PID: 1234, SequenceNumber: 10, LastLoopTime: time.Now()})
+		findExistingProcesses = func() ([]int, error) { return nil, nil }
+
+		err := enablePre(logger, 11)
+		assert.ErrorIs(t, err, liveness.ErrLocked)
+	})
+}
+
+// captureTelemetry returns a memory sink receiving the telemetry events sent
+// until the end of the test.
+func captureTelemetry(t *testing.T) *telemetry.MemorySink {
+	hEnv := &handlerenv.HandlerEnvironment{}
+	hEnv.EventsFolder = t.TempDir()
+	_, err := telemetry.NewTelemetry(hEnv)
+	require.NoError(t, err)
+	events := telemetry.NewMemorySink()
+	telemetry.AddSink(events, telemetry.VerboseEvent)
+	t.Cleanup(func() { telemetry.RemoveSink(telemetry.MemorySinkName) })
+	return events
+}
+
+func Test_checkLockHolderIdempotency_LogsResultAfterDecision(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	events := captureTelemetry(t)
+
+	for _, tc := range []struct {
+		name   string
+		holder liveness.Heartbeat
+		result string
+	}{
+		{"fresh heartbeat", liveness.Heartbeat{PID: 1234, SequenceNumber: 20, LastLoopTime: time.Now()}, "True"},
+		{"stale heartbeat", liveness.Heartbeat{PID: 1234, SequenceNumber: 20, LastLoopTime: time.Now().Add(-15 * time.Minute)}, "False"},
+		{"other sequence number", liveness.Heartbeat{PID: 1234, SequenceNumber: 19, LastLoopTime: time.Now()}, "False"},
+	} {
+		events.Reset()
+		holder := tc.holder
+		assert.Equal(t, tc.result == "True", checkLockHolderIdempotency(logger, 20, 20, &holder), tc.name)
+		require.NotEmpty(t, events.Events(), tc.name)
+		assert.Contains(t, events.Events()[0].Message, "result="+tc.result, tc.name)
+	}
+}
+
+func Test_disable(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	t.Run("RunningEnableAndVMWatch_ShouldKillBoth", func(t *testing.T) {
+		saveAndRestoreIdempotencyMocks(t)
+		findExistingProcesses = func() ([]int, error) { return []int{1234}, nil }
+		findExistingVMWatchProcesses = func() ([]int, error) { return []int{5678}, nil }
+
+		var killedPids [][]int
+		killProcesses = func(pids []int) { killedPids = append(killedPids, pids) }
+
+		msg, err := disable(context.Background(), logger, nil, 0)
+		require.NoError(t, err)
+		assert.Equal(t, disabledStatusMessage, msg)
+		assert.Equal(t, [][]int{{1234}, {5678}}, killedPids, "should stop the enable process before orphaned VMWatch")
+	})
+
+	t.Run("NothingRunning_ShouldSucceedWithoutKilling", func(t *testing.T) {
+		saveAndRestoreIdempotencyMocks(t)
+		findExistingProcesses = func() ([]int, error) { return nil, nil }
+		findExistingVMWatchProcesses = func() ([]int, error) { return nil, nil }
+
+		killCalled := false
+		killProcesses = func(pids []int) { killCalled = true }
+
+		msg, err := disable(context.Background(), logger, nil, 0)
+		require.NoError(t, err)
+		assert.Equal(t, disabledStatusMessage, msg)
+		assert.False(t, killCalled, "should not kill anything when nothing is running")
+	})
+
+	t.Run("ProcessDiscoveryError_ShouldFail", func(t *testing.T) {
+		saveAndRestoreIdempotencyMocks(t)
+		findExistingProcesses = func() ([]int, error) { return nil, fmt.Errorf("proc filesystem error") }
+
+		_, err := disable(context.Background(), logger, nil, 0)
+		assert.ErrorContains(t, err, "failed to discover running AHE processes")
+	})
+
+	t.Run("StatusReportsDisabled", func(t *testing.T) {
+		assert.Equal(t, "Disable succeeded: Application health reporting is disabled",
+			statusMsg(cmdDisable, StatusSuccess, disabledStatusMessage))
+	})
+}
+
 func Test_appHealthBinaryName(t *testing.T) {
 	origArgs := os.Args
 	defer func() { os.Args = origArgs }()
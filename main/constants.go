@@ -5,6 +5,8 @@ const (
 	SubstatusKeyNameApplicationHealthState = "ApplicationHealthState"
 	SubstatusKeyNameCustomMetrics          = "CustomMetrics"
 	SubstatusKeyNameVMWatch                = "VMWatch"
+	SubstatusKeyNameVMWatchResourceUsage   = "VMWatchResourceUsage"
+	SubstatusKeyNameVMWatchSignalHealth    = "VMWatchSignalHealth"
 
 	ProbeResponseKeyNameApplicationHealthState = "ApplicationHealthState"
 	ProbeResponseKeyNameCustomMetrics          = "CustomMetrics"
@@ -20,12 +22,31 @@ const (
 	// for timing variations such as GC pauses, high CPU load, and cgroup throttling.
 	AppHealthLogFileStaleThresholdInMinutes = 6
 
+	// Number of minutes to allow between liveness heartbeat updates before considering the
+	// process holding the enable lock as unresponsive/stuck. The heartbeat is refreshed on
+	// every probe loop iteration, so this leaves ample room for slow probes.
+	LivenessHeartbeatStaleThresholdInMinutes = 6
+
 	// HandlerLogDir is the directory where the shim writes handler.log.
 	HandlerLogDir = "/var/log/azure/applicationhealth-extension"
 
 	// HandlerLogFile is the log file name written by the shim.
 	HandlerLogFile = "handler.log"
 
+	// The handler log is rotated once it reaches HandlerLogMaxSizeInBytes or is older than
+	// HandlerLogMaxAgeInHours, keeping HandlerLogMaxBackups gzipped rotated logs.
+	HandlerLogMaxSizeInBytes = 10 * 1024 * 1024
+	HandlerLogMaxAgeInHours  = 7 * 24
+	HandlerLogMaxBackups     = 5
+
+	// The VMWatch verbose log, which VMWatch writes itself, is checked every
+	// VMWatchVerboseLogRotationIntervalInSeconds and rotated like the handler log, by copying
+	// and truncating it, which requires VMWatch to open it with O_APPEND.
+	VMWatchVerboseLogMaxSizeInBytes            = 10 * 1024 * 1024
+	VMWatchVerboseLogMaxAgeInHours             = 7 * 24
+	VMWatchVerboseLogMaxBackups                = 3
+	VMWatchVerboseLogRotationIntervalInSeconds = 300
+
 	// TODO: The github package responsible for HandlerEnvironment settings is no longer being maintained
 	// and it also doesn't have the latest properties like EventsFolder. Importing a separate package
 	// is possible, but may result in lots of code churn. We will temporarily keep this as a constant since the
@@ -35,10 +56,44 @@ const (
 	VMWatchBinaryNameArm64    = "vmwatch_linux_arm64"
 	VMWatchConfigFileName     = "vmwatch.conf"
 	VMWatchVerboseLogFileName = "vmwatch.log"
+	VMWatchOutputLogFileName  = "vmwatch-output.log"
 	VMWatchDefaultTests       = "disk_io:outbound_connectivity:clockskew:az_storage_blob"
 	VMWatchMaxProcessAttempts = 3
 	VMWatchMaxRetryCycles     = 4
 	VMWatchBaseWaitHours      = 3
 
+	// VMWatchManifestFileName is the sha256sum style manifest with the SHA-256 checksums of the VMWatch
+	// binaries and config, which is shipped next to them and verified before VMWatch is launched.
+	VMWatchManifestFileName = "vmwatch.sha256"
+
+	// VMWatch is killed when it does not update its heartbeat file within
+	// VMWatchHeartbeatTimeoutInSeconds. Exponential backoff waits are capped at
+	// VMWatchMaxBackoffHours.
+	VMWatchHeartbeatTimeoutInSeconds = 180
+	VMWatchMaxBackoffHours           = 72
+
+	// The resource usage of the VMWatch cgroup is sampled every
+	// VMWatchResourceUsageIntervalInSeconds.
+	VMWatchResourceUsageIntervalInSeconds = 300
+
+	// VMWatch stdout/stderr is streamed to VMWatchOutputLogFileName, rotated once it reaches
+	// VMWatchOutputLogMaxSizeInBytes, and only the last VMWatchOutputTailLines lines (each
+	// truncated to VMWatchOutputMaxLineLength bytes) are kept in memory, of which the last
+	// VMWatchOutputMaxErrorLength bytes are included in the exit error.
+	VMWatchOutputLogMaxSizeInBytes = 10 * 1024 * 1024
+	VMWatchOutputLogMaxBackups     = 3
+	VMWatchOutputTailLines         = 20
+	VMWatchOutputMaxLineLength     = 4096
+	VMWatchOutputMaxErrorLength    = 2048
+
+	// Telemetry events are written as JSON lines to TelemetryFileName in the log folder when the
+	// file sink is enabled in the settings, rotated like the VMWatch output log.
+	TelemetryFileName           = "telemetry.jsonl"
+	TelemetryFileMaxSizeInBytes = 10 * 1024 * 1024
+	TelemetryFileMaxBackups     = 3
+
+	// OTLPServiceName is the service.name of the metrics and logs exported to an OTLP collector.
+	OTLPServiceName = "applicationhealth-extension"
+
 	ExtensionManifestFileName = "manifest.xml"
 )
@@ -3,11 +3,17 @@ package main
 import (
 	"encoding/json"
 	"encoding/xml"
+	"fmt"
 	"log/slog"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 
+	"github.com/Azure/applicationhealth-extension-linux/internal/otlp"
 	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
+	"github.com/Azure/applicationhealth-extension-linux/pkg/redact"
 	"github.com/Azure/azure-docker-extension/pkg/vmextension"
 	"github.com/pkg/errors"
 )
@@ -19,6 +25,7 @@ var (
 	defaultIntervalInSeconds           = 5
 	defaultNumberOfProbes              = 1
 	maximumProbeSettleTime             = 240
+	defaultMetricsEndpointPort         = 9469
 )
 
 // handlerSettings holds the configuration of the extension handler.
@@ -75,6 +82,32 @@ func (s *handlerSettings) vmWatchSettings() *vmWatchSettings {
 	return s.publicSettings.VMWatchSettings
 }
 
+func (s *handlerSettings) telemetrySettings() *telemetrySettings {
+	return s.publicSettings.TelemetrySettings
+}
+
+func (s *handlerSettings) logSettings() *logSettings {
+	return s.publicSettings.LogSettings
+}
+
+func (s *handlerSettings) redactionSettings() *redactionSettings {
+	return s.publicSettings.RedactionSettings
+}
+
+// metricsEndpointAddress returns the loopback address the metrics endpoint
+// listens on, or "" if it is not enabled.
+func (s *handlerSettings) metricsEndpointAddress() string {
+	m := s.publicSettings.MetricsEndpoint
+	if m == nil || !m.Enabled {
+		return ""
+	}
+	port := m.Port
+	if port == 0 {
+		port = defaultMetricsEndpointPort
+	}
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+}
+
 // validate makes logical validation on the handlerSettings which already passed
 // the schema validation.
 func (h handlerSettings) validate() error {
@@ -91,6 +124,22 @@ func (h handlerSettings) validate() error {
 		return errProbeSettleTimeExceedsThreshold
 	}
 
+	if t := h.telemetrySettings(); t != nil {
+		if c := t.Sinks[otlp.SinkName]; c != nil {
+			if err := otlp.ValidateEndpoint(c.Endpoint); err != nil {
+				return err
+			}
+		}
+	}
+
+	if r := h.redactionSettings(); r != nil {
+		for _, p := range r.SensitiveKeyPatterns {
+			if err := redact.ValidateKeyPattern(p); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -110,6 +159,81 @@ type vmWatchSettings struct {
 	EnvironmentAttributes map[string]interface{} `json:"environmentAttributes,object"`
 	GlobalConfigUrl       string                 `json:"globalConfigUrl"`
 	DisableConfigReader   bool                   `json:"disableConfigReader,boolean"`
+	RetryPolicy           *vmWatchRetryPolicy    `json:"retryPolicy"`
+	// AllowMissingChecksumManifest launches VMWatch when its folder has no
+	// checksum manifest, e.g. for a package built without one, instead of
+	// failing the integrity check.
+	AllowMissingChecksumManifest bool `json:"allowMissingChecksumManifest,boolean"`
+}
+
+// vmWatchRetryPolicy overrides how VMWatch is restarted when it exits or stops
+// updating its heartbeat. Zero values use the defaults.
+type vmWatchRetryPolicy struct {
+	MaxProcessAttempts        int             `json:"maxProcessAttempts,int"`
+	MaxRetryCycles            int             `json:"maxRetryCycles,int"`
+	BaseWaitHours             int             `json:"baseWaitHours,int"`
+	Backoff                   BackoffStrategy `json:"backoff"`
+	HeartbeatTimeoutInSeconds int             `json:"heartbeatTimeoutInSeconds,int"`
+}
+
+// telemetrySettings configures where telemetry events are sent, keyed by sink
+// name. Sinks that are not configured keep their defaults, and the local file
+// sink is only enabled when configured.
+type telemetrySettings struct {
+	Sinks     map[string]*telemetrySinkSettings `json:"sinks"`
+	RateLimit *telemetryRateLimitSettings       `json:"rateLimit"`
+}
+
+// telemetryRateLimitSettings overrides telemetry.DefaultRateLimit. Zero values
+// use the defaults, except that rate limiting is disabled with a negative
+// MaxEventsPerWindow.
+type telemetryRateLimitSettings struct {
+	MaxEventsPerWindow int `json:"maxEventsPerWindow,int"`
+	WindowInSeconds    int `json:"windowInSeconds,int"`
+}
+
+func (r *telemetryRateLimitSettings) rateLimit() telemetry.RateLimit {
+	limit := telemetry.DefaultRateLimit
+	if r.MaxEventsPerWindow != 0 {
+		limit.MaxEvents = r.MaxEventsPerWindow
+	}
+	if r.WindowInSeconds != 0 {
+		limit.Window = time.Duration(r.WindowInSeconds) * time.Second
+	}
+	return limit
+}
+
+type telemetrySinkSettings struct {
+	// MinLevel is the minimum level of the events the sink receives.
+	MinLevel telemetry.EventLevel `json:"minLevel"`
+	// PayloadFormat is the format of the events written to the events folder,
+	// which only writes their message unless it is telemetry.JSONPayload.
+	PayloadFormat telemetry.PayloadFormat `json:"payloadFormat"`
+	// Endpoint and ExportIntervalInSeconds configure the OTLP sink, which
+	// also exports the health metrics.
+	Endpoint                string `json:"endpoint"`
+	ExportIntervalInSeconds int    `json:"exportIntervalInSeconds,int"`
+}
+
+// logSettings configures the handler log, see configureLogging.
+type logSettings struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+// redactionSettings extends the redaction of secrets from the logs and the
+// telemetry, see configureRedaction.
+type redactionSettings struct {
+	// SensitiveKeyPatterns are the regular expressions of the names, in addition
+	// to the built-in ones, whose values are redacted.
+	SensitiveKeyPatterns []string `json:"sensitiveKeyPatterns,array"`
+}
+
+// metricsEndpoint enables serving the state of the extension as Prometheus
+// metrics on http://127.0.0.1:<port>/metrics.
+type metricsEndpoint struct {
+	Enabled bool `json:"enabled,boolean"`
+	Port    int  `json:"port,int"`
 }
 
 func (v *vmWatchSettings) String() string {
@@ -117,6 +241,46 @@ func (v *vmWatchSettings) String() string {
 	return string(setting)
 }
 
+// retryConfig returns the retry cycles VMWatch is started with.
+func (v *vmWatchSettings) retryConfig() RetryConfig {
+	config := RetryConfig{
+		MaxCycles:        VMWatchMaxRetryCycles,
+		AttemptsPerCycle: VMWatchMaxProcessAttempts,
+		BaseWaitHours:    VMWatchBaseWaitHours,
+		Backoff:          LinearBackoff,
+	}
+	if p := v.RetryPolicy; p != nil {
+		if p.MaxRetryCycles > 0 {
+			config.MaxCycles = p.MaxRetryCycles
+		}
+		if p.MaxProcessAttempts > 0 {
+			config.AttemptsPerCycle = p.MaxProcessAttempts
+		}
+		if p.BaseWaitHours > 0 {
+			config.BaseWaitHours = p.BaseWaitHours
+		}
+		if p.Backoff != "" {
+			config.Backoff = p.Backoff
+		}
+	}
+	return config
+}
+
+// heartbeatTimeout returns how long VMWatch may go without updating its
+// heartbeat file before it is killed.
+func (v *vmWatchSettings) heartbeatTimeout() time.Duration {
+	if v.RetryPolicy != nil && v.RetryPolicy.HeartbeatTimeoutInSeconds > 0 {
+		return time.Duration(v.RetryPolicy.HeartbeatTimeoutInSeconds) * time.Second
+	}
+	return VMWatchHeartbeatTimeoutInSeconds * time.Second
+}
+
+// policyDescription summarizes the active retry and heartbeat policy for the
+// telemetry event sent when VMWatch is started.
+func (v *vmWatchSettings) policyDescription() string {
+	return fmt.Sprintf("retry policy: %s, heartbeat timeout %v", v.retryConfig(), v.heartbeatTimeout())
+}
+
 // Case insensitive retrieval of VMWatchCohortId from EnvironmentAttributes
 // We serialize and deserialize EnvironmentAttributes to ensure case insensitive get for VMWatchCohortId
 func (v *vmWatchSettings) TryGetVMWatchCohortId() (vmWatchCohortId string, err error) {
@@ -146,13 +310,17 @@ type environmentAttributes struct {
 // publicSettings is the type deserialized from public configuration section of
 // the extension handler. This should be in sync with publicSettingsSchema.
 type publicSettings struct {
-	Protocol          string           `json:"protocol"`
-	Port              int              `json:"port,int"`
-	RequestPath       string           `json:"requestPath"`
-	IntervalInSeconds int              `json:"intervalInSeconds,int"`
-	NumberOfProbes    int              `json:"numberOfProbes,int"`
-	GracePeriod       int              `json:"gracePeriod,int"`
-	VMWatchSettings   *vmWatchSettings `json:"vmWatchSettings"`
+	Protocol          string             `json:"protocol"`
+	Port              int                `json:"port,int"`
+	RequestPath       string             `json:"requestPath"`
+	IntervalInSeconds int                `json:"intervalInSeconds,int"`
+	NumberOfProbes    int                `json:"numberOfProbes,int"`
+	GracePeriod       int                `json:"gracePeriod,int"`
+	VMWatchSettings   *vmWatchSettings   `json:"vmWatchSettings"`
+	TelemetrySettings *telemetrySettings `json:"telemetrySettings"`
+	MetricsEndpoint   *metricsEndpoint   `json:"metricsEndpoint"`
+	LogSettings       *logSettings       `json:"logSettings"`
+	RedactionSettings *redactionSettings `json:"redactionSettings"`
 }
 
 // protectedSettings is the type decoded and deserialized from protected
@@ -2,7 +2,9 @@ package main
 
 import (
 	"testing"
+	"time"
 
+	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
 	"github.com/Azure/azure-docker-extension/pkg/vmextension"
 	"github.com/stretchr/testify/require"
 )
@@ -45,6 +47,45 @@ func Test_handlerSettingsValidate(t *testing.T) {
 		publicSettings{Protocol: "https", IntervalInSeconds: 30, NumberOfProbes: 3},
 		protectedSettings{},
 	}.validate())
+
+	// OTLP endpoint must be on localhost
+	require.ErrorContains(t, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, TelemetrySettings: &telemetrySettings{Sinks: map[string]*telemetrySinkSettings{
+			"otlp": {Endpoint: "http://collector.example.com:4318"},
+		}}},
+		protectedSettings{},
+	}.validate(), "must be on localhost")
+
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, TelemetrySettings: &telemetrySettings{Sinks: map[string]*telemetrySinkSettings{
+			"otlp": {Endpoint: "http://127.0.0.1:4318"},
+		}}},
+		protectedSettings{},
+	}.validate())
+
+	// sensitive key patterns must be valid regular expressions
+	require.ErrorContains(t, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, RedactionSettings: &redactionSettings{SensitiveKeyPatterns: []string{"contoso[license"}}},
+		protectedSettings{},
+	}.validate(), "invalid key pattern")
+
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, RedactionSettings: &redactionSettings{SensitiveKeyPatterns: []string{"contoso[_-]?license"}}},
+		protectedSettings{},
+	}.validate())
+}
+
+func Test_handlerSettingsMetricsEndpointAddress(t *testing.T) {
+	require.Equal(t, "", (&handlerSettings{}).metricsEndpointAddress())
+	require.Equal(t, "", (&handlerSettings{publicSettings: publicSettings{MetricsEndpoint: &metricsEndpoint{Port: 8080}}}).metricsEndpointAddress())
+	require.Equal(t, "127.0.0.1:9469", (&handlerSettings{publicSettings: publicSettings{MetricsEndpoint: &metricsEndpoint{Enabled: true}}}).metricsEndpointAddress())
+	require.Equal(t, "127.0.0.1:8080", (&handlerSettings{publicSettings: publicSettings{MetricsEndpoint: &metricsEndpoint{Enabled: true, Port: 8080}}}).metricsEndpointAddress())
+}
+
+func Test_telemetryRateLimitSettings(t *testing.T) {
+	require.Equal(t, telemetry.DefaultRateLimit, (&telemetryRateLimitSettings{}).rateLimit())
+	require.Equal(t, telemetry.RateLimit{MaxEvents: 5, Window: time.Minute}, (&telemetryRateLimitSettings{MaxEventsPerWindow: 5, WindowInSeconds: 60}).rateLimit())
+	require.Equal(t, "no rate limit", (&telemetryRateLimitSettings{MaxEventsPerWindow: -1}).rateLimit().String())
 }
 
 func Test_toJSON_empty(t *testing.T) {
@@ -127,3 +168,14 @@ func Test_tryGetVMWatchCohortId(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, "", actualCohortId)
 }
+
+func Test_vmWatchSettings_retryPolicy(t *testing.T) {
+	s := &vmWatchSettings{Enabled: true}
+	require.Equal(t, RetryConfig{MaxCycles: 4, AttemptsPerCycle: 3, BaseWaitHours: 3, Backoff: LinearBackoff}, s.retryConfig())
+	require.Equal(t, 180*time.Second, s.heartbeatTimeout())
+	require.Equal(t, "retry policy: 4 cycles of 3 attempts, linear backoff from 3 hours, heartbeat timeout 3m0s", s.policyDescription())
+
+	s.RetryPolicy = &vmWatchRetryPolicy{MaxRetryCycles: 2, Backoff: ExponentialBackoff, HeartbeatTimeoutInSeconds: 600}
+	require.Equal(t, RetryConfig{MaxCycles: 2, AttemptsPerCycle: 3, BaseWaitHours: 3, Backoff: ExponentialBackoff}, s.retryConfig())
+	require.Equal(t, 10*time.Minute, s.heartbeatTimeout())
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -64,7 +65,7 @@ func (p HealthStatus) GetMessageForAppHealthStatus() string {
 }
 
 type HealthProbe interface {
-	evaluate(*slog.Logger) (ProbeResponse, error)
+	evaluate(context.Context, *slog.Logger) (ProbeResponse, error)
 	address() string
 	healthStatusAfterGracePeriodExpires() HealthStatus
 }
@@ -99,8 +100,9 @@ func NewHealthProbe(lg *slog.Logger, cfg *handlerSettings) HealthProbe {
 	return p
 }
 
-func (p *TcpHealthProbe) evaluate(lg *slog.Logger) (ProbeResponse, error) {
-	conn, err := net.DialTimeout("tcp", p.address(), 30*time.Second)
+func (p *TcpHealthProbe) evaluate(ctx context.Context, lg *slog.Logger) (ProbeResponse, error) {
+	dialer := net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", p.address())
 	var probeResponse ProbeResponse
 	if err != nil {
 		probeResponse.ApplicationHealthState = Unhealthy
@@ -182,8 +184,8 @@ func NewHttpHealthProbe(protocol string, requestPath string, port int) *HttpHeal
 	return p
 }
 
-func (p *HttpHealthProbe) evaluate(lg *slog.Logger) (ProbeResponse, error) {
-	req, err := http.NewRequest("GET", p.address(), nil)
+func (p *HttpHealthProbe) evaluate(ctx context.Context, lg *slog.Logger) (ProbeResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.address(), nil)
 	var probeResponse ProbeResponse
 	if err != nil {
 		probeResponse.ApplicationHealthState = Unknown
@@ -249,7 +251,7 @@ func noRedirect(req *http.Request, via []*http.Request) error {
 type DefaultHealthProbe struct {
 }
 
-func (p DefaultHealthProbe) evaluate(lg *slog.Logger) (ProbeResponse, error) {
+func (p DefaultHealthProbe) evaluate(ctx context.Context, lg *slog.Logger) (ProbeResponse, error) {
 	var probeResponse ProbeResponse
 	probeResponse.ApplicationHealthState = Healthy
 	return probeResponse, nil
@@ -266,6 +268,7 @@ func (p DefaultHealthProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
 func LogHeartBeat() {
 	if time.Since(timeOfLastAppHealthLog) >= RecordAppHealthHeartBeatIntervalInMinutes*time.Minute {
 		timeOfLastAppHealthLog = time.Now()
-		telemetry.SendEvent(telemetry.InfoEvent, telemetry.ReportHeatBeatTask, "AppHealthExtension is running")
+		telemetry.SendHeartBeat("AppHealthExtension is running")
+		logHeartBeatToHandlerLog("AppHealthExtension is running")
 	}
 }
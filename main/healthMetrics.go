@@ -0,0 +1,188 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/otlp"
+	"github.com/Azure/applicationhealth-extension-linux/internal/prometheus"
+)
+
+// probeDurationBounds are the bucket bounds of the probe duration histograms, in
+// seconds. Probes time out after 30 seconds.
+var probeDurationBounds = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+var (
+	healthStates    = []HealthStatus{Initializing, Healthy, Unhealthy, Unknown}
+	vmWatchStatuses = []VMWatchStatus{NotRunning, Disabled, Running, Failed}
+)
+
+// healthMetrics records the outcomes of the health probes and of VMWatch as
+// metrics, which are exported to an OTLP collector and served on the metrics
+// endpoint, depending on which is configured. A nil *healthMetrics records
+// nothing, which is the case when neither is.
+type healthMetrics struct {
+	exported *exportedHealthMetrics
+	scraped  *scrapedHealthMetrics
+	// vmWatchStarted is set once VMWatch started, so that the next starts are
+	// counted as restarts.
+	vmWatchStarted atomic.Bool
+}
+
+// exportedHealthMetrics are the metrics exported to an OTLP collector.
+type exportedHealthMetrics struct {
+	state       *otlp.Gauge
+	transitions *otlp.Counter
+	duration    *otlp.Histogram
+	restarts    *otlp.Counter
+}
+
+// scrapedHealthMetrics are the metrics served on the metrics endpoint.
+type scrapedHealthMetrics struct {
+	committedState       *prometheus.Gauge
+	observedState        *prometheus.Gauge
+	duration             *prometheus.Histogram
+	consecutiveProbes    *prometheus.Gauge
+	gracePeriodRemaining *prometheus.Gauge
+	vmWatchStatus        *prometheus.Gauge
+	vmWatchRestarts      *prometheus.Counter
+	vmWatchRetryCycle    *prometheus.Gauge
+	statusWriteFailures  *prometheus.Counter
+}
+
+// metrics is set by enable once the metrics exporter and endpoint are configured.
+var metrics *healthMetrics
+
+// newHealthMetrics returns the metrics recorded with e and served from r, either
+// of which may be nil, or nil if both are.
+func newHealthMetrics(e *otlp.Exporter, r *prometheus.Registry) *healthMetrics {
+	if e == nil && r == nil {
+		return nil
+	}
+	m := &healthMetrics{}
+	if e != nil {
+		m.exported = &exportedHealthMetrics{
+			state:       e.Gauge("apphealth.health_state", "Committed health state of the application, 1 for the current state and 0 for the others", "1"),
+			transitions: e.Counter("apphealth.health_state.transitions", "Number of times the committed health state changed, by new state", "{transition}"),
+			duration:    e.Histogram("apphealth.probe.duration", "Duration of the health probes", "s", probeDurationBounds),
+			restarts:    e.Counter("apphealth.vmwatch.restarts", "Number of times VMWatch was started again", "{restart}"),
+		}
+		// export the restarts before the first one
+		m.exported.restarts.Add(0)
+	}
+	if r != nil {
+		m.scraped = &scrapedHealthMetrics{
+			committedState:       r.Gauge("apphealth_committed_state", "Committed health state of the application, 1 for the current state and 0 for the others.", "state"),
+			observedState:        r.Gauge("apphealth_observed_state", "Health state observed by the last probe, 1 for the observed state and 0 for the others.", "state"),
+			duration:             r.Histogram("apphealth_probe_duration_seconds", "Duration of the health probes.", probeDurationBounds),
+			consecutiveProbes:    r.Gauge("apphealth_consecutive_probes", "Number of consecutive probes that observed the same health state."),
+			gracePeriodRemaining: r.Gauge("apphealth_grace_period_remaining_seconds", "Time left in the grace period, 0 once it is no longer honored."),
+			vmWatchStatus:        r.Gauge("apphealth_vmwatch_status", "Status of VMWatch, 1 for the current status and 0 for the others.", "status"),
+			vmWatchRestarts:      r.Counter("apphealth_vmwatch_restarts_total", "Number of times VMWatch was started again."),
+			vmWatchRetryCycle:    r.Gauge("apphealth_vmwatch_retry_cycle", "Retry cycle VMWatch is started in, 0 before the first start."),
+			statusWriteFailures:  r.Counter("apphealth_status_write_failures_total", "Number of times the status file could not be written."),
+		}
+		m.scraped.vmWatchRestarts.Add(0)
+		m.scraped.statusWriteFailures.Add(0)
+		m.scraped.vmWatchRetryCycle.Set(0)
+	}
+	return m
+}
+
+func (m *healthMetrics) recordProbe(d time.Duration) {
+	if m == nil {
+		return
+	}
+	if m.exported != nil {
+		m.exported.duration.Record(d.Seconds())
+	}
+	if m.scraped != nil {
+		m.scraped.duration.Observe(d.Seconds())
+	}
+}
+
+// recordObservedState records the health state observed by the last probe and
+// how many consecutive probes observed it.
+func (m *healthMetrics) recordObservedState(state HealthStatus, consecutiveProbes int) {
+	if m == nil || m.scraped == nil {
+		return
+	}
+	setStateGauge(m.scraped.observedState, state)
+	m.scraped.consecutiveProbes.Set(float64(consecutiveProbes))
+}
+
+// recordCommittedState records a change of the committed health state.
+func (m *healthMetrics) recordCommittedState(state HealthStatus) {
+	if m == nil {
+		return
+	}
+	if m.exported != nil {
+		for _, s := range healthStates {
+			value := 0.0
+			if s == state {
+				value = 1
+			}
+			m.exported.state.Set(value, "state", string(s))
+		}
+		m.exported.transitions.Add(1, "state", string(state))
+	}
+	if m.scraped != nil {
+		setStateGauge(m.scraped.committedState, state)
+	}
+}
+
+func setStateGauge(g *prometheus.Gauge, state HealthStatus) {
+	for _, s := range healthStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		g.Set(value, string(s))
+	}
+}
+
+func (m *healthMetrics) recordGracePeriodRemaining(d time.Duration) {
+	if m == nil || m.scraped == nil {
+		return
+	}
+	m.scraped.gracePeriodRemaining.Set(d.Seconds())
+}
+
+func (m *healthMetrics) recordVMWatchStatus(status VMWatchStatus) {
+	if m == nil || m.scraped == nil {
+		return
+	}
+	for _, s := range vmWatchStatuses {
+		value := 0.0
+		if s == status {
+			value = 1
+		}
+		m.scraped.vmWatchStatus.Set(value, string(s))
+	}
+}
+
+func (m *healthMetrics) recordVMWatchRetryCycle(cycle int) {
+	if m == nil || m.scraped == nil {
+		return
+	}
+	m.scraped.vmWatchRetryCycle.Set(float64(cycle))
+}
+
+func (m *healthMetrics) recordVMWatchStart() {
+	if m == nil || !m.vmWatchStarted.Swap(true) {
+		return
+	}
+	if m.exported != nil {
+		m.exported.restarts.Add(1)
+	}
+	if m.scraped != nil {
+		m.scraped.vmWatchRestarts.Inc()
+	}
+}
+
+func (m *healthMetrics) recordStatusWriteFailure() {
+	if m == nil || m.scraped == nil {
+		return
+	}
+	m.scraped.statusWriteFailures.Inc()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_healthMetrics_nil(t *testing.T) {
+	var m *healthMetrics
+	require.Nil(t, newHealthMetrics(nil, nil))
+	require.NotPanics(t, func() {
+		m.recordProbe(time.Second)
+		m.recordObservedState(Healthy, 1)
+		m.recordCommittedState(Healthy)
+		m.recordGracePeriodRemaining(time.Second)
+		m.recordVMWatchStatus(Running)
+		m.recordVMWatchRetryCycle(1)
+		m.recordVMWatchStart()
+		m.recordStatusWriteFailure()
+	})
+}
+
+func Test_healthMetrics_scraped(t *testing.T) {
+	r := prometheus.NewRegistry()
+	m := newHealthMetrics(nil, r)
+
+	m.recordProbe(20 * time.Millisecond)
+	m.recordObservedState(Unhealthy, 2)
+	m.recordCommittedState(Healthy)
+	m.recordGracePeriodRemaining(90 * time.Second)
+	m.recordVMWatchStatus(Running)
+	m.recordVMWatchRetryCycle(2)
+	m.recordVMWatchStart()
+	m.recordVMWatchStart()
+	m.recordStatusWriteFailure()
+
+	var b bytes.Buffer
+	_, err := r.WriteTo(&b)
+	require.NoError(t, err)
+	for _, line := range []string{
+		`apphealth_committed_state{state="Healthy"} 1`,
+		`apphealth_committed_state{state="Unhealthy"} 0`,
+		`apphealth_observed_state{state="Unhealthy"} 1`,
+		`apphealth_probe_duration_seconds_bucket{le="0.025"} 1`,
+		`apphealth_probe_duration_seconds_count 1`,
+		`apphealth_consecutive_probes 2`,
+		`apphealth_grace_period_remaining_seconds 90`,
+		`apphealth_vmwatch_status{status="Running"} 1`,
+		`apphealth_vmwatch_status{status="Failed"} 0`,
+		`apphealth_vmwatch_restarts_total 1`,
+		`apphealth_vmwatch_retry_cycle 2`,
+		`apphealth_status_write_failures_total 1`,
+	} {
+		require.Contains(t, b.String(), line+"\n")
+	}
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -85,3 +90,24 @@ func TestNewHttpHealthProbe_RequestPath(t *testing.T) {
 	require.NotNil(t, probe.HttpClient, "Expected HttpClient, got nil")
 	require.Equal(t, "http://localhost:10400/test", probe.Address, "Expected address to be http://localhost:10400/test")
 }
+
+func TestHttpHealthProbe_EvaluateCancelled(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	probe := NewHttpHealthProbe("http", "/", 80)
+	probe.Address = server.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	response, err := probe.evaluate(ctx, slog.Default())
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, Unknown, response.ApplicationHealthState)
+	require.Less(t, time.Since(start), 5*time.Second, "cancellation should interrupt an in-flight probe")
+}
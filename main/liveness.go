@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/liveness"
+	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
+	"github.com/pkg/errors"
+)
+
+const (
+	// enableLockFileName is the advisory lock file under dataDir held by the enable
+	// process for as long as it runs.
+	enableLockFileName = "enable.lock"
+
+	// livenessFileName is the heartbeat file under dataDir refreshed by the enable
+	// process on every loop iteration. It is deliberately not registered in
+	// stateMigrations: it describes a running process, which does not survive an
+	// update of the extension.
+	livenessFileName = "liveness.json"
+)
+
+var (
+	// acquireEnableLock takes the enable lock without blocking. It is a variable
+	// to allow overriding in tests.
+	acquireEnableLock = acquireEnableLockImpl
+
+	// enableLockWaitTimeout bounds how long a process taking over waits for the
+	// previous holder to release the enable lock after it has been stopped.
+	enableLockWaitTimeout = 2 * time.Second
+
+	// enableLock is held by the enable process until it exits.
+	enableLock *liveness.Lock
+
+	// enableStartTime is recorded in the liveness heartbeat.
+	enableStartTime = time.Now()
+)
+
+func acquireEnableLockImpl() (*liveness.Lock, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "failed to create data dir")
+	}
+	return liveness.TryLock(filepath.Join(dataDir, enableLockFileName))
+}
+
+// readLivenessHeartbeat returns the heartbeat of the process holding the enable
+// lock, or nil if it cannot be read.
+func readLivenessHeartbeat() *liveness.Heartbeat {
+	h, err := liveness.ReadHeartbeat(filepath.Join(dataDir, livenessFileName))
+	if err != nil {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
+			fmt.Sprintf("Failed to read liveness heartbeat: %v", err), "error", err)
+		return nil
+	}
+	return h
+}
+
+// writeLivenessHeartbeat records that the enable loop for seqNum is making progress.
+func writeLivenessHeartbeat(seqNum uint) error {
+	return liveness.WriteHeartbeat(filepath.Join(dataDir, livenessFileName), GetExtensionVersion(), liveness.Heartbeat{
+		PID:            os.Getpid(),
+		SequenceNumber: seqNum,
+		StartTime:      enableStartTime.UTC(),
+		LastLoopTime:   time.Now().UTC(),
+	})
+}
+
+// checkLockHolderIdempotency decides, when the enable lock is held by another
+// process, whether the current process should exit because the holder is
+// already running the same sequence number and its heartbeat is fresh.
+// Returns true if the current process should exit.
+func checkLockHolderIdempotency(lg *slog.Logger, seqNum uint, mrSeqNum uint, holder *liveness.Heartbeat) bool {
+	if seqNum != mrSeqNum {
+		return false
+	}
+	if holder == nil {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
+			fmt.Sprintf("Enable lock is held but the liveness heartbeat is unavailable. PID %d taking over execution.", os.Getpid()),
+			"seqNum", seqNum, "currentPid", os.Getpid())
+		return false
+	}
+
+	threshold := time.Duration(LivenessHeartbeatStaleThresholdInMinutes) * time.Minute
+	stillExecuting := holder.SequenceNumber == seqNum && holder.IsFresh(threshold)
+	result := "False"
+	if stillExecuting {
+		result = "True"
+	}
+	telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask,
+		fmt.Sprintf("IsHandlerStillExecuting: enable lock held by PID %d, seqNum=%d, result=%s", holder.PID, holder.SequenceNumber, result),
+		"pid", holder.PID, "holderSeqNum", holder.SequenceNumber,
+		"startTime", holder.StartTime.Format(time.RFC3339Nano), "lastLoopTime", holder.LastLoopTime.Format(time.RFC3339Nano))
+
+	if holder.SequenceNumber != seqNum {
+		return false
+	}
+	if stillExecuting {
+		telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask,
+			fmt.Sprintf("Another instance of AppHealthExtension is already running with the same sequence number (%d) and is responsive. PID %d exiting to maintain idempotency.",
+				seqNum, os.Getpid()),
+			"seqNum", seqNum, "holderPid", holder.PID, "currentPid", os.Getpid())
+		return true
+	}
+
+	telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
+		fmt.Sprintf("Another instance of AppHealthExtension holds the enable lock with the same sequence number (%d) but its heartbeat is stale. Last loop: %s UTC, Threshold: %d minutes. PID %d taking over execution.",
+			seqNum, holder.LastLoopTime.UTC().Format(time.RFC3339Nano), LivenessHeartbeatStaleThresholdInMinutes, os.Getpid()),
+		"seqNum", seqNum, "holderPid", holder.PID, "currentPid", os.Getpid(),
+		"lastLoopTime", holder.LastLoopTime.UTC().Format(time.RFC3339Nano), "thresholdMinutes", LivenessHeartbeatStaleThresholdInMinutes)
+	return false
+}
+
+// takeOverEnableLock stops the process holding the enable lock and acquires the
+// lock once it has been released. The holder is identified by the heartbeat; if
+// the heartbeat is unavailable or stopping that PID does not release the lock,
+// the processes found by scanning /proc are stopped instead.
+func takeOverEnableLock(lg *slog.Logger, holder *liveness.Heartbeat) (*liveness.Lock, error) {
+	if holder != nil && holder.PID > 0 && holder.PID != os.Getpid() {
+		telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask,
+			fmt.Sprintf("Stopping enable process PID %d holding the enable lock", holder.PID), "pid", holder.PID)
+		killProcesses([]int{holder.PID})
+		if lock, err := waitForEnableLock(); err == nil {
+			return lock, nil
+		}
+	}
+
+	pids, err := findExistingProcesses()
+	if err != nil {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
+			fmt.Sprintf("Failed to discover existing processes: %v", err), "error", err)
+	} else if len(pids) > 0 {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
+			fmt.Sprintf("Enable lock holder unknown or still running, stopping existing AHE processes PIDs=%v", pids), "pids", pids)
+		killProcesses(pids)
+	}
+	return waitForEnableLock()
+}
+
+// waitForEnableLock polls for the enable lock until enableLockWaitTimeout elapses.
+func waitForEnableLock() (*liveness.Lock, error) {
+	deadline := time.Now().Add(enableLockWaitTimeout)
+	for {
+		lock, err := acquireEnableLock()
+		if err == nil || !errors.Is(err, liveness.ErrLocked) || time.Now().After(deadline) {
+			return lock, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
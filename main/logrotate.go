@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
+	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
+	"github.com/Azure/applicationhealth-extension-linux/pkg/logging"
+	"golang.org/x/sys/unix"
+)
+
+// handlerLogRotateOptions are the rotation options of the handler log. The
+// handler log always exists and is fresh after a rotation, so that the last
+// write time captured by the shim for the idempotency check is not affected.
+var handlerLogRotateOptions = logging.RotateOptions{
+	MaxSize:    HandlerLogMaxSizeInBytes,
+	MaxAge:     HandlerLogMaxAgeInHours * time.Hour,
+	MaxBackups: HandlerLogMaxBackups,
+	Compress:   true,
+}
+
+var vmWatchLogRotateOptions = logging.RotateOptions{
+	MaxSize:    VMWatchVerboseLogMaxSizeInBytes,
+	MaxAge:     VMWatchVerboseLogMaxAgeInHours * time.Hour,
+	MaxBackups: VMWatchVerboseLogMaxBackups,
+	Compress:   true,
+}
+
+// redirectStderr points the stderr of the process, which the shim set to the
+// handler log, to the current handler log once it was rotated, so that a crash
+// is still recorded there.
+func redirectStderr(f *os.File) {
+	// best effort, stderr keeps pointing to the rotated log otherwise
+	unix.Dup3(int(f.Fd()), int(os.Stderr.Fd()), 0)
+}
+
+// rotateVMWatchLog rotates the VMWatch verbose log once it is due. VMWatch keeps
+// it open, so it is copied and truncated, which relies on VMWatch opening it
+// with O_APPEND; logging.ErrNotAppended is returned if it does not.
+func rotateVMWatchLog(hEnv *handlerenv.HandlerEnvironment) error {
+	path := filepath.Join(hEnv.LogFolder, VMWatchVerboseLogFileName)
+	rotated, err := logging.RotateCopyTruncate(path, vmWatchLogRotateOptions)
+	if err != nil {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.StartVMWatchTask,
+			fmt.Sprintf("Failed to rotate VMWatch log %s: %v", path, err), "error", err)
+	} else if rotated {
+		telemetry.SendEvent(telemetry.InfoEvent, telemetry.StartVMWatchTask, fmt.Sprintf("Rotated VMWatch log %s", path))
+	}
+	return err
+}
+
+// monitorVMWatchLog rotates the VMWatch verbose log every interval until stop
+// is closed, or until the log turns out not to be appended to by VMWatch, as
+// rotating it would then only fill the backups with NUL bytes.
+func monitorVMWatchLog(hEnv *handlerenv.HandlerEnvironment, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := rotateVMWatchLog(hEnv); errors.Is(err, logging.ErrNotAppended) {
+				telemetry.SendEvent(telemetry.WarningEvent, telemetry.StartVMWatchTask,
+					"VMWatch does not append to its log, no longer rotating it until VMWatch restarts")
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_rotateVMWatchLog(t *testing.T) {
+	hEnv := &handlerenv.HandlerEnvironment{}
+	hEnv.LogFolder = t.TempDir()
+	path := filepath.Join(hEnv.LogFolder, VMWatchVerboseLogFileName)
+
+	opts := vmWatchLogRotateOptions
+	defer func() { vmWatchLogRotateOptions = opts }()
+	vmWatchLogRotateOptions.MaxSize = 10
+
+	require.NoError(t, rotateVMWatchLog(hEnv))
+	require.NoFileExists(t, path, "a missing log should not be created")
+
+	require.NoError(t, os.WriteFile(path, []byte("short\n"), 0644))
+	rotateVMWatchLog(hEnv)
+	require.NoFileExists(t, path+".1.gz")
+
+	require.NoError(t, os.WriteFile(path, []byte("long enough\n"), 0644))
+	rotateVMWatchLog(hEnv)
+	require.FileExists(t, path+".1.gz")
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Zero(t, info.Size(), "the log should be truncated for VMWatch to keep writing it")
+}
+
+func Test_monitorVMWatchLog_stopsWhenNotAppended(t *testing.T) {
+	hEnv := &handlerenv.HandlerEnvironment{}
+	hEnv.LogFolder = t.TempDir()
+	path := filepath.Join(hEnv.LogFolder, VMWatchVerboseLogFileName)
+
+	opts := vmWatchLogRotateOptions
+	defer func() { vmWatchLogRotateOptions = opts }()
+	vmWatchLogRotateOptions.MaxSize = 10
+
+	// as left by a writer that does not append once the log was truncated
+	require.NoError(t, os.WriteFile(path, append(make([]byte, 12), "next\n"...), 0644))
+
+	done := make(chan struct{})
+	go func() {
+		monitorVMWatchLog(hEnv, time.Millisecond, make(chan struct{}))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("monitorVMWatchLog should stop rotating a log that is not appended to")
+	}
+	require.NoFileExists(t, path+".1.gz")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
+	"github.com/Azure/applicationhealth-extension-linux/pkg/logging"
+)
+
+const (
+	// LogLevelVariableName overrides the level of the handler log, e.g. Debug to
+	// troubleshoot the probes on a single VM. It takes precedence over the
+	// logSettings of the public settings.
+	LogLevelVariableName = "APPHEALTH_LOG_LEVEL"
+
+	// LogFormatVariableName overrides the format of the handler log, text or json.
+	// It takes precedence over the logSettings of the public settings.
+	LogFormatVariableName = "APPHEALTH_LOG_FORMAT"
+)
+
+var (
+	// logLevel and logFormat are the level and format of the handler log, which
+	// change once the settings are parsed.
+	logLevel  = new(slog.LevelVar)
+	logFormat = new(logging.FormatVar)
+)
+
+// newHandlerLogHandler returns the handler of the handler log written to w,
+// using the level and format from the environment, if set.
+func newHandlerLogHandler(w io.Writer) slog.Handler {
+	if v := os.Getenv(LogLevelVariableName); v != "" {
+		if level, err := logging.ParseLevel(v); err == nil {
+			logLevel.Set(level)
+		} else {
+			fmt.Fprintf(os.Stderr, "ignoring %s: %v\n", LogLevelVariableName, err)
+		}
+	}
+	if v := os.Getenv(LogFormatVariableName); v != "" {
+		if format, err := logging.ParseFormat(v); err == nil {
+			logFormat.Set(format)
+		} else {
+			fmt.Fprintf(os.Stderr, "ignoring %s: %v\n", LogFormatVariableName, err)
+		}
+	}
+	return logging.NewExtensionSlogHandlerWithFormat(w, logFormat, &slog.HandlerOptions{Level: logLevel})
+}
+
+// configureLogging applies the log settings, unless overridden by the
+// environment. The settings passed the schema validation, so they are valid.
+func configureLogging(s *logSettings) {
+	if s == nil {
+		return
+	}
+	if s.Level != "" && os.Getenv(LogLevelVariableName) == "" {
+		if level, err := logging.ParseLevel(s.Level); err == nil && level != logLevel.Level() {
+			logLevel.Set(level)
+			telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask, fmt.Sprintf("Handler log level is %s", level))
+		}
+	}
+	if s.Format != "" && os.Getenv(LogFormatVariableName) == "" {
+		if format, err := logging.ParseFormat(s.Format); err == nil && format != logFormat.Format() {
+			logFormat.Set(format)
+			telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask, fmt.Sprintf("Handler log format is %s", format))
+		}
+	}
+}
+
+// logHeartBeatToHandlerLog writes the heartbeat message to the handler log,
+// which telemetry.SendHeartBeat leaves to it: enable tells whether a previous
+// enable is still running by the last write time of the handler log, see
+// checkIdempotency, so the heartbeat is written regardless of the log level and
+// of the minimum level of the log sink, at the log level if it is above Info.
+func logHeartBeatToHandlerLog(msg string) {
+	level := max(slog.LevelInfo, logLevel.Level())
+	slog.Log(context.Background(), level, msg, "task", telemetry.ReportHeatBeatTask)
+}
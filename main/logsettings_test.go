@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/pkg/logging"
+	"github.com/stretchr/testify/require"
+)
+
+func resetLogging(t *testing.T) {
+	t.Cleanup(func() {
+		logLevel.Set(slog.LevelInfo)
+		logFormat.Set(logging.TextFormat)
+	})
+}
+
+func Test_configureLogging(t *testing.T) {
+	resetLogging(t)
+
+	configureLogging(nil)
+	require.Equal(t, slog.LevelInfo, logLevel.Level())
+	require.Equal(t, logging.TextFormat, logFormat.Format())
+
+	configureLogging(&logSettings{Level: "Debug", Format: "json"})
+	require.Equal(t, slog.LevelDebug, logLevel.Level())
+	require.Equal(t, logging.JSONFormat, logFormat.Format())
+}
+
+func Test_configureLogging_environmentTakesPrecedence(t *testing.T) {
+	resetLogging(t)
+	t.Setenv(LogLevelVariableName, "warning")
+	t.Setenv(LogFormatVariableName, "json")
+
+	newHandlerLogHandler(io.Discard)
+	require.Equal(t, slog.LevelWarn, logLevel.Level())
+	require.Equal(t, logging.JSONFormat, logFormat.Format())
+
+	configureLogging(&logSettings{Level: "Debug", Format: "text"})
+	require.Equal(t, slog.LevelWarn, logLevel.Level())
+	require.Equal(t, logging.JSONFormat, logFormat.Format())
+}
+
+func TestLogHeartBeat_writtenRegardlessOfLogLevel(t *testing.T) {
+	resetLogging(t)
+	defaultLogger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	for _, level := range []slog.Level{slog.LevelInfo, slog.LevelWarn, slog.LevelError} {
+		var handlerLog bytes.Buffer
+		slog.SetDefault(slog.New(newHandlerLogHandler(&handlerLog)))
+		logLevel.Set(level)
+		timeOfLastAppHealthLog = time.Time{}
+
+		LogHeartBeat()
+		require.Equal(t, 1, strings.Count(handlerLog.String(), "AppHealthExtension is running"), "the heartbeat keeps the handler log fresh at level %v", level)
+		require.Contains(t, handlerLog.String(), "level="+level.String())
+	}
+}
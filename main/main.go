@@ -1,11 +1,12 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
-	"os/exec"
 	"os/signal"
 	"strings"
 	"syscall"
@@ -20,34 +21,32 @@ var (
 	// dataDir is where we store the logs and state for the extension handler
 	dataDir = "/var/lib/waagent/apphealth"
 
-	shutdown = false
-
-	// We need a reference to the command here so that we can cleanly shutdown VMWatch process
-	// when a shutdown signal is received
-	vmWatchCommand *exec.Cmd
-
 	seqnoManager seqno.SequenceNumberManager = seqno.New()
 )
 
 func main() {
-	logger := slog.New(logging.NewExtensionSlogHandler(os.Stdout, nil)).
+	if len(os.Args) > 1 && os.Args[1] == shimCommandName {
+		os.Exit(runShim(os.Args[2:]))
+	}
+
+	logger := slog.New(newHandlerLogHandler(handlerLogWriter())).
 		With("version", VersionString()).
 		With("pid", os.Getpid())
 	// parse command line arguments
 	cmd := parseCmd(os.Args)
 	logger = logger.With("operation", strings.ToLower(cmd.name))
 
-	// subscribe to cleanly shutdown
+	// subscribe to cleanly shutdown: the context handed to the command is cancelled
+	// with errTerminated as its cause, which interrupts in-flight probes, VMWatch
+	// and retry backoff sleeps
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		<-sigs
-		telemetry.SendEvent(telemetry.InfoEvent, telemetry.KillVMWatchTask, "Received shutdown request")
-		shutdown = true
-		err := killVMWatch(logger, vmWatchCommand)
-		if err != nil {
-			telemetry.SendEvent(telemetry.ErrorEvent, telemetry.KillVMWatchTask, fmt.Sprintf("Error when killing vmwatch process, error: %s", err.Error()))
-		}
+		sig := <-sigs
+		telemetry.SendEvent(telemetry.InfoEvent, telemetry.KillVMWatchTask, "Received shutdown request", "signal", sig.String())
+		cancel(fmt.Errorf("%w: received signal %v", errTerminated, sig))
 	}()
 
 	// parse extension environment
@@ -88,7 +87,7 @@ func main() {
 	}
 	// execute the subcommand
 	reportStatus(logger, hEnv, seqNum, StatusTransitioning, cmd, "")
-	msg, err := cmd.f(logger, hEnv, seqNum)
+	msg, err := cmd.f(ctx, logger, hEnv, seqNum)
 	if err != nil {
 		// Superseded: a newer sequence number was detected in the enable loop.
 		// Exit cleanly without overwriting the status file — the newer process
@@ -97,6 +96,13 @@ func main() {
 			telemetry.SendEvent(telemetry.InfoEvent, telemetry.MainTask, "Process superseded by newer sequence number, exiting gracefully")
 			os.Exit(0)
 		}
+		// Shutdown requested: leave a final status saying that the extension
+		// stopped on request, rather than reporting the last observed state.
+		if errors.Is(err, errTerminated) {
+			telemetry.SendEvent(telemetry.InfoEvent, telemetry.MainTask, "Shutting down AppHealth Extension gracefully", "error", err)
+			reportStatus(logger, hEnv, seqNum, StatusWarning, cmd, shutdownStatusMessage(err))
+			os.Exit(0)
+		}
 		logger.Error("failed to handle", "error", err)
 		reportStatus(logger, hEnv, seqNum, StatusError, cmd, err.Error()+msg)
 		os.Exit(cmd.failExitCode)
@@ -105,6 +111,45 @@ func main() {
 	telemetry.SendEvent(telemetry.InfoEvent, telemetry.MainTask, fmt.Sprintf("Finished execution of AppHealth Extension %s seqNum=%d operation=%s", GetExtensionVersion(), seqNum, cmd.name))
 }
 
+// shutdownStatusMessage describes a shutdown in the final status written before exit.
+func shutdownStatusMessage(err error) string {
+	return fmt.Sprintf("%v. Application health is no longer reported until the extension is enabled again.", err)
+}
+
+// handlerLogWriter returns the writer for the handler's log output. When started by
+// the shim, output is tee'd to the rotated handler log file in addition to stdout,
+// and stderr follows the handler log file when it is rotated.
+func handlerLogWriter() io.Writer {
+	logPath := os.Getenv(HandlerLogFilePathVariableName)
+	if logPath == "" {
+		return os.Stdout
+	}
+	opts := handlerLogRotateOptions
+	opts.Reopened = redirectStderr
+	f, err := logging.OpenRotatingFile(logPath, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open handler log %s: %v\n", logPath, err)
+		return os.Stdout
+	}
+	return teeHandlerLog(f, os.Stdout)
+}
+
+// teeHandlerLog returns a writer writing to the handler log and to stdout. The
+// handler log is written first, and stdout on a best effort basis: the agent may
+// stop reading the stdout of a detached enable, and io.MultiWriter stops at the
+// first failed write.
+func teeHandlerLog(log, stdout io.Writer) io.Writer {
+	return io.MultiWriter(log, ignoreErrors{stdout})
+}
+
+// ignoreErrors is an io.Writer that reports every write to w as successful.
+type ignoreErrors struct{ w io.Writer }
+
+func (w ignoreErrors) Write(p []byte) (int, error) {
+	w.w.Write(p)
+	return len(p), nil
+}
+
 // parseCmd looks at os.Args and parses the subcommand. If it is invalid,
 // it prints the usage string and an error message and exits with code 0.
 func parseCmd(args []string) cmd {
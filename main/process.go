@@ -13,9 +13,11 @@ import (
 
 // Package-level function variables to allow mocking in tests
 var (
-	findExistingProcesses = findExistingProcessesImpl
-	killProcesses         = killProcessesImpl
-	isAHEProcess          = isAHEProcessImpl
+	findExistingProcesses        = findExistingProcessesImpl
+	findExistingVMWatchProcesses = findExistingVMWatchProcessesImpl
+	killProcesses                = killProcessesImpl
+	isAHEProcess                 = isAHEProcessImpl
+	isVMWatchProcess             = isVMWatchProcessImpl
 )
 
 // procExePath returns the path to the /proc/<pid>/exe symlink for the given PID.
@@ -34,12 +36,37 @@ func isAHEProcessImpl(pid int) bool {
 	return procName == AppHealthBinaryNameAmd64 || procName == AppHealthBinaryNameArm64
 }
 
+// isVMWatchProcessImpl checks whether the given PID belongs to a VMWatch binary by
+// reading /proc/<pid>/exe. Returns true if it matches a known VMWatch binary name.
+func isVMWatchProcessImpl(pid int) bool {
+	exePath, err := os.Readlink(procExePath(pid))
+	if err != nil {
+		return false
+	}
+	procName := filepath.Base(exePath)
+	return procName == VMWatchBinaryNameAmd64 || procName == VMWatchBinaryNameArm64
+}
+
 // findExistingProcessesImpl scans /proc to find all other running instances of the
 // Application Health Extension binary (excluding the current process).
 // Uses /proc/<pid>/exe for binary identification.
 // Returns a slice of PIDs of existing processes (empty if none found).
 func findExistingProcessesImpl() ([]int, error) {
+	return findProcesses(isAHEProcess)
+}
+
+// findExistingVMWatchProcessesImpl scans /proc to find all running VMWatch processes,
+// including orphans left behind by an enable process that did not shut down cleanly.
+func findExistingVMWatchProcessesImpl() ([]int, error) {
+	return findProcesses(isVMWatchProcess)
+}
+
+// findProcesses scans /proc and returns the PIDs for which match returns true,
+// excluding the current process and its parent. When started by the shim, the
+// parent is the shim itself, which runs the same binary.
+func findProcesses(match func(pid int) bool) ([]int, error) {
 	myPid := os.Getpid()
+	parentPid := os.Getppid()
 	var pids []int
 
 	entries, err := os.ReadDir("/proc")
@@ -53,11 +80,11 @@ func findExistingProcessesImpl() ([]int, error) {
 		}
 
 		pid, err := strconv.Atoi(entry.Name())
-		if err != nil || pid == myPid {
+		if err != nil || pid == myPid || pid == parentPid {
 			continue
 		}
 
-		if isAHEProcess(pid) {
+		if match(pid) {
 			pids = append(pids, pid)
 		}
 	}
@@ -72,7 +99,7 @@ func findExistingProcessesImpl() ([]int, error) {
 // Returns the timestamp and nil on success, or zero time and an error if the env var
 // is not set or cannot be parsed.
 func getLogFileLastWriteTimeFromEnv() (time.Time, error) {
-	envTime := os.Getenv("HANDLER_LOG_LAST_WRITE_TIME")
+	envTime := os.Getenv(HandlerLogLastWriteTimeVariableName)
 	if envTime == "" {
 		return time.Time{}, fmt.Errorf("HANDLER_LOG_LAST_WRITE_TIME not set, log file may not exist")
 	}
@@ -95,17 +122,21 @@ func killProcessesImpl(pids []int) {
 	}
 }
 
-// killProcess sends SIGTERM to the specified process and waits (bounded) for it
-// to exit before returning. This prevents a race where two AHE instances run
-// simultaneously during takeover.
+// killProcess sends SIGTERM to the specified AHE or VMWatch process and waits
+// (bounded) for it to exit before returning. This prevents a race where two AHE
+// instances run simultaneously during takeover.
 func killProcess(pid int) error {
-	// Revalidate that the PID still belongs to AHE before killing to guard
-	// against PID reuse between discovery and kill time.
+	// Revalidate that the PID still belongs to AHE (or its VMWatch child) before
+	// killing to guard against PID reuse between discovery and kill time.
+	name := "AHE"
 	if !isAHEProcess(pid) {
-		telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
-			fmt.Sprintf("PID %d is no longer an AHE process at kill time, skipping", pid),
-			"pid", pid)
-		return nil
+		if !isVMWatchProcess(pid) {
+			telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
+				fmt.Sprintf("PID %d is no longer an AHE or VMWatch process at kill time, skipping", pid),
+				"pid", pid)
+			return nil
+		}
+		name = "VMWatch"
 	}
 
 	process, err := os.FindProcess(pid)
@@ -118,14 +149,14 @@ func killProcess(pid int) error {
 	}
 
 	telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask,
-		fmt.Sprintf("Sent SIGTERM to existing AHE process with PID %d, waiting for exit", pid))
+		fmt.Sprintf("Sent SIGTERM to existing %s process with PID %d, waiting for exit", name, pid))
 
 	// Wait up to 5 seconds for the process to exit
 	for i := 0; i < 10; i++ {
 		if err := process.Signal(syscall.Signal(0)); err != nil {
 			// Process is gone
 			telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask,
-				fmt.Sprintf("Existing AHE process with PID %d has exited", pid))
+				fmt.Sprintf("Existing %s process with PID %d has exited", name, pid))
 			return nil
 		}
 		time.Sleep(500 * time.Millisecond)
@@ -133,7 +164,7 @@ func killProcess(pid int) error {
 
 	// SIGTERM did not work — escalate to SIGKILL
 	telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
-		fmt.Sprintf("Existing AHE process with PID %d did not exit within 5 seconds after SIGTERM, sending SIGKILL", pid))
+		fmt.Sprintf("Existing %s process with PID %d did not exit within 5 seconds after SIGTERM, sending SIGKILL", name, pid))
 	if err := process.Signal(syscall.SIGKILL); err != nil {
 		return fmt.Errorf("failed to send SIGKILL to process %d: %w", pid, err)
 	}
@@ -143,7 +174,7 @@ func killProcess(pid int) error {
 		time.Sleep(500 * time.Millisecond)
 		if err := process.Signal(syscall.Signal(0)); err != nil {
 			telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask,
-				fmt.Sprintf("Existing AHE process with PID %d has exited after SIGKILL", pid))
+				fmt.Sprintf("Existing %s process with PID %d has exited after SIGKILL", name, pid))
 			return nil
 		}
 	}
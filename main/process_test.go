@@ -46,6 +46,23 @@ func Test_killProcess_SIGTERM(t *testing.T) {
 	assert.NoError(t, err, "killProcess should succeed for a process that handles SIGTERM")
 }
 
+func Test_killProcess_VMWatch(t *testing.T) {
+	events := captureTelemetry(t)
+	pid := spawnDetachedProcess(t, "sleep 60")
+
+	originalAHE, originalVMWatch := isAHEProcess, isVMWatchProcess
+	isAHEProcess = func(p int) bool { return false }
+	isVMWatchProcess = func(p int) bool { return p == pid }
+	defer func() { isAHEProcess, isVMWatchProcess = originalAHE, originalVMWatch }()
+
+	require.NoError(t, killProcess(pid))
+	var messages []string
+	for _, e := range events.Events() {
+		messages = append(messages, e.Message)
+	}
+	assert.Contains(t, messages, fmt.Sprintf("Existing VMWatch process with PID %d has exited", pid))
+}
+
 func Test_killProcess_SIGKILL_escalation(t *testing.T) {
 	// Spawn a process that ignores SIGTERM
 	pid := spawnDetachedProcess(t, "trap '' TERM; sleep 60")
@@ -100,6 +117,22 @@ func Test_killProcess_PIDReusedByNonAHE(t *testing.T) {
 	proc.Kill()
 }
 
+func Test_findProcesses(t *testing.T) {
+	pid := spawnDetachedProcess(t, "sleep 60")
+	defer func() {
+		proc, _ := os.FindProcess(pid)
+		proc.Kill()
+	}()
+
+	pids, err := findProcesses(func(p int) bool { return p == pid || p == os.Getpid() })
+	require.NoError(t, err)
+	assert.Equal(t, []int{pid}, pids, "should match the spawned process and exclude the current process")
+}
+
+func Test_isVMWatchProcess_NonExistentPID(t *testing.T) {
+	assert.False(t, isVMWatchProcess(9999999))
+}
+
 func Test_getLogFileLastWriteTimeFromEnv(t *testing.T) {
 	t.Run("ReturnsTimestampWhenSet", func(t *testing.T) {
 		expected := time.Now().Add(-3 * time.Minute)
@@ -126,48 +159,3 @@ func Test_getLogFileLastWriteTimeFromEnv(t *testing.T) {
 		assert.Contains(t, err.Error(), "failed to parse")
 	})
 }
-
-// Test_shimAndConstantsInSync reads the shim script and verifies that the
-// LOG_DIR and LOG_FILE values match the Go constants. This test will fail
-// if someone changes one side without updating the other.
-func Test_shimAndConstantsInSync(t *testing.T) {
-	shimPath := "../misc/applicationhealth-shim"
-	shimBytes, err := os.ReadFile(shimPath)
-	require.NoError(t, err, "failed to read shim file at %s", shimPath)
-	shimContent := string(shimBytes)
-
-	// Extract LOG_DIR value from: readonly LOG_DIR="..."
-	logDirMatch := extractShimVariable(shimContent, "LOG_DIR")
-	require.NotEmpty(t, logDirMatch, "could not find LOG_DIR in shim")
-	assert.Equal(t, HandlerLogDir, logDirMatch,
-		"HandlerLogDir constant does not match LOG_DIR in misc/applicationhealth-shim")
-
-	// Extract LOG_FILE value from: readonly LOG_FILE=...
-	logFileMatch := extractShimVariable(shimContent, "LOG_FILE")
-	require.NotEmpty(t, logFileMatch, "could not find LOG_FILE in shim")
-	assert.Equal(t, HandlerLogFile, logFileMatch,
-		"HandlerLogFile constant does not match LOG_FILE in misc/applicationhealth-shim")
-}
-
-// extractShimVariable parses a bash variable assignment from the shim content.
-// Handles both quoted (readonly VAR="value") and unquoted (readonly VAR=value) forms.
-func extractShimVariable(content, varName string) string {
-	for _, line := range strings.Split(content, "\n") {
-		line = strings.TrimSpace(line)
-		// Match: readonly VAR="value" or readonly VAR=value
-		for _, prefix := range []string{
-			"readonly " + varName + "=\"",
-			"readonly " + varName + "=",
-			varName + "=\"",
-			varName + "=",
-		} {
-			if strings.HasPrefix(line, prefix) {
-				value := strings.TrimPrefix(line, prefix)
-				value = strings.TrimSuffix(value, "\"")
-				value = strings.TrimSpace(value)
-				return value
-			}
-		}
-	}
-	return ""
-}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
+	"github.com/Azure/applicationhealth-extension-linux/pkg/redact"
+)
+
+// configureRedaction applies the sensitive key patterns of the settings to the
+// redaction of the handler log and the telemetry, replacing those of a previous
+// configuration. The patterns were validated with the settings.
+func configureRedaction(s *redactionSettings) {
+	var patterns []string
+	if s != nil {
+		patterns = s.SensitiveKeyPatterns
+	}
+	if err := redact.SetKeyPatterns(patterns...); err != nil {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
+			fmt.Sprintf("Failed to apply the redaction settings: %v", err), "error", err)
+	} else if len(patterns) > 0 {
+		telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask,
+			fmt.Sprintf("Redacting the values of %d additional sensitive key patterns", len(patterns)))
+	}
+}
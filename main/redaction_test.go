@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Azure/applicationhealth-extension-linux/pkg/redact"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_configureRedaction(t *testing.T) {
+	defer redact.SetKeyPatterns()
+
+	configureRedaction(&redactionSettings{SensitiveKeyPatterns: []string{"contoso[_-]?license"}})
+	require.Equal(t, "CONTOSO_LICENSE="+redact.Placeholder, redact.Value("CONTOSO_LICENSE=abc"))
+
+	configureRedaction(nil)
+	require.Equal(t, "CONTOSO_LICENSE=abc", redact.Value("CONTOSO_LICENSE=abc"), "the patterns of a previous configuration should be removed")
+}
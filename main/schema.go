@@ -125,8 +125,202 @@ const (
           "description": "Optional - flag to disable config reader",
           "type": "boolean",
           "default": false
+        },
+        "allowMissingChecksumManifest": {
+          "description": "Optional - launch vmwatch without verifying the checksums of its binary and config when its package has no checksum manifest, instead of failing the integrity check",
+          "type": "boolean",
+          "default": false
+        },
+        "retryPolicy": {
+          "description": "Optional - specifies how vmwatch is restarted when it exits or stops updating its heartbeat",
+          "type": "object",
+          "properties": {
+            "maxProcessAttempts": {
+              "description": "Optional - number of times vmwatch is started in each retry cycle",
+              "type": "integer",
+              "default": 3,
+              "minimum": 1,
+              "maximum": 10
+            },
+            "maxRetryCycles": {
+              "description": "Optional - number of retry cycles before vmwatch is no longer started",
+              "type": "integer",
+              "default": 4,
+              "minimum": 1,
+              "maximum": 10
+            },
+            "baseWaitHours": {
+              "description": "Optional - hours to wait after the first failed retry cycle",
+              "type": "integer",
+              "default": 3,
+              "minimum": 1,
+              "maximum": 24
+            },
+            "backoff": {
+              "description": "Optional - linear grows the wait by baseWaitHours after every failed cycle, exponential doubles it (with random jitter, up to 72 hours)",
+              "type": "string",
+              "enum": ["linear", "exponential"],
+              "default": "linear"
+            },
+            "heartbeatTimeoutInSeconds": {
+              "description": "Optional - vmwatch is killed when it does not update its heartbeat within this time",
+              "type": "integer",
+              "default": 180,
+              "minimum": 60,
+              "maximum": 3600
+            }
+          },
+          "additionalProperties": false
         }
       }
+    },
+    "telemetrySettings": {
+      "description": "Optional - specifies where telemetry events are sent",
+      "type": "object",
+      "properties": {
+        "sinks": {
+          "description": "Optional - settings of each telemetry sink",
+          "type": "object",
+          "properties": {
+            "events": { "$ref": "#/definitions/eventsSink", "description": "Optional - events uploaded by the guest agent" },
+            "log": { "$ref": "#/definitions/telemetrySink", "description": "Optional - events written to the handler log" },
+            "file": { "$ref": "#/definitions/telemetrySink", "description": "Optional - events written as JSON lines to a local file, disabled unless specified" },
+            "otlp": { "$ref": "#/definitions/otlpSink", "description": "Optional - events exported as logs, with the health metrics, to a local OpenTelemetry collector, disabled unless specified" }
+          },
+          "additionalProperties": false
+        },
+        "rateLimit": {
+          "description": "Optional - limits how many similar events are uploaded by the guest agent, summarizing the suppressed ones; the other sinks receive every event, and state changes and critical events are always sent",
+          "type": "object",
+          "properties": {
+            "maxEventsPerWindow": {
+              "description": "Optional - number of events with the same level, task and message sent per window, -1 to disable rate limiting",
+              "type": "integer",
+              "default": 10,
+              "minimum": -1
+            },
+            "windowInSeconds": {
+              "description": "Optional - length of the rate limiting window",
+              "type": "integer",
+              "default": 600,
+              "minimum": 1,
+              "maximum": 86400
+            }
+          },
+          "additionalProperties": false
+        }
+      },
+      "additionalProperties": false
+    },
+    "logSettings": {
+      "description": "Optional - configures the handler log, unless overridden on the VM by the APPHEALTH_LOG_LEVEL and APPHEALTH_LOG_FORMAT environment variables",
+      "type": "object",
+      "properties": {
+        "level": {
+          "description": "Optional - minimum level of the handler log entries",
+          "type": "string",
+          "enum": ["Debug", "Info", "Warning", "Error"],
+          "default": "Info"
+        },
+        "format": {
+          "description": "Optional - format of the handler log entries",
+          "type": "string",
+          "enum": ["text", "json"],
+          "default": "text"
+        }
+      },
+      "additionalProperties": false
+    },
+    "redactionSettings": {
+      "description": "Optional - extends the redaction of secrets from the handler log and telemetry",
+      "type": "object",
+      "properties": {
+        "sensitiveKeyPatterns": {
+          "description": "Optional - case-insensitive regular expressions of the names, e.g. of environment variables or settings, whose values are redacted in addition to the built-in ones",
+          "type": "array",
+          "items": {
+            "type": "string",
+            "minLength": 1
+          }
+        }
+      },
+      "additionalProperties": false
+    },
+    "metricsEndpoint": {
+      "description": "Optional - serves the state of the extension as Prometheus metrics on http://127.0.0.1:<port>/metrics",
+      "type": "object",
+      "properties": {
+        "enabled": {
+          "description": "Optional - whether the metrics endpoint is served",
+          "type": "boolean",
+          "default": false
+        },
+        "port": {
+          "description": "Optional - loopback port the metrics endpoint listens on",
+          "type": "integer",
+          "default": 9469,
+          "minimum": 1,
+          "maximum": 65535
+        }
+      },
+      "additionalProperties": false
+    }
+  },
+  "definitions": {
+    "eventsSink": {
+      "type": "object",
+      "properties": {
+        "minLevel": {
+          "description": "Optional - minimum level of the events sent to the sink",
+          "type": "string",
+          "enum": ["Verbose", "Informational", "Warning", "Error", "Critical"],
+          "default": "Verbose"
+        },
+        "payloadFormat": {
+          "description": "Optional - format of the event messages: message writes the message only, json a versioned JSON object with the message and the event fields",
+          "type": "string",
+          "enum": ["message", "json"],
+          "default": "message"
+        }
+      },
+      "additionalProperties": false
+    },
+    "telemetrySink": {
+      "type": "object",
+      "properties": {
+        "minLevel": {
+          "description": "Optional - minimum level of the events sent to the sink",
+          "type": "string",
+          "enum": ["Verbose", "Informational", "Warning", "Error", "Critical"],
+          "default": "Verbose"
+        }
+      },
+      "additionalProperties": false
+    },
+    "otlpSink": {
+      "type": "object",
+      "properties": {
+        "minLevel": {
+          "description": "Optional - minimum level of the events exported as logs",
+          "type": "string",
+          "enum": ["Verbose", "Informational", "Warning", "Error", "Critical"],
+          "default": "Verbose"
+        },
+        "endpoint": {
+          "description": "Required - base URL of the OTLP/HTTP receiver of the collector, which must be on localhost, e.g. http://localhost:4318",
+          "type": "string",
+          "pattern": "^https?://"
+        },
+        "exportIntervalInSeconds": {
+          "description": "Optional - how often metrics and events are exported",
+          "type": "integer",
+          "default": 10,
+          "minimum": 1,
+          "maximum": 300
+        }
+      },
+      "required": ["endpoint"],
+      "additionalProperties": false
     }
   },
   "additionalProperties": false
@@ -159,6 +159,7 @@ func TestValidatePublicSettings_vmwatch(t *testing.T) {
 	require.Nil(t, validatePublicSettings(`{"port": 1, "vmWatchSettings" : { "enabled" : false }}`), "valid settings")
 	require.Nil(t, validatePublicSettings(`{"port": 1, "vmWatchSettings" : { "enabled" : true }}`), "valid settings")
 	require.Nil(t, validatePublicSettings(`{"port": 1, "vmWatchSettings" : { "enabled" : true, "memoryLimitInBytes" : 30000000 }}`), "valid settings")
+	require.Nil(t, validatePublicSettings(`{"port": 1, "vmWatchSettings" : { "enabled" : true, "allowMissingChecksumManifest" : true }}`), "valid settings")
 
 	err := validatePublicSettings(`{"port": 1, "vmWatchSettings" : { "enabled" : true, "memoryLimitInBytes" : 20000000 }}`)
 	require.NotNil(t, err)
@@ -172,3 +173,95 @@ func TestValidatePublicSettings_vmwatch(t *testing.T) {
 	require.NotNil(t, err)
 	require.Contains(t, err.Error(), "vmWatchSettings.maxCpuPercentage: Must be less than or equal to 100")
 }
+
+func TestValidatePublicSettings_vmwatchRetryPolicy(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"port": 1, "vmWatchSettings" : { "enabled" : true, "retryPolicy" : { "maxProcessAttempts" : 5, "maxRetryCycles" : 2, "baseWaitHours" : 1, "backoff" : "exponential", "heartbeatTimeoutInSeconds" : 300 }}}`), "valid settings")
+
+	err := validatePublicSettings(`{"port": 1, "vmWatchSettings" : { "enabled" : true, "retryPolicy" : { "maxProcessAttempts" : 0 }}}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "vmWatchSettings.retryPolicy.maxProcessAttempts: Must be greater than or equal to 1")
+
+	err = validatePublicSettings(`{"port": 1, "vmWatchSettings" : { "enabled" : true, "retryPolicy" : { "baseWaitHours" : 25 }}}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "vmWatchSettings.retryPolicy.baseWaitHours: Must be less than or equal to 24")
+
+	err = validatePublicSettings(`{"port": 1, "vmWatchSettings" : { "enabled" : true, "retryPolicy" : { "heartbeatTimeoutInSeconds" : 30 }}}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "vmWatchSettings.retryPolicy.heartbeatTimeoutInSeconds: Must be greater than or equal to 60")
+
+	err = validatePublicSettings(`{"port": 1, "vmWatchSettings" : { "enabled" : true, "retryPolicy" : { "backoff" : "random" }}}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "vmWatchSettings.retryPolicy.backoff")
+}
+
+func TestValidatePublicSettings_telemetrySinks(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"port": 1, "telemetrySettings" : { "sinks" : { "events" : { "minLevel" : "Warning" }, "log" : {}, "file" : { "minLevel" : "Verbose" }}}}`), "valid settings")
+	require.Nil(t, validatePublicSettings(`{"port": 1, "telemetrySettings" : { "sinks" : { "events" : { "payloadFormat" : "json" }}}}`), "valid settings")
+
+	err := validatePublicSettings(`{"port": 1, "telemetrySettings" : { "sinks" : { "events" : { "payloadFormat" : "xml" }}}}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "telemetrySettings.sinks.events.payloadFormat")
+
+	err = validatePublicSettings(`{"port": 1, "telemetrySettings" : { "sinks" : { "events" : { "minLevel" : "Debug" }}}}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "telemetrySettings.sinks.events.minLevel")
+
+	err = validatePublicSettings(`{"port": 1, "telemetrySettings" : { "sinks" : { "syslog" : {}}}}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "syslog")
+}
+
+func TestValidatePublicSettings_otlpSink(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"port": 1, "telemetrySettings" : { "sinks" : { "otlp" : { "endpoint" : "http://localhost:4318", "minLevel" : "Informational", "exportIntervalInSeconds" : 30 }}}}`), "valid settings")
+
+	err := validatePublicSettings(`{"port": 1, "telemetrySettings" : { "sinks" : { "otlp" : { "minLevel" : "Warning" }}}}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "endpoint")
+
+	err = validatePublicSettings(`{"port": 1, "telemetrySettings" : { "sinks" : { "otlp" : { "endpoint" : "localhost:4317" }}}}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "telemetrySettings.sinks.otlp.endpoint")
+
+	err = validatePublicSettings(`{"port": 1, "telemetrySettings" : { "sinks" : { "otlp" : { "endpoint" : "http://localhost:4318", "exportIntervalInSeconds" : 0 }}}}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "exportIntervalInSeconds")
+}
+
+func TestValidatePublicSettings_metricsEndpoint(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"port": 1, "metricsEndpoint" : { "enabled" : true, "port" : 9469 }}`), "valid settings")
+	require.Nil(t, validatePublicSettings(`{"port": 1, "metricsEndpoint" : { "enabled" : false }}`), "valid settings")
+
+	err := validatePublicSettings(`{"port": 1, "metricsEndpoint" : { "enabled" : true, "port" : 70000 }}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "metricsEndpoint.port")
+
+	err = validatePublicSettings(`{"port": 1, "metricsEndpoint" : { "enabled" : true, "address" : "0.0.0.0:9469" }}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "address")
+}
+
+func TestValidatePublicSettings_telemetryRateLimit(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"port": 1, "telemetrySettings" : { "rateLimit" : { "maxEventsPerWindow" : 5, "windowInSeconds" : 60 }}}`), "valid settings")
+	require.Nil(t, validatePublicSettings(`{"port": 1, "telemetrySettings" : { "rateLimit" : { "maxEventsPerWindow" : -1 }}}`), "rate limiting disabled")
+
+	err := validatePublicSettings(`{"port": 1, "telemetrySettings" : { "rateLimit" : { "windowInSeconds" : 0 }}}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "telemetrySettings.rateLimit.windowInSeconds")
+}
+
+func TestValidatePublicSettings_logSettings(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"port": 1, "logSettings" : { "level" : "Debug", "format" : "json" }}`), "valid settings")
+	require.Nil(t, validatePublicSettings(`{"port": 1, "logSettings" : { "format" : "text" }}`), "valid settings")
+
+	err := validatePublicSettings(`{"port": 1, "logSettings" : { "level" : "Trace" }}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "logSettings.level")
+}
+
+func TestValidatePublicSettings_redactionSettings(t *testing.T) {
+	require.Nil(t, validatePublicSettings(`{"port": 1, "redactionSettings" : { "sensitiveKeyPatterns" : ["contoso[_-]?license"] }}`), "valid settings")
+
+	err := validatePublicSettings(`{"port": 1, "redactionSettings" : { "sensitiveKeyPatterns" : [""] }}`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "redactionSettings.sensitiveKeyPatterns")
+}
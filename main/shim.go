@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
+	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
+	"github.com/Azure/applicationhealth-extension-linux/pkg/logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	// shimCommandName is the first argument that runs the binary in shim mode, i.e.
+	// as the entrypoint invoked by the guest agent through misc/applicationhealth-shim.
+	shimCommandName = "shim"
+
+	// HandlerLogLastWriteTimeVariableName carries the handler log file's last write
+	// time (seconds since epoch), captured by the shim before it writes to the log.
+	HandlerLogLastWriteTimeVariableName = "HANDLER_LOG_LAST_WRITE_TIME"
+
+	// HandlerLogFilePathVariableName tells the handler process started by the shim
+	// which file to tee its log output to.
+	HandlerLogFilePathVariableName = "HANDLER_LOG_FILE_PATH"
+)
+
+// shimExecutable returns the binary the shim starts the handler process from. It is
+// a variable to allow overriding in tests.
+var shimExecutable = os.Executable
+
+// runShim is the entrypoint of shim mode. It tees its output to handler.log, stops
+// processes left over from previous invocations and then runs the requested
+// handler command: 'enable' is started detached in its own session so that it
+// outlives the guest agent's command timeout, all other commands run as a child
+// process whose exit code is returned.
+func runShim(args []string) int {
+	if len(args) != 1 {
+		printUsage(args)
+		fmt.Println("Incorrect usage.")
+		return 2
+	}
+	op := args[0]
+	if _, ok := cmds[op]; !ok {
+		printUsage(args)
+		fmt.Printf("Incorrect command: %q\n", op)
+		return 2
+	}
+
+	logPath := filepath.Join(HandlerLogDir, HandlerLogFile)
+	if err := os.MkdirAll(HandlerLogDir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create handler log dir %s: %v\n", HandlerLogDir, err)
+		return cmds[op].failExitCode
+	}
+	// Capture the handler log file's last write time BEFORE writing to it, so that
+	// it reflects the previous process's last write rather than this invocation's,
+	// which may also rotate it.
+	lastWriteTime, lastWriteErr := handlerLogLastWriteTime(logPath)
+	log, err := logging.OpenRotatingFile(logPath, handlerLogRotateOptions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open handler log %s: %v\n", logPath, err)
+		return cmds[op].failExitCode
+	}
+	defer log.Close()
+
+	out := teeHandlerLog(log, os.Stdout)
+	lg := slog.New(newHandlerLogHandler(out)).
+		With("version", VersionString()).
+		With("pid", os.Getpid()).
+		With("operation", shimCommandName+"-"+op)
+	slog.SetDefault(lg)
+	if lastWriteErr != nil {
+		lg.Info("handler log last write time not available", "path", logPath, "error", lastWriteErr)
+	}
+
+	hEnv, err := handlerenv.GetHandlerEnviroment()
+	if err != nil {
+		lg.Info("failed to parse handlerenv", "error", err)
+	} else if _, err := telemetry.NewTelemetry(hEnv); err != nil {
+		lg.Info("failed to initialize telemetry object", "error", err)
+	}
+
+	// For enable, idempotency is handled by the enable process itself, and disable
+	// stops the enable process and VMWatch itself. For the remaining commands
+	// (install, uninstall, update), stop any running processes as a safety net.
+	if op != "enable" && op != "disable" {
+		stopExistingProcesses(lg)
+	}
+
+	bin, err := shimExecutable()
+	if err != nil {
+		lg.Error("failed to locate handler binary", "error", err)
+		return cmds[op].failExitCode
+	}
+	env := shimEnvironment(os.Environ(), logPath, lastWriteTime)
+
+	// The stderr of the handler process is the handler log, opened after the shim
+	// wrote to it so that it is the current one if it was rotated.
+	logFile, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		lg.Error("failed to open handler log", "path", logPath, "error", err)
+		return cmds[op].failExitCode
+	}
+	defer logFile.Close()
+
+	if op == "enable" {
+		if hEnv != nil {
+			if err := writePlaceholderStatus(lg, hEnv); err != nil {
+				lg.Error("failed to write placeholder status file", "error", err)
+			}
+		}
+		pid, err := startDetached(bin, op, env, logFile)
+		if err != nil {
+			lg.Error("failed to start detached enable process", "error", err)
+			return cmds[op].failExitCode
+		}
+		lg.Info("started detached enable process", "childPid", pid)
+		return 0
+	}
+
+	return runChild(lg, bin, op, env, logFile)
+}
+
+// handlerLogLastWriteTime returns the handler log's modification time as seconds
+// since epoch, formatted for HANDLER_LOG_LAST_WRITE_TIME.
+func handlerLogLastWriteTime(logPath string) (string, error) {
+	info, err := os.Stat(logPath)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(info.ModTime().Unix(), 10), nil
+}
+
+// shimEnvironment returns the environment for the handler process: the shim's own
+// environment with the handler log path and its last write time set. A stale
+// last write time inherited from the caller is dropped if none was captured.
+func shimEnvironment(environ []string, logPath, lastWriteTime string) []string {
+	env := make([]string, 0, len(environ)+2)
+	for _, v := range environ {
+		if strings.HasPrefix(v, HandlerLogLastWriteTimeVariableName+"=") || strings.HasPrefix(v, HandlerLogFilePathVariableName+"=") {
+			continue
+		}
+		env = append(env, v)
+	}
+	env = append(env, HandlerLogFilePathVariableName+"="+logPath)
+	if lastWriteTime != "" {
+		env = append(env, HandlerLogLastWriteTimeVariableName+"="+lastWriteTime)
+	}
+	return env
+}
+
+// stopExistingProcesses terminates running AHE processes and then any VMWatch
+// processes they leave behind.
+func stopExistingProcesses(lg *slog.Logger) {
+	pids, err := findExistingProcesses()
+	if err != nil {
+		lg.Warn("failed to discover running AHE processes", "error", err)
+	} else if len(pids) > 0 {
+		lg.Info("terminating existing AHE processes", "pids", pids)
+		killProcesses(pids)
+	}
+
+	vmWatchPids, err := findExistingVMWatchProcesses()
+	if err != nil {
+		lg.Warn("failed to discover running VMWatch processes", "error", err)
+	} else if len(vmWatchPids) > 0 {
+		lg.Info("terminating existing VMWatch processes", "pids", vmWatchPids)
+		killProcesses(vmWatchPids)
+	}
+}
+
+// writePlaceholderStatus writes a transitioning status for the sequence number
+// about to be enabled, unless a status file already exists for it, so that the
+// guest agent sees progress before the detached enable process reports.
+func writePlaceholderStatus(lg *slog.Logger, hEnv *handlerenv.HandlerEnvironment) error {
+	seqNum, err := seqnoManager.FindSeqNum(hEnv.ConfigFolder)
+	if err != nil {
+		return errors.Wrap(err, "failed to find sequence number")
+	}
+	statusPath := filepath.Join(hEnv.StatusFolder, fmt.Sprintf("%d.status", seqNum))
+	if _, err := os.Stat(statusPath); err == nil {
+		lg.Info("not writing a placeholder status file, already exists", "path", statusPath)
+		return nil
+	}
+	lg.Info("writing a placeholder status file indicating progress before starting enable", "path", statusPath)
+	return NewStatus(StatusTransitioning, cmdEnable.name, statusMsg(cmdEnable, StatusTransitioning, "")).Save(hEnv.StatusFolder, seqNum)
+}
+
+// startDetached starts the handler command in a new session (setsid), detached from
+// the shim's process tree so that it is not terminated along with the guest
+// agent's command. Stdout is inherited and stderr goes to the handler log, so a
+// crash of the detached process is still recorded there.
+func startDetached(bin, op string, env []string, logFile *os.File) (int, error) {
+	c := exec.Command(bin, op)
+	c.Env = env
+	c.Stdout = os.Stdout
+	c.Stderr = logFile
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := c.Start(); err != nil {
+		return -1, err
+	}
+	pid := c.Process.Pid
+	return pid, c.Process.Release()
+}
+
+// runChild runs the handler command as a child process and returns its exit code.
+func runChild(lg *slog.Logger, bin, op string, env []string, logFile *os.File) int {
+	c := exec.Command(bin, op)
+	c.Env = env
+	c.Stdout = os.Stdout
+	c.Stderr = logFile
+	err := c.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	} else if err != nil {
+		lg.Error("failed to run handler command", "error", err)
+		return cmds[op].failExitCode
+	}
+	return 0
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
+	"github.com/Azure/applicationhealth-extension-linux/internal/seqno"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+	"golang.org/x/sys/unix"
+)
+
+// writeTestScript writes an executable shell script to a temporary directory and
+// returns its path.
+func writeTestScript(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "handler.sh")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+content+"\n"), 0755))
+	return path
+}
+
+// Test_bashShimDelegatesToShimMode reads the bash shim and verifies that the
+// binary names it selects match the Go constants and that it hands over to the
+// binary's shim mode. This test will fail if someone changes one side without
+// updating the other.
+func Test_bashShimDelegatesToShimMode(t *testing.T) {
+	shimPath := "../misc/applicationhealth-shim"
+	shimBytes, err := os.ReadFile(shimPath)
+	require.NoError(t, err, "failed to read shim file at %s", shimPath)
+	shimContent := string(shimBytes)
+
+	var binaries []string
+	for _, line := range strings.Split(shimContent, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "HANDLER_BIN=") {
+			binaries = append(binaries, strings.Trim(strings.TrimSuffix(strings.TrimPrefix(line, "HANDLER_BIN="), ";"), `"`))
+		}
+	}
+	assert.Equal(t, []string{AppHealthBinaryNameAmd64, AppHealthBinaryNameArm64}, binaries,
+		"HANDLER_BIN values in misc/applicationhealth-shim do not match the binary name constants")
+	assert.Contains(t, shimContent, `" `+shimCommandName+` "$1"`, "misc/applicationhealth-shim should exec the binary in shim mode")
+}
+
+func Test_runShim_IncorrectUsage(t *testing.T) {
+	assert.Equal(t, 2, runShim(nil))
+	assert.Equal(t, 2, runShim([]string{"enable", "extra"}))
+	assert.Equal(t, 2, runShim([]string{"unknown"}))
+}
+
+func Test_handlerLogLastWriteTime(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), HandlerLogFile)
+
+	_, err := handlerLogLastWriteTime(logPath)
+	assert.Error(t, err, "should fail when the log file does not exist")
+
+	require.NoError(t, os.WriteFile(logPath, []byte("log"), 0644))
+	mtime := time.Now().Add(-10 * time.Minute)
+	require.NoError(t, os.Chtimes(logPath, mtime, mtime))
+
+	lastWrite, err := handlerLogLastWriteTime(logPath)
+	require.NoError(t, err)
+	assert.Equal(t, strconv.FormatInt(mtime.Unix(), 10), lastWrite)
+}
+
+func Test_teeHandlerLog(t *testing.T) {
+	// the stdout of the agent is no longer read
+	r, stdout, err := os.Pipe()
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	defer stdout.Close()
+
+	var log bytes.Buffer
+	lg := slog.New(slog.NewTextHandler(teeHandlerLog(&log, stdout), nil))
+	lg.Info("first")
+	lg.Info("second")
+	require.Contains(t, log.String(), "first")
+	require.Contains(t, log.String(), "second", "a failing stdout should not stop the writes to the handler log")
+}
+
+func Test_shimEnvironment(t *testing.T) {
+	environ := []string{"PATH=/usr/bin", HandlerLogLastWriteTimeVariableName + "=1", HandlerLogFilePathVariableName + "=/old"}
+
+	env := shimEnvironment(environ, "/var/log/handler.log", "1700000000")
+	assert.Equal(t, []string{
+		"PATH=/usr/bin",
+		HandlerLogFilePathVariableName + "=/var/log/handler.log",
+		HandlerLogLastWriteTimeVariableName + "=1700000000",
+	}, env)
+
+	env = shimEnvironment(environ, "/var/log/handler.log", "")
+	assert.Equal(t, []string{"PATH=/usr/bin", HandlerLogFilePathVariableName + "=/var/log/handler.log"}, env,
+		"an inherited last write time should be dropped when none was captured")
+}
+
+func Test_writePlaceholderStatus(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockSeqNumManager := seqno.NewMockSequenceNumberManager(ctrl)
+	origSeqnoManager := seqnoManager
+	t.Cleanup(func() { seqnoManager = origSeqnoManager })
+	seqnoManager = mockSeqNumManager
+
+	hEnv := &handlerenv.HandlerEnvironment{}
+	hEnv.StatusFolder = t.TempDir()
+	hEnv.ConfigFolder = t.TempDir()
+	statusPath := filepath.Join(hEnv.StatusFolder, "3.status")
+	lg := slog.Default()
+
+	mockSeqNumManager.EXPECT().FindSeqNum(hEnv.ConfigFolder).Return(uint(3), nil).Times(2)
+
+	require.NoError(t, writePlaceholderStatus(lg, hEnv))
+	b, err := os.ReadFile(statusPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"status": "transitioning"`)
+	assert.Contains(t, string(b), `"message": "Enable in progress"`)
+
+	// an existing status file must not be overwritten
+	require.NoError(t, os.WriteFile(statusPath, []byte("existing"), 0644))
+	require.NoError(t, writePlaceholderStatus(lg, hEnv))
+	b, err = os.ReadFile(statusPath)
+	require.NoError(t, err)
+	assert.Equal(t, "existing", string(b))
+}
+
+func Test_startDetached(t *testing.T) {
+	dir := t.TempDir()
+	script := writeTestScript(t, `echo "$1 $HANDLER_TEST_VAR" > `+filepath.Join(dir, "out")+`; sleep 30`)
+	logFile, err := os.Create(filepath.Join(dir, HandlerLogFile))
+	require.NoError(t, err)
+	defer logFile.Close()
+
+	pid, err := startDetached(script, "enable", []string{"HANDLER_TEST_VAR=set"}, logFile)
+	require.NoError(t, err)
+	defer func() {
+		syscall.Kill(pid, syscall.SIGKILL)
+		var ws syscall.WaitStatus
+		syscall.Wait4(pid, &ws, 0, nil)
+	}()
+
+	sid, err := unix.Getsid(pid)
+	require.NoError(t, err)
+	assert.Equal(t, pid, sid, "detached process should lead its own session")
+
+	assert.Eventually(t, func() bool {
+		b, err := os.ReadFile(filepath.Join(dir, "out"))
+		return err == nil && strings.TrimSpace(string(b)) == "enable set"
+	}, 5*time.Second, 50*time.Millisecond, "detached process should receive the command and environment")
+}
+
+func Test_runChild(t *testing.T) {
+	logFile, err := os.Create(filepath.Join(t.TempDir(), HandlerLogFile))
+	require.NoError(t, err)
+	defer logFile.Close()
+	lg := slog.Default()
+
+	assert.Equal(t, 0, runChild(lg, writeTestScript(t, "exit 0"), "install", nil, logFile))
+	assert.Equal(t, 7, runChild(lg, writeTestScript(t, "exit 7"), "install", nil, logFile))
+	assert.Equal(t, cmdInstall.failExitCode, runChild(lg, "/non-existing/binary", "install", nil, logFile))
+
+	require.Equal(t, 0, runChild(lg, writeTestScript(t, "echo crash >&2"), "install", nil, logFile))
+	b, err := os.ReadFile(logFile.Name())
+	require.NoError(t, err)
+	assert.Equal(t, "crash\n", string(b), "stderr of the handler process should be written to the handler log")
+}
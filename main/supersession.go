@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
+	"github.com/Azure/applicationhealth-extension-linux/internal/seqno"
+	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
+)
+
+const settingsFileExtension = ".settings"
+
+// newSequenceNumberWatcher creates the inotify watcher used to detect a newer
+// configuration. It is a variable to allow overriding in tests.
+var newSequenceNumberWatcher = func(dirs ...string) (*seqno.Watcher, error) {
+	return seqno.NewWatcher(dirs...)
+}
+
+// checkSuperseded returns errSuperseded if another process has recorded a
+// sequence number newer than seqNum in mrseq.
+func checkSuperseded(lg *slog.Logger, seqNum uint) error {
+	mostRecentSequenceNumberStarted, err := seqnoManager.GetCurrentSequenceNumber(lg, fullName, "")
+	if err != nil {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
+			fmt.Sprintf("Failed to read current sequence number: %v. Continuing with current configuration.", err), "error", err)
+	} else if seqNum < mostRecentSequenceNumberStarted {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
+			fmt.Sprintf("Current sequence number %d is less than the most recently started sequence number %d. PID %d initiating graceful shutdown.",
+				seqNum, mostRecentSequenceNumberStarted, os.Getpid()),
+			"sequenceNumber", seqNum, "mostRecentSequenceNumberStarted", mostRecentSequenceNumberStarted, "currentPid", os.Getpid())
+		return errSuperseded
+	}
+	return nil
+}
+
+// settingsFileSequenceNumber returns the sequence number of a <seqNum>.settings
+// file, or false if path is not a settings file.
+func settingsFileSequenceNumber(path string) (uint, bool) {
+	name := filepath.Base(path)
+	if !strings.HasSuffix(name, settingsFileExtension) {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(strings.TrimSuffix(name, settingsFileExtension), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return uint(n), true
+}
+
+// checkNewerSettings returns errSuperseded if a settings file with a sequence
+// number greater than seqNum exists in the config folder.
+func checkNewerSettings(configFolder string, seqNum uint) error {
+	paths, _ := filepath.Glob(filepath.Join(configFolder, "*"+settingsFileExtension))
+	for _, path := range paths {
+		if n, ok := settingsFileSequenceNumber(path); ok && n > seqNum {
+			telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
+				fmt.Sprintf("Settings file for sequence number %d appeared while running sequence number %d. PID %d initiating graceful shutdown.",
+					n, seqNum, os.Getpid()),
+				"sequenceNumber", seqNum, "newerSequenceNumber", n, "path", path, "currentPid", os.Getpid())
+			return errSuperseded
+		}
+	}
+	return nil
+}
+
+// watchForNewerConfiguration watches the mrseq folder and the config folder and
+// cancels ctx with errSuperseded as soon as a newer sequence number is recorded
+// or a newer settings file appears, so that the enable loop does not keep
+// running a stale configuration until its next iteration. The returned flag is
+// true while the watcher is active; when it is false (inotify unavailable or the
+// watcher failed) the caller polls with checkSuperseded instead.
+func watchForNewerConfiguration(ctx context.Context, cancel context.CancelCauseFunc, lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) *atomic.Bool {
+	watching := &atomic.Bool{}
+	processDirectory, err := GetProcessDirectory()
+	if err != nil {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
+			fmt.Sprintf("Failed to determine the mrseq folder: %v. Polling for newer sequence numbers.", err), "error", err)
+		return watching
+	}
+	w, err := newSequenceNumberWatcher(processDirectory, h.ConfigFolder)
+	if err != nil {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
+			fmt.Sprintf("Sequence number watcher unavailable: %v. Polling for newer sequence numbers.", err), "error", err)
+		return watching
+	}
+	watching.Store(true)
+
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case path, ok := <-w.Changes():
+				if !ok {
+					watching.Store(false)
+					telemetry.SendEvent(telemetry.WarningEvent, telemetry.AppHealthTask,
+						"Sequence number watcher stopped unexpectedly. Polling for newer sequence numbers.")
+					return
+				}
+				if err := checkConfigurationChange(lg, h, seqNum, path); err != nil {
+					cancel(err)
+					return
+				}
+			}
+		}
+	}()
+	return watching
+}
+
+// checkConfigurationChange inspects a change reported by the watcher. An empty
+// path means events were lost, so both mrseq and the config folder are checked.
+func checkConfigurationChange(lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint, path string) error {
+	if path == "" || filepath.Base(path) == mrseqFileName {
+		if err := checkSuperseded(lg, seqNum); err != nil {
+			return err
+		}
+	}
+	if path == "" {
+		return checkNewerSettings(h.ConfigFolder, seqNum)
+	}
+	if n, ok := settingsFileSequenceNumber(path); ok && n > seqNum && filepath.Dir(path) == filepath.Clean(h.ConfigFolder) {
+		return checkNewerSettings(h.ConfigFolder, seqNum)
+	}
+	return nil
+}
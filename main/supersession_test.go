@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
+	"github.com/Azure/applicationhealth-extension-linux/internal/seqno"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func Test_settingsFileSequenceNumber(t *testing.T) {
+	n, ok := settingsFileSequenceNumber("/var/lib/waagent/ext/config/12.settings")
+	assert.True(t, ok)
+	assert.Equal(t, uint(12), n)
+
+	for _, path := range []string{"/config/HandlerState", "/config/abc.settings", "/config/12.settings.tmp"} {
+		_, ok := settingsFileSequenceNumber(path)
+		assert.False(t, ok, path)
+	}
+}
+
+func Test_checkConfigurationChange(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockSeqNumManager := seqno.NewMockSequenceNumberManager(ctrl)
+	origSeqnoManager := seqnoManager
+	t.Cleanup(func() { seqnoManager = origSeqnoManager })
+	seqnoManager = mockSeqNumManager
+
+	lg := slog.Default()
+	h := &handlerenv.HandlerEnvironment{}
+	h.ConfigFolder = t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(h.ConfigFolder, "5.settings"), []byte("{}"), 0644))
+
+	t.Run("NewerMrseq_ShouldSupersede", func(t *testing.T) {
+		mockSeqNumManager.EXPECT().GetCurrentSequenceNumber(gomock.Any(), gomock.Any(), gomock.Any()).Return(uint(6), nil)
+		assert.ErrorIs(t, checkConfigurationChange(lg, h, 5, filepath.Join(t.TempDir(), mrseqFileName)), errSuperseded)
+	})
+
+	t.Run("SameMrseq_ShouldContinue", func(t *testing.T) {
+		mockSeqNumManager.EXPECT().GetCurrentSequenceNumber(gomock.Any(), gomock.Any(), gomock.Any()).Return(uint(5), nil)
+		assert.NoError(t, checkConfigurationChange(lg, h, 5, filepath.Join(t.TempDir(), mrseqFileName)))
+	})
+
+	t.Run("CurrentSettingsRewritten_ShouldContinue", func(t *testing.T) {
+		assert.NoError(t, checkConfigurationChange(lg, h, 5, filepath.Join(h.ConfigFolder, "5.settings")))
+	})
+
+	t.Run("NewerSettings_ShouldSupersede", func(t *testing.T) {
+		path := filepath.Join(h.ConfigFolder, "6.settings")
+		require.NoError(t, os.WriteFile(path, []byte("{}"), 0644))
+		t.Cleanup(func() { os.Remove(path) })
+		assert.ErrorIs(t, checkConfigurationChange(lg, h, 5, path), errSuperseded)
+	})
+
+	t.Run("EventsLost_ShouldCheckEverything", func(t *testing.T) {
+		path := filepath.Join(h.ConfigFolder, "7.settings")
+		require.NoError(t, os.WriteFile(path, []byte("{}"), 0644))
+		t.Cleanup(func() { os.Remove(path) })
+		mockSeqNumManager.EXPECT().GetCurrentSequenceNumber(gomock.Any(), gomock.Any(), gomock.Any()).Return(uint(5), nil)
+		assert.ErrorIs(t, checkConfigurationChange(lg, h, 5, ""), errSuperseded)
+	})
+}
+
+func Test_watchForNewerConfiguration(t *testing.T) {
+	lg := slog.Default()
+	h := &handlerenv.HandlerEnvironment{}
+	h.ConfigFolder = t.TempDir()
+
+	t.Run("NewerSettingsFile_ShouldCancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		defer cancel(nil)
+
+		watching := watchForNewerConfiguration(ctx, cancel, lg, h, 3)
+		require.True(t, watching.Load(), "watcher should be active")
+
+		require.NoError(t, os.WriteFile(filepath.Join(h.ConfigFolder, "4.settings"), []byte("{}"), 0644))
+		select {
+		case <-ctx.Done():
+			assert.ErrorIs(t, context.Cause(ctx), errSuperseded)
+		case <-time.After(5 * time.Second):
+			t.Fatal("context was not cancelled by a newer settings file")
+		}
+	})
+
+	t.Run("WatcherUnavailable_ShouldFallBackToPolling", func(t *testing.T) {
+		origNewWatcher := newSequenceNumberWatcher
+		t.Cleanup(func() { newSequenceNumberWatcher = origNewWatcher })
+		newSequenceNumberWatcher = func(dirs ...string) (*seqno.Watcher, error) {
+			return nil, errors.New("inotify unavailable")
+		}
+
+		ctx, cancel := context.WithCancelCause(context.Background())
+		defer cancel(nil)
+		assert.False(t, watchForNewerConfiguration(ctx, cancel, lg, h, 3).Load())
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
+	"github.com/Azure/applicationhealth-extension-linux/internal/otlp"
+	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
+	"github.com/Azure/applicationhealth-extension-linux/pkg/logging"
+)
+
+// configureTelemetrySinks applies the telemetry settings: the rate limit of
+// similar events, the minimum level of the events and log sinks, the payload
+// format of the events sink, the local
+// JSON-lines file sink and the OTLP sink, which are only enabled when configured. It returns the OTLP exporter, if
+// any, which must be shut down to export the last events and metrics.
+func configureTelemetrySinks(h *handlerenv.HandlerEnvironment, s *telemetrySettings) (*otlp.Exporter, error) {
+	var sinks map[string]*telemetrySinkSettings
+	if s != nil {
+		sinks = s.Sinks
+		if s.RateLimit != nil {
+			limit := s.RateLimit.rateLimit()
+			telemetry.SetRateLimit(limit)
+			telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask, fmt.Sprintf("Telemetry rate limit is %s", limit))
+		}
+	}
+	for _, name := range []string{telemetry.EventsFolderSinkName, telemetry.LogSinkName} {
+		if c := sinks[name]; c != nil && c.MinLevel != "" {
+			telemetry.SetMinLevel(name, c.MinLevel)
+		}
+	}
+	if c := sinks[telemetry.EventsFolderSinkName]; c != nil && c.PayloadFormat != "" {
+		telemetry.SetPayloadFormat(c.PayloadFormat)
+		telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask,
+			fmt.Sprintf("Writing telemetry events to the events folder with the %s payload format", c.PayloadFormat))
+	}
+
+	if c := sinks[telemetry.JSONLinesSinkName]; c != nil {
+		minLevel := sinkMinLevel(c)
+		path := filepath.Join(h.LogFolder, TelemetryFileName)
+		f, err := logging.NewRotatingFile(path, TelemetryFileMaxSizeInBytes, TelemetryFileMaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open telemetry file %s: %w", path, err)
+		}
+		telemetry.AddSink(telemetry.NewJSONLinesSink(f), minLevel)
+		telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask,
+			fmt.Sprintf("Writing telemetry events at or above %s to %s", minLevel, path))
+	}
+
+	c := sinks[otlp.SinkName]
+	if c == nil {
+		return nil, nil
+	}
+	minLevel := sinkMinLevel(c)
+	e, err := otlp.New(otlp.Config{
+		Endpoint:       c.Endpoint,
+		ExportInterval: time.Duration(c.ExportIntervalInSeconds) * time.Second,
+		ServiceName:    OTLPServiceName,
+		ServiceVersion: GetExtensionVersion(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure OTLP export: %w", err)
+	}
+	telemetry.AddSink(e, minLevel)
+	telemetry.SendEvent(telemetry.InfoEvent, telemetry.AppHealthTask,
+		fmt.Sprintf("Exporting health metrics and telemetry events at or above %s to %s", minLevel, c.Endpoint))
+	return e, nil
+}
+
+func sinkMinLevel(c *telemetrySinkSettings) telemetry.EventLevel {
+	if c.MinLevel == "" {
+		return telemetry.VerboseEvent
+	}
+	return c.MinLevel
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
+	"github.com/Azure/applicationhealth-extension-linux/internal/state"
+	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
+	"github.com/Azure/azure-extension-platform/pkg/extensionerrors"
+	"github.com/pkg/errors"
+)
+
+const (
+	// UpdatingFromVersionVariableName is set by the guest agent when it invokes the
+	// update command of the new extension version, and holds the version being replaced.
+	UpdatingFromVersionVariableName = "AZURE_GUEST_AGENT_UPDATING_FROM_VERSION"
+
+	// mrseqFileName is the file, next to the extension binary, holding the most
+	// recently processed sequence number.
+	mrseqFileName = "mrseq"
+
+	// stagedStateDirName is the folder in the new extension directory that update
+	// copies migrated state to. The old version's uninstall runs after update and
+	// removes dataDir, so install restores the staged state from here.
+	stagedStateDirName = "staged-state"
+
+	extensionStateFileName      = "extension.json"
+	extensionStateSchemaVersion = 1
+)
+
+// extensionState records which extension version last owned dataDir.
+type extensionState struct {
+	PreviousVersion string `json:"previousVersion,omitempty"`
+}
+
+// stateMigration describes a version-tagged state file persisted under dataDir.
+type stateMigration struct {
+	fileName      string
+	schemaVersion int
+	// migrate upgrades a payload written with an older schema version to the
+	// current one. Files without a migrate function are discarded when their
+	// schema version does not match.
+	migrate func(fromVersion int, data json.RawMessage) (json.RawMessage, error)
+}
+
+// stateMigrations lists every state file the extension persists under dataDir.
+// New state files must be registered here so that update knows how to carry them
+// across extension versions.
+var stateMigrations = []stateMigration{
+	{fileName: extensionStateFileName, schemaVersion: extensionStateSchemaVersion},
+	{fileName: vmWatchRetryStateFileName, schemaVersion: vmWatchRetryStateSchemaVersion},
+}
+
+type migrationOutcome string
+
+const (
+	migrationKept      migrationOutcome = "kept"
+	migrationMigrated  migrationOutcome = "migrated"
+	migrationDiscarded migrationOutcome = "discarded"
+)
+
+// getStagedStateDir returns the folder used to hand migrated state from update to
+// install. It is a variable to allow overriding in tests.
+var getStagedStateDir = func() (string, error) {
+	processDirectory, err := GetProcessDirectory()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(processDirectory), stagedStateDirName), nil
+}
+
+func update(ctx context.Context, lg *slog.Logger, h *handlerenv.HandlerEnvironment, seqNum uint) (string, error) {
+	currentVersion, err := GetExtensionManifestVersion()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to determine extension version")
+	}
+	previousVersion := detectPreviousVersion()
+	telemetry.SendEvent(telemetry.InfoEvent, telemetry.UpdateTask,
+		fmt.Sprintf("Updating extension from version '%s' to version '%s'", previousVersion, currentVersion),
+		"previousVersion", previousVersion, "currentVersion", currentVersion)
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return "", errors.Wrap(err, "failed to create data dir")
+	}
+
+	if previousVersion != "" && previousVersion != currentVersion {
+		if err := migrateSequenceNumber(previousVersion, currentVersion); err != nil {
+			telemetry.SendEvent(telemetry.WarningEvent, telemetry.UpdateTask,
+				fmt.Sprintf("Failed to migrate sequence number from version %s: %v", previousVersion, err), "error", err)
+		}
+	}
+
+	outcomes := migrateStateFiles(dataDir, currentVersion)
+
+	if err := recordExtensionVersion(currentVersion, previousVersion); err != nil {
+		return "", errors.Wrap(err, "failed to record extension version in data dir")
+	}
+
+	if err := stageState(dataDir); err != nil {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.UpdateTask,
+			fmt.Sprintf("Failed to stage migrated state for install: %v", err), "error", err)
+	}
+
+	msg := fmt.Sprintf("Migrated state from version '%s' to version '%s': %s", previousVersion, currentVersion, formatMigrationOutcomes(outcomes))
+	telemetry.SendEvent(telemetry.InfoEvent, telemetry.UpdateTask, msg,
+		"previousVersion", previousVersion, "currentVersion", currentVersion, "outcomes", outcomes)
+	return msg, nil
+}
+
+// detectPreviousVersion returns the version of the extension being replaced. The
+// guest agent provides it through the environment; if it is missing, the version
+// recorded in dataDir by the previous install or update is used instead.
+func detectPreviousVersion() string {
+	if v := strings.TrimSpace(os.Getenv(UpdatingFromVersionVariableName)); v != "" {
+		return v
+	}
+	d, err := state.Read(filepath.Join(dataDir, extensionStateFileName))
+	if err != nil {
+		return ""
+	}
+	return d.ExtensionVersion
+}
+
+// recordExtensionVersion marks dataDir as owned by the current extension version,
+// so that a later update can tell which version wrote the state it finds there.
+func recordExtensionVersion(currentVersion, previousVersion string) error {
+	return state.Write(filepath.Join(dataDir, extensionStateFileName), extensionStateSchemaVersion, currentVersion,
+		extensionState{PreviousVersion: previousVersion})
+}
+
+// previousExtensionDir derives the directory of the previous extension version
+// from the current one, relying on the guest agent's <name>-<version> layout.
+func previousExtensionDir(extensionDir, currentVersion, previousVersion string) (string, error) {
+	base := filepath.Base(extensionDir)
+	if !strings.HasSuffix(base, "-"+currentVersion) {
+		return "", fmt.Errorf("extension directory %s does not end with version %s", extensionDir, currentVersion)
+	}
+	return filepath.Join(filepath.Dir(extensionDir), strings.TrimSuffix(base, currentVersion)+previousVersion), nil
+}
+
+// migrateSequenceNumber carries the most recently processed sequence number over
+// from the previous version's directory, so that the new version does not
+// reprocess (or regress to) an older configuration.
+func migrateSequenceNumber(previousVersion, currentVersion string) error {
+	processDirectory, err := GetProcessDirectory()
+	if err != nil {
+		return err
+	}
+	return migrateSequenceNumberFrom(processDirectory, previousVersion, currentVersion)
+}
+
+func migrateSequenceNumberFrom(processDirectory, previousVersion, currentVersion string) error {
+	if _, err := seqnoManager.GetSequenceNumber(fullName, ""); err == nil {
+		telemetry.SendEvent(telemetry.InfoEvent, telemetry.UpdateTask, "Sequence number already present for the current version, not migrating")
+		return nil
+	} else if err != extensionerrors.ErrNoMrseqFile && err != extensionerrors.ErrNotFound {
+		return errors.Wrap(err, "failed to read current sequence number")
+	}
+
+	oldExtensionDir, err := previousExtensionDir(filepath.Dir(processDirectory), currentVersion, previousVersion)
+	if err != nil {
+		return err
+	}
+	oldMrseqPath := filepath.Join(oldExtensionDir, filepath.Base(processDirectory), mrseqFileName)
+	b, err := os.ReadFile(oldMrseqPath)
+	if os.IsNotExist(err) {
+		telemetry.SendEvent(telemetry.InfoEvent, telemetry.UpdateTask,
+			fmt.Sprintf("No sequence number found for previous version at %s", oldMrseqPath))
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to read %s", oldMrseqPath)
+	}
+
+	seqNum, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "invalid sequence number in %s", oldMrseqPath)
+	}
+	if err := seqnoManager.SetSequenceNumber(fullName, "", uint(seqNum)); err != nil {
+		return errors.Wrap(err, "failed to save sequence number")
+	}
+	telemetry.SendEvent(telemetry.InfoEvent, telemetry.UpdateTask,
+		fmt.Sprintf("Migrated sequence number %d from %s", seqNum, oldMrseqPath))
+	return nil
+}
+
+// migrateStateFiles brings every registered state file in dir to its current
+// schema version. Files that cannot be migrated (corrupt, written by a newer
+// version, or with no migration path) are discarded so that the new version
+// starts from a clean state rather than misinterpreting them.
+func migrateStateFiles(dir, currentVersion string) map[string]migrationOutcome {
+	outcomes := map[string]migrationOutcome{}
+	for _, m := range stateMigrations {
+		path := filepath.Join(dir, m.fileName)
+		outcome, err := migrateStateFile(path, currentVersion, m)
+		if err == state.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			telemetry.SendEvent(telemetry.WarningEvent, telemetry.UpdateTask,
+				fmt.Sprintf("Discarding state file %s: %v", m.fileName, err), "file", m.fileName, "error", err)
+			if rmErr := os.Remove(path); rmErr != nil && !os.IsNotExist(rmErr) {
+				telemetry.SendEvent(telemetry.ErrorEvent, telemetry.UpdateTask,
+					fmt.Sprintf("Failed to remove state file %s: %v", m.fileName, rmErr), "file", m.fileName, "error", rmErr)
+			}
+			outcome = migrationDiscarded
+		}
+		outcomes[m.fileName] = outcome
+	}
+	return outcomes
+}
+
+func migrateStateFile(path, currentVersion string, m stateMigration) (migrationOutcome, error) {
+	d, err := state.Read(path)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case d.SchemaVersion == m.schemaVersion:
+		return migrationKept, nil
+	case d.SchemaVersion > m.schemaVersion:
+		return "", fmt.Errorf("schema version %d is newer than supported version %d", d.SchemaVersion, m.schemaVersion)
+	case m.migrate == nil:
+		return "", fmt.Errorf("no migration from schema version %d to %d", d.SchemaVersion, m.schemaVersion)
+	}
+
+	data, err := m.migrate(d.SchemaVersion, d.Data)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to migrate from schema version %d", d.SchemaVersion)
+	}
+	if err := state.WriteDocument(path, &state.Document{SchemaVersion: m.schemaVersion, ExtensionVersion: currentVersion, Data: data}); err != nil {
+		return "", err
+	}
+	return migrationMigrated, nil
+}
+
+// stageState copies the registered state files from dir into the staged state
+// folder of the new extension directory.
+func stageState(dir string) error {
+	stagedDir, err := getStagedStateDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stagedDir, 0755); err != nil {
+		return err
+	}
+	return copyStateFiles(dir, stagedDir, true)
+}
+
+// restoreStagedState moves state staged by update into dir, without overwriting
+// files already present there, and removes the staged state folder.
+func restoreStagedState(dir string) error {
+	stagedDir, err := getStagedStateDir()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(stagedDir); os.IsNotExist(err) {
+		return nil
+	}
+	if err := copyStateFiles(stagedDir, dir, false); err != nil {
+		return err
+	}
+	telemetry.SendEvent(telemetry.InfoEvent, telemetry.UpdateTask, "Restored state staged by update", "path", stagedDir)
+	return os.RemoveAll(stagedDir)
+}
+
+// copyStateFiles copies the registered state files present in srcDir to dstDir.
+func copyStateFiles(srcDir, dstDir string, overwrite bool) error {
+	for _, m := range stateMigrations {
+		dst := filepath.Join(dstDir, m.fileName)
+		if _, err := os.Stat(dst); err == nil && !overwrite {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(srcDir, m.fileName))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := os.WriteFile(dst, b, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatMigrationOutcomes(outcomes map[string]migrationOutcome) string {
+	if len(outcomes) == 0 {
+		return "no state to migrate"
+	}
+	var parts []string
+	for _, m := range stateMigrations {
+		if o, ok := outcomes[m.fileName]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%s", m.fileName, o))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/seqno"
+	"github.com/Azure/applicationhealth-extension-linux/internal/state"
+	"github.com/Azure/azure-extension-platform/pkg/extensionerrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+// setupUpdateTest points dataDir and the staged state folder at temporary
+// directories and restores the originals after the test.
+func setupUpdateTest(t *testing.T) (string, string) {
+	origDataDir, origGetStagedStateDir, origVersion := dataDir, getStagedStateDir, Version
+	t.Cleanup(func() {
+		dataDir, getStagedStateDir, Version = origDataDir, origGetStagedStateDir, origVersion
+	})
+
+	dataDir = filepath.Join(t.TempDir(), "apphealth")
+	stagedDir := filepath.Join(t.TempDir(), stagedStateDirName)
+	getStagedStateDir = func() (string, error) { return stagedDir, nil }
+	return dataDir, stagedDir
+}
+
+// registerTestStateMigration adds a state file to the migration registry for
+// the duration of the test.
+func registerTestStateMigration(t *testing.T, m stateMigration) {
+	orig := stateMigrations
+	t.Cleanup(func() { stateMigrations = orig })
+	stateMigrations = append(append([]stateMigration{}, orig...), m)
+}
+
+func Test_previousExtensionDir(t *testing.T) {
+	dir, err := previousExtensionDir("/var/lib/waagent/Microsoft.ManagedServices.ApplicationHealthLinux-2.0.14", "2.0.14", "2.0.13")
+	require.NoError(t, err)
+	assert.Equal(t, "/var/lib/waagent/Microsoft.ManagedServices.ApplicationHealthLinux-2.0.13", dir)
+
+	_, err = previousExtensionDir("/var/lib/waagent/Extension", "2.0.14", "2.0.13")
+	assert.Error(t, err, "should fail when the directory does not follow the <name>-<version> layout")
+}
+
+func Test_migrateStateFiles(t *testing.T) {
+	dir, _ := setupUpdateTest(t)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+
+	type counterV2 struct {
+		Total int `json:"total"`
+	}
+	registerTestStateMigration(t, stateMigration{
+		fileName:      "counter.json",
+		schemaVersion: 2,
+		migrate: func(fromVersion int, data json.RawMessage) (json.RawMessage, error) {
+			var v1 struct {
+				Count int `json:"count"`
+			}
+			if err := json.Unmarshal(data, &v1); err != nil {
+				return nil, err
+			}
+			return json.Marshal(counterV2{Total: v1.Count})
+		},
+	})
+	registerTestStateMigration(t, stateMigration{fileName: "nomigration.json", schemaVersion: 3})
+	registerTestStateMigration(t, stateMigration{fileName: "newer.json", schemaVersion: 1})
+	registerTestStateMigration(t, stateMigration{fileName: "corrupt.json", schemaVersion: 1})
+	registerTestStateMigration(t, stateMigration{fileName: "missing.json", schemaVersion: 1})
+
+	require.NoError(t, state.Write(filepath.Join(dir, extensionStateFileName), extensionStateSchemaVersion, "2.0.13", extensionState{}))
+	require.NoError(t, state.Write(filepath.Join(dir, "counter.json"), 1, "2.0.13", map[string]int{"count": 7}))
+	require.NoError(t, state.Write(filepath.Join(dir, "nomigration.json"), 2, "2.0.13", map[string]int{}))
+	require.NoError(t, state.Write(filepath.Join(dir, "newer.json"), 2, "2.0.15", map[string]int{}))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "corrupt.json"), []byte("garbage"), 0644))
+
+	outcomes := migrateStateFiles(dir, "2.0.14")
+	assert.Equal(t, map[string]migrationOutcome{
+		extensionStateFileName: migrationKept,
+		"counter.json":         migrationMigrated,
+		"nomigration.json":     migrationDiscarded,
+		"newer.json":           migrationDiscarded,
+		"corrupt.json":         migrationDiscarded,
+	}, outcomes)
+
+	d, err := state.Read(filepath.Join(dir, "counter.json"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, d.SchemaVersion)
+	assert.Equal(t, "2.0.14", d.ExtensionVersion)
+	var migrated counterV2
+	require.NoError(t, d.Decode(&migrated))
+	assert.Equal(t, 7, migrated.Total)
+
+	for _, f := range []string{"nomigration.json", "newer.json", "corrupt.json"} {
+		assert.NoFileExists(t, filepath.Join(dir, f), "discarded state should be removed")
+	}
+}
+
+func Test_migrateSequenceNumber(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockSeqNumManager := seqno.NewMockSequenceNumberManager(ctrl)
+	origSeqnoManager := seqnoManager
+	t.Cleanup(func() { seqnoManager = origSeqnoManager })
+	seqnoManager = mockSeqNumManager
+
+	waagentDir := t.TempDir()
+	binDir := filepath.Join(waagentDir, "Microsoft.ManagedServices.ApplicationHealthLinux-2.0.14", "bin")
+	oldBinDir := filepath.Join(waagentDir, "Microsoft.ManagedServices.ApplicationHealthLinux-2.0.13", "bin")
+	require.NoError(t, os.MkdirAll(binDir, 0755))
+	require.NoError(t, os.MkdirAll(oldBinDir, 0755))
+
+	t.Run("CopiesPreviousSequenceNumber", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(oldBinDir, mrseqFileName), []byte("12"), 0644))
+		mockSeqNumManager.EXPECT().GetSequenceNumber(gomock.Any(), gomock.Any()).Return(uint(0), extensionerrors.ErrNoMrseqFile)
+		mockSeqNumManager.EXPECT().SetSequenceNumber(gomock.Any(), gomock.Any(), uint(12)).Return(nil)
+
+		require.NoError(t, migrateSequenceNumberFrom(binDir, "2.0.13", "2.0.14"))
+	})
+
+	t.Run("KeepsExistingSequenceNumber", func(t *testing.T) {
+		mockSeqNumManager.EXPECT().GetSequenceNumber(gomock.Any(), gomock.Any()).Return(uint(3), nil)
+
+		require.NoError(t, migrateSequenceNumberFrom(binDir, "2.0.13", "2.0.14"))
+	})
+
+	t.Run("NoPreviousSequenceNumber", func(t *testing.T) {
+		require.NoError(t, os.Remove(filepath.Join(oldBinDir, mrseqFileName)))
+		mockSeqNumManager.EXPECT().GetSequenceNumber(gomock.Any(), gomock.Any()).Return(uint(0), extensionerrors.ErrNoMrseqFile)
+
+		require.NoError(t, migrateSequenceNumberFrom(binDir, "2.0.13", "2.0.14"))
+	})
+
+	t.Run("InvalidPreviousSequenceNumber", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(oldBinDir, mrseqFileName), []byte("abc"), 0644))
+		mockSeqNumManager.EXPECT().GetSequenceNumber(gomock.Any(), gomock.Any()).Return(uint(0), extensionerrors.ErrNoMrseqFile)
+
+		err := migrateSequenceNumberFrom(binDir, "2.0.13", "2.0.14")
+		assert.ErrorContains(t, err, "invalid sequence number")
+	})
+}
+
+func Test_update(t *testing.T) {
+	dir, stagedDir := setupUpdateTest(t)
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	Version = "2.0.14"
+
+	t.Run("RecordsVersionAndStagesState", func(t *testing.T) {
+		// same version as the one being updated from, so the sequence number is left alone
+		t.Setenv(UpdatingFromVersionVariableName, "2.0.14")
+
+		msg, err := update(context.Background(), logger, nil, 0)
+		require.NoError(t, err)
+		assert.Contains(t, msg, "Migrated state from version '2.0.14' to version '2.0.14'")
+
+		d, err := state.Read(filepath.Join(dir, extensionStateFileName))
+		require.NoError(t, err)
+		assert.Equal(t, "2.0.14", d.ExtensionVersion)
+		assert.FileExists(t, filepath.Join(stagedDir, extensionStateFileName))
+	})
+
+	t.Run("DetectsPreviousVersionFromDataDir", func(t *testing.T) {
+		t.Setenv(UpdatingFromVersionVariableName, "")
+		require.NoError(t, state.Write(filepath.Join(dir, extensionStateFileName), extensionStateSchemaVersion, "2.0.14", extensionState{}))
+
+		assert.Equal(t, "2.0.14", detectPreviousVersion())
+	})
+}
+
+func Test_restoreStagedState(t *testing.T) {
+	dir, stagedDir := setupUpdateTest(t)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+
+	// nothing staged is not an error
+	require.NoError(t, restoreStagedState(dir))
+
+	require.NoError(t, os.MkdirAll(stagedDir, 0755))
+	require.NoError(t, state.Write(filepath.Join(stagedDir, extensionStateFileName), extensionStateSchemaVersion, "2.0.14",
+		extensionState{PreviousVersion: "2.0.13"}))
+
+	require.NoError(t, restoreStagedState(dir))
+
+	d, err := state.Read(filepath.Join(dir, extensionStateFileName))
+	require.NoError(t, err)
+	var s extensionState
+	require.NoError(t, d.Decode(&s))
+	assert.Equal(t, "2.0.13", s.PreviousVersion)
+	assert.NoDirExists(t, stagedDir, "staged state should be removed once restored")
+}
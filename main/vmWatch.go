@@ -1,9 +1,11 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -14,6 +16,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/Azure/applicationhealth-extension-linux/internal/cgroupusage"
 	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
 	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
 	"github.com/Azure/applicationhealth-extension-linux/pkg/redact"
@@ -29,6 +32,10 @@ const (
 	DefaultMaxCpuPercentage = 1         // 1% cpu
 	DefaultMaxMemoryInBytes = 200000000 // 200MB
 	CGroupV2PeriodMs        = 1000000   // 1 second
+
+	// vmWatchShutdownTimeout bounds how long enable waits for VMWatch to be
+	// killed when it returns.
+	vmWatchShutdownTimeout = 10 * time.Second
 )
 
 const (
@@ -82,6 +89,55 @@ type RetryConfig struct {
 	MaxCycles        int
 	AttemptsPerCycle int
 	BaseWaitHours    int
+	Backoff          BackoffStrategy
+}
+
+// BackoffStrategy selects how the wait between retry cycles grows.
+type BackoffStrategy string
+
+const (
+	// LinearBackoff waits BaseWaitHours times the number of the failed cycle.
+	LinearBackoff BackoffStrategy = "linear"
+	// ExponentialBackoff doubles the wait after every failed cycle, starting from
+	// BaseWaitHours and capped at VMWatchMaxBackoffHours, and picks a random wait
+	// between half and all of it so that VMs do not retry in lockstep.
+	ExponentialBackoff BackoffStrategy = "exponential"
+)
+
+// randInt63n returns a random number in [0, n). It is a variable to allow
+// overriding in tests.
+var randInt63n = rand.Int63n
+
+func (c RetryConfig) String() string {
+	backoff := c.Backoff
+	if backoff == "" {
+		backoff = LinearBackoff
+	}
+	return fmt.Sprintf("%d cycles of %d attempts, %s backoff from %d hours", c.MaxCycles, c.AttemptsPerCycle, backoff, c.BaseWaitHours)
+}
+
+// backoff returns how long to wait after retry cycle failed.
+func (c RetryConfig) backoff(cycle int) time.Duration {
+	base := time.Duration(c.BaseWaitHours) * time.Hour
+	if c.Backoff != ExponentialBackoff {
+		return base * time.Duration(cycle)
+	}
+	wait := time.Duration(VMWatchMaxBackoffHours) * time.Hour
+	if cycle-1 < 32 && base<<(cycle-1) < wait {
+		wait = base << (cycle - 1)
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + time.Duration(randInt63n(int64(wait/2)+1))
+}
+
+// formatWait formats a backoff wait, in whole hours when possible.
+func formatWait(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return fmt.Sprintf("%d hours", d/time.Hour)
+	}
+	return d.Round(time.Minute).String()
 }
 
 // RetryResult holds the result of a retry operation
@@ -93,38 +149,71 @@ type RetryResult struct {
 }
 
 // HelperFunc defines the signature for the function that performs each attempt
-type HelperFunc func(lg *slog.Logger, attempt int, s *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment) error
+type HelperFunc func(ctx context.Context, lg *slog.Logger, attempt int, s *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment) error
 
-// SleepFunc defines the signature for sleep function (for testing)
-type SleepFunc func(time.Duration)
+// SleepFunc defines the signature for sleep function (for testing). It returns
+// early when ctx is cancelled.
+type SleepFunc func(ctx context.Context, d time.Duration)
 
-// ShutdownFunc defines the signature for checking shutdown status
-type ShutdownFunc func() bool
+// sleepContext waits for d to elapse or ctx to be cancelled, whichever comes first.
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
 
-// executeRetryLogic contains the core retry logic extracted for testability
+// executeRetryLogic contains the core retry logic extracted for testability.
+// Cancelling ctx stops further attempts and interrupts the backoff sleep.
 func executeRetryLogic(
+	ctx context.Context,
 	lg *slog.Logger,
 	s *vmWatchSettings,
 	hEnv *handlerenv.HandlerEnvironment,
 	config RetryConfig,
 	helperFunc HelperFunc,
 	sleepFunc SleepFunc,
-	shutdownFunc ShutdownFunc,
 	resultChannel chan<- VMWatchResult,
 ) RetryResult {
 	var lastErr error
-	startCycle, totalAttempts := getVMWatchRetryCounters()
+	retry := getVMWatchRetryState()
+	totalAttempts := retry.TotalAttempts
+
+	if retry.Cycle > config.MaxCycles {
+		lastErr = fmt.Errorf("VMWatch retries were exhausted after %d attempts, last failure at %v",
+			retry.TotalAttempts, retry.LastFailure.UTC().Format(time.RFC3339))
+		if resultChannel != nil {
+			resultChannel <- VMWatchResult{Status: Failed, Error: lastErr}
+		}
+		return RetryResult{TotalAttempts: totalAttempts, CyclesRun: config.MaxCycles, LastError: lastErr}
+	}
+
+	// Honour the backoff window of a previous run of the extension
+	if wait := time.Until(retry.NextEligible); wait > 0 {
+		lastErr = fmt.Errorf("VMWatch failed at %v, waiting until %v before cycle %d",
+			retry.LastFailure.UTC().Format(time.RFC3339), retry.NextEligible.UTC().Format(time.RFC3339), retry.Cycle)
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.StartVMWatchTask, lastErr.Error())
+		if resultChannel != nil {
+			resultChannel <- VMWatchResult{Status: Failed, Error: lastErr}
+		}
+		sleepFunc(ctx, wait)
+	}
 
-	for retryCycle := startCycle; retryCycle <= config.MaxCycles && !shutdownFunc(); retryCycle++ {
+	for retryCycle := retry.Cycle; retryCycle <= config.MaxCycles && ctx.Err() == nil; retryCycle++ {
 		telemetry.SendEvent(telemetry.InfoEvent, telemetry.StartVMWatchTask, fmt.Sprintf("Starting VMWatch retry cycle %d of %d", retryCycle, config.MaxCycles))
+		metrics.recordVMWatchRetryCycle(retryCycle)
 
-		// Attempt to start VMWatch process up to AttemptsPerCycle times within this cycle
-		for attempt := 1; attempt <= config.AttemptsPerCycle && !shutdownFunc(); attempt++ {
+		// Attempt to start VMWatch process up to AttemptsPerCycle times within this cycle,
+		// resuming the attempts already made in this cycle by a previous run
+		for attempt := retry.CycleAttempts + 1; attempt <= config.AttemptsPerCycle && ctx.Err() == nil; attempt++ {
 			if resultChannel != nil {
 				resultChannel <- VMWatchResult{Status: Running}
 			}
 			totalAttempts++
-			lastErr = helperFunc(lg, attempt, s, hEnv)
+			resets := getVMWatchRetryResets()
+			lastErr = helperFunc(ctx, lg, attempt, s, hEnv)
 			if resultChannel != nil {
 				resultChannel <- VMWatchResult{Status: Failed, Error: lastErr}
 			}
@@ -138,18 +227,51 @@ func executeRetryLogic(
 					Success:       true,
 				}
 			}
+
+			// Retrying cannot fix a configuration error or a failed integrity check
+			if reason := vmWatchExitReason(lastErr); reason.permanent() {
+				msg := "VMWatch cannot run with the current settings, not retrying until the settings change"
+				if reason == ExitReasonIntegrityError {
+					msg = "VMWatch files failed integrity verification, not retrying"
+				}
+				telemetry.SendEvent(telemetry.WarningEvent, telemetry.StartVMWatchTask, msg)
+				return RetryResult{
+					TotalAttempts: totalAttempts,
+					CyclesRun:     retryCycle,
+					LastError:     lastErr,
+					Success:       false,
+				}
+			}
+
+			// An attempt stopped by shutdown is not a VMWatch failure
+			if ctx.Err() == nil {
+				if getVMWatchRetryResets() != resets {
+					// The counters were reset while VMWatch ran successfully for long
+					// enough, so this failure is the first of a new retry budget
+					retryCycle, attempt, totalAttempts = 1, 1, 1
+				}
+				retry = vmWatchRetryState{Cycle: retryCycle, CycleAttempts: attempt, TotalAttempts: totalAttempts, LastFailure: time.Now()}
+				setVMWatchRetryState(retry)
+			}
+		}
+		if ctx.Err() != nil {
+			break
 		}
 
-		// Update retry state for this cycle
-		updateVMWatchRetryCounters(retryCycle, totalAttempts)
+		// Move on to the next cycle, which may only start after the backoff window
+		retry = vmWatchRetryState{Cycle: retryCycle + 1, TotalAttempts: totalAttempts, LastFailure: retry.LastFailure}
 
 		// If this is not the last retry cycle, wait with progressive backoff
-		if retryCycle < config.MaxCycles && !shutdownFunc() {
-			waitHours := config.BaseWaitHours * retryCycle
-			errMsg := fmt.Sprintf("VMWatch cycle %d reached max %d attempts, sleeping for %d hours before cycle %d",
-				retryCycle, config.AttemptsPerCycle, waitHours, retryCycle+1)
+		if retryCycle < config.MaxCycles {
+			wait := config.backoff(retryCycle)
+			retry.NextEligible = time.Now().Add(wait)
+			setVMWatchRetryState(retry)
+			errMsg := fmt.Sprintf("VMWatch cycle %d reached max %d attempts, sleeping for %s before cycle %d",
+				retryCycle, config.AttemptsPerCycle, formatWait(wait), retryCycle+1)
 			telemetry.SendEvent(telemetry.ErrorEvent, telemetry.StartVMWatchTask, errMsg)
-			sleepFunc(time.Hour * time.Duration(waitHours))
+			sleepFunc(ctx, wait)
+		} else {
+			setVMWatchRetryState(retry)
 		}
 	}
 
@@ -161,7 +283,10 @@ func executeRetryLogic(
 	}
 }
 
-func executeVMWatch(lg *slog.Logger, s *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment, vmWatchResultChannel chan VMWatchResult) {
+// executeVMWatch runs VMWatch with retries until it succeeds, the retries are
+// exhausted or ctx is cancelled, in which case the running VMWatch process is
+// killed. vmWatchResultChannel is closed when it returns.
+func executeVMWatch(ctx context.Context, lg *slog.Logger, s *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment, vmWatchResultChannel chan VMWatchResult) {
 	var vmWatchErr error
 	defer func() {
 		if r := recover(); r != nil {
@@ -172,30 +297,30 @@ func executeVMWatch(lg *slog.Logger, s *vmWatchSettings, hEnv *handlerenv.Handle
 		close(vmWatchResultChannel)
 	}()
 
-	config := RetryConfig{
-		MaxCycles:        VMWatchMaxRetryCycles,
-		AttemptsPerCycle: VMWatchMaxProcessAttempts,
-		BaseWaitHours:    VMWatchBaseWaitHours,
-	}
+	// scopes and cgroups of a previous extension process that did not shut down
+	// cleanly would otherwise keep accumulating
+	reapVMWatchCgroups()
+	loadVMWatchRetryState(s)
+	config := s.retryConfig()
+	telemetry.SendEvent(telemetry.InfoEvent, telemetry.StartVMWatchTask, fmt.Sprintf("VMWatch %s", s.policyDescription()))
 
 	result := executeRetryLogic(
-		lg, s, hEnv, config,
-		executeVMWatchHelper,            // HelperFunc
-		time.Sleep,                      // SleepFunc
-		func() bool { return shutdown }, // ShutdownFunc
+		ctx, lg, s, hEnv, config,
+		executeVMWatchHelper, // HelperFunc
+		sleepContext,         // SleepFunc
 		vmWatchResultChannel,
 	)
 
 	vmWatchErr = result.LastError
-	if !result.Success && !shutdown {
-		finalErrMsg := fmt.Sprintf("VMWatch exhausted all %d retry cycles with %d attempts each. No more retries until machine reboot or AppHealth restart.",
-			VMWatchMaxRetryCycles, VMWatchMaxProcessAttempts)
+	if !result.Success && ctx.Err() == nil && !vmWatchExitReason(vmWatchErr).permanent() {
+		finalErrMsg := fmt.Sprintf("VMWatch exhausted all %d retry cycles with %d attempts each. No more retries until the VMWatch settings change.",
+			config.MaxCycles, config.AttemptsPerCycle)
 		telemetry.SendEvent(telemetry.ErrorEvent, telemetry.StartVMWatchTask, finalErrMsg)
 		vmWatchErr = fmt.Errorf("%s Last error: %w", finalErrMsg, vmWatchErr)
 	}
 }
 
-func executeVMWatchHelper(lg *slog.Logger, attempt int, vmWatchSettings *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment) (err error) {
+func executeVMWatchHelper(ctx context.Context, lg *slog.Logger, attempt int, vmWatchSettings *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment) (err error) {
 	pid := -1
 	defer func() {
 		if r := recover(); r != nil {
@@ -204,12 +329,30 @@ func executeVMWatchHelper(lg *slog.Logger, attempt int, vmWatchSettings *vmWatch
 		}
 	}()
 
+	// Verify the VMWatch binary and config have not been tampered with before running them
+	err = verifyVMWatchFiles()
+	if errors.Is(err, errVMWatchManifestMissing) && vmWatchSettings.AllowMissingChecksumManifest {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.SetupVMWatchTask,
+			fmt.Sprintf("Attempt %d: %v, launching VMWatch as allowMissingChecksumManifest is set", attempt, err))
+		err = nil
+	}
+	if err != nil {
+		err = &VMWatchExitError{
+			Reason: ExitReasonIntegrityError,
+			Err:    fmt.Errorf("[%v][PID -1] Attempt %d: VMWatch integrity verification failed (%s). Error: %w", time.Now().UTC().Format(time.RFC3339), attempt, ExitReasonIntegrityError, err),
+		}
+		telemetry.SendEvent(telemetry.ErrorEvent, telemetry.SetupVMWatchTask, err.Error(), "exitReason", ExitReasonIntegrityError)
+		return err
+	}
+
 	// Setup command
-	var resourceGovernanceRequired bool
-	vmWatchCommand, resourceGovernanceRequired, err = setupVMWatchCommand(vmWatchSettings, hEnv)
+	vmWatchCommand, run, err := setupVMWatchCommand(vmWatchSettings, hEnv)
 	if err != nil {
-		err = fmt.Errorf("[%v][PID -1] Attempt %d: VMWatch setup failed. Error: %w", time.Now().UTC().Format(time.RFC3339), attempt, err)
-		telemetry.SendEvent(telemetry.ErrorEvent, telemetry.SetupVMWatchTask, err.Error())
+		err = &VMWatchExitError{
+			Reason: ExitReasonConfigError,
+			Err:    fmt.Errorf("[%v][PID -1] Attempt %d: VMWatch setup failed (%s). Error: %w", time.Now().UTC().Format(time.RFC3339), attempt, ExitReasonConfigError, err),
+		}
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.SetupVMWatchTask, err.Error(), "exitReason", ExitReasonConfigError)
 		return err
 	}
 
@@ -219,33 +362,53 @@ func executeVMWatchHelper(lg *slog.Logger, attempt int, vmWatchSettings *vmWatch
 		fmt.Sprintf("Attempt %d: Setup VMWatch command: %s\nArgs: %v\nDir: %s\nEnv: %v\n",
 			attempt, vmWatchCommand.Path, redact.Slice(vmWatchCommand.Args), vmWatchCommand.Dir, redact.Slice(vmWatchCommand.Env)),
 	)
-	// TODO: Combined output may get excessively long, especially since VMWatch is a long running process
-	// We should trim the output or only get from Stderr
-	combinedOutput := &bytes.Buffer{}
+	rotateVMWatchLog(hEnv)
+	combinedOutput := newVMWatchOutputCapture(hEnv)
+	defer combinedOutput.Close()
 	vmWatchCommand.Stdout = combinedOutput
 	vmWatchCommand.Stderr = combinedOutput
 	vmWatchCommand.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
 
 	// Start command
 	if err := vmWatchCommand.Start(); err != nil {
-		err = fmt.Errorf("[%v][PID -1] Attempt %d: VMWatch failed to start. Error: %w\nOutput: %s", time.Now().UTC().Format(time.RFC3339), attempt, err, redact.Text(combinedOutput.String()))
+		err = fmt.Errorf("[%v][PID -1] Attempt %d: VMWatch failed to start. Error: %w\nOutput: %s", time.Now().UTC().Format(time.RFC3339), attempt, err, errorOutput(combinedOutput.Tail()))
 		telemetry.SendEvent(telemetry.ErrorEvent, telemetry.StartVMWatchTask, err.Error(), "error", err)
 		return err
 	}
 	pid = vmWatchCommand.Process.Pid // cmd.Process should be populated on success
+	metrics.recordVMWatchStart()
+	// remove the scope or cgroup once the process has exited and its resource usage was sampled for the last time
+	defer run.cleanup()
 
 	telemetry.SendEvent(telemetry.InfoEvent, telemetry.StartVMWatchTask, fmt.Sprintf("Attempt %d: Started VMWatch with PID %d", attempt, pid))
-	if !resourceGovernanceRequired {
+	if run.Scope != "" {
 		telemetry.SendEvent(telemetry.InfoEvent, telemetry.StartVMWatchTask, fmt.Sprintf("Resource governance was already applied at process launch of PID %d", pid))
 	} else {
-		err = applyResourceGovernance(lg, vmWatchSettings, vmWatchCommand)
+		run.Group, run.V1, err = applyResourceGovernance(lg, vmWatchSettings, vmWatchCommand)
 		if err != nil {
 			// if this has failed we have already killed the process as we failed to assign to cgroup so log the appropriate error
-			err = fmt.Errorf("[%v][PID %d] Attempt %d: VMWatch process exited. Error: %w\nOutput: %s", time.Now().UTC().Format(time.RFC3339), pid, attempt, err, redact.Text(combinedOutput.String()))
+			err = fmt.Errorf("[%v][PID %d] Attempt %d: VMWatch process exited. Error: %w\nOutput: %s", time.Now().UTC().Format(time.RFC3339), pid, attempt, err, errorOutput(combinedOutput.Tail()))
 			telemetry.SendEvent(telemetry.ErrorEvent, telemetry.StopVMWatchTask, err.Error(), "error", err)
 			return err
 		}
 	}
+	if err = verifyVMWatchResourceGovernance(lg, vmWatchSettings, vmWatchCommand, run); err != nil {
+		// the process was killed as it is not governed as configured
+		err = fmt.Errorf("[%v][PID %d] Attempt %d: VMWatch process exited. Error: %w\nOutput: %s", time.Now().UTC().Format(time.RFC3339), pid, attempt, err, errorOutput(combinedOutput.Tail()))
+		telemetry.SendEvent(telemetry.ErrorEvent, telemetry.StopVMWatchTask, err.Error(), "error", err)
+		return err
+	}
+
+	// sample the resource usage of the VMWatch cgroup until the process exits
+	setVMWatchResourceUsage(nil)
+	setVMWatchHeartbeat(nil)
+	stopResourceMonitor := make(chan struct{})
+	resourceMonitorDone := make(chan struct{})
+	go func() {
+		defer close(resourceMonitorDone)
+		monitorResourceUsage(pid, VMWatchResourceUsageIntervalInSeconds*time.Second, stopResourceMonitor)
+	}()
+	go monitorVMWatchLog(hEnv, VMWatchVerboseLogRotationIntervalInSeconds*time.Second, stopResourceMonitor)
 
 	processDone := make(chan bool)
 
@@ -260,58 +423,116 @@ func executeVMWatchHelper(lg *slog.Logger, attempt int, vmWatchSettings *vmWatch
 		close(processDone)
 	}()
 	// add a task to monitor heartbeat (includes retry reset logic)
+	var killedBy VMWatchExitReason
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		monitorHeartBeat(lg, GetVMWatchHeartbeatFilePath(hEnv), processDone, vmWatchCommand, time.Now())
+		killedBy = monitorHeartBeat(ctx, lg, GetVMWatchHeartbeatFilePath(hEnv), vmWatchSettings.heartbeatTimeout(), processDone, vmWatchCommand, time.Now())
 	}()
 	wg.Wait()
-	err = fmt.Errorf("[%v][PID %d] Attempt %d: VMWatch process exited. Error: %w\nOutput: %s", time.Now().UTC().Format(time.RFC3339), pid, attempt, err, redact.Text(combinedOutput.String()))
-	telemetry.SendEvent(telemetry.ErrorEvent, telemetry.StopVMWatchTask, err.Error(), "error", err)
+	close(stopResourceMonitor)
+	<-resourceMonitorDone
+	combinedOutput.Flush()
+	exit := vmWatchExit{
+		WaitErr:            err,
+		KilledBy:           killedBy,
+		Usage:              getVMWatchResourceUsage(),
+		MemoryLimitInBytes: vmWatchSettings.MemoryLimitInBytes,
+		Output:             combinedOutput.Tail(),
+	}
+	reason := exit.classify()
+	err = &VMWatchExitError{
+		Reason: reason,
+		Err: fmt.Errorf("[%v][PID %d] Attempt %d: VMWatch process exited (%s). Error: %w\nOutput: %s",
+			time.Now().UTC().Format(time.RFC3339), pid, attempt, reason, err, errorOutput(exit.Output)),
+	}
+	level := telemetry.ErrorEvent
+	if reason == ExitReasonShutdown || reason == ExitReasonConfigError {
+		level = telemetry.WarningEvent
+	}
+	telemetry.SendEvent(level, telemetry.StopVMWatchTask, err.Error(),
+		telemetry.EventKindField, telemetry.VMWatchExitEventKind, telemetry.ErrorField, err, telemetry.ExitReasonField, reason,
+		telemetry.PIDField, pid, telemetry.AttemptField, attempt, telemetry.ExitCodeField, exit.exitCode())
 	return err
 }
 
 // Sets resource governance for VMWatch process, on linux, this is only to be used in the case where systemd-run is not available
-func applyResourceGovernance(lg *slog.Logger, vmWatchSettings *vmWatchSettings, vmWatchCommand *exec.Cmd) error {
+// It returns the cgroup the process was assigned to, which is returned even on failure so that it can be removed.
+func applyResourceGovernance(lg *slog.Logger, vmWatchSettings *vmWatchSettings, vmWatchCommand *exec.Cmd) (group string, v1 bool, err error) {
 	// The default way to run vmwatch is via systemd-run.  There are some cases where system-run is not available
 	// (in a container or in a distro without systemd).  In those cases we will manage the cgroups directly
 	pid := vmWatchCommand.Process.Pid
 	telemetry.SendEvent(telemetry.InfoEvent, telemetry.StartVMWatchTask, fmt.Sprintf("Applying resource governance to PID %d", pid))
-	err := createAndAssignCgroups(lg, vmWatchSettings, pid)
+	group, v1, err = createAndAssignCgroups(lg, vmWatchSettings, pid)
 	if err != nil {
 		err = fmt.Errorf("[%v][PID %d] Failed to assign VMWatch process to cgroup. Error: %w", time.Now().UTC().Format(time.RFC3339), pid, err)
 		telemetry.SendEvent(telemetry.ErrorEvent, telemetry.StartVMWatchTask, err.Error(), "error", err)
-		// On real VMs we want this to stop vwmwatch from running at all since we want to make sure we are protected
-		// by resource governance but on dev machines, we may fail due to limitations of execution environment (ie on dev container
-		// or in a github pipeline container we don't have permission to assign cgroups (also on WSL environments it doesn't
-		// work at all because the base OS doesn't support it)).
-		// to allow us to run integration tests we will check the variables RUNING_IN_DEV_CONTAINER and
-		// ALLOW_VMWATCH_GROUP_ASSIGNMENT_FAILURE and if they are both set we will just log and continue
-		// this allows us to test both cases
-		if os.Getenv(AllowVMWatchCgroupAssignmentFailureVariableName) == "" || os.Getenv(RunningInDevContainerVariableName) == "" {
-			lg.Info("Killing VMWatch process as cgroup assignment failed")
-			_ = killVMWatch(lg, vmWatchCommand)
-			return err
-		}
+		return group, v1, handleResourceGovernanceFailure(lg, vmWatchCommand, "cgroup assignment failed", err)
 	}
 
+	return group, v1, nil
+}
+
+// verifyVMWatchResourceGovernance checks that resource governance took effect for the VMWatch process, reporting the
+// limits in effect to telemetry. A process that is not governed as configured is handled like a failed cgroup assignment.
+func verifyVMWatchResourceGovernance(lg *slog.Logger, vmWatchSettings *vmWatchSettings, vmWatchCommand *exec.Cmd, run *vmWatchCgroup) error {
+	pid := vmWatchCommand.Process.Pid
+	limits, err := verifyResourceGovernance(pid, run, vmWatchSettings)
+	if err != nil {
+		err = fmt.Errorf("[%v][PID %d] Failed to verify resource governance of VMWatch process. Error: %w", time.Now().UTC().Format(time.RFC3339), pid, err)
+		telemetry.SendEvent(telemetry.ErrorEvent, telemetry.StartVMWatchTask, err.Error(), "error", err)
+		return handleResourceGovernanceFailure(lg, vmWatchCommand, "resource governance verification failed", err)
+	}
+	telemetry.SendEvent(telemetry.InfoEvent, telemetry.StartVMWatchTask,
+		fmt.Sprintf("Verified resource governance of VMWatch PID %d in %s: CPU quota %.2f%%, memory limit %d bytes", pid, run.name(), limits.CPUPercentage(), limits.MemoryMax),
+		"pid", pid, "cgroup", run.name(), "cpuQuotaPercentage", limits.CPUPercentage(), "memoryLimitBytes", limits.MemoryMax)
+	return nil
+}
+
+// handleResourceGovernanceFailure kills the VMWatch process and returns err, unless failing resource governance is allowed.
+func handleResourceGovernanceFailure(lg *slog.Logger, vmWatchCommand *exec.Cmd, reason string, err error) error {
+	// On real VMs we want this to stop vwmwatch from running at all since we want to make sure we are protected
+	// by resource governance but on dev machines, we may fail due to limitations of execution environment (ie on dev container
+	// or in a github pipeline container we don't have permission to assign cgroups (also on WSL environments it doesn't
+	// work at all because the base OS doesn't support it)).
+	// to allow us to run integration tests we will check the variables RUNING_IN_DEV_CONTAINER and
+	// ALLOW_VMWATCH_GROUP_ASSIGNMENT_FAILURE and if they are both set we will just log and continue
+	// this allows us to test both cases
+	if os.Getenv(AllowVMWatchCgroupAssignmentFailureVariableName) == "" || os.Getenv(RunningInDevContainerVariableName) == "" {
+		lg.Info(fmt.Sprintf("Killing VMWatch process as %s", reason))
+		_ = killVMWatch(lg, vmWatchCommand)
+		return err
+	}
 	return nil
 }
 
-func monitorHeartBeat(lg *slog.Logger, heartBeatFile string, processDone chan bool, cmd *exec.Cmd, startTime time.Time) {
-	maxTimeBetweenHeartBeatsInSeconds := 180
+// monitorHeartBeat kills the VMWatch process when it stops updating its heartbeat
+// file or when ctx is cancelled, and returns once the process has exited. The
+// returned reason is set if it killed the process.
+func monitorHeartBeat(ctx context.Context, lg *slog.Logger, heartBeatFile string, heartbeatTimeout time.Duration, processDone chan bool, cmd *exec.Cmd, startTime time.Time) (killedBy VMWatchExitReason) {
 	successThreshold := time.Hour // Same as Windows: 1 hour successful execution
 	retryResetDone := false       // Track if we've already reset for this process
 
-	ticker := time.NewTicker(time.Second * time.Duration(maxTimeBetweenHeartBeatsInSeconds))
+	heartbeat := &vmWatchHeartbeatReader{pid: cmd.Process.Pid, path: heartBeatFile}
+	ticker := time.NewTicker(heartbeatTimeout)
 	defer ticker.Stop()
 
+	done := ctx.Done()
 	for {
 		select {
+		case <-done:
+			// shutdown requested, kill the process and keep waiting for it to exit
+			done = nil
+			if err := killVMWatch(lg, cmd); err != nil {
+				telemetry.SendEvent(telemetry.ErrorEvent, telemetry.KillVMWatchTask, fmt.Sprintf("Error when killing vmwatch process, error: %s", err.Error()))
+			} else {
+				killedBy = ExitReasonShutdown
+			}
 		case <-ticker.C:
 			info, err := os.Stat(heartBeatFile)
-			if err == nil && time.Since(info.ModTime()).Seconds() < float64(maxTimeBetweenHeartBeatsInSeconds) {
+			if err == nil && time.Since(info.ModTime()) < heartbeatTimeout {
 				// heartbeat was updated - VMWatch is running successfully
+				heartbeat.read()
 
 				// Check if VMWatch has been running successfully for over an hour (same logic as Windows)
 				if !retryResetDone && time.Since(startTime) >= successThreshold {
@@ -323,13 +544,15 @@ func monitorHeartBeat(lg *slog.Logger, heartBeatFile string, processDone chan bo
 							cmd.Process.Pid, time.Since(startTime).Round(time.Minute)))
 				}
 			} else {
-				// heartbeat file was not updated within 180 seconds, process is hung
+				// heartbeat file was not updated within the heartbeat timeout, process is hung
 				err = fmt.Errorf("[%v][PID %d] VMWatch process did not update heartbeat file within the time limit, killing the process", time.Now().UTC().Format(time.RFC3339), cmd.Process.Pid)
 				telemetry.SendEvent(telemetry.ErrorEvent, telemetry.ReportHeatBeatTask, err.Error(), "error", err)
 				err = killVMWatch(lg, cmd)
 				if err != nil {
 					err = fmt.Errorf("[%v][PID %d] Failed to kill vmwatch process", time.Now().UTC().Format(time.RFC3339), cmd.Process.Pid)
 					telemetry.SendEvent(telemetry.ErrorEvent, telemetry.ReportHeatBeatTask, err.Error(), "error", err)
+				} else if killedBy == "" {
+					killedBy = ExitReasonHeartbeatTimeout
 				}
 			}
 		case <-processDone:
@@ -340,6 +563,25 @@ func monitorHeartBeat(lg *slog.Logger, heartBeatFile string, processDone chan bo
 					fmt.Sprintf("VMWatch PID %d ran successfully for %v before exit, retry counters reset",
 						cmd.Process.Pid, time.Since(startTime).Round(time.Minute)))
 			}
+			return killedBy
+		}
+	}
+}
+
+// waitForVMWatchExit drains vmWatchResultChannel until executeVMWatch closes it,
+// i.e. until VMWatch has been stopped, or until timeout elapses.
+func waitForVMWatchExit(vmWatchResultChannel <-chan VMWatchResult, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case _, ok := <-vmWatchResultChannel:
+			if !ok {
+				return
+			}
+		case <-timer.C:
+			telemetry.SendEvent(telemetry.WarningEvent, telemetry.KillVMWatchTask,
+				fmt.Sprintf("VMWatch did not stop within %v", timeout))
 			return
 		}
 	}
@@ -361,14 +603,25 @@ func killVMWatch(lg *slog.Logger, cmd *exec.Cmd) error {
 	return nil
 }
 
+// verifyVMWatchFiles verifies the integrity of the VMWatch binary and config that setupVMWatchCommand launches.
+// It is a variable to allow overriding in tests.
+var verifyVMWatchFiles = func() error {
+	processDirectory, err := GetProcessDirectory()
+	if err != nil {
+		return err
+	}
+	return verifyVMWatchIntegrity(filepath.Join(processDirectory, "VMWatch"),
+		filepath.Base(GetVMWatchBinaryFullPath(processDirectory)), VMWatchConfigFileName)
+}
+
 // setupVMWatchCommand sets up the command to run VMWatch
 // if we are on a linux distro with systemd-run available, cmd.Path will be systemd-run (or possibly the full path if resolved)
-// else it will be the vmwatch binary path.  the boolean return code indicates whether further resource goverance is needed
-// in the case of running with systemd-run this will be false, otherwise it will be true
-func setupVMWatchCommand(s *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment) (*exec.Cmd, bool, error) {
+// else it will be the vmwatch binary path.  the returned vmWatchCgroup holds the systemd scope the process is launched in,
+// if it has no scope further resource goverance is needed by assigning the process to a cgroup after it is started
+func setupVMWatchCommand(s *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment) (*exec.Cmd, *vmWatchCgroup, error) {
 	processDirectory, err := GetProcessDirectory()
 	if err != nil {
-		return nil, false, err
+		return nil, nil, err
 	}
 
 	args := []string{"--config", GetVMWatchConfigFullPath(processDirectory)}
@@ -383,7 +636,7 @@ func setupVMWatchCommand(s *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment
 	}
 	if s.MemoryLimitInBytes < 30000000 {
 		err = fmt.Errorf("[%v] Invalid MemoryLimitInBytes specified must be at least 30000000", time.Now().UTC().Format(time.RFC3339))
-		return nil, false, err
+		return nil, nil, err
 	}
 
 	// check cpu, if 0 (default) set to the default value
@@ -393,7 +646,7 @@ func setupVMWatchCommand(s *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment
 
 	if s.MaxCpuPercentage < 0 || s.MaxCpuPercentage > 100 {
 		err = fmt.Errorf("[%v] Invalid maxCpuPercentage specified must be between 0 and 100", time.Now().UTC().Format(time.RFC3339))
-		return nil, false, err
+		return nil, nil, err
 	}
 
 	args = append(args, "--memory-limit-bytes", strconv.FormatInt(s.MemoryLimitInBytes, 10))
@@ -447,16 +700,17 @@ func setupVMWatchCommand(s *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment
 		args = append(args, "--apphealth-version", extVersion)
 	}
 	var cmd *exec.Cmd
-	// flag to tell the caller that further resource governance is required by assigning to cgroups after the process is started
-	// default to true to that if systemd-run is not available, we will assign cgroups
-	resourceGovernanceRequired := true
+	// without a scope the caller assigns the process to a cgroup after it is started, which is the case if systemd-run is not available
+	run := &vmWatchCgroup{}
 	// if we have systemd available, we will use that to launch the process, otherwise we will launch directly and manipulate our own cgroups
 	if isSystemdAvailable() {
 		systemdVersion := getSystemdVersion()
 
 		// since systemd-run is in different paths on different distros, we will check for systemd but not use the full path
 		// to systemd-run.  This is how guest agent handles it also so seems appropriate.
-		systemdArgs := []string{"--scope", "-p", fmt.Sprintf("CPUQuota=%v%%", s.MaxCpuPercentage)}
+		// the scope is named so that it can be stopped when the run ends, and found if the extension did not shut down cleanly
+		run.Scope = newVMWatchScopeName()
+		systemdArgs := []string{"--scope", "--unit", run.Scope, "-p", fmt.Sprintf("CPUQuota=%v%%", s.MaxCpuPercentage)}
 
 		// systemd versions prior to 246 do not support MemoryMax, instead MemoryLimit should be used
 		if systemdVersion < 246 {
@@ -475,14 +729,12 @@ func setupVMWatchCommand(s *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment
 		// since systemd-run is in different paths on different distros, we will check for systemd but not use the full path
 		// to systemd-run.  This is how guest agent handles it also so seems appropriate.
 		cmd = exec.Command("systemd-run", systemdArgs...)
-		// cgroup assignment not required since we are using systemd-run
-		resourceGovernanceRequired = false
 	} else {
 		cmd = exec.Command(GetVMWatchBinaryFullPath(processDirectory), args...)
 		cmd.Env = GetVMWatchEnvironmentVariables(s.ParameterOverrides, hEnv)
 	}
 
-	return cmd, resourceGovernanceRequired, nil
+	return cmd, run, nil
 }
 
 func isSystemdAvailable() bool {
@@ -526,9 +778,13 @@ func extractVersion(output string) int {
 	return 0
 }
 
-func createAndAssignCgroups(lg *slog.Logger, vmwatchSettings *vmWatchSettings, vmWatchPid int) error {
-	// get our process and use this to determine the appropriate mount points for the cgroups
-	myPid := os.Getpid()
+// createAndAssignCgroups assigns the VMWatch process to the cgroup returned by vmWatchCgroupGroup, creating it with the
+// resource limits from the settings. The cgroup is returned even on failure so that the caller can remove it.
+func createAndAssignCgroups(lg *slog.Logger, vmwatchSettings *vmWatchSettings, vmWatchPid int) (group string, v1 bool, err error) {
+	group, v1, err = vmWatchCgroupGroup()
+	if err != nil {
+		return "", v1, err
+	}
 	memoryLimitInBytes := int64(vmwatchSettings.MemoryLimitInBytes)
 
 	telemetry.SendEvent(telemetry.InfoEvent, telemetry.StartVMWatchTask, "Assigning VMWatch process to cgroup")
@@ -552,23 +808,16 @@ func createAndAssignCgroups(lg *slog.Logger, vmwatchSettings *vmWatchSettings, v
 
 		// in cgroup v2, it appears that a process already in a cgroup can't create a sub group that limits the same
 		// kind of resources so we have to do it at the root level.  Reference https://manpath.be/f35/7/cgroups#L557
-		manager, err := cgroup2.NewManager("/sys/fs/cgroup", "/vmwatch.slice", &resources)
+		manager, err := cgroup2.NewManager(cgroupusage.DefaultMountRoot, group, &resources)
 		if err != nil {
-			return err
+			return group, v1, err
 		}
 		err = manager.AddProc(uint64(vmWatchPid))
 		if err != nil {
-			return err
+			return group, v1, err
 		}
 	} else {
 		telemetry.SendEvent(telemetry.InfoEvent, telemetry.StartVMWatchTask, "cgroups v1 detected")
-		p := cgroup1.PidPath(myPid)
-
-		cpuPath, err := p("cpu")
-		if err != nil {
-			return err
-		}
-
 		// in cgroup v1, the interval is implied, 1000 == 1 %
 		cpuQuota := int64(vmwatchSettings.MaxCpuPercentage * 1000)
 		memoryLimitInBytes := int64(vmwatchSettings.MemoryLimitInBytes)
@@ -582,19 +831,17 @@ func createAndAssignCgroups(lg *slog.Logger, vmwatchSettings *vmWatchSettings, v
 			},
 		}
 
-		control, err := cgroup1.New(cgroup1.StaticPath(cpuPath+"/vmwatch.slice"), &s)
+		control, err := cgroup1.New(cgroup1.StaticPath(group), &s)
 		if err != nil {
-			return err
+			return group, v1, err
 		}
 		err = control.AddProc(uint64(vmWatchPid))
 		if err != nil {
-			return err
+			return group, v1, err
 		}
-
-		defer control.Delete()
 	}
 
-	return nil
+	return group, v1, nil
 }
 
 func GetProcessDirectory() (string, error) {
@@ -649,33 +896,3 @@ func GetVMWatchEnvironmentVariables(parameterOverrides map[string]interface{}, h
 
 	return arr
 }
-
-// Global state for VMWatch retry reset functionality
-var (
-	vmWatchRetryMutex    sync.RWMutex // Mutex to protect access to retry counters
-	vmWatchCurrentCycle  int          = 1
-	vmWatchTotalAttempts int          = 0
-)
-
-// resetVMWatchRetryCounters resets the retry counters
-func resetVMWatchRetryCounters() {
-	vmWatchRetryMutex.Lock()
-	defer vmWatchRetryMutex.Unlock()
-	vmWatchCurrentCycle = 1  // Reset to first cycle
-	vmWatchTotalAttempts = 0 // Reset attempt counter
-}
-
-// updateVMWatchRetryCounters updates the current retry state
-func updateVMWatchRetryCounters(cycle int, totalAttempts int) {
-	vmWatchRetryMutex.Lock()
-	defer vmWatchRetryMutex.Unlock()
-	vmWatchCurrentCycle = cycle
-	vmWatchTotalAttempts = totalAttempts
-}
-
-// getVMWatchRetryCounters gets the current retry state
-func getVMWatchRetryCounters() (int, int) {
-	vmWatchRetryMutex.RLock()
-	defer vmWatchRetryMutex.RUnlock()
-	return vmWatchCurrentCycle, vmWatchTotalAttempts
-}
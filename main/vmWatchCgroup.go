@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/cgroupusage"
+	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
+	"github.com/containerd/cgroups/v3"
+	"github.com/containerd/cgroups/v3/cgroup1"
+	"github.com/containerd/cgroups/v3/cgroup2"
+)
+
+const (
+	// vmWatchCgroupName is the cgroup createAndAssignCgroups places VMWatch in
+	// when systemd-run is not available.
+	vmWatchCgroupName = "vmwatch.slice"
+	// vmWatchScopePrefix prefixes the names of the systemd scopes VMWatch is
+	// launched in, so that scopes left over by previous runs can be found.
+	vmWatchScopePrefix = "apphealth-vmwatch-"
+)
+
+// vmWatchScopeSequence makes the scope names of successive attempts unique.
+var vmWatchScopeSequence atomic.Uint64
+
+// newVMWatchScopeName returns the name of the systemd scope for a new VMWatch run.
+func newVMWatchScopeName() string {
+	return fmt.Sprintf("%s%d-%d.scope", vmWatchScopePrefix, os.Getpid(), vmWatchScopeSequence.Add(1))
+}
+
+// vmWatchCgroup is the resource governance container of one VMWatch run, which is
+// removed when the run ends.
+type vmWatchCgroup struct {
+	// Scope is the systemd scope VMWatch was launched in with systemd-run.
+	Scope string
+	// Group is the cgroup VMWatch was assigned to when systemd-run is not
+	// available, relative to the cgroup mount point. V1 is true on cgroup v1.
+	Group string
+	V1    bool
+}
+
+// These are variables to allow overriding in tests.
+var (
+	governanceVerificationTimeout  = 5 * time.Second
+	governanceVerificationInterval = 100 * time.Millisecond
+	runSystemctl                   = func(args ...string) ([]byte, error) {
+		return exec.Command("systemctl", args...).CombinedOutput()
+	}
+	removeCgroup = removeCgroupImpl
+)
+
+// vmWatchCgroupGroup returns the cgroup createAndAssignCgroups uses. On cgroup v2
+// it is at the root, as a process already in a cgroup cannot create a sub group
+// that limits the same resources, while on cgroup v1 it is a child of the cgroup
+// of the extension process.
+func vmWatchCgroupGroup() (group string, v1 bool, err error) {
+	if cgroups.Mode() == cgroups.Unified {
+		return "/" + vmWatchCgroupName, false, nil
+	}
+	cpuPath, err := cgroup1.PidPath(os.Getpid())("cpu")
+	if err != nil {
+		return "", true, err
+	}
+	return filepath.Join(cpuPath, vmWatchCgroupName), true, nil
+}
+
+// cleanup removes the scope or cgroup of the run. Processes VMWatch left behind
+// in a cgroup are moved to the parent cgroup first, as the kernel does not allow
+// removing a cgroup with processes in it.
+func (c *vmWatchCgroup) cleanup() {
+	if c == nil {
+		return
+	}
+	if c.Scope != "" {
+		if err := stopVMWatchScope(c.Scope); err != nil {
+			telemetry.SendEvent(telemetry.WarningEvent, telemetry.StopVMWatchTask,
+				fmt.Sprintf("Failed to stop VMWatch scope %s: %v", c.Scope, err), "scope", c.Scope, "error", err)
+		}
+	}
+	if c.Group != "" {
+		if _, err := removeCgroup(c.Group, c.V1); err != nil {
+			telemetry.SendEvent(telemetry.WarningEvent, telemetry.StopVMWatchTask,
+				fmt.Sprintf("Failed to remove VMWatch cgroup %s: %v", c.Group, err), "cgroup", c.Group, "error", err)
+		}
+	}
+}
+
+// stopVMWatchScope stops a systemd scope, killing any process left in it. A scope
+// that no longer exists, which is the case once all its processes have exited,
+// is not an error.
+func stopVMWatchScope(scope string) error {
+	out, err := runSystemctl("stop", scope)
+	if err != nil && !strings.Contains(string(out), "not loaded") {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// listVMWatchScopes returns the systemd scopes VMWatch was launched in that still
+// exist.
+func listVMWatchScopes() ([]string, error) {
+	out, err := runSystemctl("list-units", "--type=scope", "--all", "--plain", "--no-legend", "--no-pager", vmWatchScopePrefix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	var scopes []string
+	for _, line := range strings.Split(string(out), "\n") {
+		// failed units are marked with a bullet before the unit name
+		for _, field := range strings.Fields(line) {
+			if strings.HasPrefix(field, vmWatchScopePrefix) {
+				scopes = append(scopes, field)
+				break
+			}
+		}
+	}
+	return scopes, nil
+}
+
+func removeCgroupImpl(group string, v1 bool) (removed bool, err error) {
+	if v1 {
+		control, err := cgroup1.Load(cgroup1.StaticPath(group))
+		if errors.Is(err, cgroup1.ErrCgroupDeleted) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		parent, err := cgroup1.Load(cgroup1.StaticPath(filepath.Dir(group)))
+		if err != nil {
+			return false, err
+		}
+		if err := control.MoveTo(parent); err != nil {
+			return false, err
+		}
+		return true, control.Delete()
+	}
+
+	if _, err := os.Stat(filepath.Join(cgroupusage.DefaultMountRoot, group)); os.IsNotExist(err) {
+		return false, nil
+	}
+	manager, err := cgroup2.Load(group)
+	if err != nil {
+		return false, err
+	}
+	parent, err := cgroup2.Load(filepath.Dir(group))
+	if err != nil {
+		return false, err
+	}
+	if err := manager.MoveTo(parent); err != nil {
+		return false, err
+	}
+	return true, manager.Delete()
+}
+
+// reapVMWatchCgroups removes the scopes and cgroups left over by VMWatch runs of
+// extension processes that did not shut down cleanly. It must only be called
+// when no VMWatch process of this extension is supposed to be running.
+func reapVMWatchCgroups() {
+	if isSystemdAvailable() {
+		scopes, err := listVMWatchScopes()
+		if err != nil {
+			telemetry.SendEvent(telemetry.WarningEvent, telemetry.StopVMWatchTask,
+				fmt.Sprintf("Failed to list leftover VMWatch scopes: %v", err), "error", err)
+		}
+		for _, scope := range scopes {
+			telemetry.SendEvent(telemetry.InfoEvent, telemetry.StopVMWatchTask,
+				fmt.Sprintf("Stopping leftover VMWatch scope %s", scope), "scope", scope)
+			(&vmWatchCgroup{Scope: scope}).cleanup()
+		}
+	}
+
+	group, v1, err := vmWatchCgroupGroup()
+	if err != nil {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.StopVMWatchTask,
+			fmt.Sprintf("Failed to determine the VMWatch cgroup: %v", err), "error", err)
+		return
+	}
+	removed, err := removeCgroup(group, v1)
+	if err != nil {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.StopVMWatchTask,
+			fmt.Sprintf("Failed to remove leftover VMWatch cgroup %s: %v", group, err), "cgroup", group, "error", err)
+	} else if removed {
+		telemetry.SendEvent(telemetry.InfoEvent, telemetry.StopVMWatchTask,
+			fmt.Sprintf("Removed leftover VMWatch cgroup %s", group), "cgroup", group)
+	}
+}
+
+// name returns the scope or cgroup the run is governed by.
+func (c *vmWatchCgroup) name() string {
+	if c.Scope != "" {
+		return c.Scope
+	}
+	return c.Group
+}
+
+// verifyResourceGovernance checks that VMWatch process pid is in the scope or
+// cgroup of run, and that its CPU quota and memory limit are the ones from the
+// settings. It returns the limits that are in effect. A process launched with
+// systemd-run is checked until governanceVerificationTimeout, as it only moves
+// to its scope once systemd created it.
+func verifyResourceGovernance(pid int, run *vmWatchCgroup, s *vmWatchSettings) (*cgroupusage.Limits, error) {
+	deadline := time.Now().Add(governanceVerificationTimeout)
+	for {
+		limits, err := checkResourceGovernance(pid, run, s)
+		if err == nil || run.Scope == "" || time.Now().After(deadline) {
+			return limits, err
+		}
+		time.Sleep(governanceVerificationInterval)
+	}
+}
+
+func checkResourceGovernance(pid int, run *vmWatchCgroup, s *vmWatchSettings) (*cgroupusage.Limits, error) {
+	name := run.name()
+	if name == "" {
+		return nil, errors.New("VMWatch was not assigned to a scope or cgroup")
+	}
+	paths, err := vmWatchCgroupPaths(pid)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range []cgroupusage.Controller{paths.Memory, paths.CPU} {
+		if !strings.HasSuffix(filepath.ToSlash(c.Dir), "/"+strings.TrimPrefix(name, "/")) {
+			return nil, fmt.Errorf("VMWatch is in cgroup %s instead of %s", c.Dir, name)
+		}
+	}
+	limits, err := paths.ReadLimits()
+	if err != nil {
+		return nil, err
+	}
+
+	// the kernel rounds the memory limit down to a multiple of the page size
+	memoryMax := uint64(s.MemoryLimitInBytes)
+	if limits.MemoryMax == 0 || limits.MemoryMax > memoryMax || limits.MemoryMax+uint64(os.Getpagesize()) <= memoryMax {
+		return limits, fmt.Errorf("VMWatch memory limit is %d bytes instead of %d bytes", limits.MemoryMax, memoryMax)
+	}
+	// allow for rounding of the quota to whole microseconds or milliseconds
+	cpu, expected := limits.CPUPercentage(), float64(s.MaxCpuPercentage)
+	if cpu == 0 || math.Abs(cpu-expected) > expected/100 {
+		return limits, fmt.Errorf("VMWatch CPU quota is %.2f%% instead of %d%%", cpu, s.MaxCpuPercentage)
+	}
+	return limits, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/cgroupusage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSystemctl replaces runSystemctl, recording the commands it is called with.
+func fakeSystemctl(t *testing.T, run func(args ...string) ([]byte, error)) *[]string {
+	var calls []string
+	orig := runSystemctl
+	t.Cleanup(func() { runSystemctl = orig })
+	runSystemctl = func(args ...string) ([]byte, error) {
+		calls = append(calls, strings.Join(args, " "))
+		return run(args...)
+	}
+	return &calls
+}
+
+func Test_newVMWatchScopeName(t *testing.T) {
+	a, b := newVMWatchScopeName(), newVMWatchScopeName()
+	assert.NotEqual(t, a, b)
+	for _, name := range []string{a, b} {
+		assert.True(t, strings.HasPrefix(name, vmWatchScopePrefix), name)
+		assert.True(t, strings.HasSuffix(name, ".scope"), name)
+	}
+}
+
+func Test_stopVMWatchScope(t *testing.T) {
+	out, err := []byte{}, error(nil)
+	calls := fakeSystemctl(t, func(args ...string) ([]byte, error) { return out, err })
+
+	require.NoError(t, stopVMWatchScope("apphealth-vmwatch-1-1.scope"))
+	assert.Equal(t, []string{"stop apphealth-vmwatch-1-1.scope"}, *calls)
+
+	// the scope is removed by systemd once VMWatch exits
+	out, err = []byte("Failed to stop apphealth-vmwatch-1-1.scope: Unit apphealth-vmwatch-1-1.scope not loaded.\n"), errors.New("exit status 5")
+	require.NoError(t, stopVMWatchScope("apphealth-vmwatch-1-1.scope"))
+
+	out, err = []byte("Access denied\n"), errors.New("exit status 1")
+	err2 := stopVMWatchScope("apphealth-vmwatch-1-1.scope")
+	require.Error(t, err2)
+	assert.Contains(t, err2.Error(), "Access denied")
+}
+
+func Test_listVMWatchScopes(t *testing.T) {
+	fakeSystemctl(t, func(args ...string) ([]byte, error) {
+		return []byte("apphealth-vmwatch-10-1.scope loaded active running apphealth-vmwatch-10-1.scope\n" +
+			"● apphealth-vmwatch-11-3.scope loaded failed failed apphealth-vmwatch-11-3.scope\n\n"), nil
+	})
+
+	scopes, err := listVMWatchScopes()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"apphealth-vmwatch-10-1.scope", "apphealth-vmwatch-11-3.scope"}, scopes)
+}
+
+func Test_vmWatchCgroup_Cleanup(t *testing.T) {
+	calls := fakeSystemctl(t, func(args ...string) ([]byte, error) { return nil, nil })
+	var removed []string
+	orig := removeCgroup
+	t.Cleanup(func() { removeCgroup = orig })
+	removeCgroup = func(group string, v1 bool) (bool, error) {
+		removed = append(removed, group)
+		return true, nil
+	}
+
+	(&vmWatchCgroup{Scope: "apphealth-vmwatch-1-1.scope"}).cleanup()
+	assert.Equal(t, []string{"stop apphealth-vmwatch-1-1.scope"}, *calls)
+	assert.Empty(t, removed)
+
+	(&vmWatchCgroup{Group: "/vmwatch.slice"}).cleanup()
+	assert.Len(t, *calls, 1, "no scope to stop")
+	assert.Equal(t, []string{"/vmwatch.slice"}, removed)
+
+	// a run that failed before it was set up has nothing to clean up
+	(*vmWatchCgroup)(nil).cleanup()
+}
+
+// fakeGovernedCgroup points vmWatchCgroupPaths at a temporary cgroup v2 folder
+// named name with the given limits.
+func fakeGovernedCgroup(t *testing.T, name, cpuMax, memoryMax string) {
+	dir := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(cpuMax), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "memory.max"), []byte(memoryMax), 0644))
+	orig := vmWatchCgroupPaths
+	t.Cleanup(func() { vmWatchCgroupPaths = orig })
+	vmWatchCgroupPaths = func(pid int) (*cgroupusage.Paths, error) {
+		return &cgroupusage.Paths{Memory: cgroupusage.Controller{Dir: dir}, CPU: cgroupusage.Controller{Dir: dir}}, nil
+	}
+}
+
+func Test_verifyResourceGovernance(t *testing.T) {
+	origTimeout := governanceVerificationTimeout
+	t.Cleanup(func() { governanceVerificationTimeout = origTimeout })
+	governanceVerificationTimeout = 300 * time.Millisecond
+	s := &vmWatchSettings{MaxCpuPercentage: 1, MemoryLimitInBytes: 80000000}
+	scope := &vmWatchCgroup{Scope: "apphealth-vmwatch-1-1.scope"}
+
+	t.Run("LimitsApplied", func(t *testing.T) {
+		// systemd sets the quota relative to a 100ms period and the kernel rounds the memory limit down to a page
+		fakeGovernedCgroup(t, scope.Scope, "1000 100000\n", "79998976\n")
+		limits, err := verifyResourceGovernance(42, scope, s)
+		require.NoError(t, err)
+		assert.Equal(t, 1.0, limits.CPUPercentage())
+		assert.Equal(t, uint64(79998976), limits.MemoryMax)
+	})
+
+	t.Run("DirectCgroup", func(t *testing.T) {
+		fakeGovernedCgroup(t, vmWatchCgroupName, "10000 1000000\n", "80000000\n")
+		_, err := verifyResourceGovernance(42, &vmWatchCgroup{Group: "/" + vmWatchCgroupName}, s)
+		require.NoError(t, err)
+	})
+
+	t.Run("WrongCgroup", func(t *testing.T) {
+		fakeGovernedCgroup(t, "enable.scope", "1000 100000\n", "80000000\n")
+		start := time.Now()
+		_, err := verifyResourceGovernance(42, scope, s)
+		require.ErrorContains(t, err, "instead of apphealth-vmwatch-1-1.scope")
+		assert.GreaterOrEqual(t, time.Since(start), governanceVerificationTimeout, "the scope may not have been created yet")
+	})
+
+	t.Run("NoMemoryLimit", func(t *testing.T) {
+		fakeGovernedCgroup(t, scope.Scope, "1000 100000\n", "max\n")
+		_, err := verifyResourceGovernance(42, scope, s)
+		require.ErrorContains(t, err, "memory limit is 0 bytes instead of 80000000 bytes")
+	})
+
+	t.Run("WrongCPUQuota", func(t *testing.T) {
+		fakeGovernedCgroup(t, vmWatchCgroupName, "50000 100000\n", "80000000\n")
+		start := time.Now()
+		_, err := verifyResourceGovernance(42, &vmWatchCgroup{Group: "/" + vmWatchCgroupName}, s)
+		require.ErrorContains(t, err, "CPU quota is 50.00% instead of 1%")
+		assert.Less(t, time.Since(start), governanceVerificationTimeout, "a cgroup assigned directly is not checked again")
+	})
+
+	t.Run("NotAssigned", func(t *testing.T) {
+		_, err := verifyResourceGovernance(42, &vmWatchCgroup{}, s)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// VMWatchExitReason classifies why a VMWatch attempt ended.
+type VMWatchExitReason string
+
+const (
+	// ExitReasonOOM means VMWatch was killed for exceeding its memory limit.
+	ExitReasonOOM VMWatchExitReason = "OOMKilled"
+	// ExitReasonHeartbeatTimeout means monitorHeartBeat killed VMWatch because it
+	// stopped updating its heartbeat file.
+	ExitReasonHeartbeatTimeout VMWatchExitReason = "HeartbeatTimeout"
+	// ExitReasonShutdown means VMWatch was killed because enable is shutting down.
+	ExitReasonShutdown VMWatchExitReason = "Shutdown"
+	// ExitReasonCrash means VMWatch panicked, was killed by a signal or exited
+	// with an error.
+	ExitReasonCrash VMWatchExitReason = "Crashed"
+	// ExitReasonCleanExit means VMWatch exited with status 0, although it is
+	// expected to run until it is stopped.
+	ExitReasonCleanExit VMWatchExitReason = "CleanExit"
+	// ExitReasonConfigError means VMWatch cannot run with the current settings,
+	// either because they failed validation or because VMWatch rejected its
+	// command line. Retrying does not help until the settings change.
+	ExitReasonConfigError VMWatchExitReason = "ConfigError"
+	// ExitReasonIntegrityError means the VMWatch binary or config failed
+	// verification against the shipped checksum manifest, or could have been
+	// modified by an unprivileged user. Retrying does not help either.
+	ExitReasonIntegrityError VMWatchExitReason = "IntegrityCheckFailed"
+)
+
+// permanent reports whether retrying VMWatch cannot succeed after it ended for
+// reason r.
+func (r VMWatchExitReason) permanent() bool {
+	return r == ExitReasonConfigError || r == ExitReasonIntegrityError
+}
+
+// vmWatchUsageExitCode is the status a Go program exits with when its command
+// line is invalid, which is also the status of an unrecovered panic.
+const vmWatchUsageExitCode = 2
+
+// oomPeakMemoryRatio is how close to the memory limit the peak usage must have
+// been for a SIGKILL of unknown origin to be attributed to the OOM killer, when
+// the cgroup was removed before its OOM counter could be read.
+const oomPeakMemoryRatio = 0.9
+
+// goStackFrame matches a frame of a Go stack trace, e.g. "main.go:42 +0x1d".
+var goStackFrame = regexp.MustCompile(`\.go:\d+ \+0x[0-9a-f]+`)
+
+// VMWatchExitError is the error of a VMWatch attempt, with the reason it ended.
+type VMWatchExitError struct {
+	Reason VMWatchExitReason
+	Err    error
+}
+
+func (e *VMWatchExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *VMWatchExitError) Unwrap() error {
+	return e.Err
+}
+
+// vmWatchExitReason returns the reason of a failed attempt, or an empty reason if
+// err was not classified.
+func vmWatchExitReason(err error) VMWatchExitReason {
+	var exitErr *VMWatchExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Reason
+	}
+	return ""
+}
+
+// vmWatchExit describes how a VMWatch process ended.
+type vmWatchExit struct {
+	// WaitErr is the error returned by waiting for the process.
+	WaitErr error
+	// KilledBy is set when the extension killed the process itself.
+	KilledBy VMWatchExitReason
+	// Usage is the last resource usage sample of the process, if any.
+	Usage *vmWatchResourceUsage
+	// MemoryLimitInBytes is the memory limit the process ran with.
+	MemoryLimitInBytes int64
+	// Output is the tail of the process output.
+	Output string
+}
+
+// classify determines why the process ended. OOM kills take precedence over the
+// heartbeat monitor, as a process thrashing near its memory limit may also miss
+// its heartbeat before the OOM killer steps in.
+func (e *vmWatchExit) classify() VMWatchExitReason {
+	if e.Usage != nil && e.Usage.OOMKills > 0 {
+		return ExitReasonOOM
+	}
+	if e.KilledBy != "" {
+		return e.KilledBy
+	}
+	if e.WaitErr == nil {
+		return ExitReasonCleanExit
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(e.WaitErr, &exitErr) {
+		return ExitReasonCrash
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return ExitReasonCrash
+	}
+	switch {
+	case status.Signaled() && status.Signal() == syscall.SIGKILL && e.nearMemoryLimit():
+		return ExitReasonOOM
+	case status.Exited() && status.ExitStatus() == vmWatchUsageExitCode && !isGoPanic(e.Output):
+		return ExitReasonConfigError
+	default:
+		return ExitReasonCrash
+	}
+}
+
+// exitCode returns the exit status of the process, which is -1 if it was killed
+// by a signal or could not be waited for.
+func (e *vmWatchExit) exitCode() int {
+	if e.WaitErr == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(e.WaitErr, &exitErr) {
+		return -1
+	}
+	return exitErr.ExitCode()
+}
+
+func (e *vmWatchExit) nearMemoryLimit() bool {
+	return e.Usage != nil && e.MemoryLimitInBytes > 0 &&
+		float64(e.Usage.MemoryPeak) >= oomPeakMemoryRatio*float64(e.MemoryLimitInBytes)
+}
+
+func isGoPanic(output string) bool {
+	return strings.Contains(output, "panic:") || goStackFrame.MatchString(output)
+}
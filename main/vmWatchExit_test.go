@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runShell runs script and returns the error of waiting for it.
+func runShell(t *testing.T, script string) error {
+	t.Helper()
+	cmd := exec.Command("/bin/sh", "-c", script)
+	require.NoError(t, cmd.Start())
+	return cmd.Wait()
+}
+
+func Test_vmWatchExit_classify(t *testing.T) {
+	nearLimit := &vmWatchResourceUsage{MemoryPeak: 195000000}
+	tests := []struct {
+		name     string
+		exit     vmWatchExit
+		expected VMWatchExitReason
+	}{
+		{"CleanExit", vmWatchExit{WaitErr: runShell(t, "exit 0")}, ExitReasonCleanExit},
+		{"ExitStatus", vmWatchExit{WaitErr: runShell(t, "exit 1")}, ExitReasonCrash},
+		{"InvalidArguments", vmWatchExit{WaitErr: runShell(t, "exit 2"), Output: "flag provided but not defined: -foo"}, ExitReasonConfigError},
+		{"Panic", vmWatchExit{WaitErr: runShell(t, "exit 2"), Output: "panic: runtime error\n\t/src/main.go:42 +0x1d"}, ExitReasonCrash},
+		{"Signal", vmWatchExit{WaitErr: runShell(t, "kill -SEGV $$")}, ExitReasonCrash},
+		{"SIGKILL", vmWatchExit{WaitErr: runShell(t, "kill -KILL $$")}, ExitReasonCrash},
+		{"SIGKILLNearMemoryLimit", vmWatchExit{WaitErr: runShell(t, "kill -KILL $$"), Usage: nearLimit, MemoryLimitInBytes: 200000000}, ExitReasonOOM},
+		{"OOMKillCounter", vmWatchExit{WaitErr: runShell(t, "kill -KILL $$"), Usage: &vmWatchResourceUsage{OOMKills: 1}}, ExitReasonOOM},
+		{"OOMWhileHeartbeatMissed", vmWatchExit{KilledBy: ExitReasonHeartbeatTimeout, Usage: &vmWatchResourceUsage{OOMKills: 1}}, ExitReasonOOM},
+		{"HeartbeatTimeout", vmWatchExit{WaitErr: runShell(t, "kill -KILL $$"), KilledBy: ExitReasonHeartbeatTimeout, Usage: nearLimit, MemoryLimitInBytes: 200000000}, ExitReasonHeartbeatTimeout},
+		{"Shutdown", vmWatchExit{WaitErr: runShell(t, "kill -KILL $$"), KilledBy: ExitReasonShutdown}, ExitReasonShutdown},
+		{"NotStarted", vmWatchExit{WaitErr: errors.New("exec: not started")}, ExitReasonCrash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.exit.classify())
+		})
+	}
+}
+
+func Test_vmWatchExit_exitCode(t *testing.T) {
+	assert.Equal(t, 0, (&vmWatchExit{WaitErr: runShell(t, "exit 0")}).exitCode())
+	assert.Equal(t, 3, (&vmWatchExit{WaitErr: runShell(t, "exit 3")}).exitCode())
+	assert.Equal(t, -1, (&vmWatchExit{WaitErr: runShell(t, "kill -KILL $$")}).exitCode())
+	assert.Equal(t, -1, (&vmWatchExit{WaitErr: errors.New("exec: not started")}).exitCode())
+}
+
+func Test_vmWatchExitReason(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", &VMWatchExitError{Reason: ExitReasonOOM, Err: errors.New("killed")})
+	assert.Equal(t, ExitReasonOOM, vmWatchExitReason(err))
+	assert.Equal(t, "wrapped: killed", err.Error())
+	assert.Equal(t, VMWatchExitReason(""), vmWatchExitReason(errors.New("other")))
+}
+
+func TestMonitorHeartBeat_KillsProcessOnHeartbeatTimeout(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	require.NoError(t, cmd.Start())
+
+	processDone := make(chan bool)
+	go func() {
+		cmd.Wait()
+		processDone <- true
+		close(processDone)
+	}()
+
+	done := make(chan VMWatchExitReason)
+	go func() {
+		done <- monitorHeartBeat(context.Background(), slog.Default(), filepath.Join(t.TempDir(), "heartbeat.txt"), 50*time.Millisecond, processDone, cmd, time.Now())
+	}()
+
+	select {
+	case killedBy := <-done:
+		assert.Equal(t, ExitReasonHeartbeatTimeout, killedBy)
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("monitorHeartBeat did not kill the process without a heartbeat")
+	}
+}
+
+func TestExecuteRetryLogic_ConfigErrorStopsRetries(t *testing.T) {
+	resetVMWatchRetryCounters()
+	defer resetVMWatchRetryCounters()
+
+	calls, sleeps := 0, 0
+	helper := func(ctx context.Context, lg *slog.Logger, attempt int, s *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment) error {
+		calls++
+		return &VMWatchExitError{Reason: ExitReasonConfigError, Err: errors.New("invalid settings")}
+	}
+	result := executeRetryLogic(context.Background(), nil, &vmWatchSettings{}, &handlerenv.HandlerEnvironment{},
+		RetryConfig{MaxCycles: 2, AttemptsPerCycle: 3, BaseWaitHours: 1}, helper, func(ctx context.Context, d time.Duration) { sleeps++ }, nil)
+
+	assert.Equal(t, 1, calls, "a configuration error should not be retried")
+	assert.Equal(t, 0, sleeps)
+	assert.False(t, result.Success)
+	assert.Equal(t, ExitReasonConfigError, vmWatchExitReason(result.LastError))
+	cycle, attempts := getVMWatchRetryCounters()
+	assert.Equal(t, 1, cycle)
+	assert.Equal(t, 0, attempts, "a configuration error should not use up the retry budget")
+}
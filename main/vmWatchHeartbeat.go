@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
+)
+
+// Outcomes of a VMWatch signal run.
+const (
+	SignalOutcomeSuccess = "success"
+	SignalOutcomeFailure = "failure"
+	SignalOutcomeSkipped = "skipped"
+)
+
+// vmWatchHeartbeat is the content of the heartbeat file VMWatch writes. Older
+// VMWatch versions leave the file empty and only update its modification time,
+// which is still the liveness signal monitorHeartBeat checks.
+type vmWatchHeartbeat struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Version is the version of VMWatch.
+	Version        string   `json:"version"`
+	EnabledSignals []string `json:"enabledSignals"`
+	// Signals are the outcomes of the last run of each signal.
+	Signals []vmWatchSignalResult `json:"signals"`
+}
+
+// vmWatchSignalResult is the outcome of the last run of a signal, such as
+// disk_io or clockskew.
+type vmWatchSignalResult struct {
+	Name    string    `json:"name"`
+	Outcome string    `json:"outcome"`
+	LastRun time.Time `json:"lastRun"`
+	// Message describes a failure.
+	Message string `json:"message,omitempty"`
+}
+
+// parseVMWatchHeartbeat parses the content of the heartbeat file. It returns nil
+// for the legacy format, which has no JSON content.
+func parseVMWatchHeartbeat(b []byte) (*vmWatchHeartbeat, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || b[0] != '{' {
+		return nil, nil
+	}
+	var hb vmWatchHeartbeat
+	if err := json.Unmarshal(b, &hb); err != nil {
+		return nil, fmt.Errorf("invalid VMWatch heartbeat: %w", err)
+	}
+	return &hb, nil
+}
+
+func readVMWatchHeartbeat(path string) (*vmWatchHeartbeat, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseVMWatchHeartbeat(b)
+}
+
+// failingSignals returns the sorted names of the signals whose last run failed.
+func (hb *vmWatchHeartbeat) failingSignals() []string {
+	var failing []string
+	for _, s := range hb.Signals {
+		if strings.EqualFold(s.Outcome, SignalOutcomeFailure) {
+			failing = append(failing, s.Name)
+		}
+	}
+	sort.Strings(failing)
+	return failing
+}
+
+// failureDetails describes the failing signals with their messages.
+func (hb *vmWatchHeartbeat) failureDetails() string {
+	var details []string
+	for _, s := range hb.Signals {
+		if strings.EqualFold(s.Outcome, SignalOutcomeFailure) {
+			details = append(details, fmt.Sprintf("%s at %s: %s", s.Name, s.LastRun.UTC().Format(time.RFC3339), s.Message))
+		}
+	}
+	sort.Strings(details)
+	return strings.Join(details, "; ")
+}
+
+// signalHealth summarizes the signal outcomes for the VMWatch signal health
+// substatus.
+func (hb *vmWatchHeartbeat) signalHealth() string {
+	failing := hb.failingSignals()
+	s := fmt.Sprintf("signals: %d enabled", len(hb.EnabledSignals))
+	if len(failing) == 0 {
+		return s + ", none failing"
+	}
+	return fmt.Sprintf("%s, %d failing (%s)", s, len(failing), strings.Join(failing, ", "))
+}
+
+// statusType is the status of the VMWatch signal health substatus, a warning when
+// signals are failing.
+func (hb *vmWatchHeartbeat) statusType() StatusType {
+	if len(hb.failingSignals()) > 0 {
+		return StatusWarning
+	}
+	return StatusSuccess
+}
+
+// Last structured heartbeat of the current (or last) VMWatch process, shown in the VMWatch signal health substatus
+var (
+	vmWatchHeartbeatMutex   sync.RWMutex
+	currentVMWatchHeartbeat *vmWatchHeartbeat
+)
+
+func setVMWatchHeartbeat(hb *vmWatchHeartbeat) {
+	vmWatchHeartbeatMutex.Lock()
+	defer vmWatchHeartbeatMutex.Unlock()
+	currentVMWatchHeartbeat = hb
+}
+
+// getVMWatchHeartbeat returns the last structured heartbeat, or nil if VMWatch
+// did not write one.
+func getVMWatchHeartbeat() *vmWatchHeartbeat {
+	vmWatchHeartbeatMutex.RLock()
+	defer vmWatchHeartbeatMutex.RUnlock()
+	return currentVMWatchHeartbeat
+}
+
+// vmWatchHeartbeatReader reads the heartbeat file of a VMWatch process, reporting
+// changes in the set of failing signals to telemetry.
+type vmWatchHeartbeatReader struct {
+	pid  int
+	path string
+	// failing are the failing signals last reported, once reported is set.
+	failing  string
+	reported bool
+	// invalid is set once an invalid heartbeat was reported, so that a VMWatch
+	// writing a format the extension does not understand is reported only once.
+	invalid bool
+}
+
+func (r *vmWatchHeartbeatReader) read() {
+	hb, err := readVMWatchHeartbeat(r.path)
+	if err != nil {
+		if !r.invalid {
+			r.invalid = true
+			telemetry.SendEvent(telemetry.WarningEvent, telemetry.ReportHeatBeatTask,
+				fmt.Sprintf("Failed to read heartbeat of VMWatch PID %d: %v", r.pid, err), "error", err)
+		}
+		return
+	}
+	if hb == nil {
+		return
+	}
+	setVMWatchHeartbeat(hb)
+
+	failing := strings.Join(hb.failingSignals(), ",")
+	if r.reported && failing == r.failing {
+		return
+	}
+	r.failing, r.reported = failing, true
+	level := telemetry.InfoEvent
+	if failing != "" {
+		level = telemetry.WarningEvent
+	}
+	telemetry.SendStateChange(level, telemetry.ReportHeatBeatTask, fmt.Sprintf("VMWatch PID %d %s", r.pid, hb.signalHealth()),
+		"pid", r.pid, "version", hb.Version, "enabledSignals", strings.Join(hb.EnabledSignals, ","), "failingSignals", failing, "failures", hb.failureDetails())
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testVMWatchHeartbeat = `{
+	"timestamp": "2024-01-01T10:00:00Z",
+	"version": "1.2.3",
+	"enabledSignals": ["clockskew", "disk_io", "dns", "outbound_connectivity"],
+	"signals": [
+		{"name": "dns", "outcome": "success", "lastRun": "2024-01-01T09:59:00Z"},
+		{"name": "disk_io", "outcome": "failure", "lastRun": "2024-01-01T09:58:00Z", "message": "read-only filesystem"},
+		{"name": "outbound_connectivity", "outcome": "skipped", "lastRun": "2024-01-01T09:57:00Z"},
+		{"name": "clockskew", "outcome": "Failure", "lastRun": "2024-01-01T09:56:00Z", "message": "clock is 10m ahead"}
+	]
+}`
+
+func Test_parseVMWatchHeartbeat(t *testing.T) {
+	hb, err := parseVMWatchHeartbeat([]byte(testVMWatchHeartbeat))
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC), hb.Timestamp)
+	assert.Equal(t, "1.2.3", hb.Version)
+	assert.Len(t, hb.Signals, 4)
+	assert.Equal(t, []string{"clockskew", "disk_io"}, hb.failingSignals())
+	assert.Equal(t, "signals: 4 enabled, 2 failing (clockskew, disk_io)", hb.signalHealth())
+	assert.Equal(t, StatusWarning, hb.statusType())
+	assert.Equal(t, "clockskew at 2024-01-01T09:56:00Z: clock is 10m ahead; disk_io at 2024-01-01T09:58:00Z: read-only filesystem", hb.failureDetails())
+
+	hb, err = parseVMWatchHeartbeat([]byte(`{"enabledSignals": ["dns"], "signals": [{"name": "dns", "outcome": "success"}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, "signals: 1 enabled, none failing", hb.signalHealth())
+	assert.Equal(t, StatusSuccess, hb.statusType())
+}
+
+func Test_parseVMWatchHeartbeat_Legacy(t *testing.T) {
+	for _, content := range []string{"", "\n", "heartbeat"} {
+		hb, err := parseVMWatchHeartbeat([]byte(content))
+		require.NoError(t, err, content)
+		assert.Nil(t, hb, content)
+	}
+
+	_, err := parseVMWatchHeartbeat([]byte(`{"signals": [`))
+	require.Error(t, err, "a truncated heartbeat is invalid")
+}
+
+func Test_vmWatchHeartbeatReader(t *testing.T) {
+	t.Cleanup(func() { setVMWatchHeartbeat(nil) })
+	setVMWatchHeartbeat(nil)
+	path := filepath.Join(t.TempDir(), "heartbeat.txt")
+	r := &vmWatchHeartbeatReader{pid: 42, path: path}
+
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+	r.read()
+	assert.Nil(t, getVMWatchHeartbeat(), "legacy heartbeats have no signal results")
+
+	require.NoError(t, os.WriteFile(path, []byte(testVMWatchHeartbeat), 0644))
+	r.read()
+	require.NotNil(t, getVMWatchHeartbeat())
+	assert.Equal(t, "clockskew,disk_io", r.failing)
+
+	// an invalid heartbeat keeps the last valid one
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0644))
+	r.read()
+	assert.True(t, r.invalid)
+	assert.Equal(t, "1.2.3", getVMWatchHeartbeat().Version)
+}
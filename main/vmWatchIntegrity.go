@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// vmWatchFileOwnerUID is the owner the VMWatch files must have. It is a variable
+// to allow overriding in tests, which do not run as root.
+var vmWatchFileOwnerUID = 0
+
+// errVMWatchManifestMissing is returned by verifyVMWatchIntegrity when the
+// VMWatch folder has no manifest. It fails the integrity check unless the
+// allowMissingChecksumManifest setting is set, as the bundle step always
+// packages a manifest. A manifest that is present but does not match is always
+// fatal.
+var errVMWatchManifestMissing = errors.New(VMWatchManifestFileName + " is missing, the SHA-256 checksums of the VMWatch files are not verified")
+
+// verifyVMWatchIntegrity checks the VMWatch files in dir before VMWatch is
+// launched: the manifest and the files must be regular files owned by root that
+// are not world-writable, and the SHA-256 checksums of the files must match the
+// manifest. If there is no manifest only the files are checked, and
+// errVMWatchManifestMissing is returned if they pass.
+func verifyVMWatchIntegrity(dir string, files ...string) error {
+	manifestPath := filepath.Join(dir, VMWatchManifestFileName)
+	if _, err := os.Lstat(manifestPath); os.IsNotExist(err) {
+		for _, name := range files {
+			if err := checkVMWatchFileOwnership(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+		return errVMWatchManifestMissing
+	}
+	if err := checkVMWatchFileOwnership(manifestPath); err != nil {
+		return err
+	}
+	checksums, err := readVMWatchManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		path := filepath.Join(dir, name)
+		if err := checkVMWatchFileOwnership(path); err != nil {
+			return err
+		}
+		expected, ok := checksums[name]
+		if !ok {
+			return fmt.Errorf("%s is not listed in %s", name, VMWatchManifestFileName)
+		}
+		actual, err := sha256File(path)
+		if err != nil {
+			return err
+		}
+		if actual != expected {
+			return fmt.Errorf("SHA-256 checksum of %s is %s, expected %s", path, actual, expected)
+		}
+	}
+	return nil
+}
+
+// checkVMWatchFileOwnership checks that path is a regular file owned by root
+// that is not world-writable, so that it cannot have been replaced or modified
+// by an unprivileged user. Symbolic links are rejected as their target could be.
+func checkVMWatchFileOwnership(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file (mode %v)", path, info.Mode())
+	}
+	if info.Mode().Perm()&0002 != 0 {
+		return fmt.Errorf("%s is world-writable (mode %v)", path, info.Mode().Perm())
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != vmWatchFileOwnerUID {
+		return fmt.Errorf("%s is owned by uid %d instead of uid %d", path, stat.Uid, vmWatchFileOwnerUID)
+	}
+	return nil
+}
+
+// readVMWatchManifest reads a manifest in the format written by sha256sum, with
+// one "<checksum> <name>" line per file. The name may be prefixed with '*' for
+// checksums computed in binary mode.
+func readVMWatchManifest(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	checksums := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s line %d: expected a checksum and a file name", path, n)
+		}
+		checksum, name := strings.ToLower(fields[0]), strings.TrimPrefix(fields[1], "*")
+		if b, err := hex.DecodeString(checksum); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("%s line %d: invalid SHA-256 checksum for %s", path, n, name)
+		}
+		checksums[name] = checksum
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return checksums, nil
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
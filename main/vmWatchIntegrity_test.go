@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupVMWatchFiles writes a VMWatch binary, config and matching manifest to a
+// temporary folder owned by the user running the tests.
+func setupVMWatchFiles(t *testing.T) string {
+	orig := vmWatchFileOwnerUID
+	t.Cleanup(func() { vmWatchFileOwnerUID = orig })
+	vmWatchFileOwnerUID = os.Getuid()
+
+	dir := t.TempDir()
+	var manifest string
+	for name, content := range map[string]string{VMWatchBinaryNameAmd64: "#!/bin/sh\n", VMWatchConfigFileName: "{}\n"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0755))
+		sum := sha256.Sum256([]byte(content))
+		manifest += fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum[:]), name)
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, VMWatchManifestFileName), []byte(manifest), 0644))
+	return dir
+}
+
+func Test_verifyVMWatchIntegrity(t *testing.T) {
+	files := []string{VMWatchBinaryNameAmd64, VMWatchConfigFileName}
+
+	t.Run("Valid", func(t *testing.T) {
+		dir := setupVMWatchFiles(t)
+		require.NoError(t, verifyVMWatchIntegrity(dir, files...))
+	})
+
+	t.Run("ChecksumMismatch", func(t *testing.T) {
+		dir := setupVMWatchFiles(t)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, VMWatchConfigFileName), []byte(`{"tampered": true}`), 0644))
+		require.ErrorContains(t, verifyVMWatchIntegrity(dir, files...), "SHA-256 checksum of "+filepath.Join(dir, VMWatchConfigFileName))
+	})
+
+	t.Run("NotInManifest", func(t *testing.T) {
+		dir := setupVMWatchFiles(t)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, VMWatchBinaryNameArm64), nil, 0755))
+		require.ErrorContains(t, verifyVMWatchIntegrity(dir, VMWatchBinaryNameArm64), "is not listed in "+VMWatchManifestFileName)
+	})
+
+	t.Run("WorldWritable", func(t *testing.T) {
+		dir := setupVMWatchFiles(t)
+		require.NoError(t, os.Chmod(filepath.Join(dir, VMWatchBinaryNameAmd64), 0777))
+		require.ErrorContains(t, verifyVMWatchIntegrity(dir, files...), "is world-writable")
+	})
+
+	t.Run("WrongOwner", func(t *testing.T) {
+		dir := setupVMWatchFiles(t)
+		vmWatchFileOwnerUID = os.Getuid() + 1
+		require.ErrorContains(t, verifyVMWatchIntegrity(dir, files...), "instead of uid")
+	})
+
+	t.Run("Symlink", func(t *testing.T) {
+		dir := setupVMWatchFiles(t)
+		conf := filepath.Join(dir, VMWatchConfigFileName)
+		require.NoError(t, os.Rename(conf, conf+".orig"))
+		require.NoError(t, os.Symlink(conf+".orig", conf))
+		require.ErrorContains(t, verifyVMWatchIntegrity(dir, files...), "is not a regular file")
+	})
+
+	t.Run("MissingManifest", func(t *testing.T) {
+		dir := setupVMWatchFiles(t)
+		require.NoError(t, os.Remove(filepath.Join(dir, VMWatchManifestFileName)))
+		require.ErrorIs(t, verifyVMWatchIntegrity(dir, files...), errVMWatchManifestMissing)
+
+		// the files are still checked without a manifest
+		require.NoError(t, os.Chmod(filepath.Join(dir, VMWatchBinaryNameAmd64), 0777))
+		require.ErrorContains(t, verifyVMWatchIntegrity(dir, files...), "is world-writable")
+	})
+
+	t.Run("BundledManifest", func(t *testing.T) {
+		dir := setupVMWatchFiles(t)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, VMWatchBinaryNameArm64), []byte("#!/bin/sh\n"), 0755))
+		require.NoError(t, os.Remove(filepath.Join(dir, VMWatchManifestFileName)))
+		// the manifest is generated as by the bundle step of the Makefile
+		out, err := exec.Command("../misc/vmwatch-manifest.sh", dir).CombinedOutput()
+		require.NoError(t, err, string(out))
+		out, err = exec.Command("../misc/vmwatch-manifest.sh", "--check", dir).CombinedOutput()
+		require.NoError(t, err, string(out))
+		require.NoError(t, verifyVMWatchIntegrity(dir, files...))
+		require.NoError(t, verifyVMWatchIntegrity(dir, VMWatchBinaryNameArm64, VMWatchConfigFileName))
+	})
+
+	t.Run("BundleCheck", func(t *testing.T) {
+		dir := setupVMWatchFiles(t)
+		out, err := exec.Command("../misc/vmwatch-manifest.sh", "--check", dir).CombinedOutput()
+		require.NoError(t, err, string(out))
+
+		require.NoError(t, os.WriteFile(filepath.Join(dir, VMWatchBinaryNameArm64), []byte("#!/bin/sh\n"), 0755))
+		out, err = exec.Command("../misc/vmwatch-manifest.sh", "--check", dir).CombinedOutput()
+		require.Error(t, err, "a binary missing from the manifest should fail the bundle step")
+		require.Contains(t, string(out), VMWatchBinaryNameArm64+" is not listed")
+
+		require.NoError(t, os.Remove(filepath.Join(dir, VMWatchManifestFileName)))
+		out, err = exec.Command("../misc/vmwatch-manifest.sh", "--check", dir).CombinedOutput()
+		require.Error(t, err, "a missing manifest should fail the bundle step")
+		require.Contains(t, string(out), VMWatchManifestFileName+" is missing")
+	})
+
+	t.Run("InvalidManifest", func(t *testing.T) {
+		dir := setupVMWatchFiles(t)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, VMWatchManifestFileName), []byte("abc123 *"+VMWatchConfigFileName+"\n"), 0644))
+		require.ErrorContains(t, verifyVMWatchIntegrity(dir, files...), "invalid SHA-256 checksum for "+VMWatchConfigFileName)
+	})
+}
+
+func TestExecuteRetryLogic_IntegrityErrorStopsRetries(t *testing.T) {
+	resetVMWatchRetryCounters()
+	defer resetVMWatchRetryCounters()
+
+	calls := 0
+	helper := func(ctx context.Context, lg *slog.Logger, attempt int, s *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment) error {
+		calls++
+		return &VMWatchExitError{Reason: ExitReasonIntegrityError, Err: errors.New("checksum mismatch")}
+	}
+	hEnv := &handlerenv.HandlerEnvironment{}
+	hEnv.LogFolder = t.TempDir()
+	result := executeRetryLogic(context.Background(), nil, &vmWatchSettings{}, hEnv,
+		RetryConfig{MaxCycles: 2, AttemptsPerCycle: 3, BaseWaitHours: 1}, helper, func(ctx context.Context, d time.Duration) {}, nil)
+
+	assert.Equal(t, 1, calls, "a failed integrity check should not be retried")
+	assert.False(t, result.Success)
+	assert.Equal(t, ExitReasonIntegrityError, vmWatchExitReason(result.LastError))
+}
+
+func TestExecuteVMWatchHelper_MissingManifest(t *testing.T) {
+	orig := verifyVMWatchFiles
+	t.Cleanup(func() { verifyVMWatchFiles = orig })
+	verifyVMWatchFiles = func() error { return errVMWatchManifestMissing }
+	hEnv := &handlerenv.HandlerEnvironment{}
+	hEnv.LogFolder = t.TempDir()
+
+	err := executeVMWatchHelper(context.Background(), slog.Default(), 1, &vmWatchSettings{}, hEnv)
+	assert.Equal(t, ExitReasonIntegrityError, vmWatchExitReason(err), "a missing manifest should fail the integrity check")
+	assert.ErrorIs(t, err, errVMWatchManifestMissing)
+
+	err = executeVMWatchHelper(context.Background(), slog.Default(), 1, &vmWatchSettings{AllowMissingChecksumManifest: true}, hEnv)
+	assert.NotEqual(t, ExitReasonIntegrityError, vmWatchExitReason(err), "the check should be skipped when opted out")
+}
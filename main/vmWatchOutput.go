@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
+	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
+	"github.com/Azure/applicationhealth-extension-linux/pkg/logging"
+	"github.com/Azure/applicationhealth-extension-linux/pkg/redact"
+)
+
+// vmWatchOutput captures the combined stdout/stderr of a VMWatch process with
+// bounded memory: every line is redacted and streamed to a log file, and only
+// the last tailSize lines are kept for the exit error.
+type vmWatchOutput struct {
+	mu        sync.Mutex
+	log       io.Writer // may be nil if the output log could not be opened
+	partial   []byte    // incomplete last line
+	truncated int       // bytes of the last line discarded beyond maxLine
+	tail      []string  // ring buffer of the last lines
+	next      int       // index in tail the next line is written to
+	filled    bool      // tail has wrapped around
+	maxLine   int
+	logError  error
+}
+
+func newVMWatchOutput(log io.Writer, tailSize int, maxLine int) *vmWatchOutput {
+	return &vmWatchOutput{log: log, tail: make([]string, tailSize), maxLine: maxLine}
+}
+
+// Write splits p into lines, see appendPartial.
+func (o *vmWatchOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			o.appendPartial(p)
+			break
+		}
+		o.appendPartial(p[:i])
+		o.addLine()
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// appendPartial appends b to the incomplete last line. A line longer than
+// maxLine is truncated so that an output without newlines cannot grow the
+// buffer unbounded: the rest of the line is discarded rather than cut into
+// more lines, as a secret straddling the cut could not be redacted.
+func (o *vmWatchOutput) appendPartial(b []byte) {
+	if o.truncated > 0 {
+		o.truncated += len(b)
+		return
+	}
+	if len(o.partial)+len(b) > o.maxLine {
+		cut := o.maxLine - len(o.partial)
+		o.truncated = len(b) - cut
+		b = b[:cut]
+	}
+	o.partial = append(o.partial, b...)
+}
+
+// Flush records an incomplete last line, e.g. once the process has exited.
+func (o *vmWatchOutput) Flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.partial) > 0 || o.truncated > 0 {
+		o.addLine()
+	}
+}
+
+// addLine redacts the last line as a whole, writes it to the log and keeps it in
+// the tail.
+func (o *vmWatchOutput) addLine() {
+	line := redact.Text(strings.TrimRight(string(o.partial), "\r"))
+	if o.truncated > 0 {
+		line += fmt.Sprintf(" [%d bytes truncated]", o.truncated)
+	}
+	o.partial = o.partial[:0]
+	o.truncated = 0
+	if o.log != nil && o.logError == nil {
+		_, o.logError = fmt.Fprintf(o.log, "%s %s\n", time.Now().UTC().Format(time.RFC3339), line)
+	}
+	if len(o.tail) == 0 {
+		return
+	}
+	o.tail[o.next] = line
+	o.next = (o.next + 1) % len(o.tail)
+	if o.next == 0 {
+		o.filled = true
+	}
+}
+
+// Tail returns the last captured lines, oldest first, joined by newlines.
+func (o *vmWatchOutput) Tail() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	lines := o.tail[:o.next]
+	if o.filled {
+		lines = append(append([]string{}, o.tail[o.next:]...), o.tail[:o.next]...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// errorOutput returns the end of the output tail for the exit error, which is
+// reported in the status: at most VMWatchOutputMaxErrorLength bytes, starting
+// at a line if possible. The whole output is in the output log.
+func errorOutput(tail string) string {
+	if len(tail) <= VMWatchOutputMaxErrorLength {
+		return tail
+	}
+	tail = tail[len(tail)-VMWatchOutputMaxErrorLength:]
+	if i := strings.IndexByte(tail, '\n'); i >= 0 {
+		tail = tail[i+1:]
+	}
+	for len(tail) > 0 && !utf8.RuneStart(tail[0]) {
+		tail = tail[1:]
+	}
+	return "..." + tail
+}
+
+// LogError returns the first error writing to the output log, after which
+// lines are only kept in the tail.
+func (o *vmWatchOutput) LogError() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.logError
+}
+
+// vmWatchOutputCapture is the destination of a VMWatch process's stdout/stderr.
+type vmWatchOutputCapture struct {
+	*vmWatchOutput
+	log *logging.RotatingFile
+}
+
+// newVMWatchOutputCapture streams VMWatch output to the rotated output log in the
+// extension log folder. If the log cannot be opened, only the tail is kept.
+func newVMWatchOutputCapture(hEnv *handlerenv.HandlerEnvironment) *vmWatchOutputCapture {
+	path := filepath.Join(hEnv.LogFolder, VMWatchOutputLogFileName)
+	log, err := logging.NewRotatingFile(path, VMWatchOutputLogMaxSizeInBytes, VMWatchOutputLogMaxBackups)
+	if err != nil {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.StartVMWatchTask,
+			fmt.Sprintf("Failed to open VMWatch output log, only the last %d lines will be kept: %v", VMWatchOutputTailLines, err), "error", err)
+		return &vmWatchOutputCapture{vmWatchOutput: newVMWatchOutput(nil, VMWatchOutputTailLines, VMWatchOutputMaxLineLength)}
+	}
+	return &vmWatchOutputCapture{vmWatchOutput: newVMWatchOutput(log, VMWatchOutputTailLines, VMWatchOutputMaxLineLength), log: log}
+}
+
+// Close flushes the output and closes the output log.
+func (c *vmWatchOutputCapture) Close() error {
+	c.Flush()
+	if err := c.LogError(); err != nil {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.StopVMWatchTask,
+			fmt.Sprintf("Failed to write VMWatch output log: %v", err), "error", err)
+	}
+	if c.log == nil {
+		return nil
+	}
+	return c.log.Close()
+}
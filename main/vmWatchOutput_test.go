@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_vmWatchOutput_KeepsLastLines(t *testing.T) {
+	var log bytes.Buffer
+	o := newVMWatchOutput(&log, 3, 100)
+
+	_, err := o.Write([]byte("line1\nline2\nli"))
+	require.NoError(t, err)
+	assert.Equal(t, "line1\nline2", o.Tail(), "an incomplete line should not be in the tail")
+
+	_, err = o.Write([]byte("ne3\r\nline4\nline5"))
+	require.NoError(t, err)
+	o.Flush()
+	assert.Equal(t, "line3\nline4\nline5", o.Tail())
+
+	logged := strings.Split(strings.TrimSuffix(log.String(), "\n"), "\n")
+	require.Len(t, logged, 5, "every line should be written to the log")
+	assert.True(t, strings.HasSuffix(logged[0], " line1"), logged[0])
+	assert.True(t, strings.HasSuffix(logged[4], " line5"), logged[4])
+}
+
+func Test_vmWatchOutput_TruncatesLongLines(t *testing.T) {
+	var log bytes.Buffer
+	o := newVMWatchOutput(&log, 10, 4)
+
+	_, err := o.Write([]byte("abcdefghij"))
+	require.NoError(t, err)
+	assert.Equal(t, "", o.Tail(), "output without newlines should not be buffered unbounded")
+
+	_, err = o.Write([]byte("\n0123\n45678\nab"))
+	require.NoError(t, err)
+	o.Flush()
+	assert.Equal(t, "abcd [6 bytes truncated]\n0123\n4567 [1 bytes truncated]\nab", o.Tail())
+	assert.Equal(t, 4, strings.Count(log.String(), "\n"), "a truncated line should be logged once")
+}
+
+func Test_vmWatchOutput_RedactsTruncatedLines(t *testing.T) {
+	var log bytes.Buffer
+	line := "GET https://example.blob.core.windows.net/c?sv=2020&sig=secret failed"
+	o := newVMWatchOutput(&log, 5, strings.Index(line, "cret"))
+
+	// the secret straddles both the writes and the truncation
+	_, err := o.Write([]byte(line[:strings.Index(line, "sig=")+2]))
+	require.NoError(t, err)
+	_, err = o.Write([]byte(line[strings.Index(line, "sig=")+2:] + "\n"))
+	require.NoError(t, err)
+
+	for _, output := range []string{o.Tail(), log.String()} {
+		assert.NotContains(t, output, "sig=")
+		assert.NotContains(t, output, "cret")
+		assert.Contains(t, output, "https://example.blob.core.windows.net/c?<redacted> [11 bytes truncated]")
+	}
+}
+
+func Test_vmWatchOutput_RedactsLines(t *testing.T) {
+	var log bytes.Buffer
+	o := newVMWatchOutput(&log, 5, 1000)
+
+	_, err := o.Write([]byte("GET https://example.blob.core.windows.net/c?sv=2020&sig=secret failed\n"))
+	require.NoError(t, err)
+
+	assert.NotContains(t, o.Tail(), "sig=secret")
+	assert.NotContains(t, log.String(), "sig=secret")
+	assert.Contains(t, o.Tail(), "https://example.blob.core.windows.net/c")
+}
+
+func Test_errorOutput(t *testing.T) {
+	assert.Equal(t, "line1\nline2", errorOutput("line1\nline2"))
+
+	long := strings.Repeat("a", VMWatchOutputMaxErrorLength)
+	assert.Equal(t, "...panic: boom", errorOutput(long+"\npanic: boom"), "the output should start at a line")
+
+	output := errorOutput(strings.Repeat("é", VMWatchOutputMaxErrorLength))
+	assert.LessOrEqual(t, len(output), len("...")+VMWatchOutputMaxErrorLength)
+	assert.True(t, utf8.ValidString(output), "the output should not start within a character")
+}
+
+type failingWriter struct{ n int }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.n++
+	return 0, assert.AnError
+}
+
+func Test_vmWatchOutput_LogError(t *testing.T) {
+	w := &failingWriter{}
+	o := newVMWatchOutput(w, 5, 100)
+
+	_, err := o.Write([]byte("a\nb\n"))
+	require.NoError(t, err, "a log failure should not fail the process output")
+	assert.ErrorIs(t, o.LogError(), assert.AnError)
+	assert.Equal(t, 1, w.n, "the log should not be written after a failure")
+	assert.Equal(t, "a\nb", o.Tail())
+}
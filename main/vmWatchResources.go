@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/cgroupusage"
+	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
+)
+
+// vmWatchCgroupPaths resolves the cgroup VMWatch runs in, which is the systemd
+// scope when launched with systemd-run and the vmwatch.slice cgroup otherwise.
+// It is a variable to allow overriding in tests.
+var vmWatchCgroupPaths = func(pid int) (*cgroupusage.Paths, error) {
+	return cgroupusage.ForPID(pid, cgroupusage.DefaultMountRoot)
+}
+
+// vmWatchResourceUsage is the resource usage of a VMWatch process. The counters
+// are relative to when the process started, as the vmwatch.slice cgroup is
+// reused across attempts.
+type vmWatchResourceUsage struct {
+	PID                 int
+	MemoryCurrent       uint64
+	MemoryPeak          uint64
+	CPUPeriods          uint64
+	CPUThrottledPeriods uint64
+	CPUThrottledTime    time.Duration
+	OOMKills            uint64
+	// Throttled is true if the CPU was throttled since the previous sample.
+	Throttled bool
+}
+
+func (u *vmWatchResourceUsage) String() string {
+	s := fmt.Sprintf("resource usage: memory %s", formatBytes(u.MemoryCurrent))
+	if u.MemoryPeak > 0 {
+		s += fmt.Sprintf(" (peak %s)", formatBytes(u.MemoryPeak))
+	}
+	s += fmt.Sprintf(", CPU throttled in %d of %d periods, %d OOM kills", u.CPUThrottledPeriods, u.CPUPeriods, u.OOMKills)
+	var flags []string
+	if u.Throttled {
+		flags = append(flags, "THROTTLED")
+	}
+	if u.OOMKills > 0 {
+		flags = append(flags, "OOM KILLED")
+	}
+	if len(flags) > 0 {
+		s += ", " + strings.Join(flags, ", ")
+	}
+	return s
+}
+
+// statusType is the status of the VMWatch resource usage substatus, a warning
+// when the process is being throttled or was OOM-killed.
+func (u *vmWatchResourceUsage) statusType() StatusType {
+	if u.Throttled || u.OOMKills > 0 {
+		return StatusWarning
+	}
+	return StatusSuccess
+}
+
+func formatBytes(n uint64) string {
+	return fmt.Sprintf("%.1f MiB", float64(n)/(1024*1024))
+}
+
+// Resource usage of the current (or last) VMWatch process, shown in the VMWatch resource usage substatus
+var (
+	vmWatchResourceUsageMutex   sync.RWMutex
+	currentVMWatchResourceUsage *vmWatchResourceUsage
+)
+
+func setVMWatchResourceUsage(u *vmWatchResourceUsage) {
+	vmWatchResourceUsageMutex.Lock()
+	defer vmWatchResourceUsageMutex.Unlock()
+	currentVMWatchResourceUsage = u
+}
+
+// getVMWatchResourceUsage returns the last resource usage sample, or nil if none
+// was taken.
+func getVMWatchResourceUsage() *vmWatchResourceUsage {
+	vmWatchResourceUsageMutex.RLock()
+	defer vmWatchResourceUsageMutex.RUnlock()
+	return currentVMWatchResourceUsage
+}
+
+// vmWatchResourceMonitor samples the cgroup of a VMWatch process.
+type vmWatchResourceMonitor struct {
+	pid      int
+	paths    *cgroupusage.Paths
+	baseline *cgroupusage.Usage
+	previous *cgroupusage.Usage
+}
+
+func (m *vmWatchResourceMonitor) sample() (*vmWatchResourceUsage, error) {
+	if m.paths == nil {
+		paths, err := vmWatchCgroupPaths(m.pid)
+		if err != nil {
+			return nil, err
+		}
+		m.paths = paths
+	}
+	u, err := m.paths.Read()
+	if err != nil {
+		return nil, err
+	}
+	if m.baseline == nil {
+		m.baseline, m.previous = u, u
+	}
+	usage := &vmWatchResourceUsage{
+		PID:                 m.pid,
+		MemoryCurrent:       u.MemoryCurrent,
+		MemoryPeak:          u.MemoryPeak,
+		CPUPeriods:          u.CPUPeriods - m.baseline.CPUPeriods,
+		CPUThrottledPeriods: u.CPUThrottledPeriods - m.baseline.CPUThrottledPeriods,
+		CPUThrottledTime:    u.CPUThrottledTime - m.baseline.CPUThrottledTime,
+		OOMKills:            u.OOMKills - m.baseline.OOMKills,
+		Throttled:           u.CPUThrottledPeriods > m.previous.CPUThrottledPeriods,
+	}
+	m.previous = u
+	return usage, nil
+}
+
+// monitorResourceUsage samples the resource usage of VMWatch process pid every
+// interval until stop is closed, reporting each sample to telemetry and keeping
+// the last one for the VMWatch resource usage substatus.
+func monitorResourceUsage(pid int, interval time.Duration, stop <-chan struct{}) {
+	m := &vmWatchResourceMonitor{pid: pid}
+	failed := false
+	report := func(final bool) {
+		u, err := m.sample()
+		if err != nil {
+			// the cgroup of a systemd scope is removed as soon as the process exits
+			if !failed && !final {
+				telemetry.SendEvent(telemetry.WarningEvent, telemetry.VMWatchUsageTask,
+					fmt.Sprintf("Failed to read resource usage of VMWatch PID %d: %v", pid, err), "error", err)
+			}
+			failed = true
+			return
+		}
+		failed = false
+		setVMWatchResourceUsage(u)
+		level := telemetry.InfoEvent
+		if u.Throttled || u.OOMKills > 0 {
+			level = telemetry.WarningEvent
+		}
+		telemetry.SendEvent(level, telemetry.VMWatchUsageTask, fmt.Sprintf("VMWatch PID %d %s", pid, u),
+			"pid", pid, "memoryCurrentBytes", u.MemoryCurrent, "memoryPeakBytes", u.MemoryPeak,
+			"cpuPeriods", u.CPUPeriods, "cpuThrottledPeriods", u.CPUThrottledPeriods,
+			"cpuThrottledMilliseconds", u.CPUThrottledTime.Milliseconds(), "oomKills", u.OOMKills)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	report(false)
+	for {
+		select {
+		case <-stop:
+			report(true)
+			return
+		case <-ticker.C:
+			report(false)
+		}
+	}
+}
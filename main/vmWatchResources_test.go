@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/cgroupusage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeVMWatchCgroup points vmWatchCgroupPaths at a temporary cgroup v2 folder.
+func fakeVMWatchCgroup(t *testing.T) string {
+	dir := t.TempDir()
+	orig := vmWatchCgroupPaths
+	t.Cleanup(func() {
+		vmWatchCgroupPaths = orig
+		setVMWatchResourceUsage(nil)
+	})
+	vmWatchCgroupPaths = func(pid int) (*cgroupusage.Paths, error) {
+		return &cgroupusage.Paths{Memory: cgroupusage.Controller{Dir: dir}, CPU: cgroupusage.Controller{Dir: dir}}, nil
+	}
+	return dir
+}
+
+func writeCgroupCounters(t *testing.T, dir string, memory, periods, throttled, oomKills uint64) {
+	files := map[string]string{
+		"memory.current": fmt.Sprint(memory),
+		"memory.peak":    fmt.Sprint(memory * 2),
+		"memory.events":  fmt.Sprintf("oom %d\noom_kill %d\n", oomKills, oomKills),
+		"cpu.stat":       fmt.Sprintf("nr_periods %d\nnr_throttled %d\nthrottled_usec %d\n", periods, throttled, throttled*1000),
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+}
+
+func Test_vmWatchResourceMonitor_Sample(t *testing.T) {
+	dir := fakeVMWatchCgroup(t)
+	m := &vmWatchResourceMonitor{pid: 42}
+
+	// counters left over from previous VMWatch processes in the same cgroup
+	writeCgroupCounters(t, dir, 10<<20, 100, 10, 1)
+	u, err := m.sample()
+	require.NoError(t, err)
+	assert.Equal(t, &vmWatchResourceUsage{PID: 42, MemoryCurrent: 10 << 20, MemoryPeak: 20 << 20}, u)
+	assert.Equal(t, "resource usage: memory 10.0 MiB (peak 20.0 MiB), CPU throttled in 0 of 0 periods, 0 OOM kills", u.String())
+	assert.Equal(t, StatusSuccess, u.statusType())
+
+	writeCgroupCounters(t, dir, 30<<20, 160, 13, 1)
+	u, err = m.sample()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(60), u.CPUPeriods)
+	assert.Equal(t, uint64(3), u.CPUThrottledPeriods)
+	assert.Equal(t, 3*time.Millisecond, u.CPUThrottledTime)
+	assert.True(t, u.Throttled)
+	assert.Equal(t, "resource usage: memory 30.0 MiB (peak 60.0 MiB), CPU throttled in 3 of 60 periods, 0 OOM kills, THROTTLED", u.String())
+	assert.Equal(t, StatusWarning, u.statusType())
+
+	writeCgroupCounters(t, dir, 30<<20, 200, 13, 2)
+	u, err = m.sample()
+	require.NoError(t, err)
+	assert.False(t, u.Throttled, "no throttling since the previous sample")
+	assert.Equal(t, uint64(1), u.OOMKills)
+	assert.Contains(t, u.String(), "OOM KILLED")
+	assert.Equal(t, StatusWarning, u.statusType())
+}
+
+func Test_monitorResourceUsage(t *testing.T) {
+	dir := fakeVMWatchCgroup(t)
+	writeCgroupCounters(t, dir, 1<<20, 10, 0, 0)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		monitorResourceUsage(42, time.Hour, stop)
+	}()
+
+	require.Eventually(t, func() bool { return getVMWatchResourceUsage() != nil }, 5*time.Second, 10*time.Millisecond,
+		"usage should be sampled when monitoring starts")
+
+	// a final sample is taken when the process exits
+	writeCgroupCounters(t, dir, 1<<20, 10, 0, 1)
+	close(stop)
+	<-done
+	assert.Equal(t, uint64(1), getVMWatchResourceUsage().OOMKills)
+}
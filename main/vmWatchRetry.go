@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/state"
+	"github.com/Azure/applicationhealth-extension-linux/internal/telemetry"
+)
+
+const (
+	vmWatchRetryStateFileName      = "vmwatch-retry.json"
+	vmWatchRetryStateSchemaVersion = 1
+)
+
+// vmWatchRetryState is the progress of the VMWatch retry cycles. It is persisted
+// under dataDir so that restarting the extension (a new sequence number, a
+// takeover or a crash) does not hand a crash-looping VMWatch a fresh retry budget.
+type vmWatchRetryState struct {
+	// Cycle is the retry cycle the next attempt belongs to. A cycle greater than
+	// the maximum number of cycles means the retries are exhausted.
+	Cycle int `json:"cycle"`
+	// CycleAttempts is the number of failed attempts already made in Cycle.
+	CycleAttempts int       `json:"cycleAttempts"`
+	TotalAttempts int       `json:"totalAttempts"`
+	LastFailure   time.Time `json:"lastFailure,omitempty"`
+	// NextEligible is the end of the backoff window before Cycle may start.
+	NextEligible time.Time `json:"nextEligible,omitempty"`
+	// SettingsHash identifies the VMWatch settings the counters apply to; the
+	// counters are reset when the settings change.
+	SettingsHash string `json:"settingsHash,omitempty"`
+}
+
+// Global state for VMWatch retry reset functionality
+var (
+	vmWatchRetryMutex sync.RWMutex // Mutex to protect access to retry counters
+	vmWatchRetry      = vmWatchRetryState{Cycle: 1}
+	// vmWatchRetryStatePath is the file the retry state is persisted to. It is
+	// empty, and the state is only kept in memory, until loadVMWatchRetryState
+	// is called.
+	vmWatchRetryStatePath string
+	// vmWatchRetryResets counts the calls to resetVMWatchRetryCounters, so that
+	// executeRetryLogic can tell that VMWatch ran successfully for long enough
+	// to reset the counters before an attempt failed.
+	vmWatchRetryResets uint64
+)
+
+// vmWatchSettingsHash returns a fingerprint of the VMWatch settings.
+func vmWatchSettingsHash(s *vmWatchSettings) string {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadVMWatchRetryState restores the retry state persisted under dataDir. The
+// counters start over if no state was persisted, if it cannot be read, or if it
+// was recorded for different VMWatch settings.
+func loadVMWatchRetryState(s *vmWatchSettings) {
+	path := filepath.Join(dataDir, vmWatchRetryStateFileName)
+	current := vmWatchRetryState{Cycle: 1, SettingsHash: vmWatchSettingsHash(s)}
+
+	persisted, err := readVMWatchRetryState(path)
+	switch {
+	case err == state.ErrNotFound:
+	case err != nil:
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.StartVMWatchTask,
+			fmt.Sprintf("Failed to read VMWatch retry state, retry counters reset: %v", err), "error", err)
+	case persisted.SettingsHash != current.SettingsHash:
+		telemetry.SendEvent(telemetry.InfoEvent, telemetry.StartVMWatchTask, "VMWatch settings changed, retry counters reset")
+	default:
+		current = *persisted
+		telemetry.SendEvent(telemetry.InfoEvent, telemetry.StartVMWatchTask,
+			fmt.Sprintf("Restored VMWatch retry state: cycle %d, %d attempts", current.Cycle, current.TotalAttempts),
+			"cycle", current.Cycle, "cycleAttempts", current.CycleAttempts, "totalAttempts", current.TotalAttempts,
+			"lastFailure", current.LastFailure, "nextEligible", current.NextEligible)
+	}
+
+	vmWatchRetryMutex.Lock()
+	defer vmWatchRetryMutex.Unlock()
+	vmWatchRetryStatePath = path
+	vmWatchRetry = current
+	persistVMWatchRetryState()
+}
+
+func readVMWatchRetryState(path string) (*vmWatchRetryState, error) {
+	d, err := state.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	if d.SchemaVersion != vmWatchRetryStateSchemaVersion {
+		return nil, fmt.Errorf("unsupported schema version %d", d.SchemaVersion)
+	}
+	var s vmWatchRetryState
+	if err := d.Decode(&s); err != nil {
+		return nil, err
+	}
+	if s.Cycle < 1 {
+		s.Cycle = 1
+	}
+	return &s, nil
+}
+
+// persistVMWatchRetryState writes the retry state, if it was loaded from a file.
+// The caller must hold vmWatchRetryMutex.
+func persistVMWatchRetryState() {
+	if vmWatchRetryStatePath == "" {
+		return
+	}
+	if err := state.Write(vmWatchRetryStatePath, vmWatchRetryStateSchemaVersion, GetExtensionVersion(), vmWatchRetry); err != nil {
+		telemetry.SendEvent(telemetry.WarningEvent, telemetry.StartVMWatchTask,
+			fmt.Sprintf("Failed to persist VMWatch retry state: %v", err), "error", err)
+	}
+}
+
+// getVMWatchRetryState returns a copy of the retry state.
+func getVMWatchRetryState() vmWatchRetryState {
+	vmWatchRetryMutex.RLock()
+	defer vmWatchRetryMutex.RUnlock()
+	return vmWatchRetry
+}
+
+// setVMWatchRetryState replaces and persists the retry state, keeping the
+// settings it applies to.
+func setVMWatchRetryState(s vmWatchRetryState) {
+	vmWatchRetryMutex.Lock()
+	defer vmWatchRetryMutex.Unlock()
+	s.SettingsHash = vmWatchRetry.SettingsHash
+	vmWatchRetry = s
+	persistVMWatchRetryState()
+}
+
+// resetVMWatchRetryCounters resets the retry counters
+func resetVMWatchRetryCounters() {
+	vmWatchRetryMutex.Lock()
+	defer vmWatchRetryMutex.Unlock()
+	vmWatchRetryResets++
+	vmWatchRetry = vmWatchRetryState{Cycle: 1, SettingsHash: vmWatchRetry.SettingsHash}
+	persistVMWatchRetryState()
+}
+
+// getVMWatchRetryResets returns the number of times the retry counters were
+// reset by resetVMWatchRetryCounters.
+func getVMWatchRetryResets() uint64 {
+	vmWatchRetryMutex.RLock()
+	defer vmWatchRetryMutex.RUnlock()
+	return vmWatchRetryResets
+}
+
+// updateVMWatchRetryCounters updates the current retry state
+func updateVMWatchRetryCounters(cycle int, totalAttempts int) {
+	s := getVMWatchRetryState()
+	s.Cycle, s.CycleAttempts, s.TotalAttempts = cycle, 0, totalAttempts
+	setVMWatchRetryState(s)
+}
+
+// getVMWatchRetryCounters gets the current retry state
+func getVMWatchRetryCounters() (int, int) {
+	s := getVMWatchRetryState()
+	return s.Cycle, s.TotalAttempts
+}
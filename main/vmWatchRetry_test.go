@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/applicationhealth-extension-linux/internal/handlerenv"
+	"github.com/Azure/applicationhealth-extension-linux/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupVMWatchRetryStateTest points dataDir at a temporary directory and restores
+// the in-memory retry state when the test ends.
+func setupVMWatchRetryStateTest(t *testing.T) string {
+	origDataDir := dataDir
+	t.Cleanup(func() {
+		dataDir = origDataDir
+		vmWatchRetryMutex.Lock()
+		vmWatchRetry, vmWatchRetryStatePath = vmWatchRetryState{Cycle: 1}, ""
+		vmWatchRetryMutex.Unlock()
+	})
+	dataDir = t.TempDir()
+	return filepath.Join(dataDir, vmWatchRetryStateFileName)
+}
+
+func failingVMWatchHelper(calls *int) HelperFunc {
+	return func(ctx context.Context, lg *slog.Logger, attempt int, s *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment) error {
+		*calls++
+		return errors.New("fail")
+	}
+}
+
+func Test_loadVMWatchRetryState(t *testing.T) {
+	path := setupVMWatchRetryStateTest(t)
+	s := &vmWatchSettings{Enabled: true, MaxCpuPercentage: 5}
+
+	loadVMWatchRetryState(s)
+	assert.Equal(t, vmWatchRetryState{Cycle: 1, SettingsHash: vmWatchSettingsHash(s)}, getVMWatchRetryState())
+	assert.FileExists(t, path, "the retry state should be persisted when loaded")
+
+	lastFailure := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	setVMWatchRetryState(vmWatchRetryState{Cycle: 2, CycleAttempts: 1, TotalAttempts: 4, LastFailure: lastFailure})
+
+	t.Run("SameSettings_ShouldRestore", func(t *testing.T) {
+		loadVMWatchRetryState(&vmWatchSettings{Enabled: true, MaxCpuPercentage: 5})
+		got := getVMWatchRetryState()
+		assert.Equal(t, 2, got.Cycle)
+		assert.Equal(t, 1, got.CycleAttempts)
+		assert.Equal(t, 4, got.TotalAttempts)
+		assert.True(t, lastFailure.Equal(got.LastFailure))
+	})
+
+	t.Run("ChangedSettings_ShouldReset", func(t *testing.T) {
+		changed := &vmWatchSettings{Enabled: true, MaxCpuPercentage: 10}
+		loadVMWatchRetryState(changed)
+		assert.Equal(t, vmWatchRetryState{Cycle: 1, SettingsHash: vmWatchSettingsHash(changed)}, getVMWatchRetryState())
+
+		d, err := state.Read(path)
+		require.NoError(t, err)
+		var persisted vmWatchRetryState
+		require.NoError(t, d.Decode(&persisted))
+		assert.Equal(t, 0, persisted.TotalAttempts, "the reset should be persisted")
+	})
+
+	t.Run("UnsupportedSchema_ShouldReset", func(t *testing.T) {
+		require.NoError(t, state.Write(path, vmWatchRetryStateSchemaVersion+1, "2.0.14", vmWatchRetryState{Cycle: 3}))
+		loadVMWatchRetryState(s)
+		assert.Equal(t, 1, getVMWatchRetryState().Cycle)
+	})
+}
+
+func TestExecuteRetryLogic_PersistsRetryState(t *testing.T) {
+	setupVMWatchRetryStateTest(t)
+	s := &vmWatchSettings{Enabled: true}
+	loadVMWatchRetryState(s)
+
+	calls := 0
+	var slept time.Duration
+	config := RetryConfig{MaxCycles: 2, AttemptsPerCycle: 2, BaseWaitHours: 3}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// stop during the backoff sleep, as if the extension was restarted
+	sleep := func(ctx context.Context, d time.Duration) {
+		slept = d
+		cancel()
+	}
+
+	executeRetryLogic(ctx, nil, s, &handlerenv.HandlerEnvironment{}, config, failingVMWatchHelper(&calls), sleep, nil)
+	require.Equal(t, 2, calls)
+	assert.Equal(t, 3*time.Hour, slept)
+
+	// a new extension process restores the state and honours the backoff window
+	loadVMWatchRetryState(s)
+	retry := getVMWatchRetryState()
+	assert.Equal(t, 2, retry.Cycle)
+	assert.Equal(t, 2, retry.TotalAttempts)
+	assert.False(t, retry.LastFailure.IsZero())
+	assert.WithinDuration(t, time.Now().Add(3*time.Hour), retry.NextEligible, time.Minute)
+
+	calls, slept = 0, 0
+	result := executeRetryLogic(context.Background(), nil, s, &handlerenv.HandlerEnvironment{}, config, failingVMWatchHelper(&calls),
+		func(ctx context.Context, d time.Duration) { slept = d }, nil)
+	assert.InDelta(t, float64(3*time.Hour), float64(slept), float64(time.Minute), "the remaining backoff should be waited for")
+	assert.Equal(t, 2, calls, "only the last cycle should be run")
+	assert.Equal(t, 4, result.TotalAttempts)
+	assert.False(t, result.Success)
+
+	// once exhausted, VMWatch is not started again until the settings change
+	loadVMWatchRetryState(s)
+	calls = 0
+	result = executeRetryLogic(context.Background(), nil, s, &handlerenv.HandlerEnvironment{}, config, failingVMWatchHelper(&calls),
+		func(ctx context.Context, d time.Duration) {}, nil)
+	assert.Equal(t, 0, calls)
+	assert.Error(t, result.LastError)
+
+	loadVMWatchRetryState(&vmWatchSettings{Enabled: true, DisableConfigReader: true})
+	executeRetryLogic(context.Background(), nil, s, &handlerenv.HandlerEnvironment{}, config, failingVMWatchHelper(&calls),
+		func(ctx context.Context, d time.Duration) {}, nil)
+	assert.Equal(t, 4, calls, "a settings change should give VMWatch a new retry budget")
+}
+
+func TestExecuteRetryLogic_ResumesAttemptsInCycle(t *testing.T) {
+	setupVMWatchRetryStateTest(t)
+	setVMWatchRetryState(vmWatchRetryState{Cycle: 1, CycleAttempts: 2, TotalAttempts: 2, LastFailure: time.Now()})
+
+	var attempts []int
+	helper := func(ctx context.Context, lg *slog.Logger, attempt int, s *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment) error {
+		attempts = append(attempts, attempt)
+		return errors.New("fail")
+	}
+	result := executeRetryLogic(context.Background(), nil, &vmWatchSettings{}, &handlerenv.HandlerEnvironment{},
+		RetryConfig{MaxCycles: 1, AttemptsPerCycle: 3}, helper, func(ctx context.Context, d time.Duration) {}, nil)
+
+	assert.Equal(t, []int{3}, attempts, "attempts already made in the cycle should not be repeated")
+	assert.Equal(t, 3, result.TotalAttempts)
+}
+
+func TestExecuteRetryLogic_StartsOverAfterReset(t *testing.T) {
+	setupVMWatchRetryStateTest(t)
+	setVMWatchRetryState(vmWatchRetryState{Cycle: 2, TotalAttempts: 3, LastFailure: time.Now()})
+
+	var attempts []int
+	helper := func(ctx context.Context, lg *slog.Logger, attempt int, s *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment) error {
+		attempts = append(attempts, attempt)
+		if len(attempts) == 1 {
+			// VMWatch ran successfully for long enough before it failed
+			resetVMWatchRetryCounters()
+		}
+		return errors.New("fail")
+	}
+	result := executeRetryLogic(context.Background(), nil, &vmWatchSettings{}, &handlerenv.HandlerEnvironment{},
+		RetryConfig{MaxCycles: 2, AttemptsPerCycle: 2}, helper, func(ctx context.Context, d time.Duration) {}, nil)
+
+	assert.Equal(t, []int{1, 2, 1, 2}, attempts, "the failure after the reset should be the first of a new retry budget")
+	assert.Equal(t, 4, result.TotalAttempts)
+	retry := getVMWatchRetryState()
+	assert.Equal(t, 3, retry.Cycle)
+	assert.Equal(t, 4, retry.TotalAttempts)
+}
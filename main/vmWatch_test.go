@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"log/slog"
 	"os"
@@ -93,7 +94,7 @@ func TestMonitorHeartBeat_ResetsCountersAfterOneHour(t *testing.T) {
 		defer close(done)
 
 		// Start monitoring with controlled start time (1.5 hours ago)
-		monitorHeartBeat(lg, heartbeatFile, processDone, cmd, startTime)
+		monitorHeartBeat(context.Background(), lg, heartbeatFile, VMWatchHeartbeatTimeoutInSeconds*time.Second, processDone, cmd, startTime)
 	}()
 
 	// Let the monitor start
@@ -158,7 +159,7 @@ func TestMonitorHeartBeat_DoesNotResetCountersBeforeOneHour(t *testing.T) {
 		defer close(done)
 
 		// Start monitoring with recent start time
-		monitorHeartBeat(lg, heartbeatFile, processDone, cmd, startTime)
+		monitorHeartBeat(context.Background(), lg, heartbeatFile, VMWatchHeartbeatTimeoutInSeconds*time.Second, processDone, cmd, startTime)
 	}()
 
 	// Let the monitor start
@@ -220,7 +221,7 @@ func TestMonitorHeartBeat_ResetsOnProcessExit(t *testing.T) {
 		defer close(done)
 
 		// Start monitoring with controlled start time
-		monitorHeartBeat(lg, heartbeatFile, processDone, cmd, startTime)
+		monitorHeartBeat(context.Background(), lg, heartbeatFile, VMWatchHeartbeatTimeoutInSeconds*time.Second, processDone, cmd, startTime)
 	}()
 
 	// Let the monitor start
@@ -338,12 +339,13 @@ func TestExecuteRetryLogic(t *testing.T) {
 			// Setup mocks
 			callCount := 0
 			sleepCallCount := 0
-			shutdownTriggered := false
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
 
-			mockHelper := func(lg *slog.Logger, attempt int, s *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment) error {
+			mockHelper := func(ctx context.Context, lg *slog.Logger, attempt int, s *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment) error {
 				callCount++
 				if tt.shutdownAfterCalls > 0 && callCount >= tt.shutdownAfterCalls {
-					shutdownTriggered = true
+					cancel()
 				}
 				if callCount-1 < len(tt.helperErrors) {
 					return tt.helperErrors[callCount-1]
@@ -351,24 +353,20 @@ func TestExecuteRetryLogic(t *testing.T) {
 				return errors.New("unexpected call")
 			}
 
-			mockSleep := func(d time.Duration) {
+			mockSleep := func(ctx context.Context, d time.Duration) {
 				sleepCallCount++
 				// Don't actually sleep in tests
 			}
 
-			mockShutdown := func() bool {
-				return shutdownTriggered
-			}
-
 			// Test the actual production function
 			result := executeRetryLogic(
+				ctx,
 				nil,                              // logger
 				&vmWatchSettings{},               // settings
 				&handlerenv.HandlerEnvironment{}, // hEnv
 				tt.config,
 				mockHelper,
 				mockSleep,
-				mockShutdown,
 				nil, // no result channel for simplicity
 			)
 
@@ -387,6 +385,68 @@ func TestExecuteRetryLogic(t *testing.T) {
 	}
 }
 
+func TestExecuteRetryLogic_ShutdownInterruptsBackoffSleep(t *testing.T) {
+	resetVMWatchRetryCounters()
+	defer resetVMWatchRetryCounters()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	failing := func(ctx context.Context, lg *slog.Logger, attempt int, s *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment) error {
+		return errors.New("fail")
+	}
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	result := executeRetryLogic(ctx, nil, &vmWatchSettings{}, &handlerenv.HandlerEnvironment{},
+		RetryConfig{MaxCycles: 2, AttemptsPerCycle: 1, BaseWaitHours: 3}, failing, sleepContext, nil)
+
+	assert.Less(t, time.Since(start), 5*time.Second, "shutdown should interrupt the multi-hour backoff sleep")
+	assert.Equal(t, 1, result.TotalAttempts, "no attempts should be made after shutdown")
+	assert.False(t, result.Success)
+}
+
+func TestMonitorHeartBeat_KillsProcessOnShutdown(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	require.NoError(t, cmd.Start())
+
+	processDone := make(chan bool)
+	go func() {
+		cmd.Wait()
+		processDone <- true
+		close(processDone)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var killedBy VMWatchExitReason
+	go func() {
+		defer close(done)
+		killedBy = monitorHeartBeat(ctx, slog.Default(), filepath.Join(t.TempDir(), "heartbeat.txt"), VMWatchHeartbeatTimeoutInSeconds*time.Second, processDone, cmd, time.Now())
+	}()
+	cancel()
+
+	select {
+	case <-done:
+		require.NotNil(t, cmd.ProcessState, "process should have exited")
+		assert.Equal(t, ExitReasonShutdown, killedBy)
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("monitorHeartBeat did not kill the process on shutdown")
+	}
+}
+
+func TestWaitForVMWatchExit(t *testing.T) {
+	ch := make(chan VMWatchResult)
+	go func() {
+		ch <- VMWatchResult{Status: Failed}
+		close(ch)
+	}()
+	waitForVMWatchExit(ch, 5*time.Second)
+
+	start := time.Now()
+	waitForVMWatchExit(make(chan VMWatchResult), 50*time.Millisecond)
+	assert.Less(t, time.Since(start), 5*time.Second, "should give up after the timeout")
+}
+
 // Test actual production functions
 func TestGetProcessDirectory(t *testing.T) {
 	dir, err := GetProcessDirectory()
@@ -416,3 +476,40 @@ func TestGetVMWatchEnvironmentVariables(t *testing.T) {
 	}
 	assert.True(t, found, "Should contain the override variable")
 }
+
+func TestRetryConfig_Backoff(t *testing.T) {
+	linear := RetryConfig{BaseWaitHours: 3}
+	assert.Equal(t, 3*time.Hour, linear.backoff(1))
+	assert.Equal(t, 9*time.Hour, linear.backoff(3))
+
+	origRand := randInt63n
+	t.Cleanup(func() { randInt63n = origRand })
+	exponential := RetryConfig{BaseWaitHours: 3, Backoff: ExponentialBackoff}
+
+	randInt63n = func(n int64) int64 { return n - 1 }
+	assert.Equal(t, 3*time.Hour, exponential.backoff(1))
+	assert.Equal(t, 12*time.Hour, exponential.backoff(3))
+	assert.Equal(t, VMWatchMaxBackoffHours*time.Hour, exponential.backoff(10), "the wait should be capped")
+	assert.Equal(t, VMWatchMaxBackoffHours*time.Hour, exponential.backoff(100), "the wait should not overflow")
+
+	randInt63n = func(n int64) int64 { return 0 }
+	assert.Equal(t, 6*time.Hour, exponential.backoff(3), "jitter should keep at least half of the wait")
+}
+
+func TestExecuteRetryLogic_ExponentialBackoff(t *testing.T) {
+	resetVMWatchRetryCounters()
+	defer resetVMWatchRetryCounters()
+	origRand := randInt63n
+	t.Cleanup(func() { randInt63n = origRand })
+	randInt63n = func(n int64) int64 { return n - 1 }
+
+	var waits []time.Duration
+	failing := func(ctx context.Context, lg *slog.Logger, attempt int, s *vmWatchSettings, hEnv *handlerenv.HandlerEnvironment) error {
+		return errors.New("fail")
+	}
+	executeRetryLogic(context.Background(), nil, &vmWatchSettings{}, &handlerenv.HandlerEnvironment{},
+		RetryConfig{MaxCycles: 4, AttemptsPerCycle: 1, BaseWaitHours: 1, Backoff: ExponentialBackoff}, failing,
+		func(ctx context.Context, d time.Duration) { waits = append(waits, d) }, nil)
+
+	assert.Equal(t, []time.Duration{time.Hour, 2 * time.Hour, 4 * time.Hour}, waits)
+}
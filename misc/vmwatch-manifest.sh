@@ -0,0 +1,36 @@
+#!/bin/bash
+# Writes vmwatch.sha256, the checksum manifest the extension verifies the VMWatch
+# binaries and config against before launching VMWatch, to the given VMWatch
+# folder. Run it whenever the folder is packaged or its files are updated.
+#
+# With --check, it instead fails unless the folder has a manifest that lists the
+# binaries and the config and matches them, e.g. before the folder is bundled.
+set -euo pipefail
+
+check=0
+if [ "${1:-}" == "--check" ]; then
+    check=1
+    shift
+fi
+if [ "$#" -ne 1 ]; then
+    echo "Usage: $0 [--check] <VMWatch folder>"
+    exit 1
+fi
+
+cd "$1"
+if [ $check -eq 0 ]; then
+    sha256sum vmwatch_linux* vmwatch.conf > vmwatch.sha256
+    exit 0
+fi
+
+if [ ! -s vmwatch.sha256 ]; then
+    echo "$1/vmwatch.sha256 is missing"
+    exit 1
+fi
+for f in vmwatch_linux* vmwatch.conf; do
+    if ! grep -Eq "^[0-9a-f]{64} [ *]$f\$" vmwatch.sha256; then
+        echo "$f is not listed in $1/vmwatch.sha256"
+        exit 1
+    fi
+done
+sha256sum --check --strict --quiet vmwatch.sha256
@@ -2,41 +2,158 @@ package logging
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log/slog"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Azure/applicationhealth-extension-linux/pkg/redact"
 )
 
+// Format is the output format of an ExtensionSlogHandler.
+type Format string
+
+const (
+	TextFormat Format = "text"
+	JSONFormat Format = "json"
+)
+
+// ParseFormat parses a log format, case-insensitively.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case TextFormat, JSONFormat:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown log format %q, expected %q or %q", s, TextFormat, JSONFormat)
+	}
+}
+
+// FormatVar is a log format that can be changed while handlers use it, like
+// slog.LevelVar for levels. The zero value is TextFormat.
+type FormatVar struct {
+	json atomic.Bool
+}
+
+func (v *FormatVar) Format() Format {
+	if v.json.Load() {
+		return JSONFormat
+	}
+	return TextFormat
+}
+
+func (v *FormatVar) Set(f Format) {
+	v.json.Store(f == JSONFormat)
+}
+
+// ParseLevel parses a log level, case-insensitively: Debug, Info, Warning (or
+// Warn) or Error.
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warning", "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q, expected Debug, Info, Warning or Error", s)
+	}
+}
+
+// ExtensionSlogHandler writes the handler log. The message of the records is
+// written as the "event" attribute, after their other attributes. Secrets are
+// redacted from the messages and the attributes, see redact.Handler.
 type ExtensionSlogHandler struct {
-	slog.Handler
+	text, json slog.Handler
+	// format selects between text and json when both are set.
+	format *FormatVar
 }
 
+// NewExtensionSlogHandler returns a handler writing text to w. The level,
+// AddSource and ReplaceAttr options are honored, opts may be nil.
 func NewExtensionSlogHandler(w io.Writer, opts *slog.HandlerOptions) *ExtensionSlogHandler {
-	// ignore opts for now
+	return &ExtensionSlogHandler{text: redact.NewHandler(slog.NewTextHandler(w, extensionHandlerOptions(opts)))}
+}
+
+// NewExtensionJSONSlogHandler returns a handler writing JSON objects to w, one
+// per line, like NewExtensionSlogHandler.
+func NewExtensionJSONSlogHandler(w io.Writer, opts *slog.HandlerOptions) *ExtensionSlogHandler {
+	return &ExtensionSlogHandler{json: redact.NewHandler(slog.NewJSONHandler(w, extensionHandlerOptions(opts)))}
+}
+
+// NewExtensionSlogHandlerWithFormat returns a handler writing to w in the format
+// of format at the time each record is handled, like NewExtensionSlogHandler.
+func NewExtensionSlogHandlerWithFormat(w io.Writer, format *FormatVar, opts *slog.HandlerOptions) *ExtensionSlogHandler {
+	o := extensionHandlerOptions(opts)
 	return &ExtensionSlogHandler{
-		Handler: slog.NewTextHandler(w, &slog.HandlerOptions{
-			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
-				if a.Key == slog.MessageKey && a.Value.String() == "" {
-					return slog.Attr{}
-				}
-				return a
-			},
-		}),
+		text:   redact.NewHandler(slog.NewTextHandler(w, o)),
+		json:   redact.NewHandler(slog.NewJSONHandler(w, o)),
+		format: format,
 	}
 }
 
+// extensionHandlerOptions returns opts with a ReplaceAttr dropping the empty
+// message, as Handle moves it to the "event" attribute, before calling the
+// ReplaceAttr of opts, if any.
+func extensionHandlerOptions(opts *slog.HandlerOptions) *slog.HandlerOptions {
+	o := slog.HandlerOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	replace := o.ReplaceAttr
+	o.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && a.Key == slog.MessageKey && a.Value.String() == "" {
+			return slog.Attr{}
+		}
+		if replace != nil {
+			return replace(groups, a)
+		}
+		return a
+	}
+	return &o
+}
+
+func (h *ExtensionSlogHandler) handler() slog.Handler {
+	if h.text == nil || (h.json != nil && h.format != nil && h.format.Format() == JSONFormat) {
+		return h.json
+	}
+	return h.text
+}
+
+func (h *ExtensionSlogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler().Enabled(ctx, level)
+}
+
 func (h *ExtensionSlogHandler) Handle(ctx context.Context, record slog.Record) error {
-	msg := record.Message
-	if msg != "" {
-		record.Message = ""
-		record.AddAttrs(slog.Attr{Key: "event", Value: slog.StringValue(msg)})
+	r := slog.NewRecord(record.Time, record.Level, "", record.PC)
+	record.Attrs(func(a slog.Attr) bool {
+		r.AddAttrs(a)
+		return true
+	})
+	if record.Message != "" {
+		r.AddAttrs(slog.String("event", record.Message))
 	}
-	return h.Handler.Handle(ctx, record)
+	return h.handler().Handle(ctx, r)
 }
 
 func (h *ExtensionSlogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
-	return &ExtensionSlogHandler{Handler: h.Handler.WithAttrs(attrs)}
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
 }
 
 func (h *ExtensionSlogHandler) WithGroup(name string) slog.Handler {
-	return &ExtensionSlogHandler{Handler: h.Handler.WithGroup(name)}
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+func (h *ExtensionSlogHandler) with(f func(slog.Handler) slog.Handler) *ExtensionSlogHandler {
+	c := &ExtensionSlogHandler{format: h.format}
+	if h.text != nil {
+		c.text = f(h.text)
+	}
+	if h.json != nil {
+		c.json = f(h.json)
+	}
+	return c
 }
@@ -0,0 +1,102 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	secretToken = "dG9rZW4K"
+	sasURL      = "https://account.blob.core.windows.net/config/vmwatch.json?sv=2022-11-02&sig=c2lnbmF0dXJl"
+)
+
+func TestExtensionSlogHandler_redactsSecrets(t *testing.T) {
+	var handlerLog bytes.Buffer
+	lg := slog.New(NewExtensionSlogHandler(&handlerLog, nil)).With("sasToken", secretToken)
+
+	lg.Error("Failed to download "+sasURL, "error", fmt.Errorf("GET %s: 403", sasURL), "url", sasURL,
+		slog.Group("settings", "accountKey", secretToken, "globalConfigUrl", sasURL))
+	lg.WithGroup("vmwatch").Info("Starting", "apiKey", secretToken)
+
+	require.NotContains(t, handlerLog.String(), secretToken)
+	require.NotContains(t, handlerLog.String(), "sig=")
+	require.Contains(t, handlerLog.String(), "sasToken=<redacted>")
+	require.Contains(t, handlerLog.String(), "settings.accountKey=<redacted>")
+	require.Contains(t, handlerLog.String(), "vmwatch.apiKey=<redacted>")
+	require.Contains(t, handlerLog.String(), "event=\"Failed to download https://account.blob.core.windows.net/config/vmwatch.json?<redacted>\"")
+}
+
+func TestExtensionSlogHandler_honorsOptions(t *testing.T) {
+	var out bytes.Buffer
+	level := new(slog.LevelVar)
+	lg := slog.New(NewExtensionSlogHandler(&out, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+
+	lg.Debug("Evaluated health probe", "state", "Healthy")
+	require.Empty(t, out.String(), "debug records are dropped at the default level")
+
+	level.Set(slog.LevelDebug)
+	lg.Debug("Evaluated health probe", "state", "Healthy")
+	require.Equal(t, "level=DEBUG state=Healthy event=\"Evaluated health probe\"\n", out.String())
+}
+
+func TestExtensionJSONSlogHandler(t *testing.T) {
+	var out bytes.Buffer
+	lg := slog.New(NewExtensionJSONSlogHandler(&out, nil)).With("pid", 42)
+
+	lg.Info("Committed health state is healthy", "state", "Healthy")
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &entry))
+	require.NotContains(t, entry, slog.MessageKey)
+	require.Equal(t, "INFO", entry[slog.LevelKey])
+	require.Equal(t, "Committed health state is healthy", entry["event"])
+	require.Equal(t, "Healthy", entry["state"])
+	require.Equal(t, float64(42), entry["pid"])
+}
+
+func TestExtensionSlogHandlerWithFormat(t *testing.T) {
+	var out bytes.Buffer
+	format := new(FormatVar)
+	lg := slog.New(NewExtensionSlogHandlerWithFormat(&out, format, nil)).With("pid", 42)
+
+	lg.Info("text")
+	format.Set(JSONFormat)
+	lg.WithGroup("probe").Info("json", "state", "Healthy")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[0], "pid=42 event=text")
+	require.True(t, json.Valid([]byte(lines[1])), lines[1])
+	require.Contains(t, lines[1], `"pid":42,"probe":{"state":"Healthy","event":"json"}`)
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, expected := range map[string]slog.Level{"Debug": slog.LevelDebug, "info": slog.LevelInfo, "Warning": slog.LevelWarn, "WARN": slog.LevelWarn, "Error": slog.LevelError} {
+		level, err := ParseLevel(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, level, s)
+	}
+	_, err := ParseLevel("Verbose")
+	require.Error(t, err)
+}
+
+func TestParseFormat(t *testing.T) {
+	f, err := ParseFormat("JSON")
+	require.NoError(t, err)
+	require.Equal(t, JSONFormat, f)
+	_, err = ParseFormat("logfmt")
+	require.Error(t, err)
+}
@@ -0,0 +1,356 @@
+package logging
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// now returns the current time, it is a variable to allow overriding in tests.
+var now = time.Now
+
+// RotateOptions configures when a log file is rotated and which rotated files
+// are kept. Rotated files are kept as <path>.1 (most recent) through
+// <path>.<MaxBackups>, or <path>.<n>.gz when compressed; older ones are removed.
+type RotateOptions struct {
+	// MaxSize is the size in bytes beyond which the file is rotated. Zero or
+	// less disables size-based rotation.
+	MaxSize int64
+	// MaxAge is the age beyond which the file is rotated, measured from its
+	// creation or its last rotation, see fileStart. Zero or less disables
+	// age-based rotation.
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files kept.
+	MaxBackups int
+	// Compress gzips the rotated files.
+	Compress bool
+	// Reopened, if set, is called with the log file each time a RotatingFile
+	// opens it, i.e. when it is created and after every rotation, e.g. to
+	// redirect stderr to it.
+	Reopened func(*os.File)
+}
+
+// RotatingFile is an io.WriteCloser appending to a log file that is rotated once
+// it grows beyond a maximum size or age.
+//
+// Several processes may write the same file: the size of the file is read
+// before every write, the file is locked while it is rotated so that it is
+// rotated once, and writers reopen the file once it was rotated by another
+// process, or by logrotate. The file is replaced atomically, so it always exists
+// for readers of its last write time, and a stuck process, which no longer
+// writes, never rotates it.
+type RotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	opts    RotateOptions
+	f       *os.File
+	size    int64
+	started time.Time
+}
+
+// NewRotatingFile opens (or creates) the log file at path for appending. It is
+// rotated beyond maxSize bytes, keeping maxBackups uncompressed rotated files.
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	return OpenRotatingFile(path, RotateOptions{MaxSize: maxSize, MaxBackups: maxBackups})
+}
+
+// OpenRotatingFile opens (or creates) the log file at path for appending,
+// rotated as configured by opts.
+func OpenRotatingFile(path string, opts RotateOptions) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, opts: opts}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("logging: failed to open path=%s error=%v", r.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("logging: failed to stat path=%s error=%v", r.path, err)
+	}
+	r.f, r.size = f, info.Size()
+	if r.started = fileStart(r.path, f, r.opts.Compress); r.started.IsZero() {
+		r.started = now()
+	}
+	if r.opts.Reopened != nil {
+		r.opts.Reopened(f)
+	}
+	return nil
+}
+
+// Write appends p to the log file, rotating it first if p would take it beyond
+// the maximum size or if it is older than the maximum age. A single write
+// larger than the maximum size is written whole to a fresh file.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if err := r.follow(); err != nil {
+		return 0, err
+	}
+	if r.size > 0 && r.due(int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			// keep writing to the log file unless it could not be reopened
+			if r.f == nil && r.open() != nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) due(n int64) bool {
+	return (r.opts.MaxSize > 0 && r.size+n > r.opts.MaxSize) ||
+		(r.opts.MaxAge > 0 && now().Sub(r.started) >= r.opts.MaxAge)
+}
+
+// follow reopens the log file if it was moved or removed since it was opened,
+// and otherwise updates its size with the writes of other processes.
+func (r *RotatingFile) follow() error {
+	info, err := r.f.Stat()
+	if err != nil {
+		return fmt.Errorf("logging: failed to stat path=%s error=%v", r.path, err)
+	}
+	if current, err := os.Stat(r.path); err == nil && os.SameFile(info, current) {
+		r.size = info.Size()
+		return nil
+	}
+	r.f.Close()
+	r.f = nil
+	return r.open()
+}
+
+// rotate replaces the log file with an empty one, keeping it as the first
+// backup. The file is locked meanwhile, and not rotated again if another
+// process rotated it while waiting for the lock.
+func (r *RotatingFile) rotate() error {
+	old := r.f
+	defer old.Close()
+	r.f = nil
+	// the lock is released when old is closed, after the file was replaced
+	if err := syscall.Flock(int(old.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("logging: failed to lock path=%s error=%v", r.path, err)
+	}
+	info, err := old.Stat()
+	if err != nil {
+		return fmt.Errorf("logging: failed to stat path=%s error=%v", r.path, err)
+	}
+	if current, err := os.Stat(r.path); err != nil || !os.SameFile(info, current) {
+		return r.open()
+	}
+
+	removeBackups(r.path, r.opts.MaxBackups-1)
+	shiftBackups(r.path, r.opts.MaxBackups)
+	backup := backupPath(r.path, 1, false)
+	if r.opts.MaxBackups > 0 {
+		if err := os.Link(r.path, backup); err != nil {
+			// e.g. hard links are not supported, the log file is missing until it is reopened
+			if err := os.Rename(r.path, backup); err != nil {
+				return fmt.Errorf("logging: failed to rotate path=%s error=%v", r.path, err)
+			}
+		}
+	}
+	if err := r.replace(); err != nil {
+		return err
+	}
+	r.started = now()
+	if r.opts.MaxBackups > 0 && r.opts.Compress {
+		// the backup is kept uncompressed if this fails
+		compressFile(backup)
+	}
+	return nil
+}
+
+// replace atomically replaces the log file with an empty one and opens it.
+func (r *RotatingFile) replace() error {
+	tmp := r.path + ".new"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("logging: failed to create path=%s error=%v", tmp, err)
+	}
+	f.Close()
+	if err := os.Rename(tmp, r.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("logging: failed to replace path=%s error=%v", r.path, err)
+	}
+	return r.open()
+}
+
+// Close closes the log file.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// ErrNotAppended is returned by RotateCopyTruncate for a file whose writer kept
+// writing at its previous offset after the file was truncated, instead of
+// appending to it, so that the file became sparse and starts with NUL bytes.
+// Rotating it again would only copy those NUL bytes, and it stays as large.
+var ErrNotAppended = errors.New("logging: the log file is not opened for appending by its writer")
+
+// RotateCopyTruncate rotates the log file at path if it is due as configured by
+// opts, for files written by another process which cannot reopen them: the file
+// is copied to the first backup and truncated. Lines written between the copy
+// and the truncation are lost.
+//
+// The writer must have opened the file with O_APPEND, so that it writes at the
+// start of the truncated file. Otherwise ErrNotAppended is returned once the
+// file is due again, and the file is not rotated. It reports whether the file
+// was rotated; a missing file is not rotated.
+func RotateCopyTruncate(path string, opts RotateOptions) (bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("logging: failed to open path=%s error=%v", path, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, fmt.Errorf("logging: failed to stat path=%s error=%v", path, err)
+	}
+	start := fileStart(path, f, opts.Compress)
+	due := (opts.MaxSize > 0 && info.Size() >= opts.MaxSize) ||
+		(opts.MaxAge > 0 && !start.IsZero() && now().Sub(start) >= opts.MaxAge)
+	if info.Size() == 0 || !due {
+		return false, nil
+	}
+	// a log never starts with a NUL byte unless it was truncated under a writer
+	// that does not append
+	var first [1]byte
+	if _, err := f.ReadAt(first[:], 0); err == nil && first[0] == 0 {
+		return false, fmt.Errorf("logging: path=%s starts with NUL bytes after it was truncated: %w", path, ErrNotAppended)
+	}
+
+	removeBackups(path, opts.MaxBackups-1)
+	shiftBackups(path, opts.MaxBackups)
+	if opts.MaxBackups > 0 {
+		backup := backupPath(path, 1, opts.Compress)
+		if err := copyFile(backup, f, opts.Compress); err != nil {
+			os.Remove(backup)
+			return false, fmt.Errorf("logging: failed to copy path=%s error=%v", path, err)
+		}
+	}
+	if err := f.Truncate(0); err != nil {
+		return false, fmt.Errorf("logging: failed to truncate path=%s error=%v", path, err)
+	}
+	return true, nil
+}
+
+func backupPath(path string, i int, compressed bool) string {
+	p := fmt.Sprintf("%s.%d", path, i)
+	if compressed {
+		p += ".gz"
+	}
+	return p
+}
+
+// shiftBackups renames the backups 1 to maxBackups-1 of path to the next number,
+// compressed or not.
+func shiftBackups(path string, maxBackups int) {
+	for i := maxBackups - 1; i >= 1; i-- {
+		for _, compressed := range []bool{false, true} {
+			os.Rename(backupPath(path, i, compressed), backupPath(path, i+1, compressed))
+		}
+	}
+}
+
+// removeBackups removes the backups of path numbered beyond keep, compressed or
+// not, including those kept by a larger retention count before.
+func removeBackups(path string, keep int) {
+	matches, _ := filepath.Glob(path + ".*")
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(m, path+"."), ".gz")
+		if i, err := strconv.Atoi(suffix); err == nil && i > keep {
+			os.Remove(m)
+		}
+	}
+}
+
+// fileStart returns when the log file at path started: the latest of its
+// creation time, if the file system records it, and the last write time of its
+// most recent backup, which is about when it was last rotated. It is zero if
+// neither is known.
+func fileStart(path string, f *os.File, compressed bool) time.Time {
+	var start time.Time
+	var stx unix.Statx_t
+	if err := unix.Statx(int(f.Fd()), "", unix.AT_EMPTY_PATH, unix.STATX_BTIME, &stx); err == nil && stx.Mask&unix.STATX_BTIME != 0 {
+		start = time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec))
+	}
+	if info, err := os.Stat(backupPath(path, 1, compressed)); err == nil && info.ModTime().After(start) {
+		start = info.ModTime()
+	}
+	return start
+}
+
+// compressFile replaces the file at path with path.gz, keeping its last write
+// time.
+func compressFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := copyFile(path+".gz", f, true); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	if info, err := f.Stat(); err == nil {
+		os.Chtimes(path+".gz", info.ModTime(), info.ModTime())
+	}
+	return os.Remove(path)
+}
+
+// copyFile copies src from its start to a new file at path, gzipped if
+// compress is set.
+func copyFile(path string, src *os.File, compress bool) error {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	var w io.Writer = dst
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(dst)
+		w = zw
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		return err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	return dst.Close()
+}
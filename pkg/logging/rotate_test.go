@@ -0,0 +1,270 @@
+package logging
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vmwatch-output.log")
+	r, err := NewRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	defer r.Close()
+
+	for _, line := range []string{"aaaaaaa\n", "bbbbbbb\n", "ccccccc\n", "ddddddd\n"} {
+		_, err := r.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, "ddddddd\n", readFile(t, path))
+	require.Equal(t, "ccccccc\n", readFile(t, path+".1"))
+	require.Equal(t, "bbbbbbb\n", readFile(t, path+".2"))
+	require.NoFileExists(t, path+".3", "only maxBackups rotated files should be kept")
+}
+
+func TestRotatingFile_AppendsToExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vmwatch-output.log")
+	require.NoError(t, os.WriteFile(path, []byte("old\n"), 0644))
+
+	r, err := NewRotatingFile(path, 100, 1)
+	require.NoError(t, err)
+	_, err = r.Write([]byte("new\n"))
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.NoError(t, r.Close(), "closing twice should be a no-op")
+
+	require.Equal(t, "old\nnew\n", readFile(t, path))
+	_, err = r.Write([]byte("closed\n"))
+	require.ErrorIs(t, err, os.ErrClosed)
+}
+
+func TestRotatingFile_OversizedWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vmwatch-output.log")
+	r, err := NewRotatingFile(path, 4, 0)
+	require.NoError(t, err)
+	defer r.Close()
+
+	long := strings.Repeat("x", 10) + "\n"
+	_, err = r.Write([]byte(long))
+	require.NoError(t, err)
+	require.Equal(t, long, readFile(t, path), "a write larger than the maximum size should not be split")
+
+	_, err = r.Write([]byte("y\n"))
+	require.NoError(t, err)
+	require.Equal(t, "y\n", readFile(t, path))
+	require.NoFileExists(t, path+".1", "no backups should be kept when maxBackups is 0")
+}
+
+func readGzipFile(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	b, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestRotatingFile_Compress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handler.log")
+	// a backup beyond the retention count, e.g. kept by a previous version
+	require.NoError(t, os.WriteFile(path+".5.gz", []byte("stale"), 0644))
+
+	r, err := OpenRotatingFile(path, RotateOptions{MaxSize: 10, MaxBackups: 2, Compress: true})
+	require.NoError(t, err)
+	defer r.Close()
+
+	for _, line := range []string{"aaaaaaa\n", "bbbbbbb\n", "ccccccc\n", "ddddddd\n"} {
+		_, err := r.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, "ddddddd\n", readFile(t, path))
+	require.Equal(t, "ccccccc\n", readGzipFile(t, path+".1.gz"))
+	require.Equal(t, "bbbbbbb\n", readGzipFile(t, path+".2.gz"))
+	for _, name := range []string{".1", ".2", ".3.gz", ".5.gz", ".new"} {
+		require.NoFileExists(t, path+name)
+	}
+}
+
+func setNow(t *testing.T, f func() time.Time) {
+	t.Helper()
+	now = f
+	t.Cleanup(func() { now = time.Now })
+}
+
+func TestRotatingFile_MaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handler.log")
+	clock := time.Now()
+	setNow(t, func() time.Time { return clock })
+	r, err := OpenRotatingFile(path, RotateOptions{MaxAge: time.Hour, MaxBackups: 1})
+	require.NoError(t, err)
+	defer r.Close()
+
+	_, err = r.Write([]byte("old\n"))
+	require.NoError(t, err)
+	clock = clock.Add(59 * time.Minute)
+	_, err = r.Write([]byte("recent\n"))
+	require.NoError(t, err)
+	require.NoFileExists(t, path+".1")
+
+	clock = clock.Add(time.Minute)
+	_, err = r.Write([]byte("new\n"))
+	require.NoError(t, err)
+	require.Equal(t, "new\n", readFile(t, path))
+	require.Equal(t, "old\nrecent\n", readFile(t, path+".1"))
+	require.Equal(t, clock, r.started, "the age should be measured from the rotation")
+}
+
+func TestRotatingFile_SharedBetweenWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handler.log")
+	opts := RotateOptions{MaxSize: 10, MaxBackups: 2}
+	a, err := OpenRotatingFile(path, opts)
+	require.NoError(t, err)
+	defer a.Close()
+	b, err := OpenRotatingFile(path, opts)
+	require.NoError(t, err)
+	defer b.Close()
+
+	_, err = a.Write([]byte("aaaaaaa\n"))
+	require.NoError(t, err)
+	_, err = b.Write([]byte("bbbbbbb\n"))
+	require.NoError(t, err, "b should count the writes of a and rotate")
+	_, err = a.Write([]byte("a\n"))
+	require.NoError(t, err, "a should follow the file rotated by b")
+
+	require.Equal(t, "bbbbbbb\na\n", readFile(t, path))
+	require.Equal(t, "aaaaaaa\n", readFile(t, path+".1"))
+	require.NoFileExists(t, path+".2")
+}
+
+func TestRotatingFile_FollowsExternalRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handler.log")
+	var reopened []*os.File
+	r, err := OpenRotatingFile(path, RotateOptions{MaxSize: 100, Reopened: func(f *os.File) { reopened = append(reopened, f) }})
+	require.NoError(t, err)
+	defer r.Close()
+	require.Len(t, reopened, 1)
+
+	_, err = r.Write([]byte("before\n"))
+	require.NoError(t, err)
+	require.NoError(t, os.Rename(path, path+".1"), "e.g. logrotate")
+	_, err = r.Write([]byte("after\n"))
+	require.NoError(t, err)
+
+	require.Equal(t, "before\n", readFile(t, path+".1"))
+	require.Equal(t, "after\n", readFile(t, path))
+	require.Len(t, reopened, 2)
+}
+
+func TestRotatingFile_KeepsLastWriteTimeFresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handler.log")
+	require.NoError(t, os.WriteFile(path, []byte("aaaaaaa\n"), 0644))
+	stale := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(path, stale, stale))
+
+	r, err := OpenRotatingFile(path, RotateOptions{MaxSize: 10, MaxBackups: 1})
+	require.NoError(t, err)
+	defer r.Close()
+	_, err = r.Write([]byte("bbbbbbb\n"))
+	require.NoError(t, err)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), info.ModTime(), time.Minute, "a rotated log should not look stale")
+	require.Equal(t, "aaaaaaa\n", readFile(t, path+".1"))
+}
+
+func TestRotateCopyTruncate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vmwatch.log")
+	opts := RotateOptions{MaxSize: 10, MaxBackups: 2, Compress: true}
+
+	rotated, err := RotateCopyTruncate(path, opts)
+	require.NoError(t, err)
+	require.False(t, rotated, "a missing file should not be rotated")
+
+	// the file is kept open by its writer, which appends to it
+	w, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	defer w.Close()
+	_, err = w.WriteString("short\n")
+	require.NoError(t, err)
+	rotated, err = RotateCopyTruncate(path, opts)
+	require.NoError(t, err)
+	require.False(t, rotated, "a file below the maximum size should not be rotated")
+
+	_, err = w.WriteString("longer\n")
+	require.NoError(t, err)
+	rotated, err = RotateCopyTruncate(path, opts)
+	require.NoError(t, err)
+	require.True(t, rotated)
+	require.Equal(t, "short\nlonger\n", readGzipFile(t, path+".1.gz"))
+
+	_, err = w.WriteString("next\n")
+	require.NoError(t, err)
+	require.Equal(t, "next\n", readFile(t, path), "the writer should keep appending to the truncated file")
+}
+
+func TestRotateCopyTruncate_NotAppended(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vmwatch.log")
+	opts := RotateOptions{MaxSize: 10, MaxBackups: 2}
+
+	// the writer does not append, it keeps writing at its offset once truncated
+	w, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	defer w.Close()
+	_, err = w.WriteString("short\nlonger\n")
+	require.NoError(t, err)
+	rotated, err := RotateCopyTruncate(path, opts)
+	require.NoError(t, err)
+	require.True(t, rotated)
+	require.Equal(t, "short\nlonger\n", readFile(t, path+".1"))
+
+	_, err = w.WriteString("next\n")
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.EqualValues(t, len("short\nlonger\nnext\n"), info.Size(), "the file should be sparse")
+
+	rotated, err = RotateCopyTruncate(path, opts)
+	require.ErrorIs(t, err, ErrNotAppended)
+	require.False(t, rotated)
+	require.Equal(t, "short\nlonger\n", readFile(t, path+".1"), "the NUL bytes should not be rotated")
+	require.NoFileExists(t, path+".2")
+}
+
+func TestRotateCopyTruncate_MaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vmwatch.log")
+	opts := RotateOptions{MaxAge: time.Hour, MaxBackups: 1}
+	require.NoError(t, os.WriteFile(path, []byte("first\n"), 0644))
+	lastRotation := time.Now().Add(-30 * time.Minute)
+	require.NoError(t, os.WriteFile(path+".1", []byte("rotated\n"), 0644))
+	require.NoError(t, os.Chtimes(path+".1", lastRotation, lastRotation))
+
+	rotated, err := RotateCopyTruncate(path, opts)
+	require.NoError(t, err)
+	require.False(t, rotated, "the file should be as old as its creation or its last rotation")
+
+	setNow(t, func() time.Time { return time.Now().Add(time.Hour) })
+	rotated, err = RotateCopyTruncate(path, opts)
+	require.NoError(t, err)
+	require.True(t, rotated)
+	require.Equal(t, "first\n", readFile(t, path+".1"))
+	require.Empty(t, readFile(t, path))
+}
@@ -182,3 +182,10 @@ func TestJSON_NoSensitiveFieldsUnchanged(t *testing.T) {
 	in := "{\n\t\"region\": \"eastus\",\n\t\"port\": 8080\n}"
 	require.Equal(t, in, JSON(in))
 }
+
+func TestKeyValue(t *testing.T) {
+	require.Equal(t, Placeholder, KeyValue("storageAccountKey", "abc"))
+	require.Equal(t, Placeholder, KeyValue("sasToken", ""))
+	require.Equal(t, "https://host/path?"+Placeholder, KeyValue("url", "https://host/path?sig=abc"))
+	require.Equal(t, "Healthy", KeyValue("state", "Healthy"))
+}
@@ -0,0 +1,237 @@
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Rule detects a kind of secret in free text. Every match of Pattern is replaced
+// by Replacement, in which $1 etc. expand to the submatches of Pattern as in
+// regexp.Regexp.ReplaceAllString, e.g. to keep the name of a secret and redact
+// its value.
+type Rule struct {
+	// Name identifies the rule, registering a rule with the name of another
+	// replaces it.
+	Name        string
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// Names of the built-in rules.
+const (
+	URLQueryRule         = "url-query"
+	URLCredentialsRule   = "url-credentials"
+	BearerTokenRule      = "bearer-token"
+	JWTRule              = "jwt"
+	PrivateKeyRule       = "private-key"
+	ConnectionStringRule = "connection-string"
+)
+
+// builtinRules are applied in order. The character classes stop at whitespace
+// and quote/bracket delimiters so that secrets embedded in JSON or other
+// structured text are redacted keeping their surrounding syntax intact.
+var builtinRules = []Rule{
+	// the query string of http(s) URLs, where SAS tokens and similar credentials
+	// are typically passed
+	{URLQueryRule, regexp.MustCompile(`(https?://[^\s?"'<>]+)\?[^\s"'<>]*`), "$1?" + Placeholder},
+	// basic-auth credentials in user:pass@host URLs
+	{URLCredentialsRule, regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/\s:@"'<>]+:[^/\s@"'<>]*@`), "${1}" + Placeholder + "@"},
+	{BearerTokenRule, regexp.MustCompile(`(?i)(\bbearer\s+)[A-Za-z0-9._~+/-]+=*`), "${1}" + Placeholder},
+	{JWTRule, regexp.MustCompile(`\beyJ[A-Za-z0-9_-]*\.eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*`), Placeholder},
+	// PEM private key blocks, also when their newlines are escaped in JSON
+	{PrivateKeyRule, regexp.MustCompile(`(?s)-----BEGIN ([A-Z0-9 ]*)PRIVATE KEY-----.*?-----END [A-Z0-9 ]*PRIVATE KEY-----`),
+		"-----BEGIN ${1}PRIVATE KEY-----" + Placeholder + "-----END ${1}PRIVATE KEY-----"},
+	// the keys and signatures of Azure Storage and Event Hubs connection strings
+	{ConnectionStringRule, regexp.MustCompile(`(?i)(\b(?:AccountKey|SharedAccessKey|SharedAccessSignature)\s*=\s*)[^;\s"'<>\\]+`), "${1}" + Placeholder},
+}
+
+// BuiltinRules returns the rules of a new registry, in the order they are
+// applied.
+func BuiltinRules() []Rule {
+	return append([]Rule(nil), builtinRules...)
+}
+
+// sensitiveKeywords is the alternation of substrings that mark a key/name as
+// likely to carry a secret (e.g. SAS tokens, account keys, passwords). It is
+// shared by the key-name and JSON-field matchers so the rules stay in sync.
+const sensitiveKeywords = `sas|token|secret|password|passwd|pwd|credential|connection[_-]?string|account[_-]?key|api[_-]?key|access[_-]?key`
+
+// Registry holds the rules and the sensitive key patterns secrets are redacted
+// with. It is safe for concurrent use, and rules and key patterns can be
+// changed while it is used.
+type Registry struct {
+	// mu serializes the changes, which replace the rule set so that redacting
+	// does not lock.
+	mu  sync.Mutex
+	set atomic.Pointer[ruleSet]
+}
+
+// ruleSet is the immutable state of a Registry.
+type ruleSet struct {
+	rules       []Rule
+	keyPatterns []string
+
+	// sensitiveKey matches names that are likely to carry secrets, and
+	// jsonSensitiveField a JSON string field whose key name looks sensitive,
+	// capturing the key (and separator) so the value can be replaced. Only string
+	// values are matched; numbers/booleans/objects are left untouched.
+	sensitiveKey       *regexp.Regexp
+	jsonSensitiveField *regexp.Regexp
+}
+
+func newRuleSet(rules []Rule, keyPatterns []string) *ruleSet {
+	keywords := sensitiveKeywords
+	for _, p := range keyPatterns {
+		// validated as a group by ValidateKeyPattern
+		keywords += `|(?:` + p + `)`
+	}
+	return &ruleSet{
+		rules:              rules,
+		keyPatterns:        keyPatterns,
+		sensitiveKey:       regexp.MustCompile(`(?i)(` + keywords + `)`),
+		jsonSensitiveField: regexp.MustCompile(`(?i)("[^"]*(?:` + keywords + `)[^"]*"\s*:\s*)"(?:[^"\\]|\\.)*"`),
+	}
+}
+
+// NewRegistry returns a registry with the built-in rules and sensitive key
+// names.
+func NewRegistry() *Registry {
+	r := &Registry{}
+	r.set.Store(newRuleSet(BuiltinRules(), nil))
+	return r
+}
+
+// Default is the registry of the package-level functions.
+var Default = NewRegistry()
+
+// Rules returns the rules of the registry, in the order they are applied.
+func (r *Registry) Rules() []Rule {
+	return append([]Rule(nil), r.set.Load().rules...)
+}
+
+// Register adds a rule, applied after the existing ones, or replaces the rule
+// with the same name.
+func (r *Registry) Register(rule Rule) error {
+	if rule.Name == "" || rule.Pattern == nil {
+		return fmt.Errorf("redact: rule %q must have a name and a pattern", rule.Name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.set.Load()
+	rules := append([]Rule(nil), old.rules...)
+	replaced := false
+	for i := range rules {
+		if rules[i].Name == rule.Name {
+			rules[i], replaced = rule, true
+		}
+	}
+	if !replaced {
+		rules = append(rules, rule)
+	}
+	r.set.Store(newRuleSet(rules, old.keyPatterns))
+	return nil
+}
+
+// SetKeyPatterns sets the regular expressions of the key names, in addition to
+// the built-in ones, whose values are redacted, e.g. organisation-specific
+// secret names. They are matched case-insensitively anywhere in a key name.
+// Patterns matching any name, such as the empty one, are rejected.
+func (r *Registry) SetKeyPatterns(patterns ...string) error {
+	for _, p := range patterns {
+		if err := ValidateKeyPattern(p); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.set.Store(newRuleSet(r.set.Load().rules, append([]string(nil), patterns...)))
+	return nil
+}
+
+// ValidateKeyPattern reports whether p can be added to the sensitive key names
+// with SetKeyPatterns.
+func ValidateKeyPattern(p string) error {
+	re, err := regexp.Compile(`(?i)(?:` + p + `)`)
+	if err != nil {
+		return fmt.Errorf("redact: invalid key pattern %q: %v", p, err)
+	}
+	if re.MatchString("") {
+		return fmt.Errorf("redact: key pattern %q matches every key", p)
+	}
+	return nil
+}
+
+// Register adds a rule to the default registry, see Registry.Register.
+func Register(rule Rule) error {
+	return Default.Register(rule)
+}
+
+// SetKeyPatterns sets the extra sensitive key names of the default registry,
+// see Registry.SetKeyPatterns.
+func SetKeyPatterns(patterns ...string) error {
+	return Default.SetKeyPatterns(patterns...)
+}
+
+// Value scrubs a single string, see the package-level Value.
+func (r *Registry) Value(s string) string {
+	return r.set.Load().value(s)
+}
+
+// Slice scrubs each of values, see the package-level Slice.
+func (r *Registry) Slice(values []string) []string {
+	return r.set.Load().slice(values)
+}
+
+// Text scrubs free-form text, see the package-level Text.
+func (r *Registry) Text(s string) string {
+	return r.set.Load().text(s)
+}
+
+// JSON scrubs a JSON document, see the package-level JSON.
+func (r *Registry) JSON(s string) string {
+	return r.set.Load().json(s)
+}
+
+// KeyValue scrubs the value of a key/value pair, see the package-level KeyValue.
+func (r *Registry) KeyValue(key, value string) string {
+	set := r.set.Load()
+	return set.keyValue(set.sensitiveKey.MatchString(key), value)
+}
+
+func (set *ruleSet) value(s string) string {
+	if idx := strings.Index(s, "="); idx > 0 && set.sensitiveKey.MatchString(s[:idx]) {
+		return s[:idx+1] + Placeholder
+	}
+	return set.text(s)
+}
+
+func (set *ruleSet) slice(values []string) []string {
+	redacted := make([]string, len(values))
+	for i, v := range values {
+		redacted[i] = set.value(v)
+	}
+	return redacted
+}
+
+func (set *ruleSet) text(s string) string {
+	for _, rule := range set.rules {
+		s = rule.Pattern.ReplaceAllString(s, rule.Replacement)
+	}
+	return s
+}
+
+func (set *ruleSet) json(s string) string {
+	return set.text(set.jsonSensitiveField.ReplaceAllString(s, `${1}"`+Placeholder+`"`))
+}
+
+// keyValue redacts the whole value of a sensitive key, and otherwise the secrets
+// it contains, including the sensitive fields of values serialized as JSON.
+func (set *ruleSet) keyValue(sensitive bool, value string) string {
+	if sensitive {
+		return Placeholder
+	}
+	return set.json(value)
+}
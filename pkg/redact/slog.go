@@ -0,0 +1,120 @@
+package redact
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// Handler is a slog.Handler that scrubs secrets from the records before passing
+// them to the handler it wraps: from the message as by Text, and from the
+// attributes, including those added with WithAttrs, as by Attr.
+type Handler struct {
+	handler  slog.Handler
+	registry *Registry
+}
+
+// NewHandler returns a handler redacting the records passed to h with the
+// default registry.
+func NewHandler(h slog.Handler) *Handler {
+	return Default.Handler(h)
+}
+
+// Handler returns a handler redacting the records passed to h with the
+// registry.
+func (r *Registry) Handler(h slog.Handler) *Handler {
+	return &Handler{handler: h, registry: r}
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *Handler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, h.registry.Text(record.Message), record.PC)
+	record.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(h.registry.Attr(a))
+		return true
+	})
+	return h.handler.Handle(ctx, redacted)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.registry.Attr(a)
+	}
+	return &Handler{handler: h.handler.WithAttrs(redacted), registry: h.registry}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{handler: h.handler.WithGroup(name), registry: h.registry}
+}
+
+// Attr scrubs secrets from a structured log attribute with the default
+// registry, see Registry.Attr.
+func Attr(a slog.Attr) slog.Attr {
+	return Default.Attr(a)
+}
+
+// Attr scrubs secrets from a structured log attribute, after resolving
+// slog.LogValuer values. Values whose key looks sensitive, or is nested in a
+// group whose key does, are replaced with the placeholder; otherwise:
+//   - strings and errors are redacted as by KeyValue, which turns errors into
+//     strings;
+//   - string slices, such as command args/env, are redacted as by Slice;
+//   - the attributes of groups are redacted recursively;
+//   - other values, such as settings structs or maps, are kept unless secrets
+//     are redacted from their JSON or fmt representation, which is then used.
+//
+// Booleans, numbers, durations and times are returned unchanged.
+func (r *Registry) Attr(a slog.Attr) slog.Attr {
+	return r.set.Load().attr(a, false)
+}
+
+func (set *ruleSet) attr(a slog.Attr, sensitive bool) slog.Attr {
+	sensitive = sensitive || (a.Key != "" && set.sensitiveKey.MatchString(a.Key))
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, set.keyValue(sensitive, v.String()))
+	case slog.KindGroup:
+		attrs := v.Group()
+		redacted := make([]slog.Attr, len(attrs))
+		for i, ga := range attrs {
+			redacted[i] = set.attr(ga, sensitive)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	case slog.KindAny:
+		return slog.Attr{Key: a.Key, Value: set.anyValue(v.Any(), sensitive)}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+func (set *ruleSet) anyValue(v any, sensitive bool) slog.Value {
+	switch v := v.(type) {
+	case nil:
+		return slog.AnyValue(v)
+	case error:
+		return slog.StringValue(set.keyValue(sensitive, v.Error()))
+	case []string:
+		if sensitive {
+			return slog.StringValue(Placeholder)
+		}
+		return slog.AnyValue(set.slice(v))
+	}
+	if sensitive {
+		return slog.StringValue(Placeholder)
+	}
+	// the text and JSON handlers format values with fmt and encoding/json
+	text := fmt.Sprintf("%+v", v)
+	b, err := json.Marshal(v)
+	if set.json(text) == text && (err != nil || set.json(string(b)) == string(b)) {
+		return slog.AnyValue(v)
+	}
+	if err != nil {
+		return slog.StringValue(set.json(text))
+	}
+	return slog.StringValue(set.json(string(b)))
+}
@@ -0,0 +1,115 @@
+package redact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type credentials struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// LogValue logs the credentials as a group.
+func (c credentials) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("user", c.User), slog.String("password", c.Password))
+}
+
+type settings struct {
+	GlobalConfigUrl    string            `json:"globalConfigUrl"`
+	ParameterOverrides map[string]string `json:"parameterOverrides"`
+}
+
+func newTestLogger(buf *bytes.Buffer) *slog.Logger {
+	removeTime := func(groups []string, a slog.Attr) slog.Attr {
+		if a.Key == slog.TimeKey {
+			return slog.Attr{}
+		}
+		return a
+	}
+	return slog.New(NewHandler(slog.NewJSONHandler(buf, &slog.HandlerOptions{ReplaceAttr: removeTime})))
+}
+
+func logged(t *testing.T, buf *bytes.Buffer) map[string]interface{} {
+	t.Helper()
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry), buf.String())
+	buf.Reset()
+	return entry
+}
+
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	lg := newTestLogger(&buf)
+
+	lg.Info("Downloading https://acct.blob.core.windows.net/c/cfg.json?sig=SECRET",
+		"error", errors.New("GET https://acct.blob.core.windows.net/c/cfg.json?sig=SECRET returned 403"),
+		"sasToken", "SECRET",
+		"tokenCount", 3,
+		"env", []string{"SAS_TOKEN=SECRET", "REGION=eastus"},
+		"login", credentials{User: "admin", Password: "SECRET"},
+		slog.Group("storage", "accountKey", "SECRET", "account", "acct"),
+		slog.Group("secrets", "db", "SECRET", "count", 2),
+	)
+	require.Equal(t, map[string]interface{}{
+		"level":      "INFO",
+		"msg":        "Downloading https://acct.blob.core.windows.net/c/cfg.json?" + Placeholder,
+		"error":      "GET https://acct.blob.core.windows.net/c/cfg.json?" + Placeholder + " returned 403",
+		"sasToken":   Placeholder,
+		"tokenCount": float64(3),
+		"env":        []interface{}{"SAS_TOKEN=" + Placeholder, "REGION=eastus"},
+		"login":      map[string]interface{}{"user": "admin", "password": Placeholder},
+		"storage":    map[string]interface{}{"accountKey": Placeholder, "account": "acct"},
+		"secrets":    map[string]interface{}{"db": Placeholder, "count": float64(2)},
+	}, logged(t, &buf))
+}
+
+func TestHandler_otherValues(t *testing.T) {
+	var buf bytes.Buffer
+	lg := newTestLogger(&buf)
+
+	s := settings{
+		GlobalConfigUrl:    "https://acct.blob.core.windows.net/c/cfg.json?sig=SECRET",
+		ParameterOverrides: map[string]string{"AZ_STORAGE_SAS_TOKEN_BASE64": "SECRET", "REGION": "eastus"},
+	}
+	lg.Info("settings", "settings", s, "pids", []int{1, 2}, "nothing", nil)
+	entry := logged(t, &buf)
+	require.Equal(t, []interface{}{float64(1), float64(2)}, entry["pids"], "values without secrets should be kept as is")
+	require.Nil(t, entry["nothing"])
+	redacted, ok := entry["settings"].(string)
+	require.True(t, ok, "values with secrets should be replaced with their redacted JSON")
+	require.NotContains(t, redacted, "SECRET")
+	require.Contains(t, redacted, `"REGION":"eastus"`)
+
+	var text bytes.Buffer
+	slog.New(NewHandler(slog.NewTextHandler(&text, nil))).Info("settings", "settings", &s)
+	require.NotContains(t, text.String(), "SECRET")
+}
+
+func TestHandler_withAttrsAndGroup(t *testing.T) {
+	var buf bytes.Buffer
+	lg := newTestLogger(&buf).With("password", "SECRET").WithGroup("probe").With("url", "http://localhost/health?token=SECRET")
+
+	lg.Info("probed", "state", "Healthy")
+	require.Equal(t, map[string]interface{}{
+		"level":    "INFO",
+		"msg":      "probed",
+		"password": Placeholder,
+		"probe":    map[string]interface{}{"url": "http://localhost/health?" + Placeholder, "state": "Healthy"},
+	}, logged(t, &buf))
+}
+
+func TestHandler_registry(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.SetKeyPatterns("license"))
+	var buf bytes.Buffer
+	slog.New(r.Handler(slog.NewTextHandler(&buf, nil))).Info("licensed", "license", "SECRET")
+	require.NotContains(t, buf.String(), "SECRET")
+	require.True(t, r.Handler(slog.NewTextHandler(&buf, nil)).Enabled(context.Background(), slog.LevelInfo))
+}